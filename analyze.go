@@ -0,0 +1,370 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var analyzeIn = flag.String("in", "", "Results the analyze and merge commands read, separated by commas: JSON summaries, directories of -out-dir to look for them in, or glob patterns of either, and for merge HdrHistogram logs")
+var pivotRows = flag.String("pivot-rows", "", "Flags whose values make the rows of analyze, separated by commas; empty for every flag that differs between the results but -pivot-cols")
+var pivotCols = flag.String("pivot-cols", "", "Flag whose values make the columns of analyze, empty for a single column")
+var pivotMetrics = flag.String("pivot-metrics", "publish_rate,read_rate,put_p99,reserve_p99", "Metrics analyze pivots, a table each, by the names -assert knows them by")
+
+// analyzedRun is a JSON summary read by analyze.
+type analyzedRun struct {
+	path string
+	jsonSummary
+}
+
+// loadSummaries reads the JSON summaries of spec, a list of files,
+// directories and glob patterns separated by commas.
+func loadSummaries(spec string) ([]analyzedRun, error) {
+	paths, err := expandPaths(spec)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []analyzedRun
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			runs, err := findSummaries(p)
+			if err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, runs...)
+			continue
+		}
+		run, err := loadSummary(p)
+		if err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, run)
+	}
+	return loaded, nil
+}
+
+// expandPaths returns the paths spec, a list of files, directories and
+// glob patterns separated by commas, names.
+func expandPaths(spec string) ([]string, error) {
+	var paths []string
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if matches == nil {
+			return nil, fmt.Errorf("%s: no such file or directory", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// findSummaries reads the JSON summaries of -out-dir under dir, leaving out
+// those with the spread of -runs, as the summaries of the runs themselves
+// are next to them.
+func findSummaries(dir string) ([]analyzedRun, error) {
+	var loaded []analyzedRun
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != "summary.json" {
+			return err
+		}
+		run, err := loadSummary(path)
+		if err != nil {
+			return err
+		}
+		if len(run.Runs) == 0 {
+			loaded = append(loaded, run)
+		}
+		return nil
+	})
+	return loaded, err
+}
+
+func loadSummary(path string) (analyzedRun, error) {
+	run := analyzedRun{path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		return run, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&run.jsonSummary); err != nil {
+		return run, fmt.Errorf("%s: %v", path, err)
+	}
+	return run, nil
+}
+
+// metric looks up a value of the summary by its assertion name, as
+// runResult.metric does for a run; the percentiles are those the summary
+// has.
+func (s *jsonSummary) metric(name string) (float64, error) {
+	switch name {
+	case "publish_rate":
+		return s.PublishRate, nil
+	case "read_rate":
+		return s.ReadRate, nil
+	case "errors":
+		return float64(s.Errors), nil
+	case "timeouts":
+		return float64(s.Timeouts), nil
+	case "peek_mismatches":
+		if s.Paranoid == nil {
+			return 0, fmt.Errorf("the run was not -paranoid")
+		}
+		return float64(s.Paranoid.Mismatched), nil
+	case "out_mb_per_sec":
+		return s.Bandwidth.OutRate, nil
+	case "in_mb_per_sec":
+		return s.Bandwidth.InRate, nil
+	}
+	if !isLatencyMetric(name) {
+		return 0, fmt.Errorf("unknown metric %q", name)
+	}
+	i := strings.LastIndex(name, "_")
+	opName, stat := name[:i], name[i+1:]
+	l, ok := s.Latencies[opName]
+	if !ok {
+		return 0, fmt.Errorf("no %s latencies were measured", opName)
+	}
+	us := func(v float64) float64 { return v * float64(time.Microsecond) }
+	switch stat {
+	case "mean":
+		return us(float64(l.MeanUS)), nil
+	case "min":
+		return us(float64(l.MinUS)), nil
+	}
+	for _, q := range reportedQuantiles {
+		name := quantileName(q)
+		if name == stat || strings.ReplaceAll(name, ".", "") == stat {
+			return us(l.US[name]), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown percentile %q", stat)
+}
+
+// varyingFlags are the flags whose values differ between the runs, by
+// name.
+func varyingFlags(runs []analyzedRun) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, run := range runs {
+		for name := range run.Metadata.Flags {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			for _, other := range runs {
+				if other.Metadata.Flags[name] != run.Metadata.Flags[name] {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compareFlagValues orders the values of a flag by number or duration if
+// both are one, and as strings otherwise.
+func compareFlagValues(a, b string) int {
+	if x, err := strconv.ParseFloat(a, 64); err == nil {
+		if y, err := strconv.ParseFloat(b, 64); err == nil {
+			return compareFloats(x, y)
+		}
+	}
+	if x, err := time.ParseDuration(a); err == nil {
+		if y, err := time.ParseDuration(b); err == nil {
+			return compareFloats(float64(x), float64(y))
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// sortFlagValues sorts the tuples of flag values by their first value,
+// then by their second and so on.
+func sortFlagValues(tuples [][]string) {
+	sort.SliceStable(tuples, func(i, j int) bool {
+		for k := range tuples[i] {
+			if c := compareFlagValues(tuples[i][k], tuples[j][k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// pivot is a metric of the runs by the values of the flags of the rows and
+// of the flag of the columns, each cell holding the values of the runs that
+// share them.
+type pivot struct {
+	metric string
+	rows   []string
+	col    string
+
+	rowKeys [][]string
+	colKeys []string
+	cells   map[string]map[string][]float64
+	missing int
+}
+
+func newPivot(runs []analyzedRun, metric string, rows []string, col string) *pivot {
+	p := &pivot{metric: metric, rows: rows, col: col, cells: make(map[string]map[string][]float64)}
+	cols := make(map[string]bool)
+	for _, run := range runs {
+		v, err := run.metric(metric)
+		if err != nil {
+			p.missing++
+			continue
+		}
+		var key []string
+		for _, name := range rows {
+			key = append(key, run.Metadata.Flags[name])
+		}
+		k := strings.Join(key, "\x00")
+		if p.cells[k] == nil {
+			p.cells[k] = make(map[string][]float64)
+			p.rowKeys = append(p.rowKeys, key)
+		}
+		c := run.Metadata.Flags[col]
+		if !cols[c] {
+			cols[c] = true
+			p.colKeys = append(p.colKeys, c)
+		}
+		p.cells[k][c] = append(p.cells[k][c], v)
+	}
+	sortFlagValues(p.rowKeys)
+	sort.SliceStable(p.colKeys, func(i, j int) bool { return compareFlagValues(p.colKeys[i], p.colKeys[j]) < 0 })
+	return p
+}
+
+// write renders the pivot for a terminal, the mean of every cell with the
+// 95% confidence interval of the runs it has more than one of.
+func (p *pivot) write(w io.Writer) error {
+	fmt.Fprintln(w, p.metric)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := append([]string(nil), p.rows...)
+	for _, c := range p.colKeys {
+		if p.col == "" {
+			header = append(header, p.metric)
+		} else {
+			header = append(header, p.col+"="+c)
+		}
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, key := range p.rowKeys {
+		line := append([]string(nil), key...)
+		cells := p.cells[strings.Join(key, "\x00")]
+		for _, c := range p.colKeys {
+			values := cells[c]
+			if len(values) == 0 {
+				line = append(line, "-")
+				continue
+			}
+			s := newRunStat(p.metric, values)
+			cell := s.format(s.Mean)
+			if s.Runs > 1 {
+				cell += " ±" + s.format(s.CI95)
+			}
+			line = append(line, cell)
+		}
+		fmt.Fprintln(tw, strings.Join(line, "\t")+"\t")
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// splitList splits a list separated by commas, leaving out empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimPrefix(strings.TrimSpace(item), "-"); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runAnalyze reads the JSON summaries of -in, as -out-dir writes them for
+// every combination of -sweep and every run of -runs, and prints a table
+// of every metric of -pivot-metrics by the flags of -pivot-rows and
+// -pivot-cols, the runs of the same values taken together.
+func runAnalyze([]string) {
+	if *analyzeIn == "" {
+		fatal("analyze needs -in")
+	}
+	runs, err := loadSummaries(*analyzeIn)
+	if err != nil {
+		fatal("Cannot read the results", "err", err)
+	}
+	if len(runs) == 0 {
+		fatal("No results found", "in", *analyzeIn)
+	}
+	col := strings.TrimPrefix(strings.TrimSpace(*pivotCols), "-")
+	rows := splitList(*pivotRows)
+	if rows == nil {
+		for _, name := range varyingFlags(runs) {
+			if name != col {
+				rows = append(rows, name)
+			}
+		}
+	}
+	slog.Info("Analyzing", "results", len(runs), "rows", strings.Join(rows, ","), "cols", col)
+	for _, m := range splitList(*pivotMetrics) {
+		p := newPivot(runs, m, rows, col)
+		if p.missing > 0 {
+			slog.Warn("Results without the metric", "metric", m, "results", p.missing)
+		}
+		if len(p.rowKeys) == 0 {
+			continue
+		}
+		if err := p.write(os.Stdout); err != nil {
+			fatal("Cannot write the table", "err", err)
+		}
+	}
+}
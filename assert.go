@@ -0,0 +1,171 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// assertion is one of the -assert thresholds, such as put_p99<=10ms.
+type assertion struct {
+	metric string
+	op     string
+	value  float64
+	text   string
+}
+
+type assertionResult struct {
+	assertion
+	actual float64
+	passed bool
+	err    error
+}
+
+// assertOps in the order they are matched, longest first.
+var assertOps = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+// parseAssertions parses a comma separated list of thresholds. Rates are
+// jobs per second; latencies (<op>_<percentile>, <op>_mean) are durations.
+func parseAssertions(s string) ([]assertion, error) {
+	var assertions []assertion
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		a := assertion{text: f}
+		for _, op := range assertOps {
+			if i := strings.Index(f, op); i > 0 {
+				a.metric, a.op = strings.TrimSpace(f[:i]), op
+				raw := strings.TrimSpace(f[i+len(op):])
+				var err error
+				if isLatencyMetric(a.metric) {
+					var d time.Duration
+					d, err = time.ParseDuration(raw)
+					a.value = float64(d)
+				} else {
+					a.value, err = strconv.ParseFloat(raw, 64)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("assertion %q: %v", f, err)
+				}
+				break
+			}
+		}
+		if a.op == "" {
+			return nil, fmt.Errorf("assertion %q has no comparison", f)
+		}
+		assertions = append(assertions, a)
+	}
+	return assertions, nil
+}
+
+func isLatencyMetric(name string) bool {
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return false
+	}
+	suffix := name[i+1:]
+	return suffix == "mean" || suffix == "min" || suffix == "max" || strings.HasPrefix(suffix, "p")
+}
+
+// metric looks up a value of the run by its assertion name.
+func (res *runResult) metric(name string) (float64, error) {
+	switch name {
+	case "publish_rate":
+		return rate(res.produced, res.publishTime), nil
+	case "read_rate":
+		return rate(res.consumed, res.readTime), nil
+	case "errors":
+		return float64(res.metrics.errors.load()), nil
+	case "timeouts":
+		return float64(res.metrics.timeouts.load()), nil
+	case "peek_mismatches":
+		return float64(res.metrics.peekMismatched.load()), nil
+	case "out_mb_per_sec":
+		return res.bandwidth().OutRate, nil
+	case "in_mb_per_sec":
+		return res.bandwidth().InRate, nil
+	}
+	if !isLatencyMetric(name) {
+		return 0, fmt.Errorf("unknown metric %q", name)
+	}
+	i := strings.LastIndex(name, "_")
+	opName, stat := name[:i], name[i+1:]
+	for _, op := range res.metrics.operations() {
+		if op.name != opName {
+			continue
+		}
+		if op.hist.total == 0 {
+			return 0, fmt.Errorf("no %s latencies were measured", opName)
+		}
+		switch stat {
+		case "mean":
+			return float64(op.hist.mean()), nil
+		case "min":
+			return float64(op.hist.minimum()), nil
+		case "max":
+			return float64(op.hist.quantile(1)), nil
+		}
+		p, err := strconv.ParseFloat(stat[1:], 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("unknown percentile %q", stat)
+		}
+		return float64(op.hist.quantile(p / 100)), nil
+	}
+	return 0, fmt.Errorf("unknown operation %q", opName)
+}
+
+func (a assertion) holds(actual float64) bool {
+	switch a.op {
+	case "<=":
+		return actual <= a.value
+	case ">=":
+		return actual >= a.value
+	case "==":
+		return actual == a.value
+	case "!=":
+		return actual != a.value
+	case "<":
+		return actual < a.value
+	}
+	return actual > a.value
+}
+
+// check evaluates the assertions against res and logs the outcome of each.
+func checkAssertions(assertions []assertion, res *runResult) []assertionResult {
+	var results []assertionResult
+	for _, a := range assertions {
+		r := assertionResult{assertion: a}
+		r.actual, r.err = res.metric(a.metric)
+		r.passed = r.err == nil && a.holds(r.actual)
+		results = append(results, r)
+		result("Assertion", "assertion", a.text, "actual", r.format(), "passed", r.passed)
+	}
+	return results
+}
+
+func (r assertionResult) format() string {
+	if r.err != nil {
+		return r.err.Error()
+	}
+	if isLatencyMetric(r.metric) {
+		return time.Duration(r.actual).String()
+	}
+	return strconv.FormatFloat(r.actual, 'f', -1, 64)
+}
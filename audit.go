@@ -0,0 +1,260 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// auditInterval is how often the audited jobs are looked at.
+	auditInterval = 20 * time.Millisecond
+	// auditMaxJobs is the most jobs audited at once; jobs offered beyond
+	// it are not audited.
+	auditMaxJobs = 1000
+	// auditMisses is how many times in a row a job must be gone without a
+	// reader or publisher of the benchmark having deleted it before it
+	// counts as vanished, as a delete is marked only after its response.
+	auditMisses = 3
+)
+
+type auditKey struct {
+	host string
+	id   uint64
+}
+
+// auditedJob is a job the auditor follows, with the states it was seen in.
+type auditedJob struct {
+	auditKey
+	offered time.Time
+	states  []string
+	times   []time.Duration
+	misses  int
+}
+
+func (j *auditedJob) trace() string {
+	var b strings.Builder
+	for i, s := range j.states {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "%s@%v", s, j.times[i].Round(time.Microsecond))
+	}
+	return b.String()
+}
+
+// auditor follows a random sample of the published jobs through their
+// states with stats-job, next to the benchmark. States the benchmark never
+// puts a job in, and jobs that disappear without the benchmark having
+// deleted them, are logged as unexpected. As it looks at the jobs every
+// auditInterval, shorter states slip through unseen.
+type auditor struct {
+	sample float64
+	// allowed are the states the jobs may be seen in.
+	allowed map[string]bool
+
+	ids chan auditKey
+	// tracked holds the keys of the audited jobs, true once deleted by
+	// the benchmark.
+	tracked sync.Map
+
+	stop chan struct{}
+	done chan struct{}
+
+	audited, unexpected, vanished, deletes, buried, left int
+	transitions                                          map[string]int
+}
+
+// startAuditor audits sample of the jobs r publishes.
+func startAuditor(r *run, sample float64, allowed map[string]bool) *auditor {
+	a := &auditor{
+		sample:      sample,
+		allowed:     allowed,
+		ids:         make(chan auditKey, auditMaxJobs),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		transitions: make(map[string]int),
+	}
+	go a.run(r.hosts)
+	return a
+}
+
+// offer hands the auditor a job that was put on host, which it audits
+// with the odds of the sample, drawn for its id so that a run with the same
+// -seed audits the same jobs.
+func (a *auditor) offer(host string, id uint64) {
+	if a == nil {
+		return
+	}
+	if src := seededSource(streamAudit, id); float64(src.Uint64()>>11)/(1<<53) >= a.sample {
+		return
+	}
+	k := auditKey{host, id}
+	select {
+	case a.ids <- k:
+		a.tracked.Store(k, false)
+	default:
+	}
+}
+
+// deleted tells the auditor that the benchmark deleted a job.
+func (a *auditor) deleted(host string, id uint64) {
+	if a == nil {
+		return
+	}
+	k := auditKey{host, id}
+	if _, ok := a.tracked.Load(k); ok {
+		a.tracked.Store(k, true)
+	}
+}
+
+func (a *auditor) run(hosts []string) {
+	defer close(a.done)
+	conns := make(map[string]*nativeConn)
+	for _, h := range hosts {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		defer conn.Close()
+		conns[h] = conn
+	}
+	var jobs []*auditedJob
+	ticker := time.NewTicker(auditInterval)
+	defer ticker.Stop()
+	for stopping := false; ; {
+		select {
+		case <-a.stop:
+			stopping = true
+		case <-ticker.C:
+		}
+	take:
+		for len(jobs) < auditMaxJobs {
+			select {
+			case k := <-a.ids:
+				jobs = append(jobs, &auditedJob{auditKey: k, offered: time.Now()})
+				a.audited++
+			default:
+				break take
+			}
+		}
+		kept := jobs[:0]
+		for _, j := range jobs {
+			if a.look(conns[j.host], j, stopping) {
+				kept = append(kept, j)
+			}
+		}
+		jobs = kept
+		if stopping {
+			a.left += len(jobs)
+			for _, j := range jobs {
+				slog.Debug("Audited job left", "host", j.host, "id", j.id, "trace", j.trace())
+			}
+			return
+		}
+	}
+}
+
+// look fetches the state of j, and tells whether to go on following it.
+func (a *auditor) look(conn *nativeConn, j *auditedJob, last bool) bool {
+	if conn == nil {
+		// A job of a failover backup.
+		return false
+	}
+	stats, err := conn.statsJob(j.id)
+	state := ""
+	switch err {
+	case nil:
+		state = stats["state"]
+	case errNotFound:
+		if d, _ := a.tracked.Load(j.auditKey); d == true {
+			state = "deleted"
+		} else if j.misses++; j.misses < auditMisses && !last {
+			return true
+		} else {
+			state = "vanished"
+		}
+	default:
+		slog.Warn("Audit stats-job failed", "host", j.host, "id", j.id, "err", err)
+		return false
+	}
+	j.misses = 0
+	if n := len(j.states); n == 0 || j.states[n-1] != state {
+		from := "put"
+		if n > 0 {
+			from = j.states[n-1]
+		}
+		j.states = append(j.states, state)
+		j.times = append(j.times, time.Since(j.offered))
+		a.transitions[from+">"+state]++
+		if state == "vanished" {
+			a.vanished++
+			a.unexpected++
+			slog.Warn("Audited job disappeared", "host", j.host, "id", j.id, "trace", j.trace())
+		} else if state != "deleted" && !a.allowed[state] {
+			a.unexpected++
+			slog.Warn("Audited job in an unexpected state", "host", j.host, "id", j.id, "state", state, "trace", j.trace())
+		}
+	}
+	switch state {
+	case "deleted", "vanished":
+	case "buried":
+		a.buried++
+	default:
+		return true
+	}
+	if state == "deleted" {
+		a.deletes++
+	}
+	a.tracked.Delete(j.auditKey)
+	slog.Debug("Audited job", "host", j.host, "id", j.id, "trace", j.trace())
+	return false
+}
+
+func (a *auditor) report() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+	var transitions []string
+	for t, n := range a.transitions {
+		transitions = append(transitions, fmt.Sprintf("%s=%d", t, n))
+	}
+	sort.Strings(transitions)
+	result("Audit", "audited", a.audited, "deleted", a.deletes, "buried", a.buried, "left", a.left,
+		"vanished", a.vanished, "unexpected", a.unexpected, "transitions", strings.Join(transitions, ","))
+}
+
+// auditedStates are the states the jobs of a run may be seen in: buried
+// only when the readers bury, delayed only when the trace delays.
+func auditedStates(trace []traceEntry) map[string]bool {
+	allowed := map[string]bool{"ready": true, "reserved": true}
+	if outcomes[outcomeBury] > 0 {
+		allowed["buried"] = true
+	}
+	for _, e := range trace {
+		if e.delay() > 0 {
+			allowed["delayed"] = true
+			break
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,104 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	bs "github.com/prep/beanstalk"
+	"log/slog"
+	"time"
+)
+
+const (
+	// autotuneGain is how much better the read rate must get for the tuner
+	// to keep doubling the goroutines.
+	autotuneGain = 1.05
+	// autotuneBusy is the share of goroutines that must be busy on average
+	// for more of them to be worth trying.
+	autotuneBusy = 0.8
+	// autotuneMaxFactor caps the goroutines at this many per reader.
+	autotuneMaxFactor = 1000
+)
+
+// autotuneReceive consumes with a prep consumer whose number of
+// goroutines is searched for while the run goes on. The prep client fixes
+// NumGoroutines when the consumer is created, so every step runs a
+// consumer of its own for -autotune-step; the server releases whatever
+// the old one had reserved when its connections close. Starting from one
+// goroutine per reader, the count doubles as long as the read rate
+// improves and the goroutines are busy; the best count then handles the
+// rest of the jobs.
+func autotuneReceive(ctx context.Context, r *run, readers int, handle func(context.Context, *bs.Job)) {
+	// Jobs still being handled when a step ends must not fail because the
+	// step's consumer is stopped.
+	detached := func(ctx context.Context, job *bs.Job) {
+		handle(context.WithoutCancel(ctx), job)
+	}
+
+	n, best := readers, readers
+	var bestRate float64
+	for ctx.Err() == nil {
+		stepCtx, stop := context.WithTimeout(ctx, *autotuneStep)
+		before, t0 := r.reads.load(), time.Now()
+		busy := sampleBusy(stepCtx, &r.metrics.inFlight)
+		newConsumer(r, readers, n).Receive(stepCtx, detached)
+		stop()
+		if ctx.Err() != nil {
+			break
+		}
+
+		rate := float64(r.reads.load()-before) / time.Since(t0).Seconds()
+		utilization := <-busy / float64(n)
+		slog.Debug("Autotune step", "goroutines", n, "req_per_sec", rate, "busy", utilization)
+		if rate > bestRate*autotuneGain {
+			best, bestRate = n, rate
+			if utilization >= autotuneBusy && n*2 <= readers*autotuneMaxFactor {
+				n *= 2
+				continue
+			}
+		}
+		break
+	}
+	if ctx.Err() == nil {
+		result("Autotuned consumer", "num_goroutines", best, "req_per_sec", bestRate)
+		newConsumer(r, readers, best).Receive(ctx, detached)
+		return
+	}
+	result("Autotuned consumer", "num_goroutines", best, "req_per_sec", bestRate, "finished_while_tuning", true)
+}
+
+// sampleBusy returns the mean of the gauge, sampled until ctx is done.
+func sampleBusy(ctx context.Context, g *gauge) chan float64 {
+	mean := make(chan float64, 1)
+	go func() {
+		var sum, samples int64
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sum += g.load()
+				samples++
+			case <-ctx.Done():
+				if samples == 0 {
+					samples = 1
+				}
+				mean <- float64(sum) / float64(samples)
+				return
+			}
+		}
+	}()
+	return mean
+}
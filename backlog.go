@@ -0,0 +1,231 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// gate holds back the publishers while it is closed. A nil gate is always
+// open.
+type gate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	closed bool
+
+	closedAt  time.Time
+	throttled time.Duration
+	pauses    int
+}
+
+func newGate() *gate {
+	g := &gate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *gate) wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	for g.closed {
+		g.cond.Wait()
+	}
+	g.mu.Unlock()
+}
+
+func (g *gate) set(closed bool) {
+	g.mu.Lock()
+	switch {
+	case closed && !g.closed:
+		g.closedAt = time.Now()
+		g.pauses++
+	case !closed && g.closed:
+		g.throttled += time.Since(g.closedAt)
+	}
+	g.closed = closed
+	g.mu.Unlock()
+	if !closed {
+		g.cond.Broadcast()
+	}
+}
+
+func (g *gate) isClosed() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
+
+// stats returns how long the gate was closed in total and how often it
+// closed.
+func (g *gate) stats() (time.Duration, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	throttled := g.throttled
+	if g.closed {
+		throttled += time.Since(g.closedAt)
+	}
+	return throttled, g.pauses
+}
+
+// Bounds on the backlog the depth monitor enforces; 0 disables them.
+type backlogBounds struct {
+	// abortAbove aborts the run.
+	abortAbove int64
+	// The gate closes when the backlog exceeds pauseAbove and opens again
+	// once it is below resumeBelow.
+	pauseAbove  int64
+	resumeBelow int64
+}
+
+// depthMonitor samples the number of ready jobs on the hosts while the
+// benchmark runs, and enforces the backlog bounds.
+type depthMonitor struct {
+	conns    []*beanstalk.Conn
+	interval time.Duration
+	bounds   backlogBounds
+	gate     *gate
+	started  time.Time
+
+	min, max, sum, samples int64
+	// maxReserved is the most jobs the servers counted as reserved.
+	maxReserved int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startDepthMonitor starts sampling. The gate is only used if bounds has a
+// pauseAbove.
+func startDepthMonitor(hosts []string, interval time.Duration, bounds backlogBounds, g *gate) *depthMonitor {
+	m := &depthMonitor{
+		interval: interval,
+		bounds:   bounds,
+		gate:     g,
+		started:  time.Now(),
+		min:      -1,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, h := range hosts {
+		conn, err := dialBeanstalk(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		m.conns = append(m.conns, conn)
+	}
+	go m.loop()
+	return m
+}
+
+func (m *depthMonitor) loop() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.sample()
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// depth returns the number of ready and reserved jobs summed over the
+// hosts.
+func (m *depthMonitor) depth() (ready, reserved int64, ok bool) {
+	return readyJobs(m.conns)
+}
+
+// readyJobs returns the number of ready and reserved jobs summed over the
+// servers of conns.
+func readyJobs(conns []*beanstalk.Conn) (ready, reserved int64, ok bool) {
+	for _, conn := range conns {
+		stats, err := conn.Stats()
+		if err != nil {
+			slog.Warn("Cannot fetch server stats", "err", err)
+			return 0, 0, false
+		}
+		n, _ := strconv.ParseInt(stats["current-jobs-ready"], 10, 64)
+		ready += n
+		n, _ = strconv.ParseInt(stats["current-jobs-reserved"], 10, 64)
+		reserved += n
+	}
+	return ready, reserved, true
+}
+
+func (m *depthMonitor) sample() {
+	depth, reserved, ok := m.depth()
+	if !ok {
+		return
+	}
+	if reserved > m.maxReserved {
+		m.maxReserved = reserved
+	}
+	m.samples++
+	m.sum += depth
+	if m.min < 0 || depth < m.min {
+		m.min = depth
+	}
+	if depth > m.max {
+		m.max = depth
+	}
+
+	if m.bounds.abortAbove > 0 && depth > m.bounds.abortAbove {
+		m.report()
+		fatal("Backlog exceeded -max-backlog, aborting", "ready", depth, "max_backlog", m.bounds.abortAbove)
+	}
+	if m.bounds.pauseAbove > 0 {
+		if depth > m.bounds.pauseAbove {
+			m.gate.set(true)
+		} else if depth < m.bounds.resumeBelow {
+			m.gate.set(false)
+		}
+	}
+}
+
+// finish stops sampling and reports the queue depth seen.
+func (m *depthMonitor) finish() {
+	close(m.stop)
+	<-m.done
+	for _, conn := range m.conns {
+		conn.Close()
+	}
+	m.report()
+	if m.gate != nil {
+		m.gate.set(false)
+	}
+}
+
+func (m *depthMonitor) report() {
+	if m.samples > 0 {
+		result("Queue depth", "samples", m.samples, "min", m.min, "max", m.max, "avg", float64(m.sum)/float64(m.samples),
+			"max_reserved", m.maxReserved)
+	}
+	if m.bounds.pauseAbove > 0 {
+		throttled, pauses := m.gate.stats()
+		result("Publishers throttled", "time", throttled, "pauses", pauses,
+			"percent", 100*throttled.Seconds()/time.Since(m.started).Seconds())
+	}
+}
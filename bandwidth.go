@@ -0,0 +1,141 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// The bytes of the protocol around the body of a job, estimated from
+// commands and responses with typical values: a put and its INSERTED, and
+// a reserve-with-timeout with its RESERVED and the delete that follows
+// with its DELETED. Out is from the client to the server, in the other way.
+const (
+	putOutOverhead  = 22
+	putInOverhead   = 18
+	readOutOverhead = 42
+	readInOverhead  = 34
+)
+
+// totalBytes is the parsed -total-bytes flag, 0 for no cap.
+var totalBytes int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseBytes parses a number of bytes such as 512MiB or 10GB.
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bytes %q are not a number with an optional unit such as MB or GiB", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+var bitUnits = []struct {
+	suffix string
+	size   float64
+}{
+	{"Kbps", 1e3}, {"Mbps", 1e6}, {"Gbps", 1e9}, {"bps", 1},
+}
+
+// parseBandwidth parses a rate such as 10Mbps in bits or 2MB/s in bytes a
+// second into bytes a second.
+func parseBandwidth(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "/s") {
+		n, err := parseBytes(strings.TrimSuffix(s, "/s"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bandwidth %q is not a positive rate such as 10Mbps or 2MB/s", s)
+		}
+		return float64(n), nil
+	}
+	for _, u := range bitUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+			if err != nil || n <= 0 {
+				break
+			}
+			return n * u.size / 8, nil
+		}
+	}
+	return 0, fmt.Errorf("bandwidth %q is not a positive rate such as 10Mbps or 2MB/s", s)
+}
+
+// sent counts the body of a put the publishers sent, and stops them once
+// they sent -total-bytes.
+func (r *run) sent(n int) {
+	r.metrics.putBytes.add(int64(n))
+	if totalBytes > 0 && r.metrics.putBytes.load() >= totalBytes && !r.halted() {
+		slog.Info("Sent -total-bytes", "total_bytes", totalBytes)
+		r.stop()
+	}
+}
+
+// jsonBandwidth is the traffic of a run in the JSON summary. The payload
+// bytes are those of the bodies, the wire bytes add the estimated protocol
+// around them; the rates are in MB (10^6 bytes) per second.
+type jsonBandwidth struct {
+	PayloadOut int64   `json:"payload_out_bytes"`
+	PayloadIn  int64   `json:"payload_in_bytes"`
+	WireOut    int64   `json:"wire_out_bytes"`
+	WireIn     int64   `json:"wire_in_bytes"`
+	OutRate    float64 `json:"out_mb_per_sec"`
+	InRate     float64 `json:"in_mb_per_sec"`
+}
+
+// bandwidth returns the traffic of res, over the whole of the run.
+func (res *runResult) bandwidth() jsonBandwidth {
+	m := res.metrics
+	puts, reads := int64(res.produced), int64(res.consumed)
+	b := jsonBandwidth{
+		PayloadOut: m.putBytes.load(),
+		PayloadIn:  m.readBytes.load(),
+	}
+	b.WireOut = b.PayloadOut + puts*putOutOverhead + reads*readOutOverhead
+	b.WireIn = b.PayloadIn + puts*putInOverhead + reads*readInOverhead
+	if elapsed := res.elapsed(); elapsed > 0 {
+		b.OutRate = float64(b.WireOut) / 1e6 / elapsed.Seconds()
+		b.InRate = float64(b.WireIn) / 1e6 / elapsed.Seconds()
+	}
+	return b
+}
+
+func reportBandwidth(res *runResult) {
+	b := res.bandwidth()
+	if b.PayloadOut == 0 && b.PayloadIn == 0 {
+		return
+	}
+	result("Bandwidth", "payload_out_bytes", b.PayloadOut, "payload_in_bytes", b.PayloadIn,
+		"wire_out_bytes", b.WireOut, "wire_in_bytes", b.WireIn,
+		"out_mb_per_sec", fmt.Sprintf("%.2f", b.OutRate), "in_mb_per_sec", fmt.Sprintf("%.2f", b.InRate))
+}
@@ -15,11 +15,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
-	"github.com/kr/beanstalk"
+	"fmt"
 	bs "github.com/prep/beanstalk"
-	"log"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -33,26 +39,377 @@ var host = flag.String("h", "localhost:11300", "Host to beanstalkd, default to l
 var size = flag.Int("s", 256, "Size of data, default to 256. in byte")
 var drain = flag.Bool("d", false, "Drain the beanstalk before starting test")
 var fill = flag.Int("f", 0, "Place <f> jobs on the beanstalk before starting test")
+var scenario = flag.String("scenario", "", "Run a scenario instead of the benchmark: priority, maxsize, kickstorm, deadline, multiplex, fanout, tubes, delay, pressure, tenants, starvation, standby, cancelput, restart, idle, churn")
+var probeBench = flag.Bool("probe-bench", false, "After the maxsize scenario found the limit, benchmark job sizes near it")
+var deadlineTTR = flag.Duration("deadline-ttr", 2*time.Second, "TTR of the jobs of the deadline scenario")
+var deadlineHold = flag.Duration("deadline-hold", 1500*time.Millisecond, "How long the readers of the deadline scenario hold a job before reserving again")
+var multiplexWorkers = flag.Int("multiplex-workers", 64, "Most workers the multiplex scenario runs")
+var multiplexConns = flag.Int("multiplex-conns", 1, "Connections the workers of the multiplex scenario share")
+var fanoutTubes = flag.Int("fanout-tubes", 256, "Most tubes the readers of the fanout scenario watch")
+var tubeCount = flag.Int("tube-count", 10000, "Tubes the tubes scenario spreads its jobs across")
+var maxDelay = flag.Duration("max-delay", 10*time.Second, "Longest delay of the jobs of the delay scenario, in whole seconds")
+var maxServerMemory = flag.Int64("max-server-memory", 1<<30, "Bytes of jobs the pressure scenario stores at most")
+var starvationRate = flag.Float64("starvation-rate", 10, "Low priority jobs per second the starvation scenario trickles into its flood")
+var starvationFor = flag.Duration("starvation-for", 30*time.Second, "How long the starvation scenario floods the server")
+var starvationThreshold = flag.Duration("starvation-threshold", 0, "Warn of every reader that goes this long without a reserve while its tubes have ready jobs, 0 to not watch")
+var tenantsPath = flag.String("tenants", "", "JSON file of the tenants of the tenants scenario, each with its tubes, rate, size, priority band, publishers, readers and jobs")
+var tenantsIsolated = flag.Bool("tenants-isolated", true, "Run every tenant of the tenants scenario alone before running them together, to compare their latencies")
+var standbyRate = flag.Float64("standby-rate", 1000, "Jobs per second put while the readers of the standby scenario stand by and after they activate")
+var standbyIdle = flag.Duration("standby-idle", 5*time.Second, "How long the readers of the standby scenario stand by before they activate")
+var standbyFor = flag.Duration("standby-for", 10*time.Second, "How long the standby scenario measures after the readers activate")
+var idleConns = flag.Int("idle-conns", 10000, "Most idle connections the idle scenario holds open while its active set works")
+var churnProducers = flag.Float64("churn-producers", 100, "Short-lived producers the churn scenario starts a second, each on a connection of its own")
+var churnJobs = flag.Int("churn-jobs", 5, "Jobs every producer of the churn scenario puts before it disconnects")
+var churnFor = flag.Duration("churn-for", 10*time.Second, "How long the churn scenario puts over persistent connections, and then over short-lived ones")
+var cancelPutRatio = flag.Float64("cancelput-ratio", 0.1, "Share of the puts of the cancelput scenario whose context is cancelled")
+var cancelPutWithin = flag.Duration("cancelput-within", time.Millisecond, "The cancelput scenario cancels a put at a random time within this long of sending it")
+var restartCmd = flag.String("restart-cmd", "", "Shell command the restart scenario runs to restart the server, which it otherwise waits for an operator to do")
+var restartAfter = flag.Duration("restart-after", 5*time.Second, "How long the restart scenario runs before the restart, and again once the server is back")
+var restartWait = flag.Duration("restart-wait", time.Minute, "How long the restart scenario waits for the server to go away and come back")
+var restartRate = flag.Float64("restart-rate", 1000, "Jobs per second put by the restart scenario")
+var priorities = flag.String("priorities", "0,1,1024,65536", "Comma separated priorities mixed by the priority scenario")
+var payloadSpec = flag.String("payload", "zero", "Content of the jobs: zero, random, file:<path> or template:<tmpl>")
+var seed = flag.Int64("seed", 0, "Seed for all randomness, default to one derived from the clock")
+var client = flag.String("client", "prep", "Client used by the benchmark: prep (github.com/prep/beanstalk) or native")
+var pipeline = flag.Int("pipeline", 1, "Number of puts sent on a connection before reading their responses, needs -client native")
+var reservePipeline = flag.Int("reserve-pipeline", 1, "Number of reserves a reader keeps outstanding on its connection before handling the jobs they got, needs -client native")
+var injectLatency = flag.Duration("inject-latency", 0, "Delay every write on the connections of the native client by this long, to model a slow link")
+var bandwidthLimitFlag = flag.String("bandwidth-limit", "", "Limit every connection of the native client to this rate each way, such as 10Mbps or 2MB/s, to model a constrained link")
+var tcpNoDelay = flag.Bool("tcp-nodelay", true, "Disable Nagle's algorithm on the connections of the native client")
+var sndBuf = flag.Int("so-sndbuf", 0, "Socket send buffer size of the connections of the native client in bytes, default to the system's")
+var rcvBuf = flag.Int("so-rcvbuf", 0, "Socket receive buffer size of the connections of the native client in bytes, default to the system's")
+var keepAlive = flag.Duration("keepalive", 0, "TCP keep-alive period of the connections of the native client, 0 for the default, negative to disable")
+var resolveAll = flag.Bool("resolve-all", false, "Use every address the host name of -h resolves to as a target, spreading publishers and readers across them")
+var failoverHost = flag.String("failover", "", "Backup host the native client switches to mid-run")
+var tolerateHostLoss = flag.Bool("tolerate-host-loss", false, "With several hosts, go on with the others when one becomes unreachable and report the availability of every host")
+var failoverAfter = flag.Duration("failover-after", 0, "Time into the run at which to fail over, default to when the process gets SIGALRM")
+var proxyAddr = flag.String("proxy", "", "Connect through a proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port")
+var logLevel = flag.String("log-level", "info", "Log level: debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "Log format: text or json")
+var quiet = flag.Bool("quiet", false, "Only log errors and results")
+var logFilePath = flag.String("log-file", "", "Write the log lines to this file instead of stderr, starting a new one once it reaches -log-max-size")
+var logMaxSize = flag.String("log-max-size", "100MB", "Size at which -log-file is renamed to <file>.1 and started anew, such as 100MB or 1GiB")
+var logKeep = flag.Int("log-keep", 5, "Files of -log-file kept besides the one written to, <file>.1 the most recent")
+var drainRate = flag.Float64("drain-rate", 0, "Jobs per second a drain deletes at most, to clear a backlog without starving the consumers on the server; 0 is unlimited")
+var drainMatch = flag.String("drain-match", "", "Only drain the jobs whose bodies contain this substring, or match it as /regexp/, and release the rest")
+var sampleInterval = flag.Duration("sample-interval", time.Second, "How often the server is sampled during the run")
+var pauseAware = flag.Bool("pause-aware", true, "Sample the watched tubes for pause-tube every -sample-interval, keep the reserves during a pause out of the reserve latencies and mark the intervals it overlaps")
+var maxBacklog = flag.Int64("max-backlog", 0, "Bound on the number of ready jobs during the run, 0 for none")
+var backlogAction = flag.String("backlog-action", "abort", "What to do when the backlog exceeds -max-backlog: abort or throttle the publishers")
+var couple = flag.Bool("couple", false, "Pause the publishers while the backlog is above -couple-high until it drops below -couple-low")
+var coupleHigh = flag.Int64("couple-high", 10000, "Number of ready jobs above which -couple pauses the publishers")
+var coupleLow = flag.Int64("couple-low", 0, "Number of ready jobs below which -couple resumes the publishers, default to half of -couple-high")
+var reportPath = flag.String("report", "", "Write a self-contained HTML report with charts to this file")
+var asserts = flag.String("assert", "", "Comma separated thresholds the run must meet, e.g. publish_rate>=5000,put_p99<=10ms,errors==0")
+var junitPath = flag.String("junit", "", "Write the -assert results as JUnit XML to this file")
+var reserveByIDRate = flag.Float64("reserve-by-id", 0, "Jobs per second reserved by id with reserve-job (beanstalkd 1.12+), at most; needs -client native")
+var reserveByIDWorkers = flag.Int("reserve-by-id-workers", 1, "Connections reserving jobs by id")
+var produceCount = flag.Int("produce-count", 0, "Jobs the publishers put, 0 for -n")
+var producerOnly = flag.Bool("producer-only", false, "Only publish and leave the jobs on the server, as to fill it up to its limits; the puts it turns down with DRAINING or OUT_OF_MEMORY are counted and backed off from either way")
+var consumeCount = flag.Int("consume-count", 0, "Jobs the readers consume, 0 for what is produced plus -f")
+var consumeUntil = flag.String("consume-until", "count", "When the readers stop: count (-consume-count jobs), empty (the tube has no jobs left) or duration (-consume-for)")
+var consumeFor = flag.Duration("consume-for", 0, "How long the readers read with -consume-until duration")
+var sequence = flag.String("sequence", sequenceConcurrent, "When the readers start: concurrent, with the publishers, or produce-then-consume, once the publishers are done")
+var offeredRate = flag.Float64("rate", 0, "Jobs per second offered by all publishers together, 0 for as fast as possible")
+var burstFlag = flag.String("burst", "", "Publish in bursts, size=<jobs>,interval=<duration>, and report how fast each burst drains")
+var patternFlag = flag.String("pattern", "", "Modulate the offered rate over the run, e.g. sine:min=100,max=5000,period=10m")
+var replayPath = flag.String("replay", "", "Put the jobs of a recorded trace file of NDJSON lines on its schedule instead of -n jobs")
+var recordFor = flag.Duration("record-for", time.Minute, "How long the record command follows the servers, 0 until interrupted")
+var recordOut = flag.String("record-out", "trace.ndjson", "Trace file the record command writes, in the format of -replay")
+var sweepSpec = flag.String("sweep", "", "Benchmark every combination of flag values, e.g. \"p=1,2,4,8; s=128,1024\", with drains in between")
+var sweepCSV = flag.String("sweep-csv", "", "Write the results of -sweep to this CSV file")
+var maxDuration = flag.Duration("max-duration", 0, "Hard cap on the whole run: stop, report what was measured and exit with status 1 once it has passed, 0 for none")
+var sampleRate = flag.Float64("sample-rate", 1, "Share of the operations whose latency is recorded, at random; counts stay exact")
+var visibilityRate = flag.Float64("visibility-rate", 0, "Probes per second of how long a put takes to be visible to a waiting reader, apart from its acknowledgment; 0 for none")
+var visibilityHost = flag.String("visibility-host", "", "Host the visibility probes are reserved on, such as a replica or a proxy, by default the first target")
+var audit = flag.Bool("audit", false, "Follow a sample of the jobs through their states with stats-job and log the unexpected ones; needs -client native")
+var auditSample = flag.Float64("audit-sample", 0.01, "Share of the jobs -audit follows")
+var soakFor = flag.Duration("soak", 0, "Publish and read for this long, writing what every -soak-interval measured to -soak-dir and reconnecting to servers that restart; 0 for a regular run")
+var soakInterval = flag.Duration("soak-interval", time.Minute, "How often -soak writes the results of the last interval")
+var soakDir = flag.String("soak-dir", "soak", "Directory -soak writes its files of intervals to")
+var soakRotate = flag.Duration("soak-rotate", time.Hour, "How long -soak writes to a file before it starts the next")
+var opTimeout = flag.Duration("op-timeout", 0, "Deadline of every operation of the native client, beyond the wait of a reserve; one that runs out counts as a timeout and its connection is dialed again. 0 for none")
+var connectRetries = flag.Int("connect-retries", 5, "Times a publisher or reader of the native client dials again after a jittered backoff before the run goes on without it")
+var connectBackoff = flag.Duration("connect-backoff", 100*time.Millisecond, "Backoff before the first dial again of -connect-retries, doubled for every further one; the prep client dials again on its own")
+var connectRamp = flag.String("connect-ramp", "", "Rate at which the native client dials its publisher and reader connections, such as 50/s, instead of all at once")
+var dryRun = flag.Bool("dry-run", false, "Check the flags and the targets and log the plan of the run, without putting any job")
+var tubeTemplate = flag.String("tube", "", "Tube of the benchmark, such as bench-{run_id}-{worker}: {run_id} is unique to the process, {run} counts its runs and {worker} is the publisher, each of which then gets a tube of its own. Empty for the default tube")
+var cleanup = flag.Bool("cleanup", false, "After every run delete the jobs it left on the servers and check that they are gone: all jobs of the tubes of -tube, or the jobs of the default tube this process marked")
+var shared = flag.Bool("shared", false, "The servers are shared with other work: mark the jobs of this process and have the readers give the jobs of others back untouched, counting them as foreign")
+var workloadName = flag.String("workload", "", "Workload that makes up and consumes the jobs instead of -payload: the name of a registered one, such as orders, or the path of a Go plugin ending in .so")
+var scriptPath = flag.String("script", "", "Starlark script whose produce(seq, publisher) makes up the jobs and their pri, delay and ttr, and whose consume(body) picks the outcome of every reserved job; needs -client native")
+var workloadArgs = flag.String("workload-args", "", "Argument passed to the Setup of -workload")
+var decodeFormat = flag.String("decode", "none", "Put records encoded as json or msgpack of about -s bytes instead of -payload, and have the readers decode every job they reserve: json, msgpack or none")
+var compressCodec = flag.String("compress", "none", "Compress the bodies in the publishers and decompress and verify them in the readers: gzip, snappy, zstd or none")
+var sizeBucketsFlag = flag.String("size-buckets", "1KiB,16KiB", "Sizes the put and reserve latencies are split at, when the bodies are of more than one of the buckets between them")
+var totalBytesFlag = flag.String("total-bytes", "", "Stop the publishers once they sent this many bytes of bodies, such as 10GB or 512MiB")
+var tcpInfo = flag.Bool("tcp-info", false, "Sample TCP_INFO of the connections the benchmark dials each -sample-interval and report their retransmits, round trip time and congestion window; Linux only")
+var procs = flag.Int("procs", 1, "Fork this many processes that split the publishers, readers, jobs and rate between them and start at once, and merge their results")
+var consumerScheduleFlag = flag.String("consumer-schedule", "", "Change the number of readers reserving during the run, offset=readers from its start, such as 0s=10,60s=50,120s=10; needs -client native")
+var httpFrontend = flag.Bool("http-frontend", false, "Put the jobs through an HTTP server started in-process, one put per request, that the -p publishers send their requests to as web clients; needs -client native")
+var httpConns = flag.Int("http-conns", 0, "Connections of the pool the HTTP frontend puts over, 0 for one per publisher")
+var httpTimeout = flag.Duration("http-timeout", 0, "How long the clients of the HTTP frontend wait for a request before they give up on it, 0 for ever")
+var assumeYes = flag.Bool("yes", false, "Drain and fill servers that already hold -confirm-above jobs without asking")
+var confirmAbove = flag.Int64("confirm-above", 1000, "Jobs a server must hold for a drain or a large fill of it to need -yes")
+var watchPerConn = flag.Int("watch-per-conn", 0, "Tubes of -tube or -replay every reader connection of the native client watches, taking the next ones in turn; 0 for all of them")
+var streamAddr = flag.String("stream-addr", "", "Push the rates and latencies of every -sample-interval as JSON over Server-Sent Events and WebSocket on this address, such as :8081")
+var timestamps = flag.Bool("timestamps", false, "End every body in the time of its put and report the end_to_end latency from then until a reader reserved it")
+var clockPeer = flag.String("clock-peer", "", "Control API (-control-addr) of the benchmark on another machine whose publishers put the jobs the readers get, whose clock -timestamps is corrected to")
+var controlAddr = flag.String("control-addr", "", "Serve an HTTP API to inspect and steer the running benchmark on this address, such as :8080")
+var autotune = flag.Bool("autotune", false, "Search for the number of consumer goroutines of the prep client with the best read rate")
+var autotuneStep = flag.Duration("autotune-step", 2*time.Second, "How long -autotune measures every number of goroutines")
+var gomaxprocs = flag.Int("gomaxprocs", 0, "Number of CPUs the benchmark may use at once, 0 for all")
+var memStatsFlag = flag.Bool("mem-stats", false, "Report the allocations and GC activity of the benchmark itself")
+var cancelRatio = flag.Float64("cancel", 0, "Fraction of their jobs the publishers delete again right after the put; needs -client native")
+var outcomeSpec = flag.String("outcome", "delete=100", "Weights of what the readers do with a job: delete, release or bury")
+var connectTimeout = flag.Duration("connect-timeout", 10*time.Second, "How long to wait for the servers to answer a list-tubes, and for the producer to connect")
+var cooldown = flag.Duration("cooldown", 0, "Keep measuring for this long after the publishers finish")
+var settleTime = flag.Duration("settle", 0, "Wait this long between phases: drain, fill, runs and scenario stages")
+var runs = flag.Int("runs", 1, "Repeat the benchmark this many times, draining in between, and report the spread")
+var output = flag.String("o", "text", "Output of the results: text (log lines only) or json, a summary on stdout")
+var csvPath = flag.String("csv", "", "Write the throughput over time as CSV to this file")
+var slowestCount = flag.Int("slowest", 0, "Keep the N slowest puts and reserves of the run, with when they started, their job id, size and server, and log them at the end")
+var hdrLogPath = flag.String("hdr-log", "", "Log the latency histograms of every -sample-interval to this file in the log format of HdrHistogram, tagged with their operation")
+var eventsPath = flag.String("events", "", "Write the put, reserves and outcome of every job, with their times, ids, sizes, workers and latencies, to this file as NDJSON")
+var eventsSample = flag.Float64("events-sample", 1, "Share of the jobs -events logs, picked by their id")
+var hdrHistogramsPath = flag.String("hdr-histograms", "", "Write the latency histograms of the run to this file in the log format of HdrHistogram, tagged with their operation")
+var outDirFlag = flag.String("out-dir", "", "Write every result of the run, the JSON summary, CSV series, histograms, HTML report and log, to a directory of its own in this directory, with one for every run of -runs and combination of -sweep")
+var label = flag.String("label", "", "Free-form label recorded in every report")
+var selftest = flag.Bool("selftest", false, "Run against a minimal beanstalkd started in-process instead of -h")
+var reserveMode = flag.String("reserve-mode", "timeout", "How the readers of the native client reserve: timeout (reserve-with-timeout) or block (reserve)")
+var reserveTimeout = flag.Duration("reserve-timeout", 250*time.Millisecond, "Timeout of the readers' reserve-with-timeout, rounded up to whole seconds by the native client")
+var pollInterval = flag.Duration("poll-interval", 0, "How long the readers of the native client wait after a reserve timed out")
+var verifyOrder = flag.Bool("verify-order", false, "Embed per-publisher sequence numbers and check that readers get same-priority jobs in FIFO order")
 
-func testPublisher(h string, publishers, count, size int, ch chan int) {
+// run is what the publishers and readers of one benchmark share.
+type run struct {
+	hosts   []string
+	payload payloadFunc
+	verify  bool
+	// produce is the number of jobs the publishers put.
+	produce int
+	metrics *metrics
+
+	order    *orderChecker
+	failover *failover
+	// health moves the workers off the hosts that are down, nil without
+	// -tolerate-host-loss.
+	health *hostHealth
+	// gate holds back the publishers while the backlog is too large.
+	gate *gate
+	// pace spaces the puts to offer a rate, nil for as fast as possible.
+	pace *pacer
+	// burst holds the puts back between bursts; nil without -burst.
+	burst *burster
+	// reads counts the jobs the readers are done with, and consume
+	// tells them when to stop. firstRead is when they were done with the
+	// first, in unix nanoseconds.
+	reads     exactCounter
+	firstRead int64
+	consume   consumption
+	byID      *reserveByID
+	// frontend is the HTTP server of -http-frontend the publishers put
+	// through, nil without it.
+	frontend *frontend
+	// scale lets the readers reserve as -consumer-schedule says, nil
+	// without it.
+	scale *readerScale
+	// starvation watches the readers for -starvation-threshold, nil
+	// without it.
+	starvation *starvationAlarm
+	// visibility probes how long puts take to be visible, nil without
+	// -visibility-rate.
+	visibility *visibilityProbe
+	// pauses watches the tubes for pause-tube, nil without -pause-aware.
+	pauses *pauseWatch
+	// ramp spaces the dials of the publishers and readers, nil without
+	// -connect-ramp, and publishersConnected and readersConnected are how
+	// long after the start all of their connections were up.
+	ramp                                  *pacer
+	publishersConnected, readersConnected time.Duration
+	// soak writes the intervals of -soak and reconnects, nil without it.
+	soak *soak
+	// audit follows jobs through their states, nil without -audit.
+	audit   *auditor
+	cancels cancellations
+	// rejections counts the puts the server turned down.
+	rejections rejections
+	// skewed counts the jobs of -timestamps reserved before they were
+	// put, by the clocks.
+	skewed counter
+	// consumers counts the jobs of every reader connection of the
+	// native client, producers those of every publisher connection and
+	// their put latency.
+	consumers *spread
+	producers *spread
+	// trace is the schedule of -replay, and tubes the tubes the readers
+	// watch, nil for the default tube.
+	trace []traceEntry
+	tubes []string
+
+	// halt is closed to stop publishing early, and published once the
+	// publishers are done.
+	halt      chan struct{}
+	haltOnce  sync.Once
+	published chan struct{}
+}
+
+// watched returns the tubes the readers watch.
+func (r *run) watched() []string {
+	if r.tubes == nil {
+		return []string{"default"}
+	}
+	return r.tubes
+}
+
+func newRun(hosts []string, payload payloadFunc) *run {
+	r := &run{
+		hosts:     hosts,
+		payload:   payload,
+		tubes:     benchTubes,
+		metrics:   newMetrics(),
+		halt:      make(chan struct{}),
+		published: make(chan struct{}),
+		consume:   consumption{mode: untilCount, done: make(chan struct{})},
+	}
+	if *compressCodec != "none" {
+		r.payload = compressedPayload(payload, r.metrics)
+	}
+	return r
+}
+
+// admit blocks until the publishers may put n more jobs.
+func (r *run) admit(n int) {
+	r.gate.wait()
+	hold.wait()
+	r.pace.wait(n)
+	r.burst.wait(n)
+}
+
+// stop ends the publishing early; the readers go on until they have read
+// what was published.
+func (r *run) stop() {
+	r.haltOnce.Do(func() {
+		slog.Info("Stopping the publishers")
+		close(r.halt)
+	})
+}
+
+func (r *run) halted() bool {
+	select {
+	case <-r.halt:
+		return true
+	default:
+		return false
+	}
+}
+
+// target is the number of jobs the readers must be done with: count, less
+// what was never published if the run was stopped early, never confirmed
+// if puts ran out of -op-timeout or their host went down, turned down by
+// the server or never put for requests to the HTTP frontend, and less what
+// is left on hosts that are down.
+func (r *run) target(count int) int64 {
+	select {
+	case <-r.published:
+		target := int64(count) - r.health.stranded()
+		if r.halted() || r.metrics.timeouts.load() > 0 || r.rejections.total() > 0 || r.frontend.missed() || r.health.lostPuts() > 0 || lifecycle.workersFailed.load() > 0 {
+			if missing := int64(r.produce) - r.metrics.put.count(); missing > 0 {
+				return target - missing
+			}
+		}
+		return target
+	default:
+	}
+	return int64(count)
+}
+
+func testPublisher(r *run, publishers, count int, ch chan int) {
 	if count == 0 {
 		ch <- 1
 		return
 	}
 
-	producer, err := bs.NewProducer([]string{h}, bs.Config{
-		Multiply: publishers,
+	producer, err := bs.NewProducer(r.hosts, bs.Config{
+		Multiply: perHost(publishers, r.hosts),
 		ErrorFunc: func(err error, message string) {
-			log.Printf("%s: %v\n", message, err.Error())
+			r.metrics.errors.add(1)
+			slog.Warn(message, "err", err)
 		},
 	})
 	if err != nil {
-		log.Fatalln(err)
+		fatal("Cannot create producer", "err", err)
 	}
 	defer producer.Stop()
+	waitConnected(producer)
 
 	ctx := context.Background()
 
+	put := func(tube string, data []byte, p, seq int) {
+		r.admit(1)
+		if r.halted() {
+			return
+		}
+		job := defaultJob
+		jobRanges.draw(&job, p, seq)
+		r.sent(len(data))
+		t0 := time.Now()
+		id, err := producer.Put(ctx, tube, data, bs.PutParams{
+			Priority: job.pri,
+			Delay:    job.delay,
+			TTR:      job.ttr,
+		})
+		if rejection(err) {
+			r.rejections.rejected(err)
+			r.rejections.backoff(newRand(streamRejectBackoff, uint64(p)<<40|uint64(seq)))
+			return
+		}
+		if err != nil {
+			fatal("Put failed", "err", err)
+		}
+		r.rejections.accepted()
+		r.metrics.put.record(time.Since(t0))
+		r.metrics.slowPut.record(time.Since(t0), "", id, len(data))
+		r.metrics.bySize.recordPut(len(data), time.Since(t0))
+		jobEvents.put("", id, len(data), -1, time.Since(t0))
+	}
+
+	wg := sync.WaitGroup{}
+	if r.verify {
+		// Sequence numbers only mean something if every publisher waits
+		// for a put to be acknowledged before sending the next one.
+		for p := 0; p < publishers; p++ {
+			n := share(count, publishers, p)
+			wg.Add(1)
+			go func(p, n int) {
+				defer wg.Done()
+				for seq := 0; seq < n && !r.halted(); seq++ {
+					put(r.putTube(p), orderedPayload(r.payload(nil), uint32(p), uint64(seq)), p, seq)
+				}
+			}(p, n)
+		}
+		wg.Wait()
+		ch <- 1
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		// mimic HTTP/gRPC requests
+		wg.Add(1)
+		go func(tube string, p, seq int) {
+			defer wg.Done()
+			buf := payloadBuffers.Get().(*[]byte)
+			*buf = r.payload((*buf)[:0])
+			put(tube, *buf, p, seq)
+			payloadBuffers.Put(buf)
+		}(r.putTube(i%publishers), i%publishers, i/publishers)
+	}
+	wg.Wait()
+	ch <- 1
+}
+
+// waitConnected waits up to -connect-timeout for the producer to connect.
+func waitConnected(producer *bs.Producer) {
 	connected := make(chan string, 1)
 
 	go func() {
@@ -64,123 +421,1049 @@ func testPublisher(h string, publishers, count, size int, ch chan int) {
 
 	select {
 	case <-connected:
-	case <-time.After(1 * time.Second):
-		log.Fatalln("Producer is not connected")
+	case <-time.After(*connectTimeout):
+		fatal("Producer is not connected", "timeout", *connectTimeout)
 	}
-
-	data := make([]byte, size)
-	wg := sync.WaitGroup{}
-	for i := 0; i < count; i++ {
-		// mimic HTTP/gRPC requests
-		go func() {
-			wg.Add(1)
-			defer wg.Done()
-			_, err := producer.Put(ctx, "default", data, bs.PutParams{
-				TTR: 120 * time.Second,
-			})
-			if err != nil {
-				log.Fatal(err)
-			}
-		}()
-	}
-	wg.Wait()
-	ch <- 1
 }
 
-func testReader(h string, readers, count int, ch chan int) {
+func testReader(r *run, readers, count int, ch chan int) {
 	if count == 0 {
 		ch <- 1
 		return
 	}
-	consumer, err := bs.NewConsumer([]string{h}, []string{"default"}, bs.Config{
-		Multiply:       readers,
-		NumGoroutines:  readers * 10,
-		ReserveTimeout: 250 * time.Millisecond,
+	ctx, cancel := context.WithCancel(context.Background())
+
+	handle := func(ctx context.Context, job *bs.Job) {
+		if foreign(job.Body) {
+			// The client releases with the priority the job had. It does
+			// not tell the server of the job, whose id stands for it.
+			r.metrics.foreign.reserved("", job.ID)
+			if err := job.Release(ctx); err != nil {
+				slog.Warn("Release of a foreign job failed", "id", job.ID, "err", err)
+			}
+			return
+		}
+		r.starvation.reserved(0)
+		r.metrics.inFlight.add(1)
+		defer r.metrics.inFlight.add(-1)
+		r.metrics.readBytes.add(int64(len(job.Body)))
+		r.metrics.priorities.record(job.Stats.Priority, -1)
+		jobEvents.reserve("", job.ID, len(job.Body), -1, -1)
+		if r.order != nil {
+			r.order.observe(job.Stats.Tube, job.Stats.Priority, job.ReservedAt, job.Body)
+		}
+		if body, ok := r.decompress(job.Body); ok {
+			r.endToEnd(body, job.ReservedAt)
+			r.decode(body)
+		}
+		// A job is drawn for again every time it is reserved.
+		o := pickOutcome(newRand(streamOutcome, job.ID<<16|uint64(job.Stats.Reserves)))
+		t0 := time.Now()
+		var err error
+		switch o {
+		case outcomeRelease:
+			err = job.Release(ctx)
+		case outcomeBury:
+			err = job.Bury(ctx)
+		default:
+			err = job.Delete(ctx)
+		}
+		if err != nil {
+			r.metrics.errors.add(1)
+			slog.Warn("Job "+outcomeNames[o]+" failed", "id", job.ID, "err", err)
+		} else {
+			r.metrics.outcome(o).record(time.Since(t0))
+			jobEvents.outcome("", job.ID, -1, o, time.Since(t0))
+		}
+		if !o.terminal() {
+			return
+		}
+		r.read(1)
+	}
+	go func() {
+		<-r.consume.done
+		cancel()
+	}()
+	if *autotune {
+		autotuneReceive(ctx, r, readers, handle)
+	} else {
+		newConsumer(r, readers, readers*10).Receive(ctx, handle)
+	}
+	r.starvation.finished(0)
+	ch <- 1
+}
+
+// newConsumer creates a consumer of the prep client with the given number
+// of goroutines to handle the jobs.
+func newConsumer(r *run, readers, goroutines int) *bs.Consumer {
+	consumer, err := bs.NewConsumer(r.hosts, r.watched(), bs.Config{
+		Multiply:       perHost(readers, r.hosts),
+		NumGoroutines:  goroutines,
+		ReserveTimeout: *reserveTimeout,
 	})
 	if err != nil {
-		log.Fatalln(err)
+		fatal("Cannot create consumer", "err", err)
 	}
+	return consumer
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	var ops uint64
-	consumer.Receive(ctx, func(ctx context.Context, job *bs.Job) {
-		job.Delete(ctx)
-		atomic.AddUint64(&ops, 1)
+// drainProgressInterval is how often a drain logs how far it got.
+const drainProgressInterval = 5 * time.Second
 
-		if int(ops) == count {
-			cancel()
+// drainMatcher parses -drain-match: /re/ is a regular expression, anything
+// else a substring of the bodies a drain deletes. Empty matches every job.
+func drainMatcher(spec string) (func(body []byte) bool, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if len(spec) > 1 && strings.HasPrefix(spec, "/") && strings.HasSuffix(spec, "/") {
+		re, err := regexp.Compile(spec[1 : len(spec)-1])
+		if err != nil {
+			return nil, err
 		}
-	})
-	ch <- 1
+		return re.Match, nil
+	}
+	sub := []byte(spec)
+	return func(body []byte) bool { return bytes.Contains(body, sub) }, nil
 }
 
 func drainBeanstalk(h string) {
-	log.Println("Draining beanstalk")
-	conn, e := beanstalk.Dial("tcp", h)
+	match, err := drainMatcher(*drainMatch)
+	if err != nil {
+		fatal("Bad -drain-match", "match", *drainMatch, "err", err)
+	}
+	slog.Info("Draining beanstalk", "host", h, "rate", *drainRate, "match", *drainMatch)
+	conn, e := dialBeanstalk(h)
 	defer conn.Close()
 	if e != nil {
-		log.Fatal(e)
+		fatal("Cannot connect", "host", h, "err", e)
 	}
-	for {
-		id, _, e := conn.Reserve(250 * time.Millisecond)
+	pace := newPacer(*drainRate)
+	t0 := time.Now()
+	last, lastSeen := t0, 0
+	seen, deleted := 0, 0
+	// The jobs that do not match stay reserved until the drain is through,
+	// or it would reserve them again and again. The server releases them,
+	// with the priority they had, when the connection closes.
+	kept := make(map[uint64]bool)
+	defer func() {
+		if deleted > 0 || len(kept) > 0 {
+			elapsed := time.Since(t0)
+			slog.Info("Drained", "host", h, "deleted", deleted, "kept", len(kept), "elapsed", elapsed.Round(time.Millisecond), "rate", rate(deleted, elapsed))
+		}
+	}()
+	for !expired() {
+		pace.wait(1)
+		id, body, e := conn.Reserve(250 * time.Millisecond)
 		if e != nil {
 			return
 		}
-		e = conn.Delete(id)
-		if e != nil {
-			log.Println(e)
+		if kept[id] {
+			// Its TTR ran out while it was kept.
+			continue
+		}
+		seen++
+		if match != nil && !match(body) {
+			kept[id] = true
+		} else if e = conn.Delete(id); e != nil {
+			slog.Warn("Delete failed", "id", id, "err", e)
+			continue
+		} else {
+			deleted++
+		}
+		if time.Since(last) >= drainProgressInterval {
+			// The ETA is at the rate of the last interval.
+			now := time.Now()
+			current := rate(seen-lastSeen, now.Sub(last))
+			args := []any{"host", h, "deleted", deleted, "rate", current}
+			if match != nil {
+				args = append(args, "kept", len(kept))
+			}
+			if ready, err := tubeReady(conn, "default"); err == nil {
+				args = append(args, "remaining", ready)
+				if current > 0 {
+					args = append(args, "eta", time.Duration(float64(ready)/current*float64(time.Second)).Round(time.Second))
+				}
+			}
+			slog.Info("Draining", args...)
+			last, lastSeen = now, seen
+		}
+	}
+}
+
+// drainBetween drains hosts between two runs and settles before the next,
+// named by next. With -tube every run has tubes of its own, which are
+// cleaned up after it, and the default tube is left alone.
+func drainBetween(hosts []string, next string) {
+	if *tubeTemplate == "" {
+		for _, h := range hosts {
+			drainBeanstalk(h)
 		}
 	}
+	settle(next)
+}
+
+// settle waits for -settle before the next phase, so the server has
+// flushed the effects of the previous one.
+func settle(next string) {
+	if *settleTime > 0 {
+		slog.Info("Settling", "next", next, "duration", *settleTime)
+		sleepOrExpire(*settleTime)
+	}
 }
 
-func fillBeanstalk(h string, count int, size int) {
-	log.Println("Filling beanstalk")
+func fillBeanstalk(hosts []string, count int, payload payloadFunc) {
+	slog.Info("Filling beanstalk", "jobs", count)
 	ch := make(chan int)
-	go testPublisher(h, 1, count, size, ch)
-	<-ch
+	r := newRun(hosts, payload)
+	defer context.AfterFunc(runContext, r.stop)()
+	go testPublisher(r, len(hosts), count, ch)
+	waitOrExpire(ch)
 }
 
 func main() {
-	flag.Parse()
+	cmd := parseCommand(os.Args[1:])
+	if err := startLogFile(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setupLogging(logOutput, *logLevel, *logFormat, *quiet); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(envFlags) > 0 {
+		slog.Info("Flags from the environment", "vars", strings.Join(envFlags, ","))
+	}
+	if len(configFlags) > 0 {
+		slog.Info("Flags from the config file", "path", *configPath, "flags", strings.Join(configFlags, ","))
+	}
+	if offlineCommands[cmd.name] {
+		cmd.run(nil)
+		return
+	}
+	joinParent()
+	cmd.run(connect())
+}
+
+// runBench runs the benchmark, or the scenario of -scenario, against hosts.
+func runBench(hosts []string) {
+	if *dryRun {
+		planBench(hosts)
+		return
+	}
+	if *outDirFlag != "" {
+		startOutDir()
+	}
+	startBench(hosts, *drain || *tubeTemplate == "" && (*runs > 1 || *sweepSpec != ""))
+	switch *scenario {
+	case "":
+	case "priority":
+		testPriorityOrder(hosts[0], *count, *size, parsePriorities(*priorities))
+		return
+	case "kickstorm":
+		testKickStorm(hosts[0], *readers, *count, *size)
+		return
+	case "deadline":
+		testDeadlineSoon(hosts[0], *readers, *count, *size, *deadlineTTR, *deadlineHold)
+		return
+	case "multiplex":
+		testMultiplex(hosts[0], *multiplexWorkers, *multiplexConns, *count, *size)
+		return
+	case "fanout":
+		testFanout(hosts[0], *fanoutTubes, *publishers, *readers, *count, *size)
+		return
+	case "tubes":
+		testManyTubes(hosts[0], *tubeCount, *publishers, *count, *size)
+		return
+	case "delay":
+		testDelayHeap(hosts[0], *publishers, *readers, *count, *size, *maxDelay)
+		return
+	case "pressure":
+		testPressure(hosts[0], *publishers, *size, *maxServerMemory)
+		return
+	case "starvation":
+		if *starvationRate <= 0 || *starvationFor <= 0 {
+			fatal("The starvation scenario needs a -starvation-rate and -starvation-for above 0")
+		}
+		testStarvation(hosts[0], *publishers, *readers, *size, *starvationRate, *starvationFor)
+		return
+	case "tenants":
+		if *tenantsPath == "" {
+			fatal("The tenants scenario needs -tenants")
+		}
+		testTenants(hosts[0], *tenantsPath, *size, *count, *tenantsIsolated)
+		return
+	case "standby":
+		if *standbyRate <= 0 || *standbyFor <= 0 {
+			fatal("The standby scenario needs a -standby-rate and -standby-for above 0")
+		}
+		testStandby(hosts[0], *readers, *size, *standbyRate, *standbyIdle, *standbyFor)
+		return
+	case "idle":
+		testIdleConns(hosts[0], *idleConns, *publishers, *readers, *count, *size)
+		return
+	case "churn":
+		if *churnProducers <= 0 || *churnJobs < 1 || *churnFor <= 0 {
+			fatal("The churn scenario needs a -churn-producers and -churn-for above 0 and -churn-jobs of at least 1")
+		}
+		testChurn(hosts[0], *publishers, *size, *churnJobs, *churnProducers, *churnFor)
+		return
+	case "cancelput":
+		if *cancelPutRatio < 0 || *cancelPutRatio > 1 || *cancelPutWithin < 0 {
+			fatal("The cancelput scenario needs a -cancelput-ratio from 0 to 1 and a -cancelput-within of at least 0")
+		}
+		testCancelPut(hosts[0], *publishers, *count, *size, *cancelPutRatio, *cancelPutWithin)
+		return
+	case "restart":
+		if *restartRate <= 0 || *restartWait <= 0 {
+			fatal("The restart scenario needs a -restart-rate and -restart-wait above 0")
+		}
+		testRestart(hosts[0], *publishers, *readers, *size, *restartRate, *restartCmd, *restartAfter, *restartWait)
+		return
+	case "maxsize":
+		limit := probeMaxJobSize(hosts[0])
+		if *probeBench {
+			benchmarkNearLimit(hosts, *publishers, *readers, *count, limit)
+		}
+		return
+	default:
+		fatal("Unknown scenario", "scenario", *scenario)
+	}
+
+	trace := configureBench()
+	assertions, err := parseAssertions(*asserts)
+	if err != nil {
+		fatal("Invalid -assert", "err", err)
+	}
+
+	if *sweepSpec != "" {
+		grid, err := parseSweep(*sweepSpec)
+		if err != nil {
+			fatal("Invalid -sweep", "err", err)
+		}
+		runSweep(hosts, grid, trace)
+		return
+	}
+
+	var res *runResult
+	if *procs > 1 {
+		res = forkProcs(hosts)
+	} else {
+		res = measure(hosts, trace)
+	}
+	if parent != nil {
+		parent.report(res)
+		return
+	}
+	if outDir != "" {
+		writeArtifacts(outDir, res, false)
+	}
+
+	printSummary(res)
+	if *output == "json" {
+		if err := writeJSONSummary(os.Stdout, res); err != nil {
+			fatal("Cannot write JSON summary", "err", err)
+		}
+	}
+	if *csvPath != "" {
+		if err := writeCSVSeries(*csvPath, res); err != nil {
+			fatal("Cannot write CSV", "path", *csvPath, "err", err)
+		}
+		slog.Info("Wrote CSV", "path", *csvPath)
+	}
+	if *hdrHistogramsPath != "" {
+		if err := writeHDRHistograms(*hdrHistogramsPath, res); err != nil {
+			fatal("Cannot write the HdrHistogram histograms", "path", *hdrHistogramsPath, "err", err)
+		}
+		slog.Info("Wrote HdrHistogram histograms", "path", *hdrHistogramsPath)
+	}
+	if *reportPath != "" {
+		if err := writeHTMLReport(*reportPath, res); err != nil {
+			fatal("Cannot write report", "path", *reportPath, "err", err)
+		}
+		slog.Info("Wrote report", "path", *reportPath)
+	}
+
+	results := checkAssertions(assertions, res)
+	if *junitPath != "" {
+		if err := writeJUnit(*junitPath, results, res); err != nil {
+			fatal("Cannot write JUnit report", "path", *junitPath, "err", err)
+		}
+		slog.Info("Wrote JUnit report", "path", *junitPath)
+	}
+	for _, r := range results {
+		if !r.passed {
+			os.Exit(1)
+		}
+	}
+	if res.truncated {
+		os.Exit(1)
+	}
+}
+
+// startBench applies -gomaxprocs and -seed, probes the capabilities of the
+// servers, confirms the run may drain them when drains tells it will and
+// fill them with -f, starts the pacer and the control API and drains hosts
+// with -d.
+func startBench(hosts []string, drains bool) {
+	if *gomaxprocs > 0 {
+		runtime.GOMAXPROCS(*gomaxprocs)
+	}
+	seedRandomness()
+	startDeadline()
+	if *tcpInfo {
+		startSocketSampler(*sampleInterval)
+	}
+	detectCapabilities(hosts)
+	confirmDestructive(hosts, drains, *fill)
+	var err error
+	pace = newPacer(*offeredRate)
+	if *controlAddr != "" {
+		hold = newGate()
+		if control, err = startControl(*controlAddr); err != nil {
+			fatal("Cannot start the control API", "addr", *controlAddr, "err", err)
+		}
+	}
+	if *streamAddr != "" {
+		if stream, err = startStream(*streamAddr); err != nil {
+			fatal("Cannot start the event stream", "addr", *streamAddr, "err", err)
+		}
+	}
+	if *configPath != "" {
+		reloads = watchReload()
+	}
 	if *drain {
-		drainBeanstalk(*host)
+		for _, h := range hosts {
+			drainBeanstalk(h)
+		}
+		settle("scenario")
+	}
+}
+
+// configureBench checks the flags of the benchmark and parses those that
+// need it, and returns the trace of -replay.
+func configureBench() []traceEntry {
+	var err error
+	if *client != "prep" && *client != "native" {
+		fatal("Unknown client", "client", *client)
+	}
+	if *cancelRatio < 0 || *cancelRatio >= 1 {
+		fatal("-cancel must be at least 0 and below 1", "cancel", *cancelRatio)
+	}
+	if *cancelRatio > 0 && *client != "native" {
+		fatal("-cancel needs -client native")
+	}
+	if *audit && *client != "native" {
+		fatal("-audit needs -client native")
+	}
+	if *auditSample <= 0 || *auditSample > 1 {
+		fatal("-audit-sample must be above 0 and at most 1", "audit_sample", *auditSample)
+	}
+	if *reserveByIDRate > 0 && *client != "native" {
+		fatal("-reserve-by-id needs -client native")
+	}
+	if *reserveByIDRate > 0 && !supported("reserve-job") {
+		slog.Warn("Running without -reserve-by-id")
+		*reserveByIDRate = 0
+	}
+	if *cleanup && *replayPath != "" {
+		fatal("-cleanup cannot be combined with -replay, whose tubes are not the run's own")
+	}
+	if *totalBytesFlag != "" {
+		if totalBytes, err = parseBytes(*totalBytesFlag); err != nil {
+			fatal("Invalid -total-bytes", "err", err)
+		}
+	}
+	if _, ok := codecs[*compressCodec]; !ok && *compressCodec != "none" {
+		fatal("Unknown compression, want gzip, snappy, zstd or none", "compress", *compressCodec)
+	}
+	if sizeBucketBounds, err = parseSizeBuckets(*sizeBucketsFlag); err != nil {
+		fatal("Invalid -size-buckets", "err", err)
+	}
+	if *compressCodec != "none" && *replayPath != "" {
+		fatal("-compress cannot be combined with -replay, whose bodies are cut to the sizes of the trace")
+	}
+	if *decodeFormat != "none" && *replayPath != "" {
+		fatal("-decode cannot be combined with -replay, whose bodies are cut to the sizes of the trace")
+	}
+	if *scriptPath != "" {
+		if *client != "native" {
+			fatal("-script needs -client native")
+		}
+		if *workloadName != "" || *decodeFormat != "none" || *replayPath != "" || *httpFrontend {
+			fatal("-script cannot be combined with -workload, -decode, -replay or -http-frontend")
+		}
+		if script, err = loadScript(*scriptPath); err != nil {
+			fatal("Cannot load the script", "err", err)
+		}
+	}
+	if err := validOnStop(*onStop); err != nil {
+		fatal("Invalid -on-stop", "err", err)
+	}
+	if *paranoid && *client != "native" {
+		fatal("-paranoid needs -client native, as the prep client cannot peek")
+	}
+	if jobRanges, err = parsePutRanges(*priRange, *delayRange, *ttrRange); err != nil {
+		fatal("Invalid put ranges", "err", err)
+	}
+	if jobRanges != nil {
+		if *scriptPath != "" || *replayPath != "" {
+			fatal("-pri-range, -delay-range and -ttr-range cannot be combined with -script or -replay, which set the parameters of every put")
+		}
+		if jobRanges.delay && *verifyOrder {
+			fatal("-delay-range cannot be combined with -verify-order, as delayed jobs are ready out of order")
+		}
+		slog.Info("Drawing the parameters of every put", "ranges", jobRanges.String())
+	}
+	if *workloadName != "" {
+		if *decodeFormat != "none" || *replayPath != "" {
+			fatal("-workload cannot be combined with -decode or -replay")
+		}
+		if selectedWorkload, err = loadWorkload(*workloadName, *workloadArgs); err != nil {
+			fatal("Cannot load the workload", "err", err)
+		}
+	}
+	if *shared && *replayPath != "" {
+		fatal("-shared cannot be combined with -replay, whose bodies are cut to the sizes of the trace")
+	}
+	if *watchPerConn > 0 && (*client != "native" || *tubeTemplate == "" && *replayPath == "") {
+		fatal("-watch-per-conn needs -client native and the tubes of -tube or -replay")
+	}
+	if *timestamps && (*decodeFormat != "none" || *workloadName != "" || *scriptPath != "" || *replayPath != "") {
+		fatal("-timestamps cannot be combined with -decode, -workload, -script or -replay, whose bodies it would end in a trailer")
+	}
+	if *clockPeer != "" {
+		if !*timestamps {
+			fatal("-clock-peer needs -timestamps")
+		}
+		syncClock(*clockPeer)
+	}
+	if *tubeTemplate != "" {
+		if *replayPath != "" {
+			fatal("-tube cannot be combined with -replay, whose trace names the tubes")
+		}
+		if err := checkTubeTemplate(*tubeTemplate, *publishers); err != nil {
+			fatal("Invalid tube", "tube", *tubeTemplate, "err", err)
+		}
+	}
+	if *soakFor > 0 {
+		if *runs > 1 || *sweepSpec != "" || *replayPath != "" {
+			fatal("-soak cannot be combined with -runs, -sweep or -replay")
+		}
+		if *soakInterval <= 0 || *soakRotate <= 0 {
+			fatal("-soak-interval and -soak-rotate must be above 0")
+		}
+		// The publishers go on until -soak has passed, and the readers
+		// stop with them.
+		if *produceCount <= 0 {
+			*count = math.MaxInt32
+		}
+		*consumeUntil, *consumeFor = untilDuration, *soakFor
+	}
+	if err := validConsumeUntil(*consumeUntil); err != nil {
+		fatal("Invalid -consume-until", "err", err)
+	}
+	if *consumeUntil == untilDuration && *consumeFor <= 0 {
+		fatal("-consume-until duration needs -consume-for")
+	}
+	if *sequence != sequenceConcurrent && *sequence != sequenceProduceThenConsume {
+		fatal("Unknown sequence", "sequence", *sequence)
+	}
+	// Without readers during the publish phase nothing drains the backlog
+	// that would pause the publishers or keep under -max-backlog.
+	if *sequence == sequenceProduceThenConsume && (*couple || *maxBacklog > 0 || *soakFor > 0 || *consumerScheduleFlag != "") {
+		fatal("-sequence produce-then-consume cannot be combined with -couple, -max-backlog, -soak or -consumer-schedule")
+	}
+	if *autotune && *client != "prep" {
+		fatal("-autotune needs -client prep")
+	}
+	if *reserveMode != "timeout" && *reserveMode != "block" {
+		fatal("Unknown reserve mode", "reserve_mode", *reserveMode)
+	}
+	if (*reserveMode == "block" || *pollInterval > 0) && *client != "native" {
+		fatal("-reserve-mode block and -poll-interval need -client native")
+	}
+	if *connectRetries < 0 || *connectBackoff <= 0 {
+		fatal("-connect-retries must not be negative and -connect-backoff must be above 0")
+	}
+	if *connectRamp != "" {
+		if connectRate, err = parseConnectRamp(*connectRamp); err != nil {
+			fatal("Invalid -connect-ramp", "err", err)
+		}
+		if *client != "native" {
+			fatal("-connect-ramp needs -client native")
+		}
+	}
+	if *opTimeout > 0 && (*client != "native" || *reserveMode == "block") {
+		fatal("-op-timeout needs -client native and -reserve-mode timeout")
+	}
+	if *reserveMode == "block" && *failoverHost != "" {
+		fatal("-reserve-mode block cannot be combined with -failover")
+	}
+	if *pipeline > 1 && *client != "native" {
+		fatal("-pipeline needs -client native")
+	}
+	if *reservePipeline < 1 {
+		fatal("-reserve-pipeline must be at least 1", "reserve_pipeline", *reservePipeline)
+	}
+	if *reservePipeline > 1 && *client != "native" {
+		fatal("-reserve-pipeline needs -client native")
+	}
+	if *httpFrontend {
+		if *client != "native" {
+			fatal("-http-frontend needs -client native")
+		}
+		if *replayPath != "" || *pipeline > 1 || *cancelRatio > 0 || *failoverHost != "" {
+			fatal("-http-frontend cannot be combined with -replay, -pipeline, -cancel or -failover")
+		}
+	}
+	if *tolerateHostLoss && (*client != "native" || *failoverHost != "" || *httpFrontend || *replayPath != "") {
+		fatal("-tolerate-host-loss needs -client native and cannot be combined with -failover, -http-frontend or -replay")
+	}
+	if *failoverHost != "" {
+		if *client != "native" {
+			fatal("-failover needs -client native")
+		}
+		if *failoverHost, err = normalizeHost(*failoverHost); err != nil {
+			fatal("Invalid failover host", "err", err)
+		}
+	}
+	if *visibilityHost != "" {
+		if *visibilityHost, err = normalizeHost(*visibilityHost); err != nil {
+			fatal("Invalid visibility host", "err", err)
+		}
+	}
+	if *client != "native" && connFlagsSet() {
+		fatal("Connection flags such as -inject-latency, -bandwidth-limit and -tcp-nodelay need -client native, as the prep client dials its connections itself")
+	}
+
+	if *backlogAction != "abort" && *backlogAction != "throttle" {
+		fatal("Unknown backlog action", "action", *backlogAction)
+	}
+
+	if *patternFlag != "" {
+		if loadPattern, err = parsePattern(*patternFlag); err != nil {
+			fatal("Invalid -pattern", "err", err)
+		}
+	}
+	if *consumerScheduleFlag != "" {
+		if consumerSchedule, err = parseConsumerSchedule(*consumerScheduleFlag); err != nil {
+			fatal("Invalid -consumer-schedule", "err", err)
+		}
+		if *client != "native" {
+			fatal("-consumer-schedule needs -client native")
+		}
+		// Until the first step the readers of -r reserve, and every
+		// reader the schedule calls for is connected from the start.
+		if consumerSchedule[0].at > 0 {
+			consumerSchedule = append([]scheduleStep{{0, *readers}}, consumerSchedule...)
+		}
+		for _, s := range consumerSchedule {
+			if s.readers > *readers {
+				*readers = s.readers
+			}
+		}
+	}
+	if *burstFlag != "" {
+		if bursts, err = parseBurst(*burstFlag); err != nil {
+			fatal("Invalid -burst", "err", err)
+		}
+	}
+	var trace []traceEntry
+	if *replayPath != "" {
+		if *verifyOrder || *failoverHost != "" || *cancelRatio > 0 || *pipeline > 1 {
+			fatal("-replay cannot be combined with -verify-order, -failover, -cancel or -pipeline")
+		}
+		if trace, err = readTrace(*replayPath); err != nil {
+			fatal("Cannot read the trace", "path", *replayPath, "err", err)
+		}
+		slog.Info("Replaying", "path", *replayPath, "jobs", len(trace), "tubes", strings.Join(traceTubes(trace), ","), "duration", trace[len(trace)-1].offset())
 	}
-	if (*fill) > 0 {
-		fillBeanstalk(*host, *fill, *size)
+	if outcomes, err = parseOutcomes(*outcomeSpec); err != nil {
+		fatal("Invalid -outcome", "err", err)
 	}
+	if *output != "text" && *output != "json" {
+		fatal("Unknown output format", "output", *output)
+	}
+	if *sampleRate <= 0 || *sampleRate > 1 {
+		fatal("-sample-rate must be above 0 and at most 1", "sample_rate", *sampleRate)
+	}
+	latencySampling = *sampleRate
+	if *runs < 1 {
+		fatal("-runs must be at least 1", "runs", *runs)
+	}
+	if *hdrLogPath != "" {
+		if intervalLog, err = createHDRLog(*hdrLogPath); err != nil {
+			fatal("Cannot create the HdrHistogram log", "path", *hdrLogPath, "err", err)
+		}
+	}
+	if *eventsPath != "" {
+		if *eventsSample <= 0 || *eventsSample > 1 {
+			fatal("-events-sample must be above 0 and at most 1", "events_sample", *eventsSample)
+		}
+		if jobEvents, err = createEventLog(*eventsPath, *eventsSample); err != nil {
+			fatal("Cannot create the event log", "path", *eventsPath, "err", err)
+		}
+	}
+	if *procs > 1 {
+		checkProcs()
+	}
+	return trace
+}
+
+// measure runs the benchmark -runs times against hosts, draining them in
+// between, and returns the last run with the spread across the runs.
+func measure(hosts []string, trace []traceEntry) *runResult {
+	payload, produce, consume := workload(trace)
+	slog.Info("Target host", "host", *host, "targets", strings.Join(hosts, ","))
+	slog.Info("Starting publishers", "publishers", *publishers)
+	slog.Info("Starting readers", "readers", *readers, "sequence", *sequence)
+	slog.Info("Client", "client", *client, "pipeline", *pipeline, "reserve_pipeline", *reservePipeline, "reserve_mode", *reserveMode, "reserve_timeout", *reserveTimeout, "connection", connSettings())
+	slog.Info("Total jobs to be processed", "produce", produce, "consume", consume)
+	slog.Info("Benchmarking, be patient ...")
 
-	log.Println("Target host: ", *host)
-	log.Println("Starting publishers: ", *publishers)
-	log.Println("Starting readers: ", *readers)
-	log.Println("Total jobs to be processed: ", *count)
-	log.Println("Benchmarking, be patient ...")
+	var res *runResult
+	var all []*runResult
+	for i := 1; i <= *runs; i++ {
+		if i > 1 && expired() {
+			break
+		}
+		if i > 1 {
+			drainBetween(hosts, "run")
+		}
+		if *runs > 1 {
+			slog.Info("Starting run", "run", i, "runs", *runs)
+		}
+		res = runOnce(hosts, payload, produce, consume, trace)
+		all = append(all, res)
+		if outDir != "" && (*runs > 1 || *sweepSpec != "") {
+			writeArtifacts(runDir(i), res, true)
+		}
+	}
+	if len(all) > 1 {
+		res.aggregate = aggregateRuns(all)
+		reportAggregate(res.aggregate)
+	}
+	return res
+}
 
+// workload returns the payload of the jobs, how many the publishers put and
+// how many the readers read.
+func workload(trace []traceEntry) (payload payloadFunc, produce, consume int) {
+	payload, err := newPayload(*payloadSpec, *size)
+	if err != nil {
+		fatal("Invalid payload", "err", err)
+	}
+	if *decodeFormat != "none" {
+		if payload, err = encodedPayload(*decodeFormat, *size); err != nil {
+			fatal("Invalid payload", "decode", *decodeFormat, "err", err)
+		}
+	}
+	if selectedWorkload != nil {
+		payload = workloadPayload(selectedWorkload)
+	}
+	produce, consume = *produceCount, *consumeCount
+	if trace != nil {
+		produce = len(trace)
+	} else if produce <= 0 {
+		produce = *count
+	}
+	if consume <= 0 {
+		consume = produce + *fill
+	}
+	if *producerOnly {
+		consume = 0
+	}
+	if markJobs() {
+		payload = markedPayload(payload)
+	}
+	if *timestamps {
+		payload = stampedPayload(payload)
+	}
+	return payload, produce, consume
+}
+
+// markJobs tells whether the jobs carry the marker of -shared and -cleanup.
+func markJobs() bool {
+	return *shared || *cleanup && *tubeTemplate == ""
+}
+
+// runOnce fills hosts with -f and runs the benchmark against them once,
+// reporting what changed in the stats of the servers.
+func runOnce(hosts []string, payload payloadFunc, produce, consume int, trace []traceEntry) *runResult {
+	nextRunTubes(*publishers)
+	defer cleanupRun(hosts)
+	if *fill > 0 {
+		fillBeanstalk(hosts, *fill, payload)
+		settle("benchmark")
+	}
+	before := snapshotStats(hosts)
+	res := benchmark(hosts, *publishers, *readers, produce, consume, payload, *verifyOrder, trace)
+	res.meta = collectMetadata(before)
+	after := snapshotStats(hosts)
+	reportStatsDelta(before, after)
+	reportBinlog(before, after)
+	stream.publish("summary", newJSONSummary(res))
+	return res
+}
+
+// benchmark runs the publishers and readers against hosts and reports their
+// rates and latencies. The publishers put produce jobs, the readers stop as
+// -consume-until says, after consume jobs by default. With a trace the
+// publishers put its jobs on its schedule instead.
+func benchmark(hosts []string, publishers, readers, produce, consume int, payload payloadFunc, verify bool, trace []traceEntry) *runResult {
+	r := newRun(hosts, payload)
+	r.produce = produce
+	r.verify = verify
+	r.pace = pace
+	if connectRate > 0 {
+		r.ramp = newPacer(connectRate)
+	}
+	if trace != nil {
+		r.tubes = traceTubes(trace)
+	}
+	if verify {
+		r.order = &orderChecker{}
+	}
+	r.metrics.priorities.track = *client == "native" && (script != nil || trace != nil || jobRanges != nil && jobRanges.pri)
+
+	cpu := startCPUMonitor(*sampleInterval)
+	var mem *memStats
+	if *memStatsFlag {
+		mem = startMemStats()
+	}
 	chPublisher := make(chan int)
 	chReader := make(chan int)
+	parent.waitStart()
 	t0 := time.Now()
+	r.metrics.start = t0
+	if loadPattern.kind != "" {
+		defer startPattern(r.pace, loadPattern)()
+	}
+	r.pauses = startPauseWatch(r, *sampleInterval)
+	r.metrics.series = startSeries(r.metrics, *sampleInterval, r.pace.rate, r.pauses.overlaps)
+	stopHDRLog := intervalLog.follow(r.metrics, *sampleInterval)
+	res := &runResult{started: t0, publishers: publishers, readers: readers, produced: produce, metrics: r.metrics}
+	stream.publish("start", streamStart{t0, hosts, publishers, readers, produce, consume})
+	sequential := *sequence == sequenceProduceThenConsume
+	if !sequential {
+		watchConsumption(r, *consumeUntil, consume, *consumeFor)
+	}
+	defer context.AfterFunc(runContext, func() {
+		r.stop()
+		r.consumed()
+	})()
+	stopLive := watchLiveSignals(newLiveStats(r.metrics))
+	control.attach(r)
+	defer control.attach(nil)
+	if bursts.size > 0 {
+		r.burst = startBursts(r, bursts)
+	}
 
-	if (*publishers) > 0 {
-		go testPublisher(*host, *publishers, *count, *size, chPublisher)
+	if *failoverHost != "" {
+		r.failover = newFailover(*failoverHost, *failoverAfter)
 	}
+	if *tolerateHostLoss {
+		if len(hosts) < 2 {
+			fatal("-tolerate-host-loss needs more than one host")
+		}
+		r.health = newHostHealth(hosts)
+	}
+	var bounds backlogBounds
+	switch {
+	case *couple:
+		bounds.pauseAbove, bounds.resumeBelow = *coupleHigh, *coupleLow
+		if bounds.resumeBelow <= 0 {
+			bounds.resumeBelow = *coupleHigh / 2
+		}
+	case *backlogAction == "throttle":
+		bounds.pauseAbove, bounds.resumeBelow = *maxBacklog, *maxBacklog+1
+	}
+	if *backlogAction == "abort" {
+		bounds.abortAbove = *maxBacklog
+	}
+	if bounds.pauseAbove > 0 {
+		r.gate = newGate()
+	}
+	depth := startDepthMonitor(hosts, *sampleInterval, bounds, r.gate)
 
-	if (*readers) > 0 {
-		go testReader(*host, *readers, *count, chReader)
+	if *reserveByIDRate > 0 {
+		r.byID = newReserveByID(r, *reserveByIDWorkers, *reserveByIDRate)
+	}
+	if *visibilityRate > 0 {
+		readHost := hosts[0]
+		if *visibilityHost != "" {
+			readHost = *visibilityHost
+		}
+		r.visibility = startVisibilityProbe(r, hosts[0], readHost, *visibilityRate)
+	}
+	if *soakFor > 0 {
+		r.soak = startSoak(r)
+	}
+	if *audit {
+		r.audit = startAuditor(r, *auditSample, auditedStates(trace))
+	}
+	switch {
+	case consumerSchedule != nil:
+		r.scale = startReaderScale(r, consumerSchedule, readers)
+	case *configPath != "" && *client == "native" && readers > 0:
+		// A reload of -config may scale the readers down and up again.
+		r.scale = newReaderScale(r, readers)
+	}
+	reloads.attach(r)
+	defer reloads.attach(nil)
+	startReaders := func() {
+		if consume > 0 {
+			r.starvation = startStarvationAlarm(r, readers, *starvationThreshold)
+		}
+		if readers == 0 {
+			return
+		}
+		if *client == "native" {
+			go testReaderNative(r, readers, consume, chReader)
+		} else {
+			go testReader(r, readers, consume, chReader)
+		}
+	}
+	if *client == "native" {
+		r.consumers = newSpread(readers)
+		r.producers = newLatencySpread(publishers)
+		if publishers > 0 && trace != nil {
+			go testReplay(r, trace, publishers, chPublisher)
+		} else if publishers > 0 && *httpFrontend {
+			conns := *httpConns
+			if conns <= 0 {
+				conns = publishers
+			}
+			r.frontend = startFrontend(r, conns)
+			go testPublisherHTTP(r, publishers, produce, chPublisher)
+		} else if publishers > 0 {
+			go testPublisherNative(r, publishers, produce, *pipeline, chPublisher)
+		}
+	} else {
+		if publishers > 0 && trace != nil {
+			go testReplay(r, trace, publishers, chPublisher)
+		} else if publishers > 0 {
+			go testPublisher(r, publishers, produce, chPublisher)
+		}
+	}
+	if !sequential {
+		startReaders()
 	}
 
 	// Wait for return, assume publishers will finish first
-	if (*publishers) > 0 {
-		<-chPublisher
-		log.Println("---------------")
+	if publishers > 0 {
+		if !waitOrExpire(chPublisher) {
+			slog.Warn("The publishers did not stop, leaving them behind")
+		}
 		delta := time.Now().Sub(t0)
-		log.Println("Publishers finished at: ", delta)
-		log.Println("Publish rate: ", float64(*count)/delta.Seconds(), " req/s")
+		res.publishTime = delta
+		res.produced = int(r.metrics.put.count())
+		result("Publishers finished", "produced", res.produced, "elapsed", delta, "req_per_sec", rate(res.produced, delta))
+	}
+	close(r.published)
+	if r.failover != nil {
+		close(r.failover.published)
+	}
+	if sequential {
+		// The readers only start on the jobs once all of them are put.
+		watchConsumption(r, *consumeUntil, consume, *consumeFor)
+		startReaders()
 	}
+	// The cooldown runs from the end of the publishers and keeps the
+	// samplers going until the tail of the consumption is captured.
+	cooled := time.After(*cooldown)
 
-	if (*readers) > 0 {
-		<-chReader
-		delta := time.Now().Sub(t0)
-		log.Println("Readers finished at: ", delta)
-		log.Println("Read rate: ", float64(*count)/delta.Seconds(), " req/s")
+	if readers > 0 {
+		if !waitOrExpire(chReader) {
+			slog.Warn("The readers did not stop, leaving them behind")
+		}
+		// The read phase starts with the first job the readers are done
+		// with rather than with the run, which may have been publishing
+		// for a while by then.
+		res.readStart = r.readStart()
+		delta := time.Since(t0) - res.readStart
+		res.readTime = delta
+		res.consumed = int(r.reads.load())
+		result("Readers finished", "consumed", res.consumed, "elapsed", delta, "req_per_sec", rate(res.consumed, delta))
+
+		if r.order != nil {
+			r.order.report()
+		}
+	}
+	reportPhases(res)
+	r.starvation.report()
+	res.consumerSteps = r.scale.finish()
+	if r.ramp != nil {
+		result("Connect phase", "ramp", *connectRamp, "publishers", r.publishersConnected.Round(time.Millisecond),
+			"readers", r.readersConnected.Round(time.Millisecond))
+	}
+	if *cooldown > 0 {
+		slog.Info("Cooling down", "cooldown", *cooldown)
+		select {
+		case <-cooled:
+		case <-runContext.Done():
+		}
+	}
+
+	stopLive()
+	r.metrics.series.finish()
+	res.tubePauses = r.pauses.finish(r.metrics.reservePaused)
+	stopHDRLog()
+	if n := jobEvents.flush(); n > 0 {
+		slog.Info("Job events", "path", *eventsPath, "events", n)
+	}
+	if r.halted() && r.soak == nil {
+		result("Stopped early", "produced", res.produced, "of", produce)
+	}
+	if expired() {
+		res.truncated = true
+		result("Truncated", "max_duration", *maxDuration, "interrupted", interrupted(), "produced", res.produced, "consumed", res.consumed)
+	}
+	r.visibility.report()
+	r.audit.report()
+	res.memoryTrends = r.soak.report()
+	r.metrics.reportLatencies()
+	reportClock(r)
+	res.clientCPU = cpu.finish()
+	if mem != nil {
+		mem.report(res.produced)
+	}
+	if r.byID != nil {
+		r.byID.report()
+	}
+	if *cancelRatio > 0 {
+		r.cancels.report()
+	}
+	r.rejections.report()
+	if n := r.metrics.timeouts.load(); n > 0 {
+		result("Timeouts", "timeouts", n, "op_timeout", *opTimeout)
+	}
+	if *shared {
+		r.metrics.foreign.report()
+	}
+	res.frontend = r.frontend.report()
+	res.slowest = append(r.metrics.slowPut.report(r.metrics.start, mem), r.metrics.slowReserve.report(r.metrics.start, mem)...)
+	reportCompression(res)
+	reportBandwidth(res)
+	reportParanoid(res)
+	reportStop(res)
+	r.metrics.reportInFlight()
+	r.metrics.reportLatencyOverTime()
+	res.priorities = r.metrics.priorities.report()
+	res.sizeBuckets = r.metrics.bySize.report()
+	res.putBudget = r.metrics.putBudget.report()
+	r.producers.report("Producer fairness")
+	r.consumers.report("Consumer fairness")
+	depth.finish()
+	if r.failover != nil {
+		r.failover.report()
+	}
+	res.hostAvailability = r.health.report()
+	if n := atomic.LoadInt64(&proxyHandshakes); n > 0 {
+		result("Proxy handshakes", "count", n, "mean", time.Duration(atomic.LoadInt64(&proxyHandshakeNanos)/n))
 	}
+	lifecycle.report()
+	sockets.report()
+	return res
 }
@@ -0,0 +1,64 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+)
+
+// binlogEnabled tells from its stats whether a server writes a binlog
+// (beanstalkd -b). Without one the binlog indexes stay at 0.
+func binlogEnabled(stats map[string]string) bool {
+	n, _ := strconv.ParseInt(stats["binlog-current-index"], 10, 64)
+	return n > 0
+}
+
+// reportBinlog logs the binlog activity of every host over the run, the
+// cost of persistence next to the throughput. beanstalkd has no counters
+// for its fsyncs; their cost is part of its rusage-stime.
+func reportBinlog(before, after map[string]map[string]string) {
+	hosts := make([]string, 0, len(after))
+	for h := range after {
+		if before[h] != nil {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+
+	for _, h := range hosts {
+		if !binlogEnabled(after[h]) {
+			slog.Info("Server writes no binlog", "host", h)
+			continue
+		}
+		delta := statsDelta(before[h], after[h])
+		oldest, _ := strconv.ParseInt(after[h]["binlog-oldest-index"], 10, 64)
+		current, _ := strconv.ParseInt(after[h]["binlog-current-index"], 10, 64)
+		args := []any{
+			"host", h,
+			"records_written", delta["binlog-records-written"],
+			"records_migrated", delta["binlog-records-migrated"],
+			"files_rotated", delta["binlog-current-index"],
+			"files", current - oldest + 1,
+			"max_size", after[h]["binlog-max-size"],
+		}
+		if puts := delta["cmd-put"]; puts > 0 {
+			args = append(args, "records_per_put", delta["binlog-records-written"]/puts)
+		}
+		args = append(args, "rusage_stime", delta["rusage-stime"])
+		result("Server binlog", args...)
+	}
+}
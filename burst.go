@@ -0,0 +1,206 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bursts is the parsed -burst flag, with a size of 0 without it.
+var bursts burstSpec
+
+type burstSpec struct {
+	size     int
+	interval time.Duration
+}
+
+// parseBurst parses size=<jobs>,interval=<duration>.
+func parseBurst(s string) (burstSpec, error) {
+	var b burstSpec
+	for _, f := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return b, fmt.Errorf("burst setting %q is not name=value", f)
+		}
+		var err error
+		switch k {
+		case "size":
+			b.size, err = strconv.Atoi(v)
+		case "interval":
+			b.interval, err = time.ParseDuration(v)
+		default:
+			return b, fmt.Errorf("unknown burst setting %q, want size or interval", k)
+		}
+		if err != nil {
+			return b, fmt.Errorf("burst setting %q: %v", f, err)
+		}
+	}
+	if b.size < 1 || b.interval <= 0 {
+		return b, fmt.Errorf("burst %q needs a positive size and interval", s)
+	}
+	return b, nil
+}
+
+// burster lets the publishers put a burst of jobs at the start of every
+// interval and holds them back in between. A burst the publishers did not
+// get out before the next one is added to it. A nil burster does not hold
+// anything back.
+type burster struct {
+	spec   burstSpec
+	mu     sync.Mutex
+	cond   *sync.Cond
+	tokens int
+	done   bool
+	// start is when the current burst began, reserve the latency of the
+	// reserves sent since then.
+	start   time.Time
+	reserve *histogram
+}
+
+// startBursts releases the bursts of r, and reports for every burst how
+// long the readers took to catch up with it and the reserve latency until
+// they did.
+func startBursts(r *run, spec burstSpec) *burster {
+	b := &burster{spec: spec}
+	b.cond = sync.NewCond(&b.mu)
+	go b.run(r)
+	return b
+}
+
+// wait blocks until the current burst has room for n more jobs.
+func (b *burster) wait(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.tokens <= 0 && !b.done {
+		b.cond.Wait()
+	}
+	b.tokens -= n
+}
+
+// reserved records the latency of a reserve sent at t0. Reserves that were
+// already waiting when the burst began are left out, as their latency is
+// mostly the idle time before it.
+func (b *burster) reserved(t0 time.Time, d time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if !t0.Before(b.start) {
+		b.reserve.record(d)
+	}
+	b.mu.Unlock()
+}
+
+func (b *burster) release(n int, done bool) {
+	b.mu.Lock()
+	b.tokens += n
+	b.done = b.done || done
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *burster) run(r *run) {
+	defer b.release(0, true)
+	// The readers have the jobs of -f to read before those of the bursts.
+	offset := 0
+	if r.consume.mode == untilCount && r.consume.count > r.produce {
+		offset = r.consume.count - r.produce
+	}
+	var drains []time.Duration
+	undrained := 0
+	defer func() {
+		if len(drains)+undrained == 0 {
+			return
+		}
+		var sum, max time.Duration
+		for _, d := range drains {
+			sum += d
+			if d > max {
+				max = d
+			}
+		}
+		args := []any{"bursts", len(drains) + undrained, "size", b.spec.size, "interval", b.spec.interval, "undrained", undrained}
+		if len(drains) > 0 {
+			args = append(args, "drain_mean", sum/time.Duration(len(drains)), "drain_max", max)
+		}
+		result("Bursts", args...)
+	}()
+
+	for k := 1; ; k++ {
+		start := time.Now()
+		reserve := newHistogram()
+		b.mu.Lock()
+		b.start, b.reserve = start, reserve
+		b.mu.Unlock()
+		put := k * b.spec.size
+		last := put >= r.produce
+		if last {
+			put = r.produce
+		}
+		b.release(b.spec.size, false)
+		next := time.NewTimer(b.spec.interval)
+		target := int64(offset + put)
+
+		drained := false
+		poll := time.NewTicker(time.Millisecond)
+	wait:
+		for {
+			select {
+			case <-r.consume.done:
+				drained = r.reads.load() >= target
+				break wait
+			case <-r.halt:
+				break wait
+			case <-next.C:
+				if !last {
+					break wait
+				}
+			case <-poll.C:
+				if r.reads.load() >= target {
+					drained = true
+					break wait
+				}
+			}
+		}
+		poll.Stop()
+		if drained {
+			d := time.Since(start)
+			drains = append(drains, d)
+			args := []any{"burst", k, "drain", d}
+			if reserve := reserve.snapshot(); reserve.total > 0 {
+				args = append(args, "reserve_p99", reserve.quantile(0.99), "reserve_max", reserve.quantile(1))
+			}
+			result("Burst", args...)
+			if !last {
+				<-next.C
+			}
+		} else if r.consuming() && !r.halted() {
+			undrained++
+			slog.Warn("Burst not drained before the next one", "burst", k, "read", r.reads.load()-int64(offset), "of", put)
+		}
+		next.Stop()
+		if last || !r.consuming() || r.halted() {
+			return
+		}
+	}
+}
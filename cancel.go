@@ -0,0 +1,62 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// cancellations is the accounting of -cancel: jobs that their publisher
+// deleted again by id, and the NOT_FOUND responses seen on either side
+// because a reader and a publisher went for the same job.
+type cancellations struct {
+	cancelled counter
+	// lost counts the cancels that came too late, as a reader had
+	// reserved the job already.
+	lost counter
+	// readerNotFound counts the deletes of readers that found their job
+	// gone.
+	readerNotFound counter
+}
+
+// cancelBatch deletes those of the ids that rng picks with the -cancel
+// probability, and counts the cancelled jobs as read.
+func cancelBatch(r *run, conn *nativeConn, rng *rand.Rand, ids []uint64) error {
+	for _, id := range ids {
+		if rng.Float64() >= *cancelRatio {
+			continue
+		}
+		t0 := time.Now()
+		err := conn.delete(id)
+		if err == errNotFound {
+			r.cancels.lost.add(1)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		r.metrics.cancel.record(time.Since(t0))
+		r.audit.deleted(conn.host, id)
+		r.cancels.cancelled.add(1)
+		r.read(1)
+	}
+	return nil
+}
+
+func (c *cancellations) report() {
+	result("Cancellations", "cancelled", c.cancelled.load(), "too_late", c.lost.load(),
+		"reader_not_found", c.readerNotFound.load())
+}
@@ -0,0 +1,110 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// capability is a command that older versions of beanstalkd don't know.
+// Whether a server knows it is probed with a command that is answered with
+// NOT_FOUND if it does, rather than by its version, which forks and proxies
+// don't keep in step with beanstalkd.
+type capability struct {
+	name  string
+	since string
+	probe string
+}
+
+var capabilities = []capability{
+	{"kick-job", "1.8", "kick-job 0"},
+	{"reserve-job", "1.12", "reserve-job 0"},
+}
+
+// serverCapabilities are the capabilities every target was found to have,
+// by host, for the metadata of the runs.
+var serverCapabilities map[string][]string
+
+// probeCapabilities returns the names of the capabilities the server at h
+// has.
+func probeCapabilities(h string) ([]string, error) {
+	conn, err := dialNative(h)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var names []string
+	for _, c := range capabilities {
+		_, err := conn.call("", "%s", c.probe)
+		switch err {
+		case errUnknown:
+		case errNotFound:
+			names = append(names, c.name)
+		default:
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// detectCapabilities probes every host and logs its version and
+// capabilities.
+func detectCapabilities(hosts []string) {
+	serverCapabilities = make(map[string][]string)
+	for _, h := range hosts {
+		names, err := probeCapabilities(h)
+		if err != nil {
+			fatal("Cannot probe the server", "host", h, "err", err)
+		}
+		version := "unknown"
+		if stats, err := serverStats(h); err == nil && stats["version"] != "" {
+			version = stats["version"]
+		}
+		serverCapabilities[h] = names
+		slog.Info("Server capabilities", "host", h, "version", version, "capabilities", strings.Join(names, ","))
+	}
+}
+
+// supported tells whether every target has the capability, warning about
+// the first that hasn't.
+func supported(name string) bool {
+	hosts := make([]string, 0, len(serverCapabilities))
+	for h := range serverCapabilities {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		if !hasCapability(serverCapabilities[h], name) {
+			for _, c := range capabilities {
+				if c.name == name {
+					slog.Warn("The server does not know "+name+", which needs beanstalkd "+c.since+" or later", "host", h)
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func hasCapability(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
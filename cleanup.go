@@ -0,0 +1,201 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Without -tube the jobs of the run share the default tube with whatever
+// else is on the server, so -cleanup marks them: the magic and the run id
+// follow the header of -verify-order.
+const (
+	cleanupMagic       = 0x4253434c // "BSCL"
+	cleanupMarkerAt    = orderHeaderSize
+	cleanupMarkerSize  = 8
+	cleanupMarkerAfter = cleanupMarkerAt + cleanupMarkerSize
+)
+
+// cleanupMarker is the marker of the jobs of this process.
+var cleanupMarker = func() []byte {
+	id, _ := hex.DecodeString(runID)
+	marker := binary.BigEndian.AppendUint32(nil, cleanupMagic)
+	return append(marker, id...)
+}()
+
+// markedPayload returns a payload that carries the marker of this process,
+// padding bodies too short for it.
+func markedPayload(payload payloadFunc) payloadFunc {
+	return func(buf []byte) []byte {
+		start := len(buf)
+		buf = payload(buf)
+		for len(buf)-start < cleanupMarkerAfter {
+			buf = append(buf, 0)
+		}
+		copy(buf[start+cleanupMarkerAt:], cleanupMarker)
+		return buf
+	}
+}
+
+// marked tells whether a job was put by this process.
+func marked(body []byte) bool {
+	return len(body) >= cleanupMarkerAfter && bytes.Equal(body[cleanupMarkerAt:cleanupMarkerAfter], cleanupMarker)
+}
+
+// cleanupRun deletes the jobs the run left on the servers with -cleanup
+// and checks that none are left: every job of the tubes of -tube, or the
+// marked ready jobs of the default tube.
+func cleanupRun(hosts []string) {
+	if !*cleanup {
+		return
+	}
+	tubes, dedicated := benchTubes, true
+	if tubes == nil {
+		tubes, dedicated = []string{"default"}, false
+	}
+	slog.Info("Cleaning up", "tubes", len(tubes))
+	for _, h := range hosts {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		var deleted, kept, left int64
+		var unchecked []any
+		for _, tube := range tubes {
+			if expired() {
+				break
+			}
+			if dedicated {
+				n, err := clearNative(conn, tube)
+				if err != nil {
+					fatal("Cleanup failed", "host", h, "tube", tube, "err", err)
+				}
+				deleted += n
+			} else {
+				n, k, err := clearMarked(conn)
+				if err != nil {
+					fatal("Cleanup failed", "host", h, "tube", tube, "err", err)
+				}
+				deleted, kept = deleted+n, kept+k
+			}
+			stats, err := conn.statsTube(tube)
+			if err == errNotFound {
+				// No job ever made it to this host's tube.
+				continue
+			} else if err != nil {
+				fatal("Cannot fetch tube stats", "host", h, "tube", tube, "err", err)
+			}
+			if dedicated {
+				left += heldJobs(stats)
+			} else {
+				// Delayed and buried jobs cannot be read without making
+				// them ready, and those of others are left alone.
+				for _, state := range []string{"delayed", "buried"} {
+					if n, _ := strconv.ParseInt(stats["current-jobs-"+state], 10, 64); n > 0 {
+						unchecked = append(unchecked, state, n)
+					}
+				}
+			}
+		}
+		conn.Close()
+		args := []any{"host", h, "deleted", deleted, "left", left}
+		if !dedicated {
+			args = append(args, "others_kept", kept)
+		}
+		result("Cleanup", args...)
+		if left > 0 {
+			slog.Warn("TUBES NOT EMPTY AFTER CLEANUP: jobs of the run are still on the server", "host", h, "left", left, "tubes", strings.Join(tubes, ","))
+		}
+		if len(unchecked) > 0 {
+			slog.Warn("Jobs of the default tube not checked by the cleanup", append([]any{"host", h}, unchecked...)...)
+		}
+	}
+}
+
+// clearNative deletes every job of a tube, delayed and buried ones
+// included, and returns how many it deleted.
+func clearNative(conn *nativeConn, tube string) (int64, error) {
+	if err := watchTubes(conn, []string{tube}); err != nil {
+		return 0, err
+	}
+	if err := conn.use(tube); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for !expired() {
+		id, _, err := conn.reserve(0)
+		if err == errTimedOut {
+			n, err := conn.kick(1 << 20)
+			if err != nil || n == 0 {
+				return deleted, err
+			}
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		if err := conn.delete(id); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// clearMarked deletes the ready jobs of the default tube that carry the
+// marker of this process. The jobs of others are held until the tube has
+// been gone through and then released with their priority, and their
+// number returned as kept.
+func clearMarked(conn *nativeConn) (deleted, kept int64, err error) {
+	if err := watchTubes(conn, []string{"default"}); err != nil {
+		return 0, 0, err
+	}
+	var others []uint64
+	defer func() {
+		for _, id := range others {
+			pri := uint32(0)
+			if stats, err := conn.statsJob(id); err == nil {
+				n, _ := strconv.ParseUint(stats["pri"], 10, 32)
+				pri = uint32(n)
+			}
+			if err := conn.release(id, pri, 0); err != nil {
+				slog.Warn("Release failed", "id", id, "err", err)
+			}
+		}
+	}()
+	for !expired() {
+		id, body, err := conn.reserve(0)
+		if err == errTimedOut || err == errDeadlineSoon {
+			// Deadline soon: a job held here is about to be handed out
+			// again, so the tube is left to its owners from here.
+			return deleted, int64(len(others)), nil
+		} else if err != nil {
+			return deleted, int64(len(others)), err
+		}
+		if !marked(body) {
+			others = append(others, id)
+			continue
+		}
+		if err := conn.delete(id); err != nil {
+			return deleted, int64(len(others)), err
+		}
+		deleted++
+	}
+	return deleted, int64(len(others)), nil
+}
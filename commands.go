@@ -0,0 +1,209 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of the benchmark. The flags of every command are
+// taken from flag.CommandLine by name, so the commands share the variables
+// and defaults of the flags they have in common.
+type command struct {
+	name    string
+	summary string
+	// flags are the names of the flags the command takes, nil for all.
+	flags []string
+	run   func(hosts []string)
+}
+
+// connectionFlags are the flags of every command: where the servers are,
+// how to connect to them, what to log and the file of -config.
+var connectionFlags = []string{
+	"h", "resolve-all", "selftest", "connect-timeout",
+	"inject-latency", "bandwidth-limit", "proxy", "tcp-nodelay", "so-sndbuf", "so-rcvbuf", "keepalive",
+	"log-level", "log-format", "quiet", "log-file", "log-max-size", "log-keep", "read-only",
+	"config",
+}
+
+var commands = []*command{
+	{"bench", "Run the benchmark or a -scenario, the default", nil, runBench},
+	{"fill", "Put -n jobs on the servers", append([]string{"n", "s", "payload", "seed", "yes", "confirm-above"}, connectionFlags...), runFill},
+	{"drain", "Delete every ready job of the default tube", append([]string{"drain-rate", "drain-match", "yes", "confirm-above"}, connectionFlags...), runDrain},
+	{"stats", "Log the stats of the servers", connectionFlags, runStats},
+	{"monitor", "Log the stats of every tube each -sample-interval, without load", append([]string{"sample-interval", "o", "csv"}, connectionFlags...), runMonitor},
+	{"probe", "Send a trickle of canary jobs through every server and log their latency and success each -sample-interval", append([]string{"probe-rate", "probe-tube", "probe-timeout", "probe-for", "sample-interval", "o", "csv", "stream-addr"}, connectionFlags...), runProbe},
+	{"record", "Write the jobs put on the servers for -record-for to a trace for -replay", append([]string{"record-for", "record-out", "sample-interval"}, connectionFlags...), runRecord},
+	{"compare", "Run the same benchmark against -a and -b and log their results side by side", nil, runCompare},
+	{"overhead", "Run the same benchmark against -h directly and through the proxy of -via and log what the proxy costs", nil, runOverhead},
+	{"conformance", "Check the answers of the server to protocol edge cases", connectionFlags, runConformance},
+	{"analyze", "Print tables of the metrics of the JSON summaries of a -sweep or of -runs by the flags they differ in", []string{"in", "pivot-rows", "pivot-cols", "pivot-metrics", "log-level", "log-format", "quiet", "log-file", "log-max-size", "log-keep", "read-only", "config"}, runAnalyze},
+	{"merge", "Add up the JSON summaries and HdrHistogram logs of workers or runs into one result, merging their latency histograms", []string{"in", "o", "hdr-histograms", "log-level", "log-format", "quiet", "log-file", "log-max-size", "log-keep", "read-only", "config"}, runMerge},
+}
+
+// offlineCommands work on the results of earlier runs and connect to no
+// server.
+var offlineCommands = map[string]bool{"analyze": true, "merge": true}
+
+// parseCommand picks the command named by the first argument, bench if
+// there is none, and parses its flags.
+func parseCommand(args []string) *command {
+	c := commands[0]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		c = nil
+		for _, o := range commands {
+			if o.name == args[0] {
+				c = o
+			}
+		}
+		if c == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+			usage()
+			os.Exit(2)
+		}
+		args = args[1:]
+	}
+
+	fs := flag.CommandLine
+	if c.flags != nil {
+		fs = flag.NewFlagSet(c.name, flag.ExitOnError)
+		for _, name := range c.flags {
+			f := flag.Lookup(name)
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	fs.Usage = func() {
+		if c.name == "bench" {
+			usage()
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Usage of %s %s: %s\n\n", os.Args[0], c.name, c.summary)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments %q\n\n", fs.Args())
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := applyEnv(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := applyConfig(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := checkReadOnly(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return c
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s [command] [flags]:\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -help for the flags of a command. Every flag can also be set with\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "an environment variable, such as %s for -reserve-timeout, which the command\nline overrides. The flags of bench:\n\n", envName("reserve-timeout"))
+	flag.PrintDefaults()
+}
+
+// connect resolves -h and waits for the servers to be ready, starting the
+// embedded server first with -selftest.
+func connect() []string {
+	if *selftest {
+		startSelftest()
+	}
+	if *proxyAddr != "" {
+		var err error
+		if proxy, err = parseProxy(*proxyAddr); err != nil {
+			fatal("Invalid proxy", "err", err)
+		}
+	}
+	if *bandwidthLimitFlag != "" {
+		var err error
+		if bandwidthLimit, err = parseBandwidth(*bandwidthLimitFlag); err != nil {
+			fatal("Invalid bandwidth limit", "err", err)
+		}
+	}
+	return connectTo(*host)
+}
+
+// connectTo resolves addr, a host as -h takes it, and waits for its servers
+// to be ready.
+func connectTo(addr string) []string {
+	hosts, err := resolveHosts(addr, *resolveAll)
+	if err != nil {
+		fatal("Cannot resolve host", "host", addr, "err", err)
+	}
+	if err := waitReady(hosts, *connectTimeout); err != nil {
+		fatal("Server is not ready", "err", err)
+	}
+	return hosts
+}
+
+// seedRandomness picks a seed from the clock unless -seed is given, and
+// logs it so the run can be reproduced.
+func seedRandomness() {
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	result("Random seed", "seed", *seed)
+}
+
+func runFill(hosts []string) {
+	seedRandomness()
+	payload, err := newPayload(*payloadSpec, *size)
+	if err != nil {
+		fatal("Invalid payload", "err", err)
+	}
+	confirmDestructive(hosts, false, *count)
+	fillBeanstalk(hosts, *count, payload)
+	result("Filled", "jobs", *count, "targets", strings.Join(hosts, ","))
+}
+
+func runDrain(hosts []string) {
+	confirmDestructive(hosts, true, 0)
+	for _, h := range hosts {
+		drainBeanstalk(h)
+	}
+}
+
+func runStats(hosts []string) {
+	for _, h := range hosts {
+		stats, err := serverStats(h)
+		if err != nil {
+			fatal("Cannot fetch server stats", "host", h, "err", err)
+		}
+		args := []any{"host", h}
+		for _, k := range sortedKeys(stats) {
+			args = append(args, k, stats[k])
+		}
+		result("Server stats", args...)
+	}
+}
+
+func runConformance(hosts []string) {
+	if !testConformance(hosts[0]) {
+		os.Exit(1)
+	}
+}
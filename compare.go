@@ -0,0 +1,158 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+)
+
+var compareB = flag.String("b", "", "Host of the second server of the compare command, the first is -a")
+var overheadVia = flag.String("via", "", "Proxy or sidecar in front of -h, such as haproxy or envoy, that the overhead command runs the benchmark through")
+var compareMode = flag.String("compare-mode", "interleaved", "How the compare command takes turns: interleaved (a, b, a, b, ...) or sequential (all runs of a, then those of b)")
+
+func init() {
+	// -a is -h under the name compare gives it.
+	flag.Var(flag.Lookup("h").Value, "a", "Host of the first server of the compare command, the same as -h")
+}
+
+// compareMetrics are compared between the servers, by the names -assert
+// knows them by.
+var compareMetrics = []string{
+	"publish_rate", "read_rate",
+	"put_p50", "put_p90", "put_p99", "put_max",
+	"reserve_p50", "reserve_p90", "reserve_p99", "reserve_max",
+	"delete_p50", "delete_p99",
+}
+
+// runCompare runs the benchmark -runs times against the servers of -a and
+// of -b each, draining them before every run, and logs the metrics of both
+// side by side.
+func runCompare(a []string) {
+	if *compareB == "" {
+		fatal("compare needs -b")
+	}
+	stats := compareRuns("compare", a, connectTo(*compareB))
+	for _, m := range compareMetrics {
+		sa, okA := stats[0][m]
+		sb, okB := stats[1][m]
+		if !okA || !okB {
+			continue
+		}
+		args := []any{"metric", m, "a", sa.format(sa.Mean), "b", sb.format(sb.Mean)}
+		if sa.Mean != 0 {
+			args = append(args, "change", fmt.Sprintf("%+.1f%%", 100*(sb.Mean-sa.Mean)/sa.Mean))
+		}
+		if *runs > 1 {
+			args = append(args, "a_ci95", "±"+sa.format(sa.CI95), "b_ci95", "±"+sb.format(sb.CI95))
+		}
+		result("Compare", args...)
+	}
+	if expired() {
+		os.Exit(1)
+	}
+}
+
+// runOverhead runs the benchmark -runs times directly against the servers
+// of -h and through the proxy of -via each, and logs the latency the proxy
+// adds to every operation and the throughput it costs.
+func runOverhead(direct []string) {
+	if *overheadVia == "" {
+		fatal("overhead needs -via")
+	}
+	stats := compareRuns("overhead", direct, connectTo(*overheadVia))
+	for _, m := range compareMetrics {
+		sd, okD := stats[0][m]
+		sv, okV := stats[1][m]
+		if !okD || !okV {
+			continue
+		}
+		// The proxy costs throughput and adds latency.
+		cost := sv.Mean - sd.Mean
+		name := "added"
+		if !isLatencyMetric(m) {
+			cost, name = -cost, "cost"
+		}
+		args := []any{"metric", m, "direct", sd.format(sd.Mean), "via", sv.format(sv.Mean), name, sd.format(cost)}
+		if sd.Mean != 0 {
+			args = append(args, name+"_pct", fmt.Sprintf("%+.1f%%", 100*cost/sd.Mean))
+		}
+		if *runs > 1 {
+			args = append(args, name+"_ci95", "±"+sd.format(math.Hypot(sd.CI95, sv.CI95)))
+		}
+		result("Proxy overhead", args...)
+	}
+	if expired() {
+		os.Exit(1)
+	}
+}
+
+// compareRuns runs the benchmark -runs times against the servers of a and
+// of b each, draining them before every run, in the turns of
+// -compare-mode, and returns the statistics of the runs of both by metric.
+func compareRuns(name string, a, b []string) [2]map[string]runStat {
+	if *scenario != "" || *sweepSpec != "" {
+		fatal(name + " cannot be combined with -scenario or -sweep")
+	}
+	if *compareMode != "interleaved" && *compareMode != "sequential" {
+		fatal("Unknown compare mode", "compare_mode", *compareMode)
+	}
+	targets := [][]string{a, b}
+	startBench(append(append([]string(nil), a...), b...), *drain || *tubeTemplate == "")
+	trace := configureBench()
+	payload, produce, consume := workload(trace)
+	slog.Info("Comparing", "a", strings.Join(a, ","), "b", strings.Join(b, ","), "runs", *runs, "mode", *compareMode)
+
+	var order []int
+	for i := 0; i < *runs; i++ {
+		order = append(order, 0, 1)
+	}
+	if *compareMode == "sequential" {
+		order = order[:0]
+		for side := 0; side < 2; side++ {
+			for i := 0; i < *runs; i++ {
+				order = append(order, side)
+			}
+		}
+	}
+	results := make([][]*runResult, 2)
+	for n, side := range order {
+		if expired() {
+			break
+		}
+		hosts := targets[side]
+		if n > 0 {
+			drainBetween(hosts, "run")
+		}
+		slog.Info("Starting run", "server", string(rune('a'+side)), "run", len(results[side])+1, "runs", *runs)
+		results[side] = append(results[side], runOnce(hosts, payload, produce, consume, trace))
+	}
+
+	stats := [2]map[string]runStat{}
+	for side := range results {
+		stats[side] = make(map[string]runStat)
+		if len(results[side]) == 0 {
+			continue
+		}
+		for _, s := range aggregateRuns(results[side]) {
+			stats[side][s.Metric] = s
+		}
+	}
+	return stats
+}
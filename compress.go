@@ -0,0 +1,191 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A body compressed with -compress starts with the first bytes of the
+// uncompressed one, which hold the headers of -verify-order and -shared,
+// followed by the checksum and the length the readers verify it with.
+const (
+	compressCopied = cleanupMarkerAfter
+	compressHeader = compressCopied + 8
+)
+
+// codec compresses and decompresses the bodies of -compress.
+type codec struct {
+	compress   func(dst, src []byte) []byte
+	decompress func(dst, src []byte) ([]byte, error)
+}
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+var codecs = map[string]codec{
+	"gzip": {
+		compress: func(dst, src []byte) []byte {
+			b := bytes.NewBuffer(dst)
+			w := gzipWriters.Get().(*gzip.Writer)
+			w.Reset(b)
+			w.Write(src)
+			w.Close()
+			gzipWriters.Put(w)
+			return b.Bytes()
+		},
+		decompress: func(dst, src []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			b := bytes.NewBuffer(dst)
+			_, err = io.Copy(b, r)
+			return b.Bytes(), err
+		},
+	},
+	"snappy": {
+		compress: func(dst, src []byte) []byte {
+			return append(dst, snappy.Encode(nil, src)...)
+		},
+		decompress: func(dst, src []byte) ([]byte, error) {
+			out, err := snappy.Decode(nil, src)
+			return append(dst, out...), err
+		},
+	},
+	"zstd": {
+		compress:   func(dst, src []byte) []byte { return zstdEncoder.EncodeAll(src, dst) },
+		decompress: func(dst, src []byte) ([]byte, error) { return zstdDecoder.DecodeAll(src, dst) },
+	},
+}
+
+// compressedPayload returns a payload of the bodies of payload compressed
+// as -compress says, counting the bytes before and after in m.
+func compressedPayload(payload payloadFunc, m *metrics) payloadFunc {
+	c := codecs[*compressCodec]
+	raws := sync.Pool{New: func() any { return new([]byte) }}
+	return func(buf []byte) []byte {
+		raw := raws.Get().(*[]byte)
+		*raw = payload((*raw)[:0])
+		for len(*raw) < compressCopied {
+			*raw = append(*raw, 0)
+		}
+		start := len(buf)
+		buf = append(buf, (*raw)[:compressCopied]...)
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(*raw))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(*raw)))
+		t0 := time.Now()
+		buf = c.compress(buf, *raw)
+		m.compress.record(time.Since(t0))
+		m.rawBytes.add(int64(len(*raw)))
+		m.compressedBytes.add(int64(len(buf) - start))
+		raws.Put(raw)
+		return buf
+	}
+}
+
+// decompress returns the body a publisher compressed with -compress, and
+// false if it does not decompress to what was put, which counts as an
+// error.
+func (r *run) decompress(body []byte) ([]byte, bool) {
+	if *compressCodec == "none" {
+		return body, true
+	}
+	t0 := time.Now()
+	raw, err := verifiedDecompress(codecs[*compressCodec], body)
+	if err != nil {
+		r.metrics.errors.add(1)
+		slog.Warn("Cannot decompress the job", "compress", *compressCodec, "err", err)
+		return nil, false
+	}
+	r.metrics.decompress.record(time.Since(t0))
+	r.metrics.decompressedBytes.add(int64(len(raw)))
+	return raw, true
+}
+
+func verifiedDecompress(c codec, body []byte) ([]byte, error) {
+	if len(body) < compressHeader {
+		return nil, errors.New("body too short")
+	}
+	raw, err := c.decompress(nil, body[compressHeader:])
+	if err != nil {
+		return nil, err
+	}
+	if n := binary.BigEndian.Uint32(body[compressCopied+4:]); int(n) != len(raw) {
+		return nil, fmt.Errorf("decompressed to %d bytes instead of %d", len(raw), n)
+	}
+	if binary.BigEndian.Uint32(body[compressCopied:]) != crc32.ChecksumIEEE(raw) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return raw, nil
+}
+
+// jsonCompression is the compression of a run in the JSON summary.
+type jsonCompression struct {
+	Codec           string  `json:"codec"`
+	RawBytes        int64   `json:"raw_bytes"`
+	CompressedBytes int64   `json:"compressed_bytes"`
+	Ratio           float64 `json:"ratio"`
+	// The rates are in bytes per second, of the publishers before and
+	// after compressing and of the readers after decompressing.
+	RawPublishRate        float64 `json:"raw_publish_rate"`
+	CompressedPublishRate float64 `json:"compressed_publish_rate"`
+	RawReadRate           float64 `json:"raw_read_rate"`
+}
+
+// compression returns the compression of res, nil without -compress.
+func (res *runResult) compression() *jsonCompression {
+	if *compressCodec == "none" {
+		return nil
+	}
+	m := res.metrics
+	c := &jsonCompression{
+		Codec:           *compressCodec,
+		RawBytes:        m.rawBytes.load(),
+		CompressedBytes: m.compressedBytes.load(),
+	}
+	if c.CompressedBytes > 0 {
+		c.Ratio = float64(c.RawBytes) / float64(c.CompressedBytes)
+	}
+	if res.publishTime > 0 {
+		c.RawPublishRate = float64(c.RawBytes) / res.publishTime.Seconds()
+		c.CompressedPublishRate = float64(c.CompressedBytes) / res.publishTime.Seconds()
+	}
+	if res.readTime > 0 {
+		c.RawReadRate = float64(m.decompressedBytes.load()) / res.readTime.Seconds()
+	}
+	return c
+}
+
+func reportCompression(res *runResult) {
+	if c := res.compression(); c != nil {
+		result("Compression", "codec", c.Codec, "raw_bytes", c.RawBytes, "compressed_bytes", c.CompressedBytes,
+			"ratio", fmt.Sprintf("%.2f", c.Ratio), "raw_publish_rate", fmt.Sprintf("%.0f B/s", c.RawPublishRate),
+			"compressed_publish_rate", fmt.Sprintf("%.0f B/s", c.CompressedPublishRate), "raw_read_rate", fmt.Sprintf("%.0f B/s", c.RawReadRate))
+	}
+}
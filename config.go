@@ -0,0 +1,213 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var configPath = flag.String("config", "", "File of name = value lines setting the flags that the command line and the environment leave alone; on SIGHUP the run takes -rate, -r and -outcome from it again")
+
+// configFlags are the flags set from -config, for the log.
+var configFlags []string
+
+// reloadable are the flags a run takes from -config again on SIGHUP.
+var reloadable = []string{"rate", "r", "outcome"}
+
+// readConfig reads a file of name = value lines, one flag a line, the
+// name with or without its dash. Blank lines and those starting with # are
+// left out.
+func readConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: %q is not name = value", path, n, line)
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("%s:%d: -%s is set twice", path, n, name)
+		}
+		values[name] = strings.TrimSpace(value)
+	}
+	return values, sc.Err()
+}
+
+// applyConfig sets every flag of fs that the command line and the
+// environment left alone from -config, if it is given. Flags of other
+// commands are skipped, so one file can serve them all.
+func applyConfig(fs *flag.FlagSet) error {
+	if *configPath == "" {
+		return nil
+	}
+	values, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, name := range sortedKeys(values) {
+		if fs.Lookup(name) == nil {
+			if flag.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown flag -%s", *configPath, name)
+			}
+			continue
+		}
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("%s: invalid value %q for -%s: %v", *configPath, values[name], name, err)
+		}
+		configFlags = append(configFlags, name)
+	}
+	return nil
+}
+
+// reloads takes the tunables of the run going on from -config again on
+// SIGHUP, nil without -config or where there is no SIGHUP.
+var reloads *reloader
+
+// reloader applies the reloadable flags of -config to whichever run of
+// -runs is going on. It changes only what differs from what it last
+// applied, so a value the control API or -consumer-schedule set holds
+// until the file changes it.
+type reloader struct {
+	mu   sync.Mutex
+	r    *run
+	last map[string]string
+}
+
+func newReloader() *reloader {
+	l := &reloader{last: make(map[string]string)}
+	for _, name := range reloadable {
+		l.last[name] = flag.Lookup(name).Value.String()
+	}
+	return l
+}
+
+// attach makes r the run a reload acts on; nil detaches it.
+func (l *reloader) attach(r *run) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.r = r
+	l.mu.Unlock()
+}
+
+// jsonReload is the reload event of the stream.
+type jsonReload struct {
+	ElapsedSeconds float64  `json:"elapsed_seconds"`
+	Changes        []string `json:"changes"`
+}
+
+// reload reads -config and applies the reloadable values that changed.
+// A file with any invalid value changes nothing. Every change is logged
+// and noted on the next point of the series.
+func (l *reloader) reload() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.r
+	if r == nil {
+		slog.Warn("No run is going on, the config is not reloaded", "path", *configPath)
+		return
+	}
+	values, err := readConfig(*configPath)
+	if err != nil {
+		slog.Warn("Cannot reload the config, nothing changed", "err", err)
+		return
+	}
+	changed := make(map[string]string)
+	for _, name := range reloadable {
+		if v, ok := values[name]; ok && v != l.last[name] {
+			changed[name] = v
+		}
+	}
+
+	var rate float64
+	var readers int
+	var mix outcomeMix
+	if v, ok := changed["rate"]; ok {
+		if rate, err = strconv.ParseFloat(v, 64); err != nil || rate < 0 {
+			err = fmt.Errorf("-rate %q is not a rate in jobs per second", v)
+		}
+	}
+	if v, ok := changed["r"]; ok && err == nil {
+		if readers, err = strconv.Atoi(v); err != nil || readers < 0 {
+			err = fmt.Errorf("-r %q is not a number of readers", v)
+		} else if r.scale == nil {
+			err = fmt.Errorf("-r can only be reloaded while readers of -client native run")
+		}
+	}
+	if v, ok := changed["outcome"]; ok && err == nil {
+		if mix, err = parseOutcomes(v); err != nil {
+			err = fmt.Errorf("-outcome: %v", err)
+		}
+	}
+	if err != nil {
+		slog.Warn("Invalid config, nothing changed", "path", *configPath, "err", err)
+		return
+	}
+
+	var changes []string
+	for _, name := range reloadable {
+		v, ok := changed[name]
+		if !ok {
+			continue
+		}
+		switch name {
+		case "rate":
+			pace.setRate(rate)
+		case "r":
+			if readers > r.scale.connected {
+				slog.Warn("Only the readers connected at the start can reserve", "readers", readers, "connected", r.scale.connected)
+				readers = r.scale.connected
+			}
+			r.scale.rescale(readers)
+			v = strconv.Itoa(readers)
+		case "outcome":
+			setOutcomes(mix)
+		}
+		l.last[name] = changed[name]
+		changes = append(changes, name+"="+v)
+	}
+	if len(changes) == 0 {
+		slog.Info("Reloaded the config, nothing changed", "path", *configPath)
+		return
+	}
+	elapsed := time.Since(r.metrics.start)
+	result("Reloaded the config", "elapsed", elapsed.Round(time.Millisecond), "changes", strings.Join(changes, " "))
+	r.metrics.series.annotate("reload " + strings.Join(changes, " "))
+	stream.publish("reload", jsonReload{elapsed.Seconds(), changes})
+}
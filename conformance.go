@@ -0,0 +1,164 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const conformanceTube = "bench-conformance"
+
+// conformanceCase sends raw protocol to a fresh connection that uses and
+// watches conformanceTube, and returns what the server answered. want is
+// the start of the expected answer, as beanstalkd 1.13 gives it.
+type conformanceCase struct {
+	name string
+	want string
+	run  func(c *nativeConn, maxJobSize int) string
+}
+
+// exchange sends raw and returns the first line of the answer, without its
+// CRLF, or what went wrong.
+func exchange(c *nativeConn, raw string) string {
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.w.WriteString(raw); err != nil {
+		return "error: " + err.Error()
+	}
+	if err := c.flush(); err != nil {
+		return "error: " + err.Error()
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// exchangeYAML sends a stats command and returns the line of the answer
+// with key.
+func exchangeYAML(c *nativeConn, cmd, key string) string {
+	line := exchange(c, cmd+"\r\n")
+	var n int
+	if _, err := fmt.Sscanf(line, "OK %d", &n); err != nil {
+		return line
+	}
+	body := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return "error: " + err.Error()
+	}
+	for _, l := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(l, key+":") {
+			return l
+		}
+	}
+	return "no " + key
+}
+
+func rawPut(pri string, ttr string, body string) string {
+	return fmt.Sprintf("put %s 0 %s %d\r\n%s\r\n", pri, ttr, len(body), body)
+}
+
+func sendRaw(raw string) func(*nativeConn, int) string {
+	return func(c *nativeConn, _ int) string { return exchange(c, raw) }
+}
+
+var conformanceCases = []conformanceCase{
+	// Before any case leaves a job in the tube.
+	{"reserve from an empty tube", "TIMED_OUT", sendRaw("reserve-with-timeout 0\r\n")},
+	{"unknown command", "UNKNOWN_COMMAND", sendRaw("frobnicate\r\n")},
+	{"empty line", "UNKNOWN_COMMAND", sendRaw("\r\n")},
+	{"put without arguments", "BAD_FORMAT", sendRaw("put\r\n")},
+	{"body without CRLF", "EXPECTED_CRLF", sendRaw("put 0 0 10 3\r\nabcXY\r\n")},
+	{"body longer than announced", "EXPECTED_CRLF", sendRaw("put 0 0 10 3\r\nabcdef\r\n")},
+	{"job of the largest size", "INSERTED", func(c *nativeConn, max int) string {
+		return exchange(c, rawPut("0", "10", strings.Repeat("x", max)))
+	}},
+	{"oversized job", "JOB_TOO_BIG", func(c *nativeConn, max int) string {
+		return exchange(c, rawPut("0", "10", strings.Repeat("x", max+1)))
+	}},
+	{"zero TTR is raised to one second", "ttr: 1", func(c *nativeConn, _ int) string {
+		line := exchange(c, rawPut("0", "0", "x"))
+		id, ok := strings.CutPrefix(line, "INSERTED ")
+		if !ok {
+			return line
+		}
+		return exchangeYAML(c, "stats-job "+id, "ttr")
+	}},
+	{"largest priority", "INSERTED", sendRaw(rawPut("4294967295", "10", "x"))},
+	{"priority above 32 bits", "BAD_FORMAT", sendRaw(rawPut("4294967296", "10", "x"))},
+	{"negative priority", "BAD_FORMAT", sendRaw(rawPut("-1", "10", "x"))},
+	{"command line too long", "BAD_FORMAT", sendRaw("use " + strings.Repeat("t", 300) + "\r\n")},
+	{"tube name too long", "BAD_FORMAT", sendRaw("use " + strings.Repeat("t", 201) + "\r\n")},
+	{"tube name starting with a hyphen", "BAD_FORMAT", sendRaw("use -tube\r\n")},
+	{"ignore the last watched tube", "NOT_IGNORED", sendRaw("ignore " + conformanceTube + "\r\n")},
+	{"delete an unknown job", "NOT_FOUND", sendRaw("delete 18446744073709551615\r\n")},
+	{"release an unreserved job", "NOT_FOUND", sendRaw("release 18446744073709551615 0 0\r\n")},
+	{"peek job 0", "NOT_FOUND", sendRaw("peek 0\r\n")},
+}
+
+// testConformance runs the protocol edge cases against h and logs the
+// answer to each. It returns whether all answers were as expected.
+func testConformance(h string) bool {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	clearTube(conn, conformanceTube)
+	conn.Close()
+
+	maxJobSize := selftestMaxJobSize
+	if stats, err := serverStats(h); err == nil {
+		if n, err := strconv.Atoi(stats["max-job-size"]); err == nil {
+			maxJobSize = n
+		}
+	}
+	slog.Info("Running conformance cases", "host", h, "cases", len(conformanceCases), "max_job_size", maxJobSize)
+
+	failed := 0
+	for _, tc := range conformanceCases {
+		c, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := c.use(conformanceTube); err == nil {
+			if err = c.watch(conformanceTube); err == nil {
+				err = c.ignore("default")
+			}
+		}
+		if err != nil {
+			fatal("Cannot watch tube", "tube", conformanceTube, "err", err)
+		}
+		got := tc.run(c, maxJobSize)
+		c.Close()
+		ok := strings.HasPrefix(got, tc.want)
+		if !ok {
+			failed++
+		}
+		result("Conformance", "case", tc.name, "want", tc.want, "got", got, "ok", ok)
+	}
+
+	conn, err = dialBeanstalk(h)
+	if err == nil {
+		clearTube(conn, conformanceTube)
+		conn.Close()
+	}
+	result("Conformance summary", "cases", len(conformanceCases), "failed", failed)
+	return failed == 0
+}
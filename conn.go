@@ -0,0 +1,288 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kr/beanstalk"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxy is the parsed -proxy flag, nil to connect directly.
+var proxy *url.URL
+
+// bandwidthLimit is the parsed -bandwidth-limit flag, in bytes per second;
+// 0 for no limit.
+var bandwidthLimit float64
+
+// connectRate is the parsed -connect-ramp flag, in connections per second;
+// 0 dials them all at once.
+var connectRate float64
+
+// parseConnectRamp parses a rate of connections such as 50/s, or just 50.
+func parseConnectRamp(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "/s"), 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("connect ramp %q is not a positive rate such as 50/s", s)
+	}
+	return v, nil
+}
+
+// dial opens a connection to h for the native client and the
+// github.com/kr/beanstalk connections, applying the connection level flags,
+// and tracks its lifecycle.
+func dial(h string) (net.Conn, error) {
+	t0 := time.Now()
+	conn, err := dialTuned(h)
+	if err != nil {
+		lifecycle.dialFailed(err)
+		return nil, err
+	}
+	lifecycle.dials.add(1)
+	lifecycle.dial.record(time.Since(t0))
+	if *readOnly {
+		return &readOnlyConn{Conn: newTrackedConn(conn, t0)}, nil
+	}
+	return newTrackedConn(conn, t0), nil
+}
+
+func dialTuned(h string) (net.Conn, error) {
+	addr := h
+	if proxy != nil {
+		addr = proxy.Host
+	}
+	dialer := net.Dialer{Timeout: 10 * time.Second, KeepAlive: *keepAlive}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := tuneTCP(conn.(*net.TCPConn)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if proxy != nil {
+		if err := proxyHandshake(conn, proxy, h); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if *injectLatency > 0 {
+		conn = newDelayedConn(conn, *injectLatency)
+	}
+	if bandwidthLimit > 0 {
+		conn = newThrottledConn(conn, bandwidthLimit)
+	}
+	return conn, nil
+}
+
+func tuneTCP(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(*tcpNoDelay); err != nil {
+		return err
+	}
+	if *sndBuf > 0 {
+		if err := conn.SetWriteBuffer(*sndBuf); err != nil {
+			return err
+		}
+	}
+	if *rcvBuf > 0 {
+		if err := conn.SetReadBuffer(*rcvBuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connFlagsSet tells whether any of the connection level flags differ from
+// their defaults.
+func connFlagsSet() bool {
+	return proxy != nil || *injectLatency > 0 || bandwidthLimit > 0 || !*tcpNoDelay || *sndBuf > 0 || *rcvBuf > 0 || *keepAlive != 0
+}
+
+// connSettings describes the connection level flags for the report.
+func connSettings() string {
+	keepalive := "default"
+	if *keepAlive > 0 {
+		keepalive = keepAlive.String()
+	} else if *keepAlive < 0 {
+		keepalive = "off"
+	}
+	buf := func(n int) string {
+		if n > 0 {
+			return strconv.Itoa(n)
+		}
+		return "default"
+	}
+	bandwidth := "unlimited"
+	if bandwidthLimit > 0 {
+		bandwidth = *bandwidthLimitFlag
+	}
+	return fmt.Sprintf("nodelay=%v sndbuf=%s rcvbuf=%s keepalive=%s bandwidth=%s", *tcpNoDelay, buf(*sndBuf), buf(*rcvBuf), keepalive, bandwidth)
+}
+
+func dialBeanstalk(h string) (*beanstalk.Conn, error) {
+	conn, err := dial(h)
+	if err != nil {
+		return nil, err
+	}
+	return beanstalk.NewConn(conn), nil
+}
+
+type delayedWrite struct {
+	due  time.Time
+	data []byte
+}
+
+// delayedConn holds back everything written for a fixed delay before it is
+// sent, without blocking the writer, like a link with a long round trip.
+type delayedConn struct {
+	net.Conn
+	delay   time.Duration
+	writes  chan delayedWrite
+	closing chan struct{}
+	once    sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func newDelayedConn(conn net.Conn, delay time.Duration) *delayedConn {
+	c := &delayedConn{
+		Conn:    conn,
+		delay:   delay,
+		writes:  make(chan delayedWrite, 1024),
+		closing: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *delayedConn) run() {
+	for {
+		select {
+		case w := <-c.writes:
+			time.Sleep(time.Until(w.due))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				c.mu.Lock()
+				c.err = err
+				c.mu.Unlock()
+				return
+			}
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+func (c *delayedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	w := delayedWrite{due: time.Now().Add(c.delay), data: append([]byte(nil), p...)}
+	select {
+	case c.writes <- w:
+		return len(p), nil
+	case <-c.closing:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *delayedConn) Close() error {
+	c.once.Do(func() { close(c.closing) })
+	return c.Conn.Close()
+}
+
+// tokenBucket paces bytes to a rate, letting through a burst of up to a
+// hundredth of a second of it at once.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate / 100
+	if burst < 1500 {
+		burst = 1500
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes n bytes from the bucket, which may go into debt, and returns
+// how long to wait until the debt is paid.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledConn limits the bytes written to and read from a connection to
+// a rate each way, like a constrained link. A write blocks until all of it
+// went out at the rate, so a reader that writes slowly holds its jobs for
+// longer, and reads are paced by holding back the next one.
+type throttledConn struct {
+	net.Conn
+	in, out *tokenBucket
+}
+
+func newThrottledConn(conn net.Conn, rate float64) *throttledConn {
+	return &throttledConn{Conn: conn, in: newTokenBucket(rate), out: newTokenBucket(rate)}
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := len(p) - written
+		if chunk > int(c.out.burst) {
+			chunk = int(c.out.burst)
+		}
+		time.Sleep(c.out.take(chunk))
+		n, err := c.Conn.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(p) > int(c.in.burst) {
+		p = p[:int(c.in.burst)]
+	}
+	n, err := c.Conn.Read(p)
+	time.Sleep(c.in.take(n))
+	return n, err
+}
@@ -0,0 +1,177 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When the readers are done, set with -consume-until.
+const (
+	// untilCount stops after the readers are done with -consume-count
+	// jobs, fewer if the run was stopped early.
+	untilCount = "count"
+	// untilEmpty stops once the publishers are done and the tube has no
+	// ready or reserved jobs left on any host.
+	untilEmpty = "empty"
+	// untilDuration stops -consume-for after the start of the run.
+	untilDuration = "duration"
+)
+
+// When the readers start, set with -sequence.
+const (
+	// sequenceConcurrent starts the readers with the publishers, so the
+	// run measures the pipeline as a whole.
+	sequenceConcurrent = "concurrent"
+	// sequenceProduceThenConsume starts the readers once the publishers
+	// are done, so they drain a full tube alone.
+	sequenceProduceThenConsume = "produce-then-consume"
+)
+
+// consumption tells the readers of a run when to stop.
+type consumption struct {
+	mode  string
+	count int
+	done  chan struct{}
+	once  sync.Once
+}
+
+func validConsumeUntil(mode string) error {
+	switch mode {
+	case untilCount, untilEmpty, untilDuration:
+		return nil
+	}
+	return fmt.Errorf("unknown -consume-until %q, want count, empty or duration", mode)
+}
+
+// read counts n jobs the readers of r are done with. The first of them
+// starts the read phase.
+func (r *run) read(n int64) {
+	v := r.reads.add(n)
+	if v == n {
+		atomic.CompareAndSwapInt64(&r.firstRead, 0, time.Now().UnixNano())
+	}
+	if r.consume.mode == untilCount && v >= r.target(r.consume.count) {
+		r.consumed()
+	}
+}
+
+// readStart returns when the readers were done with their first job, after
+// the start of the run, or 0 if they never were.
+func (r *run) readStart() time.Duration {
+	first := atomic.LoadInt64(&r.firstRead)
+	if first == 0 {
+		return 0
+	}
+	return time.Unix(0, first).Sub(r.metrics.start)
+}
+
+// consumed ends the reading.
+func (r *run) consumed() {
+	r.consume.once.Do(func() { close(r.consume.done) })
+}
+
+// consuming tells whether the readers should go on.
+func (r *run) consuming() bool {
+	select {
+	case <-r.consume.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// watchConsumption ends the reading of r when the mode says so, for what
+// read does not catch as it happens.
+func watchConsumption(r *run, mode string, count int, d time.Duration) {
+	r.consume.mode, r.consume.count = mode, count
+	switch mode {
+	case untilDuration:
+		time.AfterFunc(d, r.consumed)
+	case untilCount:
+		// A run stopped early lowers the target after the last read.
+		go func() {
+			<-r.published
+			for r.consuming() && r.reads.load() < r.target(count) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			r.consumed()
+		}()
+	case untilEmpty:
+		go func() {
+			<-r.published
+			var conns []*beanstalk.Conn
+			for _, h := range r.hosts {
+				conn, err := dialBeanstalk(h)
+				if err != nil {
+					fatal("Cannot connect", "host", h, "err", err)
+				}
+				defer conn.Close()
+				conns = append(conns, conn)
+			}
+			for r.consuming() {
+				if tubesEmpty(conns, r.watched()) {
+					r.consumed()
+					return
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+	}
+}
+
+// tubeEmpty tells whether no host has ready or reserved jobs in the tube.
+func tubeEmpty(conns []*beanstalk.Conn, tube string) bool {
+	for _, conn := range conns {
+		t := &beanstalk.Tube{Conn: conn, Name: tube}
+		stats, err := t.Stats()
+		if err != nil {
+			slog.Warn("Cannot fetch tube stats", "tube", tube, "err", err)
+			return false
+		}
+		ready, _ := strconv.ParseInt(stats["current-jobs-ready"], 10, 64)
+		reserved, _ := strconv.ParseInt(stats["current-jobs-reserved"], 10, 64)
+		if ready+reserved > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tubeReady returns the ready jobs of the tube on conn.
+func tubeReady(conn *beanstalk.Conn, tube string) (int64, error) {
+	t := &beanstalk.Tube{Conn: conn, Name: tube}
+	stats, err := t.Stats()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(stats["current-jobs-ready"], 10, 64)
+}
+
+// tubesEmpty tells whether all of the tubes are empty on every host.
+func tubesEmpty(conns []*beanstalk.Conn, tubes []string) bool {
+	for _, tube := range tubes {
+		if !tubeEmpty(conns, tube) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// consumerSchedule is the parsed -consumer-schedule flag, nil without it.
+var consumerSchedule []scheduleStep
+
+// scheduleStep sets the number of readers at a time into the run.
+type scheduleStep struct {
+	at      time.Duration
+	readers int
+}
+
+// parseConsumerSchedule parses a comma separated list of offset=readers
+// pairs, such as 0s=10,60s=50,120s=10.
+func parseConsumerSchedule(s string) ([]scheduleStep, error) {
+	var steps []scheduleStep
+	for _, f := range strings.Split(s, ",") {
+		at, n, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return nil, fmt.Errorf("step %q is not offset=readers", f)
+		}
+		d, err := time.ParseDuration(at)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("step %q has an invalid offset", f)
+		}
+		readers, err := strconv.Atoi(n)
+		if err != nil || readers < 0 {
+			return nil, fmt.Errorf("step %q has an invalid number of readers", f)
+		}
+		steps = append(steps, scheduleStep{d, readers})
+	}
+	for i := 1; i < len(steps); i++ {
+		if steps[i].at <= steps[i-1].at {
+			return nil, fmt.Errorf("the offsets of %q do not increase", s)
+		}
+	}
+	return steps, nil
+}
+
+// consumerStep is how the run responded to a step of -consumer-schedule,
+// from its change until the next one. The backlog is the ready jobs on the
+// servers as the step started and ended.
+type consumerStep struct {
+	AtSeconds    float64 `json:"at_seconds"`
+	Readers      int     `json:"readers"`
+	Seconds      float64 `json:"seconds"`
+	BacklogStart int64   `json:"backlog_start"`
+	BacklogEnd   int64   `json:"backlog_end"`
+	ReadRate     float64 `json:"read_rate"`
+	ReserveP99US int64   `json:"reserve_p99_us"`
+}
+
+// readerScale lets as many readers of the native client reserve at a time
+// as -consumer-schedule, or a reload of -config, says. The others stay
+// connected and watch their tubes, which leaves them out of the server's
+// reserves like a worker that was scaled down. A nil readerScale lets all
+// readers reserve.
+type readerScale struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// active is read without the lock by the readers that may reserve.
+	active int64
+	done   bool
+	// connected is the number of readers, the most that can reserve.
+	connected int
+
+	// The channels are nil without a schedule.
+	steps   []consumerStep
+	changes chan int
+	stop    chan struct{}
+	ended   chan struct{}
+}
+
+// newReaderScale lets all readers of r reserve until they are scaled with
+// rescale. Without a schedule it records no steps and dials nothing.
+func newReaderScale(r *run, readers int) *readerScale {
+	s := &readerScale{active: int64(readers), connected: readers}
+	s.cond = sync.NewCond(&s.mu)
+	go func() {
+		<-r.consume.done
+		s.mu.Lock()
+		s.done = true
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}()
+	return s
+}
+
+// startReaderScale applies the steps, the first of which is at 0, to the
+// readers of r from the start of the run, and any change of rescale as it
+// comes, and records how the backlog, the read rate and the reserve latency
+// respond to each.
+func startReaderScale(r *run, steps []scheduleStep, readers int) *readerScale {
+	s := newReaderScale(r, readers)
+	s.set(steps[0].readers)
+	s.changes, s.stop, s.ended = make(chan int), make(chan struct{}), make(chan struct{})
+	var conns []*beanstalk.Conn
+	for _, h := range r.hosts {
+		conn, err := dialBeanstalk(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		conns = append(conns, conn)
+	}
+	go func() {
+		defer close(s.ended)
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		var step *consumerStep
+		var at time.Duration
+		var reads int64
+		var reserve *histogram
+		// finish closes the step under way with the backlog the next one
+		// starts from.
+		finish := func(backlog int64) {
+			if step == nil {
+				return
+			}
+			d := time.Since(r.metrics.start) - at
+			p99 := r.metrics.reserve.snapshot().since(reserve).quantile(0.99)
+			step.Seconds = d.Seconds()
+			step.BacklogEnd = backlog
+			step.ReadRate = rate(int(r.reads.load()-reads), d)
+			step.ReserveP99US = int64(p99 / time.Microsecond)
+			s.steps = append(s.steps, *step)
+			result("Consumer step", "at", at.Round(time.Millisecond), "readers", step.Readers, "backlog_start", step.BacklogStart,
+				"backlog_end", step.BacklogEnd, "read_per_sec", step.ReadRate, "reserve_p99", p99)
+		}
+		for i := 0; ; {
+			// Once the steps are over only rescale changes the readers.
+			var due <-chan time.Time
+			readers := 0
+			if i < len(steps) {
+				due = time.After(time.Until(r.metrics.start.Add(steps[i].at)))
+			}
+			select {
+			case <-due:
+				readers = steps[i].readers
+				i++
+			case readers = <-s.changes:
+			case <-s.stop:
+				backlog, _, _ := readyJobs(conns)
+				finish(backlog)
+				return
+			}
+			backlog, _, _ := readyJobs(conns)
+			finish(backlog)
+			s.set(readers)
+			slog.Info("Scaling the readers", "readers", readers, "backlog", backlog)
+			at = time.Since(r.metrics.start)
+			step = &consumerStep{AtSeconds: at.Seconds(), Readers: readers, BacklogStart: backlog}
+			reads, reserve = r.reads.load(), r.metrics.reserve.snapshot()
+		}
+	}()
+	return s
+}
+
+func (s *readerScale) set(active int) {
+	s.mu.Lock()
+	atomic.StoreInt64(&s.active, int64(active))
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// rescale lets n readers reserve from now on, as a step of its own if
+// there is a schedule.
+func (s *readerScale) rescale(n int) {
+	if s.changes == nil {
+		s.set(n)
+		slog.Info("Scaling the readers", "readers", n)
+		return
+	}
+	select {
+	case s.changes <- n:
+	case <-s.ended:
+	}
+}
+
+// wait holds reader i back while it is scaled down, and tells whether the
+// reader is to go on, which it is not once the reading is over.
+func (s *readerScale) wait(i int) bool {
+	if s == nil || int64(i) < atomic.LoadInt64(&s.active) {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for int64(i) >= atomic.LoadInt64(&s.active) && !s.done {
+		s.cond.Wait()
+	}
+	return !s.done
+}
+
+// idle tells whether reader i is scaled down and not meant to reserve.
+func (s *readerScale) idle(i int) bool {
+	return s != nil && int64(i) >= atomic.LoadInt64(&s.active)
+}
+
+// finish ends the schedule and returns how the run responded to its steps.
+func (s *readerScale) finish() []consumerStep {
+	if s == nil || s.stop == nil {
+		return nil
+	}
+	close(s.stop)
+	<-s.ended
+	return s.steps
+}
@@ -0,0 +1,174 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pace is the offered rate of the publishers of the benchmark, set with
+// -rate and changed through the control API.
+var pace *pacer
+
+// hold is closed while the control API has paused the publishers. It is
+// nil, and always open, without -control-addr.
+var hold *gate
+
+// control is the API of -control-addr, nil without it.
+var control *controlServer
+
+// controlServer is the HTTP API of -control-addr. It outlives the runs of
+// -runs and acts on whichever run is going on.
+type controlServer struct {
+	mu sync.Mutex
+	r  *run
+}
+
+// startControl serves the control API on addr:
+//
+//	GET  /stats            counters, rates and latencies of the current run
+//	POST /rate?value=<n>   offer n jobs per second, 0 for as fast as possible
+//	POST /pause            hold back the publishers
+//	POST /resume           let the publishers go on
+//	POST /stop             stop publishing; the readers finish what was published
+//	GET  /clock            the local time, for -clock-peer
+func startControl(addr string) (*controlServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &controlServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", c.stats)
+	mux.HandleFunc("/clock", serveClock)
+	mux.HandleFunc("/rate", c.post(c.setRate))
+	mux.HandleFunc("/pause", c.post(func(*http.Request) (string, error) {
+		hold.set(true)
+		return "paused", nil
+	}))
+	mux.HandleFunc("/resume", c.post(func(*http.Request) (string, error) {
+		hold.set(false)
+		return "resumed", nil
+	}))
+	mux.HandleFunc("/stop", c.post(func(*http.Request) (string, error) {
+		r := c.current()
+		if r == nil {
+			return "", fmt.Errorf("no run is going on")
+		}
+		hold.set(false)
+		r.stop()
+		return "stopping", nil
+	}))
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Warn("Control API stopped", "err", err)
+		}
+	}()
+	slog.Info("Control API listening", "addr", ln.Addr().String())
+	return c, nil
+}
+
+// attach makes r the run the API acts on; nil detaches it.
+func (c *controlServer) attach(r *run) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.r = r
+	c.mu.Unlock()
+}
+
+func (c *controlServer) current() *run {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.r
+}
+
+// post wraps an action that changes the run, logging what it did.
+func (c *controlServer) post(action func(*http.Request) (string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		msg, err := action(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("Control API", "action", req.URL.Path, "result", msg, "remote", req.RemoteAddr)
+		fmt.Fprintln(w, msg)
+	}
+}
+
+func (c *controlServer) setRate(req *http.Request) (string, error) {
+	rate, err := strconv.ParseFloat(req.URL.Query().Get("value"), 64)
+	if err != nil || rate < 0 {
+		return "", fmt.Errorf("value must be a rate in jobs per second, 0 for unlimited")
+	}
+	pace.setRate(rate)
+	return fmt.Sprintf("rate %v", rate), nil
+}
+
+type controlStats struct {
+	Elapsed   float64                `json:"elapsed_seconds"`
+	Puts      int64                  `json:"puts"`
+	Reads     int64                  `json:"reads"`
+	Errors    int64                  `json:"errors"`
+	InFlight  int64                  `json:"in_flight"`
+	PutRate   float64                `json:"put_rate"`
+	ReadRate  float64                `json:"read_rate"`
+	Offered   float64                `json:"offered_rate"`
+	Paused    bool                   `json:"paused"`
+	Stopping  bool                   `json:"stopping"`
+	Latencies map[string]jsonLatency `json:"latencies"`
+}
+
+func (c *controlServer) stats(w http.ResponseWriter, req *http.Request) {
+	r := c.current()
+	if r == nil {
+		http.Error(w, "no run is going on", http.StatusServiceUnavailable)
+		return
+	}
+	m := r.metrics
+	elapsed := time.Since(m.start)
+	s := controlStats{
+		Elapsed:   elapsed.Seconds(),
+		Puts:      m.put.count(),
+		Reads:     m.delete.count() + m.bury.count(),
+		Errors:    m.errors.load(),
+		InFlight:  m.inFlight.load(),
+		Offered:   pace.rate(),
+		Paused:    hold.isClosed(),
+		Stopping:  r.halted(),
+		Latencies: make(map[string]jsonLatency),
+	}
+	s.PutRate = float64(s.Puts) / elapsed.Seconds()
+	s.ReadRate = float64(s.Reads) / elapsed.Seconds()
+	for _, op := range m.operations() {
+		if op.hist.total > 0 {
+			s.Latencies[op.name] = newJSONLatency(op.hist)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
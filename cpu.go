@@ -0,0 +1,102 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// cpuSaturated is the share of the CPUs available to the process above
+// which the benchmark measures itself rather than the server.
+const cpuSaturated = 0.9
+
+// cpuMonitor samples the CPU time of the process at a fixed interval, as a
+// share of what GOMAXPROCS allows.
+type cpuMonitor struct {
+	mu        sync.Mutex
+	start     time.Time
+	startCPU  time.Duration
+	last      time.Time
+	lastCPU   time.Duration
+	peak      float64
+	available bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startCPUMonitor(interval time.Duration) *cpuMonitor {
+	m := &cpuMonitor{start: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	m.startCPU, m.available = processCPUTime()
+	m.last, m.lastCPU = m.start, m.startCPU
+	if !m.available {
+		close(m.done)
+		return m
+	}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func utilization(cpu, wall time.Duration) float64 {
+	if wall <= 0 {
+		return 0
+	}
+	return cpu.Seconds() / wall.Seconds() / float64(runtime.GOMAXPROCS(0))
+}
+
+func (m *cpuMonitor) sample() {
+	now := time.Now()
+	cpu, _ := processCPUTime()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u := utilization(cpu-m.lastCPU, now.Sub(m.last)); u > m.peak {
+		m.peak = u
+	}
+	m.last, m.lastCPU = now, cpu
+}
+
+// finish stops sampling and returns the utilization over the whole run,
+// reporting it and warning if the process was saturated.
+func (m *cpuMonitor) finish() float64 {
+	if !m.available {
+		return 0
+	}
+	close(m.stop)
+	<-m.done
+	cpu, _ := processCPUTime()
+	mean := utilization(cpu-m.startCPU, time.Since(m.start))
+	result("Client CPU", "utilization", mean, "peak", m.peak, "gomaxprocs", runtime.GOMAXPROCS(0))
+	if mean > cpuSaturated || m.peak > cpuSaturated {
+		slog.Warn("THE BENCHMARK PROCESS WAS CPU-SATURATED: the results measure the client, not beanstalkd. "+
+			"Raise -gomaxprocs, lower -p/-r or run the benchmark from more machines",
+			"utilization", mean, "peak", m.peak)
+	}
+	return mean
+}
@@ -0,0 +1,106 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// runContext is the root of every phase of the benchmark. It is done once
+// -max-duration has passed or the process is interrupted.
+var runContext = context.Background()
+
+// interruptedFlag is set once SIGINT or SIGTERM stopped the run.
+var interruptedFlag int32
+
+// interrupted tells whether SIGINT or SIGTERM stopped the run.
+func interrupted() bool {
+	return atomic.LoadInt32(&interruptedFlag) == 1
+}
+
+// endRun releases runContext.
+var endRun context.CancelFunc = func() {}
+
+// truncationGrace is how long the publishers and readers get to wind down
+// once -max-duration has passed before they are left behind. The process
+// ends with status 1 if the reports are not written within three times
+// that.
+const truncationGrace = 5 * time.Second
+
+// startDeadline derives runContext from -max-duration and from SIGINT and
+// SIGTERM, which stop the run as -max-duration does, so that the readers
+// settle the jobs they hold as -on-stop says and the reports are written.
+// A second signal ends the process at once.
+func startDeadline() {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		signal.Stop(sig)
+		atomic.StoreInt32(&interruptedFlag, 1)
+		slog.Warn("Interrupted, stopping; interrupt again to exit at once", "signal", s, "on_stop", *onStop)
+		cancel()
+	}()
+	runContext, endRun = ctx, cancel
+	if *maxDuration <= 0 {
+		return
+	}
+	runContext, endRun = context.WithTimeout(ctx, *maxDuration)
+	context.AfterFunc(runContext, func() {
+		if !interrupted() {
+			slog.Warn("The run reached -max-duration, stopping", "max_duration", *maxDuration)
+		}
+	})
+	time.AfterFunc(*maxDuration+3*truncationGrace, func() {
+		fatal("The run did not end within -max-duration", "max_duration", *maxDuration, "grace", 3*truncationGrace)
+	})
+}
+
+// expired tells whether the run was cut short, by -max-duration or by an
+// interrupt.
+func expired() bool {
+	return runContext.Err() != nil
+}
+
+// waitOrExpire waits for ch, or for truncationGrace after the run was cut
+// short, and tells whether ch came.
+func waitOrExpire(ch chan int) bool {
+	select {
+	case <-ch:
+		return true
+	case <-runContext.Done():
+	}
+	select {
+	case <-ch:
+		return true
+	case <-time.After(truncationGrace):
+		return false
+	}
+}
+
+// sleepOrExpire sleeps for d, or until -max-duration has passed.
+func sleepOrExpire(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-runContext.Done():
+	}
+}
@@ -0,0 +1,316 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// decodePrefix are the bytes in front of an encoded body that are left to
+// the headers of -verify-order and -shared, which would break the encoding.
+const decodePrefix = cleanupMarkerAfter
+
+// decodeRecord is the structure the publishers encode with -decode, made
+// up like a typical job: a few scalars, a list, a map and the data that
+// makes up the rest of -s.
+type decodeRecord struct {
+	ID       int64             `json:"id"`
+	Created  int64             `json:"created"`
+	Kind     string            `json:"kind"`
+	Priority float64           `json:"priority"`
+	Retry    bool              `json:"retry"`
+	Tags     []string          `json:"tags"`
+	Attrs    map[string]string `json:"attrs"`
+	Data     string            `json:"data"`
+}
+
+var decodeKinds = []string{"email", "resize", "webhook", "report"}
+
+func newDecodeRecord(i int64, data string) *decodeRecord {
+	return &decodeRecord{
+		ID:       i,
+		Created:  time.Now().UnixNano(),
+		Kind:     decodeKinds[i%int64(len(decodeKinds))],
+		Priority: float64(i%100) / 10,
+		Retry:    i%2 == 0,
+		Tags:     []string{"benchmark", "tenant-" + fmt.Sprint(i%16), "v2"},
+		Attrs:    map[string]string{"origin": "beanstalkd-benchmark", "region": "eu-west-1", "trace": fmt.Sprintf("%016x", i)},
+		Data:     data,
+	}
+}
+
+// encodedPayload returns a payload of records encoded as format, json or
+// msgpack, of about size bytes.
+func encodedPayload(format string, size int) (payloadFunc, error) {
+	var encode func(buf []byte, rec *decodeRecord) []byte
+	switch format {
+	case "json":
+		encode = func(buf []byte, rec *decodeRecord) []byte {
+			data, _ := json.Marshal(rec)
+			return append(buf, data...)
+		}
+	case "msgpack":
+		encode = appendMsgpackRecord
+	default:
+		return nil, fmt.Errorf("unknown decode format %q, want json, msgpack or none", format)
+	}
+	overhead := decodePrefix + len(encode(nil, newDecodeRecord(math.MaxInt32, "")))
+	data := strings.Repeat("x", max(size-overhead, 0))
+	var index int64
+	return func(buf []byte) []byte {
+		for i := 0; i < decodePrefix; i++ {
+			buf = append(buf, 0)
+		}
+		return encode(buf, newDecodeRecord(atomic.AddInt64(&index, 1), data))
+	}, nil
+}
+
+// decode decodes body as the readers of -decode do, timing it as an
+// operation of its own. A body that does not decode counts as an error.
+func (r *run) decode(body []byte) {
+	if selectedWorkload != nil {
+		r.consumeWorkload(body)
+		return
+	}
+	if *decodeFormat == "none" {
+		return
+	}
+	t0 := time.Now()
+	var v any
+	var err error
+	if len(body) < decodePrefix {
+		err = errors.New("body too short")
+	} else if *decodeFormat == "json" {
+		err = json.Unmarshal(body[decodePrefix:], &v)
+	} else {
+		v, err = decodeMsgpack(body[decodePrefix:])
+	}
+	if err != nil {
+		r.metrics.errors.add(1)
+		slog.Warn("Cannot decode the job", "format", *decodeFormat, "err", err)
+		return
+	}
+	r.metrics.decode.record(time.Since(t0))
+}
+
+// appendMsgpackRecord appends rec encoded as a msgpack map with the keys
+// of its JSON encoding.
+func appendMsgpackRecord(buf []byte, rec *decodeRecord) []byte {
+	buf = append(buf, 0x80|8)
+	buf = appendMsgpackString(buf, "id")
+	buf = appendMsgpackInt(buf, rec.ID)
+	buf = appendMsgpackString(buf, "created")
+	buf = appendMsgpackInt(buf, rec.Created)
+	buf = appendMsgpackString(buf, "kind")
+	buf = appendMsgpackString(buf, rec.Kind)
+	buf = appendMsgpackString(buf, "priority")
+	buf = binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(rec.Priority))
+	buf = appendMsgpackString(buf, "retry")
+	if rec.Retry {
+		buf = append(buf, 0xc3)
+	} else {
+		buf = append(buf, 0xc2)
+	}
+	buf = appendMsgpackString(buf, "tags")
+	buf = append(buf, 0x90|byte(len(rec.Tags)))
+	for _, t := range rec.Tags {
+		buf = appendMsgpackString(buf, t)
+	}
+	buf = appendMsgpackString(buf, "attrs")
+	buf = append(buf, 0x80|byte(len(rec.Attrs)))
+	for _, k := range sortedKeys(rec.Attrs) {
+		buf = appendMsgpackString(buf, k)
+		buf = appendMsgpackString(buf, rec.Attrs[k])
+	}
+	buf = appendMsgpackString(buf, "data")
+	return appendMsgpackString(buf, rec.Data)
+}
+
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	if n >= 0 && n < 128 {
+		return append(buf, byte(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n < 1<<8:
+		buf = append(buf, 0xd9, byte(n))
+	case n < 1<<16:
+		buf = binary.BigEndian.AppendUint16(append(buf, 0xda), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint32(append(buf, 0xdb), uint32(n))
+	}
+	return append(buf, s...)
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// decodeMsgpack decodes a msgpack value into maps, slices, strings and
+// numbers, as a consumer that does not know the structure would.
+func decodeMsgpack(data []byte) (any, error) {
+	d := msgpackDecoder{data: data}
+	v, err := d.value()
+	if err == nil && d.pos != len(d.data) {
+		err = errors.New("msgpack: trailing data")
+	}
+	return v, err
+}
+
+// msgpackSizes are the bytes of the length, or of the value, after the
+// types that carry one.
+var msgpackSizes = map[byte]int{
+	0xc4: 1, 0xc5: 2, 0xc6: 4, // bin
+	0xca: 4, 0xcb: 8, // float
+	0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, // uint
+	0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, // int
+	0xd9: 1, 0xda: 2, 0xdb: 4, // str
+	0xdc: 2, 0xdd: 4, // array
+	0xde: 2, 0xdf: 4, // map
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+// next returns the next n bytes.
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) value() (any, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := b[0]; {
+	case c < 0x80:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2:
+		return false, nil
+	case c == 0xc3:
+		return true, nil
+	}
+	c := b[0]
+	size, ok := msgpackSizes[c]
+	if !ok {
+		return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+	}
+	n, err := d.uint(size)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0xc6:
+		b, err := d.next(int(n))
+		return append([]byte(nil), b...), err
+	case c == 0xca:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case c == 0xcb:
+		return math.Float64frombits(n), nil
+	case c <= 0xcf:
+		return n, nil
+	case c <= 0xd3:
+		// Sign extend from the size of the integer.
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case c <= 0xdb:
+		return d.str(int(n))
+	case c <= 0xdd:
+		return d.arrayOf(int(n))
+	}
+	return d.mapOf(int(n))
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) arrayOf(n int) (any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	a := make([]any, n)
+	for i := range a {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int) (any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map key is not a string")
+		}
+		if m[key], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,100 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// planBench logs what the benchmark would do against hosts with the flags
+// given, without putting a single job: the targets with their versions,
+// every phase of a run with its rates and totals, and how many jobs and
+// bytes all runs put together. The flags are checked as for a real run, so
+// a plan that is logged also starts.
+func planBench(hosts []string) {
+	seedRandomness()
+	detectCapabilities(hosts)
+	for _, h := range hosts {
+		stats, err := serverStats(h)
+		if err != nil {
+			fatal("Cannot fetch server stats", "host", h, "err", err)
+		}
+		result("Plan target", "host", h, "version", stats["version"], "ready", stats["current-jobs-ready"],
+			"reserved", stats["current-jobs-reserved"], "buried", stats["current-jobs-buried"])
+	}
+	if *scenario != "" {
+		result("Plan", "scenario", *scenario, "jobs", *count, "publishers", *publishers, "readers", *readers, "size", *size)
+		return
+	}
+
+	trace := configureBench()
+	if _, err := parseAssertions(*asserts); err != nil {
+		fatal("Invalid -assert", "err", err)
+	}
+	combos := 1
+	if *sweepSpec != "" {
+		grid, err := parseSweep(*sweepSpec)
+		if err != nil {
+			fatal("Invalid -sweep", "err", err)
+		}
+		combos = len(combinations(grid))
+	}
+	_, produce, consume := workload(trace)
+	bytes := int64(produce) * int64(*size)
+	if trace != nil {
+		bytes = 0
+		for _, e := range trace {
+			bytes += int64(e.Size)
+		}
+	}
+
+	phase := 0
+	step := func(name string, args ...any) {
+		phase++
+		result("Plan phase", append([]any{"phase", phase, "name", name}, args...)...)
+	}
+	if *drain {
+		step("drain", "targets", strings.Join(hosts, ","))
+	}
+	if *fill > 0 {
+		step("fill", "jobs", *fill, "bytes", int64(*fill)*int64(*size))
+		if *settleTime > 0 {
+			step("settle", "duration", *settleTime)
+		}
+	}
+	bench := []any{"client", *client, "publishers", *publishers, "readers", *readers, "produce", produce, "bytes", bytes,
+		"consume_until", *consumeUntil, "consume", consume}
+	switch {
+	case *soakFor > 0:
+		bench = append(bench, "duration", *soakFor)
+	case trace != nil:
+		bench = append(bench, "replay", *replayPath, "duration", trace[len(trace)-1].offset())
+	case *offeredRate > 0:
+		bench = append(bench, "rate", *offeredRate, "duration", time.Duration(float64(produce) / *offeredRate * float64(time.Second)))
+	default:
+		bench = append(bench, "rate", "unlimited")
+	}
+	step("benchmark", bench...)
+	if *cooldown > 0 {
+		step("cooldown", "duration", *cooldown)
+	}
+	if *runs > 1 || combos > 1 {
+		step("repeat", "runs", *runs, "sweep_combinations", combos, "drain_between", true)
+	}
+	iterations := int64(*runs * combos)
+	result("Plan", "iterations", iterations, "jobs", iterations*int64(produce+*fill), "bytes", iterations*(bytes+int64(*fill)*int64(*size)),
+		"max_duration", *maxDuration)
+}
@@ -0,0 +1,172 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With -timestamps every body ends in a trailer of a magic and the time,
+// in nanoseconds since the epoch, its publisher made it up, right before
+// the put. Bodies are padded past the marker of -cleanup first, so the
+// trailer never overlaps it or the header of -verify-order.
+const (
+	stampMagic       = 0x42535453 // "BSTS"
+	stampTrailerSize = 12
+)
+
+// clockSamples is the number of round trips to -clock-peer the offset is
+// estimated from; the one with the shortest round trip is taken.
+const clockSamples = 8
+
+// clockOffset is how far the clock of -clock-peer is ahead of the local
+// one, and clockUncertainty how far off that may be, half the round trip
+// it was measured over.
+var clockOffset, clockUncertainty time.Duration
+
+// stampedPayload returns a payload whose bodies end in the time they were
+// made up.
+func stampedPayload(payload payloadFunc) payloadFunc {
+	return func(buf []byte) []byte {
+		start := len(buf)
+		buf = payload(buf)
+		for len(buf)-start < cleanupMarkerAfter {
+			buf = append(buf, 0)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, stampMagic)
+		return binary.BigEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+	}
+}
+
+// readStamp returns the time a body was made up by its publisher, by the
+// clock of its machine.
+func readStamp(body []byte) (time.Time, bool) {
+	n := len(body) - stampTrailerSize
+	if n < cleanupMarkerAfter || binary.BigEndian.Uint32(body[n:]) != stampMagic {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(body[n+4:]))), true
+}
+
+// endToEnd records the time from the put of a stamped job until a reader
+// reserved it at reserved, by the local clock, corrected by -clock-peer.
+// A time below 0 is the clocks being further apart than the correction
+// knows of, and is counted and recorded as 0.
+func (r *run) endToEnd(body []byte, reserved time.Time) {
+	if !*timestamps {
+		return
+	}
+	stamp, ok := readStamp(body)
+	if !ok {
+		return
+	}
+	d := reserved.Sub(stamp) + clockOffset
+	if d < 0 {
+		r.skewed.add(1)
+		d = 0
+	}
+	r.metrics.endToEnd.record(d)
+}
+
+// clockReading is the answer of /clock of the control API.
+type clockReading struct {
+	UnixNano int64 `json:"unix_nano"`
+}
+
+// serveClock answers with the time of the local clock, for the peers of
+// -clock-peer.
+func serveClock(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clockReading{time.Now().UnixNano()})
+}
+
+// measureClock estimates how far the clock of the control API at peer is
+// ahead of the local one, the way NTP does: of clockSamples round trips,
+// the shortest is taken to have the peer read its clock halfway through.
+func measureClock(peer string) (offset, rtt time.Duration, err error) {
+	url := strings.TrimSuffix(peer, "/") + "/clock"
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	rtt = time.Duration(math.MaxInt64)
+	for i := 0; i < clockSamples; i++ {
+		t0 := time.Now()
+		resp, err := client.Get(url)
+		if err != nil {
+			return 0, 0, err
+		}
+		var reading clockReading
+		err = json.NewDecoder(resp.Body).Decode(&reading)
+		resp.Body.Close()
+		t1 := time.Now()
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed answer of %s: %v", url, err)
+		}
+		if d := t1.Sub(t0); d < rtt {
+			rtt = d
+			offset = time.Unix(0, reading.UnixNano).Sub(t0.Add(d / 2))
+		}
+	}
+	return offset, rtt, nil
+}
+
+// syncClock sets clockOffset to the clock of -clock-peer.
+func syncClock(peer string) {
+	offset, rtt, err := measureClock(peer)
+	if err != nil {
+		fatal("Cannot read the clock of -clock-peer", "peer", peer, "err", err)
+	}
+	clockOffset, clockUncertainty = offset, rtt/2
+	slog.Info("Clock of the peer", "peer", peer, "offset", offset, "uncertainty", clockUncertainty)
+}
+
+// reportClock logs the correction of the end-to-end latencies and how far
+// the clocks drifted apart during the run, and warns when the skew or the
+// latencies below 0 are large enough to matter to them.
+func reportClock(r *run) {
+	e2e := r.metrics.endToEnd.snapshot()
+	if e2e.total == 0 {
+		return
+	}
+	if skewed := r.skewed.load(); skewed > 0 {
+		slog.Warn("END-TO-END LATENCIES BELOW 0: THE CLOCKS OF THE PUBLISHERS AND READERS ARE APART BY MORE THAN IS CORRECTED FOR",
+			"jobs", skewed, "offset", clockOffset, "hint", "Run NTP on both machines, or point -clock-peer at the control API of the publishers")
+	}
+	if *clockPeer == "" {
+		return
+	}
+	args := []any{"peer", *clockPeer, "offset", clockOffset, "uncertainty", clockUncertainty}
+	if offset, rtt, err := measureClock(*clockPeer); err == nil {
+		args = append(args, "drift", offset-clockOffset, "uncertainty_after", rtt/2)
+	}
+	result("Clock", args...)
+	p50 := e2e.quantile(0.5)
+	if clockOffset > p50 || -clockOffset > p50 {
+		slog.Warn("CLOCK SKEW EXCEEDS THE MEDIAN END-TO-END LATENCY; IT IS CORRECTED FOR",
+			"offset", clockOffset, "end_to_end_p50", p50)
+	}
+	if clockUncertainty > p50 {
+		slog.Warn("THE CLOCK OFFSET IS UNCERTAIN BY MORE THAN THE MEDIAN END-TO-END LATENCY",
+			"uncertainty", clockUncertainty, "end_to_end_p50", p50, "hint", "Use a peer with a shorter round trip")
+	}
+}
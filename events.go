@@ -0,0 +1,125 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// jobEvents is the log of -events, nil without it.
+var jobEvents *eventLog
+
+// jobEvent is a line of the log of -events: a step in the life of a job.
+// The prep client does not tell the host or the worker, and its reserves
+// are not timed.
+type jobEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host,omitempty"`
+	ID        uint64    `json:"id"`
+	Size      int       `json:"size,omitempty"`
+	Worker    *int      `json:"worker,omitempty"`
+	LatencyUS *float64  `json:"latency_us,omitempty"`
+}
+
+// eventLog writes every step in the life of a sample of the jobs as a line
+// of JSON: its put, each reserve and what the reader did with it. Whether
+// a job is in the sample depends on its id alone, so all the steps of the
+// jobs in it are logged.
+type eventLog struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+	// threshold is the highest draw of a sampled id.
+	threshold uint64
+	events    int64
+}
+
+// createEventLog creates the log at path with a sample of the jobs.
+func createEventLog(path string, sample float64) (*eventLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLog{f: f, w: bufio.NewWriterSize(f, 256*1024), threshold: math.MaxUint64}
+	if sample < 1 {
+		l.threshold = uint64(sample * math.MaxUint64)
+	}
+	return l, nil
+}
+
+// sampled tells whether the job with the given id is logged.
+func (l *eventLog) sampled(id uint64) bool {
+	src := seededSource(streamEvents, id)
+	return src.Uint64() <= l.threshold
+}
+
+// put logs the put of a job by publisher worker, negative if unknown.
+func (l *eventLog) put(host string, id uint64, size, worker int, latency time.Duration) {
+	l.log("put", host, id, size, worker, latency)
+}
+
+// reserve logs the reserve of a job by reader worker; a negative latency
+// is unknown.
+func (l *eventLog) reserve(host string, id uint64, size, worker int, latency time.Duration) {
+	l.log("reserve", host, id, size, worker, latency)
+}
+
+// outcome logs what reader worker did with a job it reserved.
+func (l *eventLog) outcome(host string, id uint64, worker int, o outcome, latency time.Duration) {
+	l.log(outcomeNames[o], host, id, 0, worker, latency)
+}
+
+func (l *eventLog) log(event, host string, id uint64, size, worker int, latency time.Duration) {
+	if l == nil || !l.sampled(id) {
+		return
+	}
+	e := jobEvent{Event: event, Time: time.Now(), Host: host, ID: id, Size: size}
+	if worker >= 0 {
+		e.Worker = &worker
+	}
+	if latency >= 0 {
+		us := float64(latency) / float64(time.Microsecond)
+		e.LatencyUS = &us
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		fatal("Cannot encode job event", "err", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events++
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		fatal("Cannot write the event log", "path", l.f.Name(), "err", err)
+	}
+}
+
+// flush writes out the events logged so far and returns their number.
+func (l *eventLog) flush() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		fatal("Cannot write the event log", "path", l.f.Name(), "err", err)
+	}
+	return l.events
+}
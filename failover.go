@@ -0,0 +1,151 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// failoverSide is the accounting of the publishers or the readers across a
+// failover. Times are in unix nanoseconds.
+type failoverSide struct {
+	lastPrimary int64
+	firstBackup int64
+	primary     int64
+	backup      int64
+	failed      int64
+}
+
+// done records n jobs that were handled on the primary or backup host.
+func (s *failoverSide) done(onBackup bool, n int) {
+	now := time.Now().UnixNano()
+	if onBackup {
+		atomic.AddInt64(&s.backup, int64(n))
+		atomic.CompareAndSwapInt64(&s.firstBackup, 0, now)
+		return
+	}
+	atomic.AddInt64(&s.primary, int64(n))
+	for {
+		last := atomic.LoadInt64(&s.lastPrimary)
+		if last >= now || atomic.CompareAndSwapInt64(&s.lastPrimary, last, now) {
+			return
+		}
+	}
+}
+
+// fail records n jobs whose fate is unknown because the connection broke
+// during the cutover.
+func (s *failoverSide) fail(n int) {
+	atomic.AddInt64(&s.failed, int64(n))
+}
+
+// failover moves the workers of the native client from their hosts to a
+// backup host, either after a fixed time or when the process gets SIGALRM.
+type failover struct {
+	backup    string
+	triggered chan struct{}
+	once      sync.Once
+	at        int64
+
+	// published is closed once the publishers are done, after which the
+	// readers stop as soon as the backup has nothing left for them.
+	published chan struct{}
+
+	publish failoverSide
+	read    failoverSide
+}
+
+func newFailover(backup string, after time.Duration) *failover {
+	f := &failover{
+		backup:    backup,
+		triggered: make(chan struct{}),
+		published: make(chan struct{}),
+	}
+	if after > 0 {
+		time.AfterFunc(after, f.trigger)
+	} else {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGALRM)
+		go func() {
+			<-sig
+			signal.Stop(sig)
+			f.trigger()
+		}()
+	}
+	return f
+}
+
+func (f *failover) trigger() {
+	f.once.Do(func() {
+		atomic.StoreInt64(&f.at, time.Now().UnixNano())
+		slog.Info("Failing over", "backup", f.backup)
+		close(f.triggered)
+	})
+}
+
+// active tells whether workers should be on the backup host by now.
+func (f *failover) active() bool {
+	if f == nil {
+		return false
+	}
+	select {
+	case <-f.triggered:
+		return true
+	default:
+		return false
+	}
+}
+
+// finished tells whether the publishers are done.
+func (f *failover) finished() bool {
+	select {
+	case <-f.published:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *failover) report() {
+	at := atomic.LoadInt64(&f.at)
+	if at == 0 {
+		slog.Warn("Failover was never triggered")
+		return
+	}
+	side := func(name string, s *failoverSide) {
+		if s.firstBackup == 0 {
+			result(name+" never completed a job on the backup", "primary", s.primary, "broken_off", s.failed)
+			return
+		}
+		// Workers switch one by one, so the primary may still have been
+		// busy when the first job completed on the backup.
+		gap := time.Duration(s.firstBackup - s.lastPrimary)
+		if gap < 0 {
+			gap = 0
+		}
+		result(name+" failed over", "primary", s.primary, "backup", s.backup, "broken_off", s.failed, "gap", gap,
+			"last_primary_after_trigger", time.Duration(s.lastPrimary-at),
+			"first_backup_after_trigger", time.Duration(s.firstBackup-at))
+	}
+	side("Publishers", &f.publish)
+	side("Readers", &f.read)
+	result("Jobs published but not read", "jobs", f.publish.primary+f.publish.backup-f.read.primary-f.read.backup)
+}
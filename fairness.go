@@ -0,0 +1,140 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// spread counts the jobs of every connection of a kind, to tell whether
+// the work was shared out evenly between them, and optionally records their
+// latency by connection.
+type spread struct {
+	// cells are the counts of the connections, a cache line each, as
+	// every connection adds to its own.
+	cells   []cell
+	counts  []int64
+	latency []*histogram
+}
+
+func newSpread(n int) *spread {
+	return &spread{cells: make([]cell, n)}
+}
+
+// newLatencySpread returns a spread that also keeps a latency histogram
+// for every connection.
+func newLatencySpread(n int) *spread {
+	s := newSpread(n)
+	s.latency = make([]*histogram, n)
+	for i := range s.latency {
+		s.latency[i] = newHistogram()
+	}
+	return s
+}
+
+// record counts a job of connection i that took d.
+func (s *spread) record(i int, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.add(i, 1)
+	s.latency[i].record(d)
+}
+
+// add counts n jobs for connection i. A nil spread counts nothing.
+func (s *spread) add(i int, n int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.cells[i].n, n)
+}
+
+// gini is the Gini coefficient of counts: 0 if every connection did the
+// same, approaching 1 if one did everything.
+func gini(counts []int64) float64 {
+	sorted := append([]int64(nil), counts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum, weighted float64
+	n := float64(len(sorted))
+	for i, c := range sorted {
+		sum += float64(c)
+		weighted += (2*float64(i+1) - n - 1) * float64(c)
+	}
+	if sum == 0 {
+		return 0
+	}
+	return weighted / (n * sum)
+}
+
+// report logs the spread of the counts over the connections; the count of
+// every connection is logged at debug level.
+func (s *spread) report(msg string) {
+	if s == nil || len(s.cells) == 0 {
+		return
+	}
+	min, max := int64(math.MaxInt64), int64(0)
+	var sum float64
+	s.counts = make([]int64, len(s.cells))
+	for i := range s.cells {
+		c := atomic.LoadInt64(&s.cells[i].n)
+		s.counts[i] = c
+		if c < min {
+			min = c
+		}
+		if c > max {
+			max = c
+		}
+		sum += float64(c)
+	}
+	mean := sum / float64(len(s.counts))
+	var variance float64
+	for _, c := range s.counts {
+		variance += (float64(c) - mean) * (float64(c) - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(s.counts)))
+	args := []any{"connections", len(s.counts), "min", min, "max", max, "mean", mean, "stddev", stddev, "gini", gini(s.counts)}
+	if s.latency != nil {
+		// A connection whose p99 stands out from the others is held up
+		// by what queues on it.
+		low, high := time.Duration(math.MaxInt64), time.Duration(0)
+		for _, h := range s.latency {
+			if h.count() == 0 {
+				continue
+			}
+			p99 := h.quantile(0.99)
+			if p99 < low {
+				low = p99
+			}
+			if p99 > high {
+				high = p99
+			}
+		}
+		if high > 0 {
+			args = append(args, "p99_lowest", low, "p99_highest", high)
+		}
+	}
+	result(msg, args...)
+	for i, c := range s.counts {
+		args := []any{"connection", i, "jobs", c}
+		if s.latency != nil && c > 0 {
+			args = append(args, "p50", s.latency[i].quantile(0.5), "p99", s.latency[i].quantile(0.99), "max", s.latency[i].quantile(1))
+		}
+		slog.Debug(msg+" per connection", args...)
+	}
+}
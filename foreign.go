@@ -0,0 +1,84 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// foreignJobs counts the jobs without the marker of this process that the
+// readers reserved with -shared and gave back untouched.
+type foreignJobs struct {
+	mu   sync.Mutex
+	seen map[foreignJob]struct{}
+	// reserves counts every time one was reserved, as a job given back
+	// may be reserved again.
+	reserves counter
+}
+
+type foreignJob struct {
+	host string
+	id   uint64
+}
+
+func newForeignJobs() *foreignJobs {
+	return &foreignJobs{seen: make(map[foreignJob]struct{})}
+}
+
+// reserved records that a reader reserved the foreign job id of host, or
+// of any host if it is not known.
+func (f *foreignJobs) reserved(host string, id uint64) {
+	f.reserves.add(1)
+	f.mu.Lock()
+	f.seen[foreignJob{host, id}] = struct{}{}
+	f.mu.Unlock()
+}
+
+// jobs is the number of distinct foreign jobs reserved.
+func (f *foreignJobs) jobs() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int64(len(f.seen))
+}
+
+func (f *foreignJobs) report() {
+	result("Foreign jobs", "jobs", f.jobs(), "reserves", f.reserves.load())
+}
+
+// foreign tells whether a reader is to give the job with body back, with
+// -shared, for not having been put by this process.
+func foreign(body []byte) bool {
+	return *shared && !marked(body)
+}
+
+// releaseForeign releases the foreign jobs a reader of the native client
+// held with the priority they had, so their owner finds them as they were.
+func releaseForeign(conn *nativeConn, ids []uint64) error {
+	for _, id := range ids {
+		stats, err := conn.statsJob(id)
+		if err == errNotFound {
+			// Their time to run ran out and the server took them back.
+			continue
+		} else if err != nil {
+			return err
+		}
+		pri, _ := strconv.ParseUint(stats["pri"], 10, 32)
+		if err := conn.release(id, uint32(pri), 0); err != nil && err != errNotFound {
+			return err
+		}
+	}
+	return nil
+}
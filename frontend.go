@@ -0,0 +1,236 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// frontend is an HTTP server started in-process with -http-frontend whose
+// handler puts a job per request over a pool of connections of the
+// native client, as the web frontends of an application enqueue a job for
+// a request. The clients that request it stand in for the users.
+type frontend struct {
+	r      *run
+	url    string
+	server *http.Server
+	pool   chan poolConn
+	conns  int
+
+	requests, created, clientTimeouts counter
+	// cancelledBefore counts the requests that were given up on before
+	// their job was put, enqueuedAfter those whose job was put though the
+	// request was given up on meanwhile.
+	cancelledBefore, enqueuedAfter counter
+	failed                         counter
+}
+
+// poolConn is a connection of the pool of the frontend, which puts on the
+// tube of the publisher of the same number.
+type poolConn struct {
+	*nativeConn
+	p int
+}
+
+// jsonFrontend is what -http-frontend measured in the JSON summary.
+type jsonFrontend struct {
+	Conns              int   `json:"conns"`
+	Requests           int64 `json:"requests"`
+	Created            int64 `json:"created"`
+	ClientTimeouts     int64 `json:"client_timeouts"`
+	CancelledBeforePut int64 `json:"cancelled_before_put"`
+	EnqueuedAfterGone  int64 `json:"enqueued_after_cancel"`
+	Failed             int64 `json:"failed"`
+}
+
+// startFrontend starts the frontend of r on a local port, with a pool of
+// conns connections spread over the hosts.
+func startFrontend(r *run, conns int) *frontend {
+	f := &frontend{r: r, pool: make(chan poolConn, conns), conns: conns}
+	for p := 0; p < conns; p++ {
+		conn := dialWorker(r, r.hosts[p%len(r.hosts)], newRand(streamDialPublisher, uint64(p)))
+		if conn == nil {
+			f.conns--
+			continue
+		}
+		r.useTube(conn, p)
+		f.pool <- poolConn{conn, p}
+	}
+	if f.conns == 0 {
+		fatal("No connection of the HTTP frontend could connect", "conns", conns)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatal("Cannot start the HTTP frontend", "err", err)
+	}
+	f.url = "http://" + l.Addr().String() + "/jobs"
+	f.server = &http.Server{Handler: f}
+	go f.server.Serve(l)
+	slog.Info("HTTP frontend listening", "url", f.url, "conns", f.conns)
+	return f
+}
+
+// ServeHTTP puts the body of a request as a job and answers with its id. A
+// request that is given up on while it waits for a connection of the pool
+// puts nothing; once the put is sent the job is enqueued all the same.
+func (f *frontend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		f.cancelledBefore.add(1)
+		return
+	}
+	var conn poolConn
+	select {
+	case conn = <-f.pool:
+	case <-req.Context().Done():
+		f.cancelledBefore.add(1)
+		return
+	}
+	t0 := time.Now()
+	id, err := conn.put(0, 0, 120*time.Second, body)
+	latency := time.Since(t0)
+	if err != nil && (deadlineExceeded(err) || connectionLost(err)) {
+		conn.nativeConn = redial(conn.nativeConn, nil, f.r.halted)
+		f.r.useTube(conn.nativeConn, conn.p)
+	}
+	f.pool <- conn
+	if err != nil {
+		f.failed.add(1)
+		f.r.metrics.errors.add(1)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	f.r.metrics.put.record(latency)
+	f.r.metrics.slowPut.record(latency, conn.host, id, len(body))
+	f.r.metrics.bySize.recordPut(len(body), latency)
+	f.r.byID.offer(id)
+	f.r.audit.offer(conn.host, id)
+	if req.Context().Err() != nil {
+		f.enqueuedAfter.add(1)
+	}
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, strconv.FormatUint(id, 10))
+}
+
+// missed tells whether any request may have put no job.
+func (f *frontend) missed() bool {
+	if f == nil {
+		return false
+	}
+	return f.clientTimeouts.load()+f.cancelledBefore.load()+f.failed.load() > 0
+}
+
+// testPublisherHTTP sends count requests to the frontend of r from the
+// given number of clients, each of which waits for the answer to a request
+// before it sends the next, giving up on it after -http-timeout.
+func testPublisherHTTP(r *run, clients, count int, ch chan int) {
+	f := r.frontend
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: clients}}
+	wg := sync.WaitGroup{}
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c, n int) {
+			defer wg.Done()
+			var buf []byte
+			for seq := 0; seq < n && !r.halted(); seq++ {
+				r.admit(1)
+				buf = r.payload(buf[:0])
+				if r.verify {
+					for len(buf) < orderHeaderSize {
+						buf = append(buf, 0)
+					}
+					putOrderHeader(buf, uint32(c), uint64(seq))
+				}
+				r.sent(len(buf))
+				f.request(client, c, buf)
+			}
+		}(c, share(count, clients, c))
+	}
+	r.publishersConnected = time.Since(r.metrics.start)
+	wg.Wait()
+	client.CloseIdleConnections()
+	// The handlers of the requests given up on may still be putting.
+	f.server.Shutdown(context.Background())
+	ch <- 1
+}
+
+// request posts a job to the frontend for client c and records how long
+// the request took.
+func (f *frontend) request(client *http.Client, c int, body []byte) {
+	ctx := context.Background()
+	if *httpTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *httpTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		fatal("Cannot create the request", "err", err)
+	}
+	f.requests.add(1)
+	t0 := time.Now()
+	resp, err := client.Do(req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		f.clientTimeouts.add(1)
+		return
+	} else if err != nil {
+		fatal("Request to the HTTP frontend failed", "err", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(t0)
+	f.r.metrics.httpRequest.record(latency)
+	if resp.StatusCode == http.StatusCreated {
+		f.created.add(1)
+		f.r.producers.record(c, latency)
+	}
+}
+
+// report closes the pool of the frontend and reports the fate of its
+// requests.
+func (f *frontend) report() *jsonFrontend {
+	if f == nil {
+		return nil
+	}
+	f.server.Close()
+	close(f.pool)
+	for conn := range f.pool {
+		conn.Close()
+	}
+	j := &jsonFrontend{
+		Conns:              f.conns,
+		Requests:           f.requests.load(),
+		Created:            f.created.load(),
+		ClientTimeouts:     f.clientTimeouts.load(),
+		CancelledBeforePut: f.cancelledBefore.load(),
+		EnqueuedAfterGone:  f.enqueuedAfter.load(),
+		Failed:             f.failed.load(),
+	}
+	result("HTTP frontend", "conns", j.Conns, "requests", j.Requests, "created", j.Created, "client_timeouts", j.ClientTimeouts,
+		"cancelled_before_put", j.CancelledBeforePut, "enqueued_after_cancel", j.EnqueuedAfterGone, "failed", j.Failed)
+	if j.EnqueuedAfterGone > 0 {
+		slog.Warn("Jobs were enqueued for requests that were given up on, which a retry would put twice", "jobs", j.EnqueuedAfterGone)
+	}
+	return j
+}
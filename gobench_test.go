@@ -0,0 +1,223 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kr/beanstalk"
+	bs "github.com/prep/beanstalk"
+)
+
+// The benchmarks of the clients run against a server, one operation at a
+// time on an otherwise idle tube, for benchstat to compare two versions of
+// a client library. Like the benchmark they take the server from BSBENCH_H
+// and the size of the jobs from BSBENCH_S, and they are skipped without a
+// server:
+//
+//	BSBENCH_H=beanstalkd:11300 go test -run '^$' -bench . -count 10
+
+const gobenchTube = "bench-gobench"
+
+var (
+	gobenchOnce sync.Once
+	gobenchHost string
+	gobenchErr  error
+)
+
+// gobenchTarget returns the server of the benchmarks and the body of their
+// jobs, with the tube of the benchmarks cleared before and after b.
+func gobenchTarget(b *testing.B) (string, []byte) {
+	gobenchOnce.Do(func() {
+		if gobenchErr = applyEnv(flag.CommandLine); gobenchErr != nil {
+			return
+		}
+		var hosts []string
+		if hosts, gobenchErr = resolveHosts(*host, false); gobenchErr == nil {
+			gobenchHost = hosts[0]
+		}
+	})
+	if gobenchErr != nil {
+		b.Fatal(gobenchErr)
+	}
+	conn, err := dialBeanstalk(gobenchHost)
+	if err != nil {
+		b.Skipf("no server at %s: %v", gobenchHost, err)
+	}
+	clearTube(conn, gobenchTube)
+	b.Cleanup(func() {
+		clearTube(conn, gobenchTube)
+		conn.Close()
+	})
+	body := make([]byte, *size)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	return gobenchHost, body
+}
+
+func BenchmarkPut(b *testing.B) {
+	b.Run("native", benchPutNative)
+	b.Run("kr", benchPutKr)
+	b.Run("prep", benchPutPrep)
+}
+
+func BenchmarkReserveDelete(b *testing.B) {
+	b.Run("native", benchReserveNative)
+	b.Run("kr", benchReserveKr)
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	b.Run("native", benchRoundTripNative)
+}
+
+func gobenchNative(b *testing.B, h string) *nativeConn {
+	conn, err := dialNative(h)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := conn.use(gobenchTube); err != nil {
+		b.Fatal(err)
+	}
+	if err := watchTubes(conn, []string{gobenchTube}); err != nil {
+		b.Fatal(err)
+	}
+	return conn
+}
+
+// gobenchFill puts n jobs on the tube of the benchmarks, pipelined, without
+// their time counting.
+func gobenchFill(b *testing.B, h string, n int, body []byte) {
+	b.StopTimer()
+	defer b.StartTimer()
+	conn := gobenchNative(b, h)
+	defer conn.Close()
+	for n > 0 {
+		batch := min(n, 1000)
+		job := defaultJob
+		job.body = body
+		if _, err := putBatch(conn, nil, batch, func(int, uint64, time.Duration) {}, nil, func(int) putJob { return job }); err != nil {
+			b.Fatal(err)
+		}
+		n -= batch
+	}
+}
+
+func benchPutNative(b *testing.B) {
+	h, body := gobenchTarget(b)
+	conn := gobenchNative(b, h)
+	defer conn.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.put(0, 0, 120*time.Second, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchPutKr(b *testing.B) {
+	h, body := gobenchTarget(b)
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	tube := &beanstalk.Tube{Conn: conn, Name: gobenchTube}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tube.Put(body, 0, 0, 120*time.Second); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchPutPrep(b *testing.B) {
+	h, body := gobenchTarget(b)
+	producer, err := bs.NewProducer([]string{h}, bs.Config{Multiply: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer producer.Stop()
+	waitConnected(producer)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := producer.Put(ctx, gobenchTube, body, bs.PutParams{TTR: 120 * time.Second}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchReserveNative(b *testing.B) {
+	h, body := gobenchTarget(b)
+	gobenchFill(b, h, b.N, body)
+	conn := gobenchNative(b, h)
+	defer conn.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id, _, err := conn.reserve(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := conn.delete(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchReserveKr(b *testing.B) {
+	h, body := gobenchTarget(b)
+	gobenchFill(b, h, b.N, body)
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	tubes := beanstalk.NewTubeSet(conn, gobenchTube)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id, _, err := tubes.Reserve(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := conn.Delete(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchRoundTripNative puts a job and reserves and deletes it again, the
+// latency a job sees on an idle server.
+func benchRoundTripNative(b *testing.B) {
+	h, body := gobenchTarget(b)
+	conn := gobenchNative(b, h)
+	defer conn.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.put(0, 0, 120*time.Second, body); err != nil {
+			b.Fatal(err)
+		}
+		id, _, err := conn.reserve(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := conn.delete(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The cookies of the V2 encoding of HdrHistogram, for 64 bit counts, and of
+// its compressed form.
+const (
+	hdrEncodingCookie           = 0x1c849303 | 0x10
+	hdrCompressedEncodingCookie = 0x1c849304 | 0x10
+)
+
+// intervalLog is the log of -hdr-log, nil without it.
+var intervalLog *hdrLog
+
+// hdrLog writes latency histograms in the log format of HdrHistogram, one
+// line per histogram tagged with the name of its operation, so that its
+// tools, such as HistogramLogProcessor, can merge and plot them. The
+// values are in microseconds.
+type hdrLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+// createHDRLog creates the log at path and writes its header.
+func createHDRLog(path string) (*hdrLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &hdrLog{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	secs := float64(l.start.UnixNano()) / 1e9
+	fmt.Fprintf(l.w, "#[Logged with beanstalkd-benchmark, values in microseconds]\n")
+	fmt.Fprintf(l.w, "#[Histogram log format version 1.3]\n")
+	fmt.Fprintf(l.w, "#[StartTime: %.3f (seconds since epoch), %s]\n", secs, l.start.Format(time.UnixDate))
+	fmt.Fprintf(l.w, "#[BaseTime: %.3f (seconds since epoch)]\n", secs)
+	fmt.Fprintf(l.w, "\"StartTimestamp\",\"Interval_Length\",\"Interval_Max\",\"Interval_Compressed_Histogram\"\n")
+	return l, nil
+}
+
+// write logs the snapshot h of op for the interval from start to end.
+func (l *hdrLog) write(op string, start, end time.Time, h *histogram) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// The maximum is in milliseconds, as the tools expect it.
+	_, err := fmt.Fprintf(l.w, "Tag=%s,%.3f,%.3f,%.3f,%s\n", op, start.Sub(l.start).Seconds(), end.Sub(start).Seconds(),
+		float64(h.max)/1000, encodeHDR(h))
+	return err
+}
+
+// follow logs what the histograms of m recorded every interval, until the
+// returned function is called, which logs the rest.
+func (l *hdrLog) follow(m *metrics, interval time.Duration) (stop func()) {
+	if l == nil {
+		return func() {}
+	}
+	last := time.Now()
+	prev := make(map[string]*histogram)
+	for _, op := range m.operations() {
+		prev[op.name] = op.hist
+	}
+	flush := func() {
+		now := time.Now()
+		for _, op := range m.operations() {
+			h := op.hist.since(prev[op.name])
+			prev[op.name] = op.hist
+			if h.total == 0 {
+				continue
+			}
+			if err := l.write(op.name, last, now, h); err != nil {
+				fatal("Cannot write the HdrHistogram log", "err", err)
+			}
+		}
+		last = now
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				flush()
+				return
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if err := l.w.Flush(); err != nil {
+			fatal("Cannot write the HdrHistogram log", "err", err)
+		}
+	}
+}
+
+// writeHDRHistograms writes the histograms of every operation of res over
+// the whole run to path, in the log format of HdrHistogram.
+func writeHDRHistograms(path string, res *runResult) error {
+	l, err := createHDRLog(path)
+	if err != nil {
+		return err
+	}
+	l.start = res.started
+	end := res.started.Add(res.elapsed())
+	for _, op := range res.metrics.operations() {
+		if op.hist.total == 0 {
+			continue
+		}
+		if err := l.write(op.name, res.started, end, op.hist); err != nil {
+			l.f.Close()
+			return err
+		}
+	}
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// encodeHDR encodes the snapshot h as HdrHistogram does in its logs: the
+// V2 encoding, with the counts up to the last one that is not 0 as zig-zag
+// LEB128 varints and runs of zeros as their negated length, compressed
+// with zlib and in base64.
+func encodeHDR(h *histogram) string {
+	last := -1
+	for i, n := range h.counts {
+		if n > 0 {
+			last = i
+		}
+	}
+	var counts []byte
+	for i := 0; i <= last; {
+		n := h.counts[i]
+		i++
+		if n == 0 {
+			zeros := int64(1)
+			for i <= last && h.counts[i] == 0 {
+				zeros++
+				i++
+			}
+			if zeros > 1 {
+				n = -zeros
+			}
+		}
+		counts = binary.AppendVarint(counts, n)
+	}
+
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, []int32{hdrEncodingCookie, int32(len(counts)), 0, histSigFigs})
+	binary.Write(&payload, binary.BigEndian, []int64{1, histHighest})
+	binary.Write(&payload, binary.BigEndian, float64(1))
+	payload.Write(counts)
+
+	var compressed bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	io.Copy(zw, &payload)
+	zw.Close()
+	out := binary.BigEndian.AppendUint32(nil, hdrCompressedEncodingCookie)
+	out = binary.BigEndian.AppendUint32(out, uint32(compressed.Len()))
+	return base64.StdEncoding.EncodeToString(append(out, compressed.Bytes()...))
+}
+
+// decodeHDR decodes a histogram encoded by encodeHDR into a snapshot. Only
+// the counts are encoded, so the sum is taken from the middle of every
+// bucket and the extremes from the buckets at either end.
+func decodeHDR(s string) (*histogram, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 8 || int32(binary.BigEndian.Uint32(raw)) != hdrCompressedEncodingCookie {
+		return nil, errors.New("not a compressed HdrHistogram")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(raw[8:]))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Cookie, Length, Offset, SigFigs int32
+		Lowest, Highest                 int64
+		Ratio                           float64
+	}
+	r := bytes.NewReader(payload)
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Cookie != hdrEncodingCookie {
+		return nil, errors.New("not a V2 HdrHistogram")
+	}
+	if header.SigFigs != histSigFigs || header.Lowest != 1 || header.Highest != histHighest {
+		return nil, fmt.Errorf("recorded with %d significant figures from %d to %d rather than as the benchmark records",
+			header.SigFigs, header.Lowest, header.Highest)
+	}
+	h := newHistogram()
+	h.cells = nil
+	for i := 0; r.Len() > 0; {
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			i += int(-n)
+			continue
+		}
+		if i >= len(h.counts) {
+			return nil, errors.New("more counts than the benchmark records")
+		}
+		h.counts[i] = n
+		i++
+	}
+	h.min, h.max = math.MaxInt64, 0
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		h.total += n
+		h.sum += n * ((histValue(i) + histHighestEquivalent(i)) / 2)
+		if h.min == math.MaxInt64 {
+			h.min = histValue(i)
+		}
+		h.max = histHighestEquivalent(i)
+	}
+	h.ops = h.total
+	return h, nil
+}
+
+// readHDRLog reads a log of -hdr-log or -hdr-histograms and adds up the
+// histograms of every operation over its intervals.
+func readHDRLog(path string) (map[string]*histogram, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hists := make(map[string]*histogram)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, `"StartTimestamp"`) {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 5 || !strings.HasPrefix(fields[0], "Tag=") {
+			return nil, fmt.Errorf("%s:%d: not an interval tagged with its operation", path, line)
+		}
+		h, err := decodeHDR(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		// The maximum of the interval is exact, in milliseconds.
+		if max, err := strconv.ParseFloat(fields[3], 64); err == nil && h.total > 0 && int64(math.Round(max*1000)) < h.max {
+			h.max = int64(math.Round(max * 1000))
+		}
+		op := strings.TrimPrefix(fields[0], "Tag=")
+		if hists[op] == nil {
+			hists[op] = h
+		} else {
+			hists[op].add(h)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return hists, nil
+}
@@ -0,0 +1,321 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostProbeInterval is how often a host that is down is dialed to see
+// whether it is back.
+const hostProbeInterval = 500 * time.Millisecond
+
+// hostAvailability is how much of a run a host of -tolerate-host-loss
+// answered.
+type hostAvailability struct {
+	Host            string  `json:"host"`
+	AvailabilityPct float64 `json:"availability_pct"`
+	Outages         int     `json:"outages"`
+	DowntimeSeconds float64 `json:"downtime_seconds"`
+	JobsGone        int64   `json:"jobs_gone"`
+}
+
+// degradedPeriod is a time some hosts were down, as offsets from the start
+// of the run.
+type degradedPeriod struct {
+	From  time.Duration
+	To    time.Duration
+	Hosts []string
+}
+
+// hostState is the health of one host.
+type hostState struct {
+	down      bool
+	downSince time.Time
+	downtime  time.Duration
+	outages   int
+	// put and read count the jobs put on and finished from the host, and
+	// gone those that were not read before it restarted.
+	put, read, gone int64
+}
+
+// hostHealth keeps the native client going with -tolerate-host-loss when
+// hosts become unreachable: the workers of a host that is down move to the
+// others until it answers again, and the time every host was down is kept.
+type hostHealth struct {
+	start time.Time
+	hosts []string
+
+	mu       sync.Mutex
+	state    map[string]*hostState
+	down     int
+	periods  []degradedPeriod
+	degraded time.Time
+	// downHosts are the hosts that were down in the current period.
+	downHosts map[string]bool
+	// brokenOff counts the puts sent on connections that broke before
+	// they were acknowledged.
+	brokenOff counter
+}
+
+func newHostHealth(hosts []string) *hostHealth {
+	h := &hostHealth{start: time.Now(), hosts: hosts, state: make(map[string]*hostState)}
+	for _, host := range hosts {
+		h.state[host] = &hostState{}
+	}
+	return h
+}
+
+// lost marks host down, which err showed, and probes it until it is back.
+func (h *hostHealth) lost(host string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.state[host]
+	if s == nil || s.down {
+		return
+	}
+	now := time.Now()
+	s.down, s.downSince = true, now
+	s.outages++
+	if h.down == 0 {
+		h.degraded, h.downHosts = now, make(map[string]bool)
+	}
+	h.down++
+	h.downHosts[host] = true
+	slog.Warn("Host down, going on with the others", "host", host, "err", err, "up", len(h.hosts)-h.down)
+	go h.probe(host)
+}
+
+// probe dials host until it answers, then marks it up. A server that was
+// up for less time than it was down restarted, and the jobs that were on it
+// are written off.
+func (h *hostHealth) probe(host string) {
+	for !expired() {
+		time.Sleep(hostProbeInterval)
+		conn, err := dialNative(host)
+		if err != nil {
+			continue
+		}
+		stats, err := conn.stats("stats")
+		conn.Close()
+		if err != nil {
+			continue
+		}
+		uptime, _ := strconv.ParseInt(stats["uptime"], 10, 64)
+		h.mu.Lock()
+		s := h.state[host]
+		now := time.Now()
+		down := now.Sub(s.downSince)
+		restarted := time.Duration(uptime)*time.Second < down
+		var gone int64
+		if restarted {
+			gone = s.put - s.read - s.gone
+			s.gone += gone
+		}
+		s.down = false
+		s.downtime += down
+		h.down--
+		if h.down == 0 {
+			h.periods = append(h.periods, h.period(now))
+		}
+		h.mu.Unlock()
+		slog.Info("Host back", "host", host, "after", down.Round(time.Millisecond), "restarted", restarted, "jobs_gone", gone)
+		return
+	}
+}
+
+// period is the degraded period ending at now, with h.mu held.
+func (h *hostHealth) period(now time.Time) degradedPeriod {
+	p := degradedPeriod{From: h.degraded.Sub(h.start), To: now.Sub(h.start)}
+	for _, host := range h.hosts {
+		if h.downHosts[host] {
+			p.Hosts = append(p.Hosts, host)
+		}
+	}
+	return p
+}
+
+// up tells whether host is up.
+func (h *hostHealth) up(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.state[host].down
+}
+
+// pick returns home if it is up, or else the next host that is, and empty
+// when all of them are down.
+func (h *hostHealth) pick(home string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	at := 0
+	for i, host := range h.hosts {
+		if host == home {
+			at = i
+		}
+	}
+	for i := range h.hosts {
+		if host := h.hosts[(at+i)%len(h.hosts)]; !h.state[host].down {
+			return host
+		}
+	}
+	return ""
+}
+
+// redial replaces conn, which broke, with a connection to home, or to
+// another host while home is down, that watches tubes. It waits while
+// every host is down, and gives up and returns conn once stopped tells it
+// to.
+func (h *hostHealth) redial(conn *nativeConn, home string, tubes []string, stopped func() bool) *nativeConn {
+	conn.Close()
+	for !stopped() && !expired() {
+		host := h.pick(home)
+		if host == "" {
+			time.Sleep(hostProbeInterval / 5)
+			continue
+		}
+		c, err := dialNative(host)
+		if err == nil {
+			if err = watchTubes(c, tubes); err == nil {
+				if host != home {
+					slog.Debug("Moved to another host", "home", home, "host", host)
+				}
+				return c
+			}
+			c.Close()
+		}
+		h.lost(host, err)
+	}
+	return conn
+}
+
+// rehome moves conn back to home once it is up again, returning conn as it
+// is while it is on home or home is still down.
+func (h *hostHealth) rehome(conn *nativeConn, home string, tubes []string) *nativeConn {
+	if h == nil || conn.host == home || !h.up(home) {
+		return conn
+	}
+	c, err := dialNative(home)
+	if err == nil {
+		if err = watchTubes(c, tubes); err == nil {
+			conn.Close()
+			return c
+		}
+		c.Close()
+	}
+	h.lost(home, err)
+	return conn
+}
+
+// put counts n jobs put on host.
+func (h *hostHealth) put(host string, n int) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.state[host].put += int64(n)
+	h.mu.Unlock()
+}
+
+// read counts a job finished from host.
+func (h *hostHealth) read(host string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.state[host].read++
+	h.mu.Unlock()
+}
+
+// lostPuts is the number of puts whose host went down before they were
+// acknowledged.
+func (h *hostHealth) lostPuts() int64 {
+	if h == nil {
+		return 0
+	}
+	return h.brokenOff.load()
+}
+
+// stranded is the number of jobs put on the hosts that are down and not
+// read from them, which the readers cannot finish until the hosts are back,
+// and of those that were gone when a host came back.
+func (h *hostHealth) stranded() int64 {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int64
+	for _, s := range h.state {
+		if s.down && s.put > s.read {
+			n += s.put - s.read
+		} else {
+			n += s.gone
+		}
+	}
+	return n
+}
+
+// report logs the availability of every host and the degraded periods,
+// and returns the availabilities.
+func (h *hostHealth) report() []hostAvailability {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(h.start)
+	periods := h.periods
+	if h.down > 0 {
+		periods = append(periods[:len(periods):len(periods)], h.period(now))
+	}
+	var hosts []hostAvailability
+	var stranded, gone int64
+	for _, host := range h.hosts {
+		s := h.state[host]
+		gone += s.gone
+		if s.down && s.put > s.read {
+			stranded += s.put - s.read - s.gone
+		}
+		downtime := s.downtime
+		if s.down {
+			downtime += now.Sub(s.downSince)
+		}
+		a := hostAvailability{
+			Host:            host,
+			AvailabilityPct: 100 * (1 - downtime.Seconds()/elapsed.Seconds()),
+			Outages:         s.outages,
+			DowntimeSeconds: downtime.Seconds(),
+			JobsGone:        s.gone,
+		}
+		hosts = append(hosts, a)
+		result("Host availability", "host", host, "availability_pct", a.AvailabilityPct, "outages", s.outages,
+			"downtime", downtime.Round(time.Millisecond), "put", s.put, "read", s.read, "gone", s.gone)
+	}
+	for _, p := range periods {
+		result("Degraded", "from", p.From.Round(time.Millisecond), "to", p.To.Round(time.Millisecond), "hosts", strings.Join(p.Hosts, ","))
+	}
+	if stranded > 0 {
+		slog.Warn("JOBS LEFT ON HOSTS THAT ARE DOWN", "jobs", stranded)
+	}
+	if gone > 0 {
+		slog.Warn("JOBS GONE WITH HOSTS THAT RESTARTED", "jobs", gone)
+	}
+	return hosts
+}
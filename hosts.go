@@ -0,0 +1,77 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const defaultPort = "11300"
+
+// normalizeHost adds the default port to h if it has none. IPv6 literals
+// have to be bracketed when they come with a port, [::1]:11300, but may be
+// given bare without one.
+func normalizeHost(h string) (string, error) {
+	if _, _, err := net.SplitHostPort(h); err == nil {
+		return h, nil
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid host %q, bracket IPv6 addresses with a port: [::1]:%s", h, defaultPort)
+	}
+	return net.JoinHostPort(host, defaultPort), nil
+}
+
+// resolveHosts returns the targets for h. With all set, a host name becomes
+// one target per A and AAAA record.
+func resolveHosts(h string, all bool) ([]string, error) {
+	h, err := normalizeHost(h)
+	if err != nil {
+		return nil, err
+	}
+	if !all {
+		return []string{h}, nil
+	}
+
+	host, port, _ := net.SplitHostPort(h)
+	if net.ParseIP(host) != nil {
+		return []string{h}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, ip := range ips {
+		hosts = append(hosts, net.JoinHostPort(ip.String(), port))
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%s did not resolve to any address", host)
+	}
+	return hosts, nil
+}
+
+// perHost is the number of connections to open to each of hosts for n
+// workers in total, as the client library connects to every host it is
+// given.
+func perHost(n int, hosts []string) int {
+	m := (n + len(hosts) - 1) / len(hosts)
+	if m < 1 {
+		m = 1
+	}
+	return m
+}
@@ -0,0 +1,87 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+)
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestSuite struct {
+	XMLName    xml.Name        `xml:"testsuite"`
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	TestCases  []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+// writeJUnit renders the assertion results as a JUnit test suite, one test
+// case per assertion, timed with the run it was checked against.
+func writeJUnit(path string, results []assertionResult, res *runResult) error {
+	seconds := fmt.Sprintf("%.3f", res.elapsed().Seconds())
+
+	suite := junitTestSuite{
+		Name:      "beanstalkd-benchmark",
+		Tests:     len(results),
+		Time:      seconds,
+		Timestamp: res.started.Format("2006-01-02T15:04:05"),
+	}
+	for _, row := range append(res.meta.environment(), res.meta.flags()...) {
+		suite.Properties = append(suite.Properties, junitProperty{row.Name, row.Value})
+	}
+	for _, r := range results {
+		tc := junitTestCase{Name: r.text, ClassName: "beanstalkd-benchmark", Time: seconds}
+		if !r.passed {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%s: got %s", r.text, r.format()),
+				Text:    fmt.Sprintf("%s %s threshold not met, actual value %s", r.metric, r.op, r.format()),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
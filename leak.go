@@ -0,0 +1,160 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// The memory trends of -soak are fitted to the samples after the first
+// leakWarmup of them, while the heap and the buffers grow to their working
+// size, and only with at least leakMinSamples left. A series is suspected
+// of leaking when a line fits it with an r² of leakMinR2 or more, it grew
+// by leakMinGrowth of where the fit starts and rose in at least leakRising
+// of the steps.
+const (
+	leakWarmup     = 0.2
+	leakMinSamples = 5
+	leakMinR2      = 0.8
+	leakMinGrowth  = 0.1
+	leakRising     = 0.6
+)
+
+type memorySample struct {
+	at    time.Duration
+	bytes int64
+}
+
+// memoryTrend is the line fitted to the samples of a memory series.
+type memoryTrend struct {
+	Series       string  `json:"series"`
+	Samples      int     `json:"samples"`
+	First        int64   `json:"first_bytes"`
+	Last         int64   `json:"last_bytes"`
+	BytesPerHour float64 `json:"bytes_per_hour"`
+	R2           float64 `json:"r2"`
+	Rising       float64 `json:"rising"`
+	Leak         bool    `json:"suspected_leak"`
+}
+
+// memoryWatch samples the resident memory and heap of the benchmark and the
+// resident memory of the servers on this machine over a soak run, for
+// growth that does not level off.
+type memoryWatch struct {
+	hosts   []string
+	start   time.Time
+	names   []string
+	samples map[string][]memorySample
+}
+
+func newMemoryWatch(hosts []string) *memoryWatch {
+	return &memoryWatch{hosts: hosts, start: time.Now(), samples: make(map[string][]memorySample)}
+}
+
+// sample records the memory now, and returns it by series.
+func (w *memoryWatch) sample() map[string]int64 {
+	now := make(map[string]int64)
+	if rss, ok := processRSS("self"); ok {
+		now["client_rss"] = rss
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	now["client_heap"] = int64(ms.HeapInuse)
+	for _, h := range w.hosts {
+		stats, err := serverStats(h)
+		if err != nil {
+			continue
+		}
+		if rss, ok := serverRSS(h, stats); ok {
+			now["server_rss "+h] = rss
+		}
+	}
+	at := time.Since(w.start)
+	for name, bytes := range now {
+		if _, ok := w.samples[name]; !ok {
+			w.names = append(w.names, name)
+		}
+		w.samples[name] = append(w.samples[name], memorySample{at, bytes})
+	}
+	return now
+}
+
+// fitTrend fits a line to the samples after the warmup by least squares,
+// and tells whether there were enough of them.
+func fitTrend(name string, samples []memorySample) (memoryTrend, bool) {
+	t := memoryTrend{Series: name, Samples: len(samples)}
+	fit := samples[int(float64(len(samples))*leakWarmup):]
+	if len(fit) < leakMinSamples {
+		return t, false
+	}
+	t.First, t.Last = fit[0].bytes, fit[len(fit)-1].bytes
+	n := float64(len(fit))
+	var sx, sy, sxx, sxy, syy float64
+	rising := 0
+	for i, s := range fit {
+		x, y := s.at.Hours(), float64(s.bytes)
+		sx, sy, sxx, sxy, syy = sx+x, sy+y, sxx+x*x, sxy+x*y, syy+y*y
+		if i > 0 && s.bytes > fit[i-1].bytes {
+			rising++
+		}
+	}
+	vx, vy, cov := n*sxx-sx*sx, n*syy-sy*sy, n*sxy-sx*sy
+	if vx == 0 {
+		return t, false
+	}
+	t.BytesPerHour = cov / vx
+	if vy > 0 {
+		t.R2 = cov * cov / (vx * vy)
+	}
+	t.Rising = float64(rising) / (n - 1)
+	t.Leak = t.BytesPerHour > 0 && t.R2 >= leakMinR2 && t.Rising >= leakRising &&
+		float64(t.Last-t.First) >= leakMinGrowth*float64(t.First)
+	return t, true
+}
+
+// trends fits the trend of every series with enough samples, in the order
+// they were first seen.
+func (w *memoryWatch) trends() []memoryTrend {
+	var trends []memoryTrend
+	for _, name := range w.names {
+		if t, ok := fitTrend(name, w.samples[name]); ok {
+			trends = append(trends, t)
+		}
+	}
+	return trends
+}
+
+func reportMemoryTrends(trends []memoryTrend) {
+	for _, t := range trends {
+		result("Memory trend", "series", t.Series, "samples", t.Samples, "first_bytes", t.First, "last_bytes", t.Last,
+			"bytes_per_hour", int64(t.BytesPerHour), "r2", t.R2, "rising", t.Rising, "suspected_leak", t.Leak)
+		if t.Leak {
+			slog.Warn("MEMORY GROWS STEADILY: "+t.Series+" may leak; check whether the backlog grew with it", "series", t.Series,
+				"bytes_per_hour", int64(t.BytesPerHour))
+		}
+	}
+}
+
+// String describes the trend for the HTML report.
+func (t memoryTrend) String() string {
+	s := fmt.Sprintf("%d → %d bytes, %+.0f bytes/h, r² %.2f, rising in %.0f%% of the samples", t.First, t.Last, t.BytesPerHour, t.R2, 100*t.Rising)
+	if t.Leak {
+		s += ", suspected leak"
+	}
+	return s
+}
@@ -0,0 +1,186 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// connLifecycle accounts for every connection the benchmark dials itself,
+// which is all but those of the prep client: how long dialing took, how
+// long they lived, which of them the other side closed or broke and how
+// long they had been idle then, and the reconnects of the native client.
+// Load balancers and proxies that drop idle connections show up as
+// connections closed by the peer after about the same idle time.
+type connLifecycle struct {
+	dials, dialFailures counter
+	open                gauge
+	closedByPeer        counter
+	broken              counter
+
+	// refused, reset and dialTimeouts are the failed dials by their cause,
+	// which for a server whose accept queue overflows are mostly the first
+	// two.
+	refused, reset, dialTimeouts counter
+	// workerRetries are the dials of publishers and readers that were tried
+	// again, and workersFailed the workers the run went on without.
+	workerRetries, workersFailed counter
+
+	dial     *histogram
+	lifetime *histogram
+	// idle is how long the connections the peer closed or broke had
+	// been idle.
+	idle *histogram
+
+	reconnects, reconnectAttempts counter
+	// reconnect is the time from losing a connection until it was dialed
+	// again, backoff included.
+	reconnect *histogram
+}
+
+var lifecycle = &connLifecycle{
+	dial:      newHistogram(),
+	lifetime:  newHistogram(),
+	idle:      newHistogram(),
+	reconnect: newHistogram(),
+}
+
+// trackedConn is a connection that tells the lifecycle how it ends.
+type trackedConn struct {
+	net.Conn
+	opened time.Time
+	// active is the time of the last read or write, in unix nanoseconds.
+	active int64
+	failed int32
+	once   sync.Once
+	// tcp is the connection -tcp-info samples, and retransmits the
+	// retransmits it had at the last sample.
+	tcp         *net.TCPConn
+	retransmits uint32
+}
+
+func newTrackedConn(conn net.Conn, opened time.Time) *trackedConn {
+	lifecycle.open.add(1)
+	c := &trackedConn{Conn: conn, opened: opened, active: time.Now().UnixNano(), tcp: tcpOf(conn)}
+	sockets.track(c)
+	return c
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.observe(n, err)
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.observe(n, err)
+	return n, err
+}
+
+// observe notes the activity of a read or write, and the first error that
+// came from the other side: the connection was closed when it read EOF,
+// broken on any other error but a deadline.
+func (c *trackedConn) observe(n int, err error) {
+	if n > 0 {
+		atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	}
+	if err == nil || errors.Is(err, net.ErrClosed) || deadlineExceeded(err) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.failed, 0, 1) {
+		return
+	}
+	if errors.Is(err, io.EOF) {
+		lifecycle.closedByPeer.add(1)
+	} else {
+		lifecycle.broken.add(1)
+	}
+	lifecycle.idle.record(time.Since(time.Unix(0, atomic.LoadInt64(&c.active))))
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		sockets.untrack(c)
+		lifecycle.open.add(-1)
+		lifecycle.lifetime.record(time.Since(c.opened))
+	})
+	return c.Conn.Close()
+}
+
+// dialFailed records a dial that failed with err.
+func (l *connLifecycle) dialFailed(err error) {
+	l.dialFailures.add(1)
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		l.refused.add(1)
+	case errors.Is(err, syscall.ECONNRESET):
+		l.reset.add(1)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		l.dialTimeouts.add(1)
+	}
+}
+
+// reconnected records a connection of the native client that was dialed
+// again after attempts, lost since the given time.
+func (l *connLifecycle) reconnected(since time.Time, attempts int) {
+	l.reconnects.add(1)
+	l.reconnectAttempts.add(int64(attempts))
+	l.reconnect.record(time.Since(since))
+}
+
+// report logs the lifecycle of the connections.
+func (l *connLifecycle) report() {
+	if l.dials.load() == 0 && l.dialFailures.load() == 0 {
+		return
+	}
+	result("Connections", "dialed", l.dials.load(), "dial_failures", l.dialFailures.load(), "max_open", l.open.highest(),
+		"open_at_end", l.open.load(), "closed_by_peer", l.closedByPeer.load(), "broken", l.broken.load())
+	if l.dialFailures.load() > 0 || l.workerRetries.load() > 0 {
+		args := []any{"refused", l.refused.load(), "reset", l.reset.load(), "timed_out", l.dialTimeouts.load(),
+			"worker_retries", l.workerRetries.load(), "failed_workers", l.workersFailed.load()}
+		if *client != "native" {
+			// The prep client dials its connections itself, so only those
+			// of the benchmark's own connections are counted.
+			args = append(args, "prep_client", "not counted")
+		}
+		result("Connection errors", args...)
+	}
+	for _, op := range l.operations() {
+		if op.hist.total > 0 {
+			result("Connection lifecycle", append([]any{"stage", op.name}, latencyArgs(op.hist)...)...)
+		}
+	}
+	if n := l.reconnects.load(); n > 0 {
+		result("Reconnects", "reconnects", n, "attempts", l.reconnectAttempts.load())
+	}
+}
+
+// operations pairs the histograms of the lifecycle with their names.
+func (l *connLifecycle) operations() []operation {
+	return []operation{
+		{"dial", l.dial.snapshot()},
+		{"lifetime", l.lifetime.snapshot()},
+		{"idle_before_peer_close", l.idle.snapshot()},
+		{"reconnect", l.reconnect.snapshot()},
+	}
+}
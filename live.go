@@ -0,0 +1,77 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// liveStats dumps the state of a running benchmark on demand. The latencies
+// it dumps are those since the last reset; the report at the end of the run
+// still covers all of it.
+type liveStats struct {
+	m *metrics
+
+	mu        sync.Mutex
+	base      map[string]*histogram
+	resetAt   time.Time
+	lastDump  time.Time
+	lastPuts  int64
+	lastReads int64
+}
+
+func newLiveStats(m *metrics) *liveStats {
+	l := &liveStats{m: m}
+	l.reset()
+	l.lastDump = l.resetAt
+	return l
+}
+
+// reset starts the latencies of the next dumps over.
+func (l *liveStats) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.base = make(map[string]*histogram)
+	for _, op := range l.m.operations() {
+		l.base[op.name] = op.hist
+	}
+	l.resetAt = time.Now()
+}
+
+// dump logs the counters, the rates overall and since the last dump, and
+// the latency percentiles since the last reset.
+func (l *liveStats) dump() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	puts, reads := l.m.put.count(), l.m.delete.count()+l.m.bury.count()
+	elapsed := now.Sub(l.m.start)
+	window := now.Sub(l.lastDump).Seconds()
+	result("Live stats", "elapsed", elapsed, "puts", puts, "reads", reads,
+		"errors", l.m.errors.load(), "in_flight", l.m.inFlight.load(),
+		"put_rate", float64(puts)/elapsed.Seconds(), "read_rate", float64(reads)/elapsed.Seconds(),
+		"recent_put_rate", float64(puts-l.lastPuts)/window, "recent_read_rate", float64(reads-l.lastReads)/window)
+	l.lastDump, l.lastPuts, l.lastReads = now, puts, reads
+
+	for _, op := range l.m.operations() {
+		hist := op.hist.since(l.base[op.name])
+		if hist.total == 0 {
+			continue
+		}
+		args := append([]any{"op", op.name, "since", now.Sub(l.resetAt)}, latencyArgs(hist)...)
+		result("Live latency", args...)
+	}
+}
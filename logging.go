@@ -0,0 +1,197 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// levelResult is the level of the measurements the run reports. It sits
+// above every other level so that -quiet never hides them.
+const levelResult = slog.Level(12)
+
+// setupLogging installs the default logger according to the -log-level,
+// -log-format and -quiet flags.
+func setupLogging(w io.Writer, level, format string, quiet bool) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", level)
+	}
+	if quiet {
+		lvl = slog.LevelError
+	}
+
+	opts := &slog.HandlerOptions{
+		Level: lvl,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == levelResult {
+				a.Value = slog.StringValue("RESULT")
+			}
+			return a
+		},
+	}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	// Whatever still goes through the log package, such as the output of
+	// the client libraries, ends up in the same stream.
+	log.SetFlags(0)
+	return nil
+}
+
+// result logs a measurement of the run.
+func result(msg string, args ...any) {
+	slog.Log(context.Background(), levelResult, msg, args...)
+}
+
+// fatal logs msg as an error and exits. With -log-file it is also written
+// to stderr, so whoever started the process learns why it ended.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	if logFile != nil {
+		fmt.Fprintf(os.Stderr, "%s, see %s\n", msg, logFile.path)
+	}
+	os.Exit(1)
+}
+
+// logFile is the file of -log-file, nil without it.
+var logFile *rotatingFile
+
+// startLogFile has the log lines written to -log-file instead of stderr.
+func startLogFile() error {
+	if *logFilePath == "" {
+		return nil
+	}
+	maxSize, err := parseBytes(*logMaxSize)
+	if err != nil {
+		return fmt.Errorf("invalid -log-max-size: %v", err)
+	}
+	if maxSize <= 0 || *logKeep < 0 {
+		return fmt.Errorf("-log-max-size must be above 0 and -log-keep must not be negative")
+	}
+	if logFile, err = openRotatingFile(*logFilePath, maxSize, *logKeep); err != nil {
+		return fmt.Errorf("cannot open the log file: %v", err)
+	}
+	logOutput = logFile
+	return nil
+}
+
+// rotatingFile is a file that is appended to until it reaches maxSize,
+// when it is renamed to path.1, the one before that to path.2 and so on up
+// to path.<keep>, and started anew, so that a long run neither fills the
+// disk nor loses its latest lines. As the lines of the log are written
+// whole, files only ever break between them.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	// f is nil after it could not be opened again, which the next write
+	// tries once more.
+	f    *os.File
+	size int64
+	// grace is how far past maxSize the file grows before the next try
+	// after a rotation failed.
+	grace int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	return r, r.open()
+}
+
+// open opens the file to append to it, as a run started again carries on
+// with the file the last one wrote.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.grace = f, info.Size(), 0
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize+r.grace {
+		if err := r.rotate(); err != nil {
+			if r.f == nil {
+				return 0, err
+			}
+			// Better to go on writing past maxSize than to stop logging;
+			// the rotation is tried again once another maxSize is written.
+			fmt.Fprintf(os.Stderr, "Cannot rotate the log file %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the files kept by one, dropping the oldest, and starts the
+// file anew. If that fails it opens the file again to go on with it, and
+// returns the error.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	name := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+	switch {
+	case err != nil:
+	case r.keep == 0:
+		err = os.Remove(r.path)
+	default:
+		for i := r.keep - 1; i > 0 && err == nil; i-- {
+			if err = os.Rename(name(i), name(i+1)); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err == nil {
+			err = os.Rename(r.path, name(1))
+		}
+	}
+	if oerr := r.open(); oerr != nil {
+		return oerr
+	}
+	if err != nil {
+		// The file is the one that could not be moved away.
+		r.grace = r.size
+	}
+	return err
+}
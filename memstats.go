@@ -0,0 +1,130 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memStats is the allocation and GC activity of the benchmark process over
+// a run, for -mem-stats.
+type memStats struct {
+	before runtime.MemStats
+
+	// pauses are the stop-the-world pauses of the GC during the run. The
+	// runtime only keeps the last 256, so they are collected every second.
+	mu     sync.Mutex
+	pauses []gcPause
+	numGC  uint32
+
+	stop, done chan struct{}
+}
+
+// gcPause is a pause of the GC, which ended at end.
+type gcPause struct {
+	end time.Time
+	d   time.Duration
+}
+
+func startMemStats() *memStats {
+	m := &memStats{stop: make(chan struct{}), done: make(chan struct{})}
+	runtime.ReadMemStats(&m.before)
+	m.numGC = m.before.NumGC
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				var s runtime.MemStats
+				runtime.ReadMemStats(&s)
+				m.collect(&s)
+			}
+		}
+	}()
+	return m
+}
+
+// collect adds the pauses of the GC cycles of s that are new since the last
+// call. Cycles that fell out of the pauses the runtime keeps are lost.
+func (m *memStats) collect(s *runtime.MemStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	first := m.numGC + 1
+	if s.NumGC-m.numGC > uint32(len(s.PauseNs)) {
+		first = s.NumGC - uint32(len(s.PauseNs)) + 1
+	}
+	for n := first; n <= s.NumGC; n++ {
+		i := (n - 1) % uint32(len(s.PauseNs))
+		m.pauses = append(m.pauses, gcPause{end: time.Unix(0, int64(s.PauseEnd[i])), d: time.Duration(s.PauseNs[i])})
+	}
+	m.numGC = s.NumGC
+}
+
+// pausedDuring returns how long the GC paused the process between start and
+// end, 0 without -mem-stats.
+func (m *memStats) pausedDuring(start, end time.Time) time.Duration {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var d time.Duration
+	for _, p := range m.pauses {
+		from, to := p.end.Add(-p.d), p.end
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			d += to.Sub(from)
+		}
+	}
+	return d
+}
+
+// report logs what was allocated and collected since start, per job where
+// that is telling.
+func (m *memStats) report(jobs int) {
+	close(m.stop)
+	<-m.done
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	m.collect(&after)
+	var longest time.Duration
+	for _, p := range m.pauses {
+		longest = max(longest, p.d)
+	}
+	mallocs := after.Mallocs - m.before.Mallocs
+	bytes := after.TotalAlloc - m.before.TotalAlloc
+	perJob := func(n uint64) float64 {
+		if jobs == 0 {
+			return 0
+		}
+		return float64(n) / float64(jobs)
+	}
+	result("Client allocations", "mallocs", mallocs, "bytes", bytes,
+		"mallocs_per_job", perJob(mallocs), "bytes_per_job", perJob(bytes), "heap_in_use", after.HeapInuse)
+	result("Client GC", "cycles", after.NumGC-m.before.NumGC,
+		"pause_total", time.Duration(after.PauseTotalNs-m.before.PauseTotalNs),
+		"pause_max", longest, "cpu_fraction", after.GCCPUFraction)
+}
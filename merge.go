@@ -0,0 +1,300 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// span is a time something was going on, such as the publishing of a run.
+type span struct {
+	from, to time.Time
+}
+
+// covered is how much of the time the spans cover, those that overlap
+// counted once: the spans of workers that ran together add up to the time
+// they ran, and those of runs one after another to the sum of their times.
+func covered(spans []span) time.Duration {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].from.Before(spans[j].from) })
+	var total time.Duration
+	var end time.Time
+	for _, s := range spans {
+		if s.from.After(end) {
+			end = s.from
+		}
+		if s.to.After(end) {
+			total += s.to.Sub(end)
+			end = s.to
+		}
+	}
+	return total
+}
+
+// merged adds up the results of workers or runs.
+type merged struct {
+	inputs    int
+	summaries int
+	hists     map[string]*histogram
+	summary   jsonSummary
+	published []span
+	read      []span
+}
+
+func newMerged() *merged {
+	return &merged{hists: make(map[string]*histogram), summary: jsonSummary{Latencies: make(map[string]jsonLatency)}}
+}
+
+func (m *merged) addHistogram(op string, h *histogram) {
+	if m.hists[op] == nil {
+		m.hists[op] = newHistogram()
+		m.hists[op].cells = nil
+	}
+	m.hists[op].add(h)
+}
+
+// addSummary adds a JSON summary. Its latencies are added from the
+// histograms it has; without them, as in the summaries of older versions,
+// they are left out, as percentiles cannot be added up.
+func (m *merged) addSummary(run analyzedRun) {
+	m.inputs++
+	m.summaries++
+	s := &m.summary
+	if s.Started.IsZero() || run.Started.Before(s.Started) {
+		s.Started = run.Started
+	}
+	s.Produced += run.Produced
+	s.Consumed += run.Consumed
+	s.Publishers += run.Publishers
+	s.Readers += run.Readers
+	s.Errors += run.Errors
+	s.Timeouts += run.Timeouts
+	s.ForeignJobs += run.ForeignJobs
+	s.Truncated = s.Truncated || run.Truncated
+	if run.PublishSeconds > 0 {
+		m.published = append(m.published, span{run.Started, run.Started.Add(secondsDuration(run.PublishSeconds))})
+	}
+	if run.ReadSeconds > 0 {
+		from := run.Started.Add(secondsDuration(run.ReadStart))
+		m.read = append(m.read, span{from, from.Add(secondsDuration(run.ReadSeconds))})
+	}
+	if m.summaries == 1 {
+		s.Metadata.Flags = run.Metadata.Flags
+	} else {
+		for name, v := range s.Metadata.Flags {
+			if run.Metadata.Flags[name] != v {
+				delete(s.Metadata.Flags, name)
+			}
+		}
+	}
+	for op, l := range run.Latencies {
+		if l.Histogram == "" {
+			slog.Warn("No histogram to merge, the latencies are left out", "path", run.path, "op", op)
+			continue
+		}
+		h, err := decodeHDR(l.Histogram)
+		if err != nil {
+			fatal("Cannot decode the histogram", "path", run.path, "op", op, "err", err)
+		}
+		// The summary knows better than the buckets.
+		h.ops, h.min = l.Count, l.MinUS
+		h.sum = l.MeanUS * h.total
+		if max, ok := l.US["max"]; ok {
+			h.max = int64(max)
+		}
+		m.addHistogram(op, h)
+	}
+}
+
+// finish fills in the rates and latencies of the merged summary. The rates
+// are those over the time any of the inputs were publishing or reading.
+func (m *merged) finish() *jsonSummary {
+	s := &m.summary
+	s.Metadata.Label = "merged"
+	publish, read := covered(m.published), covered(m.read)
+	s.PublishSeconds, s.PublishRate = publish.Seconds(), rate(s.Produced, publish)
+	s.ReadSeconds, s.ReadRate = read.Seconds(), rate(s.Consumed, read)
+	for op, h := range m.hists {
+		l := newJSONLatency(h)
+		l.Histogram = encodeHDR(h)
+		s.Latencies[op] = l
+	}
+	return s
+}
+
+// secondsDuration is s seconds, as the JSON summaries count them.
+func secondsDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// isHDRLog tells whether the file at path is a log of HdrHistogram rather
+// than a JSON summary.
+func isHDRLog(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b != '{', nil
+		}
+	}
+}
+
+// runMerge adds up the results of -in, the JSON summaries and HdrHistogram
+// logs of workers that ran the benchmark together or of runs one after
+// another, and logs their consolidated results. The latencies are merged
+// from the histograms, so their percentiles are those of all the operations
+// together rather than averages of percentiles.
+func runMerge([]string) {
+	if *analyzeIn == "" {
+		fatal("merge needs -in")
+	}
+	if *output != "text" && *output != "json" {
+		fatal("Unknown output format", "output", *output)
+	}
+	paths, err := expandPaths(*analyzeIn)
+	if err != nil {
+		fatal("Cannot read the results", "err", err)
+	}
+	m := newMerged()
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			fatal("Cannot read the results", "err", err)
+		}
+		if info.IsDir() {
+			runs, err := findSummaries(p)
+			if err != nil {
+				fatal("Cannot read the results", "err", err)
+			}
+			for _, run := range runs {
+				m.addSummary(run)
+			}
+			continue
+		}
+		hdr, err := isHDRLog(p)
+		if err != nil {
+			fatal("Cannot read the results", "path", p, "err", err)
+		}
+		if !hdr {
+			run, err := loadSummary(p)
+			if err != nil {
+				fatal("Cannot read the results", "err", err)
+			}
+			m.addSummary(run)
+			continue
+		}
+		hists, err := readHDRLog(p)
+		if err != nil {
+			fatal("Cannot read the HdrHistogram log", "err", err)
+		}
+		m.inputs++
+		for op, h := range hists {
+			m.addHistogram(op, h)
+		}
+	}
+	if m.inputs == 0 {
+		fatal("No results found", "in", *analyzeIn)
+	}
+	s := m.finish()
+
+	result("Merged", "inputs", m.inputs, "summaries", m.summaries)
+	if m.summaries > 0 {
+		result("Publishers finished", "publishers", s.Publishers, "produced", s.Produced,
+			"elapsed", secondsDuration(s.PublishSeconds).Round(time.Millisecond), "req_per_sec", s.PublishRate)
+		result("Readers finished", "readers", s.Readers, "consumed", s.Consumed,
+			"elapsed", secondsDuration(s.ReadSeconds).Round(time.Millisecond), "req_per_sec", s.ReadRate)
+	}
+	for _, op := range m.ops() {
+		if h := m.hists[op]; h.total > 0 {
+			result("Latency", append([]any{"op", op}, latencyArgs(h)...)...)
+		}
+	}
+	if *hdrHistogramsPath != "" {
+		if err := m.writeHDR(*hdrHistogramsPath); err != nil {
+			fatal("Cannot write the HdrHistogram histograms", "path", *hdrHistogramsPath, "err", err)
+		}
+		slog.Info("Wrote HdrHistogram histograms", "path", *hdrHistogramsPath)
+	}
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s); err != nil {
+			fatal("Cannot write the summary", "err", err)
+		}
+	}
+}
+
+// ops are the operations of the merged histograms in report order, those
+// the benchmark does not know last.
+func (m *merged) ops() []string {
+	var ops []string
+	known := make(map[string]bool)
+	for _, op := range newMetrics().histograms() {
+		known[op.name] = true
+		if m.hists[op.name] != nil {
+			ops = append(ops, op.name)
+		}
+	}
+	var unknown []string
+	for op := range m.hists {
+		if !known[op] {
+			unknown = append(unknown, op)
+		}
+	}
+	sort.Strings(unknown)
+	return append(ops, unknown...)
+}
+
+// writeHDR writes the merged histograms to path as -hdr-histograms writes
+// those of a run, over the time from the start of the first input to the
+// end of the last.
+func (m *merged) writeHDR(path string) error {
+	l, err := createHDRLog(path)
+	if err != nil {
+		return err
+	}
+	end := l.start
+	if !m.summary.Started.IsZero() {
+		l.start, end = m.summary.Started, m.summary.Started
+		for _, s := range append(append([]span(nil), m.published...), m.read...) {
+			if s.to.After(end) {
+				end = s.to
+			}
+		}
+	}
+	for _, op := range m.ops() {
+		if err := l.write(op, l.start, end, m.hists[op]); err != nil {
+			l.f.Close()
+			return err
+		}
+	}
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,140 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runMetadata describes the circumstances of a run, so that its reports
+// still make sense months later.
+type runMetadata struct {
+	Label              string              `json:"label,omitempty"`
+	Hostname           string              `json:"hostname"`
+	OS                 string              `json:"os"`
+	Arch               string              `json:"arch"`
+	NumCPU             int                 `json:"num_cpu"`
+	GOMAXPROCS         int                 `json:"gomaxprocs"`
+	GoVersion          string              `json:"go_version"`
+	Client             string              `json:"client"`
+	ClientVersion      string              `json:"client_version"`
+	ServerVersions     map[string]string   `json:"server_versions"`
+	ServerBinlogs      map[string]bool     `json:"server_binlogs"`
+	ServerCapabilities map[string][]string `json:"server_capabilities"`
+	Flags              map[string]string   `json:"flags"`
+}
+
+// clientModules are the modules of the client libraries by -client value.
+var clientModules = map[string]string{
+	"prep": "github.com/prep/beanstalk",
+}
+
+// moduleVersion returns the version of a module compiled into the binary.
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// collectMetadata describes the run; stats are the server stats of each
+// host taken before it.
+func collectMetadata(stats map[string]map[string]string) runMetadata {
+	hostname, _ := os.Hostname()
+	meta := runMetadata{
+		Label:          *label,
+		Hostname:       hostname,
+		OS:             runtime.GOOS,
+		Arch:           runtime.GOARCH,
+		NumCPU:         runtime.NumCPU(),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		GoVersion:      runtime.Version(),
+		Client:         *client,
+		ClientVersion:  "built in",
+		ServerVersions: make(map[string]string),
+		ServerBinlogs:  make(map[string]bool),
+		Flags:          make(map[string]string),
+	}
+	if path, ok := clientModules[*client]; ok {
+		meta.Client = path
+		meta.ClientVersion = moduleVersion(path)
+	}
+	for h, s := range stats {
+		meta.ServerVersions[h] = s["version"]
+		meta.ServerBinlogs[h] = binlogEnabled(s)
+	}
+	meta.ServerCapabilities = serverCapabilities
+	flag.VisitAll(func(f *flag.Flag) {
+		meta.Flags[f.Name] = f.Value.String()
+	})
+	return meta
+}
+
+// environment lists the metadata other than the flags as name/value pairs.
+func (m runMetadata) environment() []reportRow {
+	rows := []reportRow{
+		{"Label", m.Label},
+		{"Hostname", m.Hostname},
+		{"OS/Arch", m.OS + "/" + m.Arch},
+		{"CPUs", strconv.Itoa(m.NumCPU)},
+		{"GOMAXPROCS", strconv.Itoa(m.GOMAXPROCS)},
+		{"Go version", m.GoVersion},
+		{"Client", m.Client + " " + m.ClientVersion},
+	}
+	for _, h := range sortedKeys(m.ServerVersions) {
+		version := m.ServerVersions[h]
+		if m.ServerBinlogs[h] {
+			version += " with binlog"
+		}
+		if caps := m.ServerCapabilities[h]; len(caps) > 0 {
+			version += " (" + strings.Join(caps, ", ") + ")"
+		}
+		rows = append(rows, reportRow{"beanstalkd " + h, version})
+	}
+	return rows
+}
+
+// flags lists the value of every flag by name.
+func (m runMetadata) flags() []reportRow {
+	var rows []reportRow
+	for _, name := range sortedKeys(m.Flags) {
+		rows = append(rows, reportRow{name, m.Flags[name]})
+	}
+	return rows
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,848 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The latency histograms use the bucket layout of HdrHistogram: values in
+// microseconds from 1µs up to an hour, with 3 significant digits.
+const (
+	histSigFigs      = 3
+	histHighest      = int64(time.Hour / time.Microsecond)
+	histSubBucketMag = 11 // ceil(log2(2 * 10^histSigFigs))
+	histSubBuckets   = 1 << histSubBucketMag
+	histHalfMag      = histSubBucketMag - 1
+	histHalfCount    = 1 << histHalfMag
+	histSubMask      = int64(histSubBuckets - 1)
+)
+
+var histBuckets = func() int {
+	smallestUntrackable := int64(histSubBuckets)
+	n := 1
+	for smallestUntrackable <= histHighest {
+		smallestUntrackable <<= 1
+		n++
+	}
+	return n
+}()
+
+// latencySampling is the share of the operations whose latency is
+// recorded, as set with -sample-rate.
+var latencySampling = 1.0
+
+// counterShards is the number of cells a count that every operation adds
+// to is spread over. Goroutines adding to one cache line take turns owning
+// it, which at millions of operations per second costs more than the
+// operations; spread over cells of their own they rarely meet, and the
+// cells are summed up when the count is read.
+const counterShards = 16
+
+// cell is a count alone on its cache line.
+type cell struct {
+	n int64
+	_ [56]byte
+}
+
+// shard picks the cell for an update. Go has no cheap way to tell which
+// worker or CPU a goroutine is on, so it is picked at random; the top level
+// functions of math/rand are not locked unless seeded, and they never are.
+func shard() int {
+	return int(rand.Uint32() % counterShards)
+}
+
+// histCell holds the counts that every record of a histogram adds to.
+type histCell struct {
+	ops, total, sum int64
+	_               [40]byte
+}
+
+// histogram is a latency histogram that can be recorded into from many
+// goroutines at once without locking. A nil histogram ignores records.
+// With -sample-rate below 1 only a random share of the values is recorded,
+// while ops still counts every one of them. While the histogram is
+// recorded into, ops, total and sum are spread over cells; a snapshot has
+// them summed up and no cells.
+type histogram struct {
+	counts []int64
+	ops    int64
+	total  int64
+	sum    int64
+	min    int64
+	max    int64
+	cells  *[counterShards]histCell
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]int64, (histBuckets+1)*histHalfCount),
+		min:    math.MaxInt64,
+		cells:  new([counterShards]histCell),
+	}
+}
+
+// sums returns the number of operations, of recorded values and their sum.
+func (h *histogram) sums() (ops, total, sum int64) {
+	if h.cells == nil {
+		return h.ops, h.total, h.sum
+	}
+	for i := range h.cells {
+		c := &h.cells[i]
+		ops += atomic.LoadInt64(&c.ops)
+		total += atomic.LoadInt64(&c.total)
+		sum += atomic.LoadInt64(&c.sum)
+	}
+	return ops, total, sum
+}
+
+func histIndex(v int64) int {
+	bucket := 64 - bits.LeadingZeros64(uint64(v|histSubMask)) - (histHalfMag + 1)
+	sub := int(v >> uint(bucket))
+	return (bucket+1)<<histHalfMag + sub - histHalfCount
+}
+
+// histValue is the lowest value counted at index i.
+func histValue(i int) int64 {
+	bucket := (i >> histHalfMag) - 1
+	sub := (i & (histHalfCount - 1)) + histHalfCount
+	if bucket < 0 {
+		sub -= histHalfCount
+		bucket = 0
+	}
+	return int64(sub) << uint(bucket)
+}
+
+// histHighestEquivalent is the highest value counted at index i.
+func histHighestEquivalent(i int) int64 {
+	bucket := (i >> histHalfMag) - 1
+	if bucket < 0 {
+		bucket = 0
+	}
+	return histValue(i) + int64(1)<<uint(bucket) - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	if h == nil {
+		return
+	}
+	h.recordValue(int64(d / time.Microsecond))
+}
+
+func (h *histogram) recordValue(v int64) {
+	if v < 0 {
+		v = 0
+	} else if v > histHighest {
+		v = histHighest
+	}
+	s := shard()
+	c := &h.cells[s]
+	n := atomic.AddInt64(&c.ops, 1)
+	if latencySampling < 1 && !sampledOp(s, n) {
+		return
+	}
+	atomic.AddInt64(&h.counts[histIndex(v)], 1)
+	atomic.AddInt64(&c.total, 1)
+	atomic.AddInt64(&c.sum, v)
+	// The extremes are only written while they move, so after the first
+	// values they are read far more often than contended.
+	for {
+		min := atomic.LoadInt64(&h.min)
+		if v >= min || atomic.CompareAndSwapInt64(&h.min, min, v) {
+			break
+		}
+	}
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if v <= max || atomic.CompareAndSwapInt64(&h.max, max, v) {
+			break
+		}
+	}
+}
+
+// sampledOp tells whether the latency of the nth operation of a shard is
+// recorded, with the odds of -sample-rate drawn from a stream of -seed.
+func sampledOp(shard int, n int64) bool {
+	src := seededSource(streamLatencySample, uint64(shard)<<40|uint64(n))
+	return float64(src.Uint64()>>11)/(1<<53) < latencySampling
+}
+
+// count is the number of operations, whether or not their latency was
+// recorded.
+func (h *histogram) count() int64 {
+	if h == nil {
+		return 0
+	}
+	ops, _, _ := h.sums()
+	return ops
+}
+
+// snapshot returns a copy of h that is no longer recorded into.
+func (h *histogram) snapshot() *histogram {
+	s := newHistogram()
+	for i := range h.counts {
+		s.counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	s.cells = nil
+	s.ops, s.total, s.sum = h.sums()
+	s.min = atomic.LoadInt64(&h.min)
+	s.max = atomic.LoadInt64(&h.max)
+	return s
+}
+
+// since returns the values of the snapshot h that were recorded after the
+// earlier snapshot base. The minimum and maximum are only known to the
+// precision of the buckets.
+func (h *histogram) since(base *histogram) *histogram {
+	s := newHistogram()
+	s.cells = nil
+	ops, total, sum := h.sums()
+	baseOps, baseTotal, baseSum := base.sums()
+	s.ops, s.total, s.sum = ops-baseOps, total-baseTotal, sum-baseSum
+	s.min, s.max = math.MaxInt64, 0
+	for i := range h.counts {
+		s.counts[i] = h.counts[i] - base.counts[i]
+		if s.counts[i] > 0 {
+			if s.min == math.MaxInt64 {
+				s.min = histValue(i)
+			}
+			s.max = histHighestEquivalent(i)
+		}
+	}
+	if s.max > h.max {
+		s.max = h.max
+	}
+	return s
+}
+
+// add adds the values of the snapshot o to the snapshot h, as if they had
+// been recorded into it.
+func (h *histogram) add(o *histogram) {
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.ops += o.ops
+	h.total += o.total
+	h.sum += o.sum
+	if o.total > 0 && o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// quantile returns the latency below which q (0 to 1) of the recorded
+// values fall. It must only be called on a snapshot, or once nothing
+// records into the histogram any more.
+func (h *histogram) quantile(q float64) time.Duration {
+	_, total, _ := h.sums()
+	if total == 0 {
+		return 0
+	}
+	if q >= 1 {
+		return time.Duration(h.max) * time.Microsecond
+	}
+	want := int64(q*float64(total) + 0.5)
+	if want < 1 {
+		want = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= want {
+			v := histHighestEquivalent(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+func (h *histogram) mean() time.Duration {
+	_, total, sum := h.sums()
+	if total == 0 {
+		return 0
+	}
+	return time.Duration(sum/total) * time.Microsecond
+}
+
+func (h *histogram) minimum() time.Duration {
+	if _, total, _ := h.sums(); total == 0 {
+		return 0
+	}
+	return time.Duration(h.min) * time.Microsecond
+}
+
+// reportedQuantiles are the percentiles logged and charted for every
+// operation.
+var reportedQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99, 0.999, 0.9999, 1}
+
+func quantileName(q float64) string {
+	switch q {
+	case 0.5:
+		return "p50"
+	case 0.75:
+		return "p75"
+	case 0.9:
+		return "p90"
+	case 0.95:
+		return "p95"
+	case 0.99:
+		return "p99"
+	case 0.999:
+		return "p99.9"
+	case 0.9999:
+		return "p99.99"
+	case 1:
+		return "max"
+	}
+	return ""
+}
+
+// counter is a count that many goroutines add to, spread over cells.
+type counter struct {
+	cells [counterShards]cell
+}
+
+func (c *counter) add(n int64) {
+	atomic.AddInt64(&c.cells[shard()].n, n)
+}
+
+func (c *counter) load() int64 {
+	var n int64
+	for i := range c.cells {
+		n += atomic.LoadInt64(&c.cells[i].n)
+	}
+	return n
+}
+
+// exactCounter is a count that many goroutines add to where every add
+// needs to know the total it led to, which one cell gives at the cost of
+// contention.
+type exactCounter struct {
+	n int64
+}
+
+func (c *exactCounter) add(n int64) int64 {
+	return atomic.AddInt64(&c.n, n)
+}
+
+func (c *exactCounter) load() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// gauge is a level that many goroutines move up and down. It remembers
+// its highest level overall and since the last call of takePeak.
+type gauge struct {
+	n, max, peak int64
+}
+
+func (g *gauge) add(n int64) {
+	v := atomic.AddInt64(&g.n, n)
+	raise(&g.max, v)
+	raise(&g.peak, v)
+}
+
+// raise sets *p to v if v is higher.
+func raise(p *int64, v int64) {
+	for {
+		old := atomic.LoadInt64(p)
+		if v <= old || atomic.CompareAndSwapInt64(p, old, v) {
+			return
+		}
+	}
+}
+
+func (g *gauge) load() int64 {
+	return atomic.LoadInt64(&g.n)
+}
+
+func (g *gauge) highest() int64 {
+	return atomic.LoadInt64(&g.max)
+}
+
+// takePeak returns the highest level since the last call and starts over
+// from the current one.
+func (g *gauge) takePeak() int64 {
+	return atomic.SwapInt64(&g.peak, g.load())
+}
+
+// metrics is what a benchmark measures.
+type metrics struct {
+	start time.Time
+
+	put     *histogram
+	reserve *histogram
+	delete  *histogram
+	release *histogram
+	bury    *histogram
+	// reservePaused are the reserves that overlapped a pause of a watched
+	// tube, kept out of reserve.
+	reservePaused *histogram
+	// reserveJob is the latency of the reserve-job command.
+	reserveJob *histogram
+	// cancel is the latency of the publishers deleting their own jobs.
+	cancel *histogram
+	// decode is the time the readers take to decode a job with -decode.
+	decode *histogram
+	// workload is the time the Consume of -workload takes.
+	workload *histogram
+	// compress and decompress are the time a job takes to compress and
+	// decompress with -compress.
+	compress   *histogram
+	decompress *histogram
+	// visible is the time from sending a put until the job is reserved,
+	// and visibleAfterAck from its acknowledgment, of -visibility-rate.
+	visible         *histogram
+	visibleAfterAck *histogram
+	// httpRequest is the time a request to the frontend of
+	// -http-frontend takes, as its client sees it.
+	httpRequest *histogram
+	// endToEnd is the time from the put of a job of -timestamps until a
+	// reader reserved it.
+	endToEnd *histogram
+	// peek is the latency of the peeks of -paranoid.
+	peek *histogram
+	// slowPut and slowReserve keep the slowest puts and reserves with
+	// -slowest.
+	slowPut, slowReserve *slowest
+	// priorities counts the jobs the readers reserved by priority.
+	priorities *priorityStats
+	// bySize splits the put and reserve latencies by -size-buckets.
+	bySize *sizeBuckets
+	// putBudget splits the puts of the native client into their phases.
+	putBudget *putBudget
+
+	// errors counts the operations that failed without ending the run.
+	errors counter
+	// timeouts counts the operations that ran out of -op-timeout, after
+	// which their connection is dialed again.
+	timeouts counter
+	// inFlight counts the jobs reserved by the readers and not deleted yet.
+	inFlight gauge
+	// foreign counts the jobs of others the readers gave back with -shared.
+	foreign *foreignJobs
+	// rawBytes and compressedBytes count the bytes the publishers put
+	// before and after -compress, decompressedBytes those the readers got
+	// back.
+	rawBytes, compressedBytes, decompressedBytes counter
+	// putBytes counts the bytes of the bodies the publishers sent and
+	// readBytes those of the jobs the readers reserved.
+	putBytes, readBytes counter
+	// peekChecked counts the jobs -paranoid peeked before deleting them,
+	// peekMismatched those whose body differed from the reserved one and
+	// peekMissing those the server did not have while they were reserved.
+	peekChecked, peekMismatched, peekMissing counter
+	// stopDeleted and stopReleased count the jobs the readers still held
+	// when they stopped and settled as -on-stop says, leftReserved those
+	// they left reserved.
+	stopDeleted, stopReleased, leftReserved counter
+
+	series *series
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		start:   time.Now(),
+		put:     newHistogram(),
+		reserve: newHistogram(),
+		delete:  newHistogram(),
+		release: newHistogram(),
+		bury:    newHistogram(),
+		foreign: newForeignJobs(),
+
+		reserveJob: newHistogram(),
+		cancel:     newHistogram(),
+		decode:     newHistogram(),
+		workload:   newHistogram(),
+		compress:   newHistogram(),
+		decompress: newHistogram(),
+
+		reservePaused:   newHistogram(),
+		visible:         newHistogram(),
+		visibleAfterAck: newHistogram(),
+		httpRequest:     newHistogram(),
+		endToEnd:        newHistogram(),
+		peek:            newHistogram(),
+		slowPut:         newSlowest("put", *slowestCount),
+		slowReserve:     newSlowest("reserve", *slowestCount),
+		priorities:      newPriorityStats(),
+		bySize:          newSizeBuckets(sizeBucketBounds),
+		putBudget:       newPutBudget(),
+	}
+}
+
+// outcome returns the histogram of what the readers did with a job.
+func (m *metrics) outcome(o outcome) *histogram {
+	switch o {
+	case outcomeRelease:
+		return m.release
+	case outcomeBury:
+		return m.bury
+	}
+	return m.delete
+}
+
+// histograms pairs the histograms of m with their names, in report order.
+func (m *metrics) histograms() []operation {
+	return []operation{
+		{"put", m.put},
+		{"reserve", m.reserve},
+		{"reserve_paused", m.reservePaused},
+		{"delete", m.delete},
+		{"release", m.release},
+		{"bury", m.bury},
+		{"reserve_job", m.reserveJob},
+		{"cancel", m.cancel},
+		{"decode", m.decode},
+		{"workload", m.workload},
+		{"compress", m.compress},
+		{"decompress", m.decompress},
+		{"visible", m.visible},
+		{"visible_after_ack", m.visibleAfterAck},
+		{"http_request", m.httpRequest},
+		{"end_to_end", m.endToEnd},
+		{"peek", m.peek},
+	}
+}
+
+// operations is histograms with snapshots of them.
+func (m *metrics) operations() []operation {
+	ops := m.histograms()
+	for i := range ops {
+		ops[i].hist = ops[i].hist.snapshot()
+	}
+	return ops
+}
+
+// counters are the counters of m that add up across processes, by name.
+func (m *metrics) counters() map[string]*counter {
+	return map[string]*counter{
+		"errors":             &m.errors,
+		"timeouts":           &m.timeouts,
+		"raw_bytes":          &m.rawBytes,
+		"compressed_bytes":   &m.compressedBytes,
+		"decompressed_bytes": &m.decompressedBytes,
+		"put_bytes":          &m.putBytes,
+		"read_bytes":         &m.readBytes,
+		"peek_checked":       &m.peekChecked,
+		"peek_mismatched":    &m.peekMismatched,
+		"peek_missing":       &m.peekMissing,
+		"stop_deleted":       &m.stopDeleted,
+		"stop_released":      &m.stopReleased,
+		"left_reserved":      &m.leftReserved,
+	}
+}
+
+type operation struct {
+	name string
+	hist *histogram
+}
+
+// reportLatencies logs the latency percentiles of every operation that was
+// measured.
+func (m *metrics) reportLatencies() {
+	for _, op := range m.operations() {
+		if op.hist.total == 0 {
+			continue
+		}
+		result("Latency", append([]any{"op", op.name}, latencyArgs(op.hist)...)...)
+	}
+}
+
+// latencyArgs are the log attributes of the latencies in a snapshot. Of
+// sampled latencies the number recorded is given, and how far off the p99
+// may be for it.
+func latencyArgs(h *histogram) []any {
+	ops, total, _ := h.sums()
+	args := []any{"count", ops}
+	if total != ops {
+		lo, hi := h.quantileCI(0.99)
+		args = append(args, "sampled", total, "p99_ci95", fmt.Sprintf("%v-%v", lo, hi))
+	}
+	args = append(args, "min", h.minimum(), "mean", h.mean())
+	for _, q := range reportedQuantiles {
+		args = append(args, quantileName(q), h.quantile(q))
+	}
+	return args
+}
+
+// quantileCI returns the range the q quantile of all the operations is in
+// with 95% confidence, given the values of the snapshot are a random
+// sample of them: the rank of the quantile in a sample of n is off by up to
+// 1.96 standard deviations of sqrt(q(1-q)/n).
+func (h *histogram) quantileCI(q float64) (time.Duration, time.Duration) {
+	_, total, _ := h.sums()
+	if total == 0 {
+		return 0, 0
+	}
+	d := 1.96 * math.Sqrt(q*(1-q)/float64(total))
+	return h.quantile(math.Max(q-d, 0)), h.quantile(math.Min(q+d, 1))
+}
+
+type seriesPoint struct {
+	elapsed  time.Duration
+	puts     int64
+	reads    int64
+	inFlight int64
+	offered  float64
+	// The percentiles are of the latencies of the interval alone.
+	putP50, putP99         time.Duration
+	reserveP50, reserveP99 time.Duration
+	// paused is set if a watched tube was paused during the interval.
+	paused bool
+	// note is what was changed during the interval, such as by a reload
+	// of -config.
+	note string
+}
+
+// series samples the number of jobs published and read at a fixed interval,
+// for the throughput over time, with the offered rate and the latency of
+// every interval.
+type series struct {
+	mu     sync.Mutex
+	points []seriesPoint
+	// limit is the most points kept, 0 for all, and base the last point
+	// dropped, which the rates of the first point kept are taken from.
+	limit int
+	base  seriesPoint
+	// notes are the changes to note on the next point.
+	notes []string
+
+	offered          func() float64
+	paused           func(from, to time.Time) bool
+	lastPut, lastRes *histogram
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startSeries samples m every interval; offered returns the rate offered
+// to the publishers at the time, 0 for unlimited, and paused whether a
+// watched tube was paused between two times.
+func startSeries(m *metrics, interval time.Duration, offered func() float64, paused func(from, to time.Time) bool) *series {
+	s := &series{
+		offered: offered,
+		paused:  paused,
+		lastPut: newHistogram(),
+		lastRes: newHistogram(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.add(m)
+				stream.interval(s)
+			case <-s.stop:
+				s.add(m)
+				stream.interval(s)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *series) add(m *metrics) {
+	put, res := m.put.snapshot(), m.reserve.snapshot()
+	putWindow, resWindow := put.since(s.lastPut), res.since(s.lastRes)
+	now := time.Now()
+	s.mu.Lock()
+	last := s.base
+	if n := len(s.points); n > 0 {
+		last = s.points[n-1]
+	}
+	s.points = append(s.points, seriesPoint{
+		elapsed:    now.Sub(m.start),
+		puts:       m.put.count(),
+		reads:      m.delete.count() + m.bury.count(),
+		inFlight:   m.inFlight.takePeak(),
+		offered:    s.offered(),
+		putP50:     putWindow.quantile(0.5),
+		putP99:     putWindow.quantile(0.99),
+		reserveP50: resWindow.quantile(0.5),
+		reserveP99: resWindow.quantile(0.99),
+		paused:     s.paused(m.start.Add(last.elapsed), now),
+		note:       strings.Join(s.notes, "; "),
+	})
+	s.notes = nil
+	s.lastPut, s.lastRes = put, res
+	if s.limit > 0 && len(s.points) > s.limit {
+		drop := len(s.points) - s.limit/2
+		s.base = s.points[drop-1]
+		s.points = append([]seriesPoint(nil), s.points[drop:]...)
+	}
+	s.mu.Unlock()
+}
+
+// annotate notes a change of the run on the next point.
+func (s *series) annotate(note string) {
+	s.mu.Lock()
+	s.notes = append(s.notes, note)
+	s.mu.Unlock()
+}
+
+// keep limits the series to the last n points, about.
+func (s *series) keep(n int) {
+	s.mu.Lock()
+	s.limit = n
+	s.mu.Unlock()
+}
+
+func (s *series) finish() {
+	close(s.stop)
+	<-s.done
+}
+
+// reportInFlight logs how many jobs the readers held at once.
+func (m *metrics) reportInFlight() {
+	rates := m.series.rates()
+	if len(rates) == 0 || m.inFlight.highest() == 0 {
+		return
+	}
+	var sum int64
+	for _, p := range rates {
+		sum += p.inFlight
+	}
+	result("Jobs in flight", "max", m.inFlight.highest(), "mean_interval_peak", float64(sum)/float64(len(rates)))
+}
+
+// reportLatencyOverTime logs how the latencies of the intervals changed
+// over the run, comparing the mean percentiles of its first and last
+// quarters, and its worst interval, so that a latency that grows while the
+// run goes on is not averaged away by the percentiles of the whole run.
+func (m *metrics) reportLatencyOverTime() {
+	rates := m.series.rates()
+	ops := []struct {
+		name     string
+		p50, p99 func(seriesRate) time.Duration
+	}{
+		{"put", func(p seriesRate) time.Duration { return p.putP50 }, func(p seriesRate) time.Duration { return p.putP99 }},
+		{"reserve", func(p seriesRate) time.Duration { return p.reserveP50 }, func(p seriesRate) time.Duration { return p.reserveP99 }},
+	}
+	mean := func(rates []seriesRate, q func(seriesRate) time.Duration) time.Duration {
+		var sum time.Duration
+		for _, p := range rates {
+			sum += q(p)
+		}
+		return sum / time.Duration(len(rates))
+	}
+	for _, op := range ops {
+		// Only the intervals the operation ran in count.
+		var active []seriesRate
+		var worst seriesRate
+		for _, p := range rates {
+			if op.p99(p) == 0 {
+				continue
+			}
+			active = append(active, p)
+			if op.p99(p) > op.p99(worst) {
+				worst = p
+			}
+		}
+		if len(active) < 4 {
+			continue
+		}
+		quarter := len(active) / 4
+		first, last := active[:quarter], active[len(active)-quarter:]
+		result("Latency over time", "op", op.name,
+			"p50_first", mean(first, op.p50), "p50_last", mean(last, op.p50),
+			"p99_first", mean(first, op.p99), "p99_last", mean(last, op.p99),
+			"p99_worst", op.p99(worst), "p99_worst_at", worst.elapsed.Round(time.Millisecond))
+	}
+}
+
+// seriesRate is an interval of the series.
+type seriesRate struct {
+	elapsed time.Duration
+	// put and read are the jobs per second published and read.
+	put, read float64
+	// inFlight is the most jobs in flight during the interval.
+	inFlight int64
+	offered  float64
+	putP50   time.Duration
+	putP99   time.Duration
+	// The reserve latencies are only known for the native client.
+	reserveP50, reserveP99 time.Duration
+	paused                 bool
+	note                   string
+}
+
+// rates returns the intervals of the series.
+func (s *series) rates() []seriesRate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rates []seriesRate
+	last := s.base
+	for _, p := range s.points {
+		if p.elapsed <= last.elapsed {
+			continue
+		}
+		rates = append(rates, p.since(last))
+		last = p
+	}
+	return rates
+}
+
+// latest returns the last interval of the series, if there is one.
+func (s *series) latest() (seriesRate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.points)
+	if n == 0 {
+		return seriesRate{}, false
+	}
+	last := s.base
+	if n > 1 {
+		last = s.points[n-2]
+	}
+	if s.points[n-1].elapsed <= last.elapsed {
+		return seriesRate{}, false
+	}
+	return s.points[n-1].since(last), true
+}
+
+// since returns the interval from last to p.
+func (p seriesPoint) since(last seriesPoint) seriesRate {
+	d := (p.elapsed - last.elapsed).Seconds()
+	return seriesRate{
+		elapsed:    p.elapsed,
+		put:        float64(p.puts-last.puts) / d,
+		read:       float64(p.reads-last.reads) / d,
+		inFlight:   p.inFlight,
+		offered:    p.offered,
+		putP50:     p.putP50,
+		putP99:     p.putP99,
+		reserveP50: p.reserveP50,
+		reserveP99: p.reserveP99,
+		paused:     p.paused,
+		note:       p.note,
+	}
+}
@@ -0,0 +1,178 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// tubeSample is what the monitor reads from the stats-tube of one tube.
+type tubeSample struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Tube       string    `json:"tube"`
+	Ready      int64     `json:"ready"`
+	Reserved   int64     `json:"reserved"`
+	Delayed    int64     `json:"delayed"`
+	Buried     int64     `json:"buried"`
+	Waiting    int64     `json:"waiting"`
+	PutRate    float64   `json:"put_rate"`
+	DeleteRate float64   `json:"delete_rate"`
+	// RTTUS is how long the stats-tube of the sample took, a probe of the
+	// latency of the server that changes nothing.
+	RTTUS int64 `json:"rtt_us"`
+
+	total, deletes int64
+}
+
+func sampleTube(conn *beanstalk.Conn, h, name string, now time.Time) (tubeSample, error) {
+	t0 := time.Now()
+	stats, err := (&beanstalk.Tube{Conn: conn, Name: name}).Stats()
+	rtt := time.Since(t0)
+	if err != nil {
+		return tubeSample{}, err
+	}
+	n := func(k string) int64 {
+		v, _ := strconv.ParseInt(stats[k], 10, 64)
+		return v
+	}
+	return tubeSample{
+		Time:     now,
+		Host:     h,
+		Tube:     name,
+		Ready:    n("current-jobs-ready"),
+		Reserved: n("current-jobs-reserved"),
+		Delayed:  n("current-jobs-delayed"),
+		Buried:   n("current-jobs-buried"),
+		Waiting:  n("current-waiting"),
+		total:    n("total-jobs"),
+		deletes:  n("cmd-delete"),
+		RTTUS:    int64(rtt / time.Microsecond),
+	}, nil
+}
+
+// monitor samples the stats of every tube of every host each interval
+// until it is interrupted. The put and delete rates are derived from the
+// change of the tube's total-jobs and cmd-delete since the previous sample.
+func monitor(hosts []string, interval time.Duration, emit func(tubeSample)) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conns := make(map[string]*beanstalk.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	previous := make(map[[2]string]tubeSample)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		for _, h := range hosts {
+			conn := conns[h]
+			if conn == nil {
+				var err error
+				if conn, err = dialBeanstalk(h); err != nil {
+					slog.Warn("Cannot connect", "host", h, "err", err)
+					continue
+				}
+				conns[h] = conn
+			}
+			tubes, err := conn.ListTubes()
+			if err != nil {
+				slog.Warn("Cannot list tubes", "host", h, "err", err)
+				conn.Close()
+				delete(conns, h)
+				continue
+			}
+			for _, name := range tubes {
+				s, err := sampleTube(conn, h, name, now)
+				if err != nil {
+					// The tube went away since it was listed.
+					slog.Debug("Cannot fetch tube stats", "host", h, "tube", name, "err", err)
+					continue
+				}
+				key := [2]string{h, name}
+				if p, ok := previous[key]; ok {
+					d := s.Time.Sub(p.Time).Seconds()
+					s.PutRate = float64(s.total-p.total) / d
+					s.DeleteRate = float64(s.deletes-p.deletes) / d
+				}
+				previous[key] = s
+				emit(s)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runMonitor(hosts []string) {
+	if *output != "text" && *output != "json" {
+		fatal("Unknown output format", "output", *output)
+	}
+	var w *csv.Writer
+	if *csvPath != "" {
+		f, err := os.Create(*csvPath)
+		if err != nil {
+			fatal("Cannot write CSV", "path", *csvPath, "err", err)
+		}
+		defer f.Close()
+		w = csv.NewWriter(f)
+		w.Write([]string{"time", "host", "tube", "ready", "reserved", "delayed", "buried", "waiting", "put_rate", "delete_rate", "rtt_us"})
+	}
+	enc := json.NewEncoder(os.Stdout)
+
+	slog.Info("Monitoring", "targets", len(hosts), "interval", *sampleInterval)
+	monitor(hosts, *sampleInterval, func(s tubeSample) {
+		if *output == "json" {
+			enc.Encode(s)
+		} else {
+			result("Tube", "host", s.Host, "tube", s.Tube, "ready", s.Ready, "reserved", s.Reserved, "delayed", s.Delayed,
+				"buried", s.Buried, "waiting", s.Waiting, "put_rate", s.PutRate, "delete_rate", s.DeleteRate,
+				"rtt", time.Duration(s.RTTUS)*time.Microsecond)
+		}
+		if w != nil {
+			w.Write([]string{
+				s.Time.Format(time.RFC3339Nano), s.Host, s.Tube,
+				strconv.FormatInt(s.Ready, 10), strconv.FormatInt(s.Reserved, 10),
+				strconv.FormatInt(s.Delayed, 10), strconv.FormatInt(s.Buried, 10),
+				strconv.FormatInt(s.Waiting, 10),
+				strconv.FormatFloat(s.PutRate, 'f', 1, 64), strconv.FormatFloat(s.DeleteRate, 'f', 1, 64),
+				strconv.FormatInt(s.RTTUS, 10),
+			})
+			w.Flush()
+		}
+	})
+	if w != nil {
+		if err := w.Error(); err != nil {
+			fatal("Cannot write CSV", "path", *csvPath, "err", err)
+		}
+		slog.Info("Wrote CSV", "path", *csvPath)
+	}
+}
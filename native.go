@@ -0,0 +1,347 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors for the responses of the server the native client understands.
+var (
+	errBuried       = errors.New("buried")
+	errDeadlineSoon = errors.New("deadline soon")
+	errDraining     = errors.New("draining")
+	errJobTooBig    = errors.New("job too big")
+	errNotFound     = errors.New("not found")
+	errOutOfMemory  = errors.New("out of memory")
+	errTimedOut     = errors.New("timed out")
+	errUnknown      = errors.New("unknown command")
+)
+
+// deadlineExceeded tells whether err is an operation that ran out of
+// -op-timeout.
+func deadlineExceeded(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+var responseErrors = map[string]error{
+	"BAD_FORMAT":      errors.New("bad format"),
+	"DEADLINE_SOON":   errDeadlineSoon,
+	"DRAINING":        errDraining,
+	"EXPECTED_CRLF":   errors.New("expected CRLF"),
+	"INTERNAL_ERROR":  errors.New("internal error"),
+	"JOB_TOO_BIG":     errJobTooBig,
+	"NOT_FOUND":       errNotFound,
+	"NOT_IGNORED":     errors.New("not ignored"),
+	"OUT_OF_MEMORY":   errOutOfMemory,
+	"TIMED_OUT":       errTimedOut,
+	"UNKNOWN_COMMAND": errUnknown,
+}
+
+// nativeConn is a minimal beanstalkd protocol client. Unlike the client
+// libraries it leaves it to the caller when commands are flushed and when
+// their responses are read, which is what pipelining needs.
+type nativeConn struct {
+	host string
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// dialed is how long dialing the connection took, until the first
+	// batch of puts on it takes it for the put budget.
+	dialed time.Duration
+}
+
+func dialNative(h string) (*nativeConn, error) {
+	t0 := time.Now()
+	conn, err := dial(h)
+	if err != nil {
+		return nil, err
+	}
+	return &nativeConn{
+		host:   h,
+		conn:   conn,
+		r:      bufio.NewReaderSize(conn, 64*1024),
+		w:      bufio.NewWriterSize(conn, 64*1024),
+		dialed: time.Since(t0),
+	}, nil
+}
+
+func (c *nativeConn) Close() error {
+	return c.conn.Close()
+}
+
+// flush sends the buffered commands. With -op-timeout they and their
+// responses must be through within it.
+func (c *nativeConn) flush() error {
+	return c.flushWaiting(0)
+}
+
+// flushWaiting is flush for commands the server may take wait to answer,
+// such as a reserve with a timeout.
+func (c *nativeConn) flushWaiting(wait time.Duration) error {
+	if *opTimeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(*opTimeout + wait))
+	}
+	return c.w.Flush()
+}
+
+// writeCommand buffers a command without a body.
+func (c *nativeConn) writeCommand(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(c.w, format, args...); err != nil {
+		return err
+	}
+	_, err := c.w.WriteString("\r\n")
+	return err
+}
+
+// writePut buffers a put command.
+func (c *nativeConn) writePut(pri uint32, delay, ttr time.Duration, body []byte) error {
+	err := c.writeCommand("put %d %d %d %d", pri, seconds(delay), seconds(ttr), len(body))
+	if err != nil {
+		return err
+	}
+	if _, err := c.w.Write(body); err != nil {
+		return err
+	}
+	_, err = c.w.WriteString("\r\n")
+	return err
+}
+
+// readResponse reads a response line, returning the response word and its
+// arguments. Error responses are turned into errors.
+func (c *nativeConn) readResponse() (string, []string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("empty response")
+	}
+	if err, ok := responseErrors[fields[0]]; ok {
+		return fields[0], fields[1:], err
+	}
+	return fields[0], fields[1:], nil
+}
+
+// readPut reads the response to a put.
+func (c *nativeConn) readPut() (uint64, error) {
+	word, args, err := c.readResponse()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case word == "INSERTED" && len(args) == 1:
+		return strconv.ParseUint(args[0], 10, 64)
+	case word == "BURIED" && len(args) == 1:
+		return 0, errBuried
+	}
+	return 0, fmt.Errorf("unexpected response to put: %s %s", word, strings.Join(args, " "))
+}
+
+// readExpect reads a response that must be want, with any arguments.
+func (c *nativeConn) readExpect(want string) ([]string, error) {
+	word, args, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if word != want {
+		return nil, fmt.Errorf("unexpected response: %s %s", word, strings.Join(args, " "))
+	}
+	return args, nil
+}
+
+// readJob reads a response carrying a job, such as RESERVED or FOUND.
+func (c *nativeConn) readJob(want string) (uint64, []byte, error) {
+	args, err := c.readExpect(want)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(args) != 2 {
+		return 0, nil, fmt.Errorf("malformed %s response", want)
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return id, body[:n], nil
+}
+
+func (c *nativeConn) call(want string, format string, args ...interface{}) ([]string, error) {
+	if err := c.writeCommand(format, args...); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	return c.readExpect(want)
+}
+
+func (c *nativeConn) use(tube string) error {
+	_, err := c.call("USING", "use %s", tube)
+	return err
+}
+
+func (c *nativeConn) watch(tube string) error {
+	_, err := c.call("WATCHING", "watch %s", tube)
+	return err
+}
+
+func (c *nativeConn) ignore(tube string) error {
+	_, err := c.call("WATCHING", "ignore %s", tube)
+	return err
+}
+
+func (c *nativeConn) put(pri uint32, delay, ttr time.Duration, body []byte) (uint64, error) {
+	if err := c.writePut(pri, delay, ttr, body); err != nil {
+		return 0, err
+	}
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	return c.readPut()
+}
+
+func (c *nativeConn) reserve(timeout time.Duration) (uint64, []byte, error) {
+	if err := c.writeCommand("reserve-with-timeout %d", seconds(timeout)); err != nil {
+		return 0, nil, err
+	}
+	if err := c.flushWaiting(time.Duration(seconds(timeout)) * time.Second); err != nil {
+		return 0, nil, err
+	}
+	return c.readJob("RESERVED")
+}
+
+// reserveBlocking reserves with reserve, which waits for a job for as long
+// as it takes.
+func (c *nativeConn) reserveBlocking() (uint64, []byte, error) {
+	if err := c.writeCommand("reserve"); err != nil {
+		return 0, nil, err
+	}
+	if err := c.flush(); err != nil {
+		return 0, nil, err
+	}
+	return c.readJob("RESERVED")
+}
+
+// reserveJob reserves the job with the given id, which needs beanstalkd
+// 1.12 or later.
+func (c *nativeConn) reserveJob(id uint64) ([]byte, error) {
+	if err := c.writeCommand("reserve-job %d", id); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	_, body, err := c.readJob("RESERVED")
+	return body, err
+}
+
+// peek returns the body of the job with the given id.
+func (c *nativeConn) peek(id uint64) ([]byte, error) {
+	if err := c.writeCommand("peek %d", id); err != nil {
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	_, body, err := c.readJob("FOUND")
+	return body, err
+}
+
+// statsJob returns the stats of the job with the given id.
+func (c *nativeConn) statsJob(id uint64) (map[string]string, error) {
+	return c.stats("stats-job %d", id)
+}
+
+// statsTube returns the stats of a tube.
+func (c *nativeConn) statsTube(tube string) (map[string]string, error) {
+	return c.stats("stats-tube %s", tube)
+}
+
+// stats sends a stats command and returns the stats of its answer.
+func (c *nativeConn) stats(format string, a ...interface{}) (map[string]string, error) {
+	resp, err := c.call("OK", format, a...)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 1 {
+		return nil, fmt.Errorf("malformed OK response")
+	}
+	n, err := strconv.Atoi(resp[0])
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	stats := make(map[string]string)
+	for _, line := range strings.Split(string(body[:n]), "\n") {
+		if k, v, ok := strings.Cut(line, ": "); ok {
+			stats[k] = strings.TrimSpace(v)
+		}
+	}
+	return stats, nil
+}
+
+func (c *nativeConn) delete(id uint64) error {
+	_, err := c.call("DELETED", "delete %d", id)
+	return err
+}
+
+func (c *nativeConn) release(id uint64, pri uint32, delay time.Duration) error {
+	_, err := c.call("RELEASED", "release %d %d %d", id, pri, seconds(delay))
+	return err
+}
+
+// kick kicks up to n buried jobs of the used tube, or delayed ones if
+// there are none, and returns how many it kicked.
+func (c *nativeConn) kick(n int) (int, error) {
+	args, err := c.call("KICKED", "kick %d", n)
+	if err != nil {
+		return 0, err
+	}
+	if len(args) != 1 {
+		return 0, fmt.Errorf("malformed KICKED response")
+	}
+	return strconv.Atoi(args[0])
+}
+
+func (c *nativeConn) bury(id uint64, pri uint32) error {
+	_, err := c.call("BURIED", "bury %d %d", id, pri)
+	return err
+}
+
+// seconds rounds d up to whole seconds, the resolution of the protocol.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,621 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// share returns the part of count that worker i of n is responsible for.
+func share(count, n, i int) int {
+	c := count / n
+	if i < count%n {
+		c++
+	}
+	return c
+}
+
+// testPublisherNative publishes count jobs over the given number of
+// connections of the native client. Each connection sends up to pipeline
+// puts before it reads their responses; a pipeline of 1 is strict
+// request/response.
+func testPublisherNative(r *run, publishers, count, pipeline int, ch chan int) {
+	if count == 0 {
+		ch <- 1
+		return
+	}
+	if pipeline < 1 {
+		pipeline = 1
+	}
+
+	fo := r.failover
+	wg := sync.WaitGroup{}
+	connected := 0
+	for p := 0; p < publishers; p++ {
+		home := r.hosts[p%len(r.hosts)]
+		conn := dialWorker(r, home, newRand(streamDialPublisher, uint64(p)))
+		if conn == nil {
+			// Its share of the jobs is left out, as for a run stopped
+			// early.
+			continue
+		}
+		connected++
+		wg.Add(1)
+		go func(p, n int) {
+			defer wg.Done()
+			onBackup := false
+			defer func() { conn.Close() }()
+			r.useTube(conn, p)
+			rng := newRand(streamCancel, uint64(p))
+			jitter := newRand(streamRejectBackoff, uint64(p))
+			var ids []uint64
+			var buf []byte
+			// sizes are those of the bodies of the batch, for -slowest, and
+			// acks how many of them were acknowledged.
+			var sizes []int
+			var pris []uint32
+			// raw is the body the script made up for the job.
+			var raw []byte
+			scripted := r.scriptPayload(&raw)
+			rejected := 0
+			inserted := func(i int, id uint64, latency time.Duration) {
+				r.metrics.put.record(latency)
+				r.metrics.slowPut.record(latency, conn.host, id, sizes[i])
+				r.metrics.bySize.recordPut(sizes[i], latency)
+				r.metrics.priorities.put(conn.host, id, pris[i])
+				jobEvents.put(conn.host, id, sizes[i], p, latency)
+				r.producers.record(p, latency)
+				r.byID.offer(id)
+				r.audit.offer(conn.host, id)
+				if *cancelRatio > 0 {
+					ids = append(ids, id)
+				}
+			}
+			for seq := 0; seq < n && !r.halted(); {
+				if fo.active() && !onBackup {
+					conn = switchToBackup(conn, fo)
+					r.useTube(conn, p)
+					onBackup = true
+				}
+				if c := r.health.rehome(conn, home, nil); c != conn {
+					conn = c
+					r.useTube(conn, p)
+				}
+
+				batch := pipeline
+				if n-seq < batch {
+					batch = n - seq
+				}
+				r.admit(batch)
+				sizes, pris, rejected = sizes[:0], pris[:0], 0
+				acked, err := putBatch(conn, r.metrics.putBudget, batch, inserted, func(err error) {
+					r.rejections.rejected(err)
+					rejected++
+				}, func(i int) putJob {
+					// The body is copied into the connection's buffer before
+					// the next one is generated.
+					job := defaultJob
+					if script != nil {
+						job = script.next(p, seq+i)
+						raw = job.body
+						buf = scripted(buf[:0])
+					} else {
+						jobRanges.draw(&job, p, seq+i)
+						buf = r.payload(buf[:0])
+					}
+					if r.verify {
+						for len(buf) < orderHeaderSize {
+							buf = append(buf, 0)
+						}
+						putOrderHeader(buf, uint32(p), uint64(seq+i))
+					}
+					r.sent(len(buf))
+					sizes = append(sizes, len(buf))
+					pris = append(pris, job.pri)
+					job.body = buf
+					return job
+				})
+				if fo != nil {
+					fo.publish.done(onBackup, acked)
+				}
+				r.health.put(conn.host, acked)
+				if err == nil && rejected > 0 {
+					r.rejections.backoff(jitter)
+				} else if err == nil {
+					r.rejections.accepted()
+				}
+				if err != nil && r.health != nil && connectionLost(err) {
+					// The puts still due may or may not have been put
+					// before the host went down.
+					broken := int64(batch - acked - rejected)
+					r.health.brokenOff.add(broken)
+					if deadlineExceeded(err) {
+						r.metrics.timeouts.add(broken)
+					} else {
+						r.metrics.errors.add(broken)
+					}
+					r.health.lost(conn.host, err)
+					conn = r.health.redial(conn, home, nil, r.halted)
+					r.useTube(conn, p)
+				} else if err != nil && deadlineExceeded(err) {
+					// The responses still due would be taken for those of
+					// the next batch.
+					r.metrics.timeouts.add(int64(batch - acked - rejected))
+					conn = redial(conn, nil, r.halted)
+					r.useTube(conn, p)
+				} else if err != nil && r.soak != nil && connectionLost(err) {
+					r.soak.lost.add(int64(batch - acked - rejected))
+					r.metrics.errors.add(int64(batch - acked - rejected))
+					conn = r.soak.reconnect(conn, nil, r.halted)
+					r.useTube(conn, p)
+				} else if err != nil {
+					// Losing the primary is expected once the failover is
+					// triggered; those jobs were sent but never confirmed.
+					if !fo.active() || onBackup {
+						fatal("Put failed", "err", err)
+					}
+					fo.publish.fail(batch - acked - rejected)
+					r.metrics.errors.add(int64(batch - acked - rejected))
+				} else if len(ids) > 0 {
+					if err := cancelBatch(r, conn, rng, ids); err != nil {
+						fatal("Cancel failed", "err", err)
+					}
+				}
+				ids = ids[:0]
+				seq += batch
+			}
+		}(p, share(count, publishers, p))
+	}
+	r.publishersConnected = time.Since(r.metrics.start)
+	if connected == 0 {
+		fatal("No publisher could connect", "publishers", publishers)
+	}
+	wg.Wait()
+	ch <- 1
+}
+
+// dialWorker dials a publisher or reader connection to h, no faster than
+// -connect-ramp allows. A server flooded with connections at the start
+// refuses or resets some once its accept queue is full, so a failed dial is
+// tried again -connect-retries times, after a random backoff of at least
+// half of -connect-backoff, doubled every time, lest the workers come back
+// all at once. The backoffs are drawn from jitter, a stream of -seed of the
+// worker. It returns nil if the worker could not connect, for the run to go
+// on without it.
+func dialWorker(r *run, h string, jitter *rand.Rand) *nativeConn {
+	backoff := *connectBackoff
+	for attempt := 1; ; attempt++ {
+		r.ramp.wait(1)
+		conn, err := dialNative(h)
+		if err == nil {
+			// Only the connections dialed again during the run count
+			// against the puts that waited for them.
+			conn.dialed = 0
+			return conn
+		}
+		if attempt > *connectRetries || r.halted() {
+			lifecycle.workersFailed.add(1)
+			slog.Warn("Cannot connect, going on without the worker", "host", h, "attempts", attempt, "err", err)
+			return nil
+		}
+		lifecycle.workerRetries.add(1)
+		time.Sleep(backoff/2 + time.Duration(jitter.Int63n(int64(backoff/2)+1)))
+		backoff *= 2
+	}
+}
+
+// putBatch sends n puts of the jobs returned by job before reading their
+// responses, and returns how many were acknowledged. The index and id of
+// every job is passed to inserted with the latency of its put, which runs
+// from the start of the batch to its response, and its phases are recorded
+// in budget, which may be nil. The first batch on a connection dialed again
+// waited for the dial. The puts the server turns down with DRAINING or
+// OUT_OF_MEMORY are passed to rejected, unless it is nil and they are
+// errors.
+func putBatch(conn *nativeConn, budget *putBudget, n int, inserted func(i int, id uint64, latency time.Duration), rejected func(err error), job func(i int) putJob) (int, error) {
+	t0 := time.Now()
+	dialed := conn.dialed
+	conn.dialed = 0
+	for i := 0; i < n; i++ {
+		j := job(i)
+		if err := conn.writePut(j.pri, j.delay, j.ttr, j.body); err != nil {
+			return 0, err
+		}
+	}
+	if err := conn.flush(); err != nil {
+		return 0, err
+	}
+	written := time.Since(t0)
+	acked := 0
+	for i := 0; i < n; i++ {
+		id, err := conn.readPut()
+		if rejected != nil && rejection(err) {
+			rejected(err)
+			continue
+		}
+		if err != nil {
+			return acked, err
+		}
+		latency := time.Since(t0)
+		budget.record(dialed, written, latency)
+		inserted(i, id, latency)
+		acked++
+	}
+	return acked, nil
+}
+
+func switchToBackup(conn *nativeConn, fo *failover) *nativeConn {
+	conn.Close()
+	backup, err := dialNative(fo.backup)
+	if err != nil {
+		fatal("Cannot connect", "host", fo.backup, "err", err)
+	}
+	return backup
+}
+
+// redial replaces conn, which broke or is out of step with the server, with
+// a new connection to its host that watches tubes, dialing with a backoff
+// while the server is down. It gives up and returns conn once stopped
+// tells it to.
+func redial(conn *nativeConn, tubes []string, stopped func() bool) *nativeConn {
+	conn.Close()
+	t0 := time.Now()
+	backoff := 100 * time.Millisecond
+	for attempt := 1; !stopped() && !expired(); attempt++ {
+		c, err := dialNative(conn.host)
+		if err == nil {
+			if err = watchTubes(c, tubes); err == nil {
+				lifecycle.reconnected(t0, attempt)
+				if attempt > 1 {
+					slog.Info("Reconnected", "host", conn.host, "attempts", attempt, "after", time.Since(t0).Round(time.Millisecond))
+				}
+				return c
+			}
+			c.Close()
+		}
+		if attempt == 1 {
+			slog.Warn("Connection lost, reconnecting", "host", conn.host, "err", err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+	return conn
+}
+
+// watchTubes makes conn watch tubes instead of the default tube; nil tubes
+// leave it as it is.
+func watchTubes(conn *nativeConn, tubes []string) error {
+	if tubes == nil {
+		return nil
+	}
+	for _, tube := range tubes {
+		if err := conn.watch(tube); err != nil {
+			return err
+		}
+	}
+	for _, tube := range tubes {
+		if tube == "default" {
+			return nil
+		}
+	}
+	return conn.ignore("default")
+}
+
+// reserveNext reserves a job as -reserve-mode says. After a reserve that
+// timed out it waits for -poll-interval.
+func reserveNext(conn *nativeConn) (uint64, []byte, error) {
+	if *reserveMode == "block" {
+		return conn.reserveBlocking()
+	}
+	id, body, err := conn.reserve(*reserveTimeout)
+	if err == errTimedOut && *pollInterval > 0 {
+		time.Sleep(*pollInterval)
+	}
+	return id, body, err
+}
+
+// claim is the answer to one of the reserves of a reader: the job it got, or
+// why it got none, with when its batch was sent and how long the answer took.
+type claim struct {
+	id      uint64
+	body    []byte
+	err     error
+	start   time.Time
+	latency time.Duration
+}
+
+// claimBatch sends n reserves as -reserve-mode says before reading their
+// answers, and appends them to claims. Every latency runs from the start of
+// the batch to its answer, like those of putBatch. An answer that broke the
+// connection is the last. After a batch of which a reserve timed out it
+// waits for -poll-interval.
+func claimBatch(conn *nativeConn, n int, claims []claim) []claim {
+	t0 := time.Now()
+	if n == 1 {
+		id, body, err := reserveNext(conn)
+		return append(claims, claim{id, body, err, t0, time.Since(t0)})
+	}
+	cmd, wait := "reserve", time.Duration(0)
+	if *reserveMode != "block" {
+		cmd = fmt.Sprintf("reserve-with-timeout %d", seconds(*reserveTimeout))
+		// The server answers the reserves of a connection one after the
+		// other, so each may wait for its timeout in turn.
+		wait = time.Duration(n*int(seconds(*reserveTimeout))) * time.Second
+	}
+	for i := 0; i < n; i++ {
+		if err := conn.writeCommand("%s", cmd); err != nil {
+			return append(claims, claim{err: err, start: t0})
+		}
+	}
+	if err := conn.flushWaiting(wait); err != nil {
+		return append(claims, claim{err: err, start: t0})
+	}
+	timedOut := false
+	for i := 0; i < n; i++ {
+		id, body, err := conn.readJob("RESERVED")
+		claims = append(claims, claim{id, body, err, t0, time.Since(t0)})
+		if err == errTimedOut {
+			timedOut = true
+		}
+		if err != nil && connectionLost(err) {
+			break
+		}
+	}
+	if timedOut && *pollInterval > 0 {
+		time.Sleep(*pollInterval)
+	}
+	return claims
+}
+
+// claimQueue holds the answers to the reserves a reader sent ahead with
+// -reserve-pipeline until it gets to them.
+type claimQueue struct {
+	claims []claim
+	next   int
+}
+
+// take returns the next answer, sending a batch of reserves on conn once
+// the queue is empty.
+func (q *claimQueue) take(conn *nativeConn) claim {
+	if q.next == len(q.claims) {
+		q.claims, q.next = claimBatch(conn, *reservePipeline, q.claims[:0]), 0
+	}
+	c := q.claims[q.next]
+	q.next++
+	return c
+}
+
+// drop forgets the answers still queued when the reader leaves their
+// connection, which gives their jobs back as it closes.
+func (q *claimQueue) drop() {
+	q.claims, q.next = q.claims[:0], 0
+}
+
+// testReaderNative reserves and deletes count jobs of the watched tubes over
+// the given number of connections of the native client. Like the publishers'
+// connections, they are spread round-robin over the hosts.
+func testReaderNative(r *run, readers, count int, ch chan int) {
+	if count == 0 {
+		ch <- 1
+		return
+	}
+
+	if n := *watchPerConn; n > 0 && r.tubes != nil {
+		if readers*n < len(r.tubes) {
+			fatal("-watch-per-conn leaves tubes no reader watches", "tubes", len(r.tubes), "readers", readers, "watch_per_conn", n)
+		}
+		slog.Info("Watched tubes", "tubes", len(r.tubes), "per_conn", len(r.readerTubes(0)))
+	}
+	fo := r.failover
+	wg := sync.WaitGroup{}
+	connected := 0
+	for i := 0; i < readers; i++ {
+		home := r.hosts[i%len(r.hosts)]
+		conn := dialWorker(r, home, newRand(streamDialReader, uint64(i)))
+		tubes := r.readerTubes(i)
+		if conn == nil {
+			if *watchPerConn > 0 && r.tubes != nil {
+				fatal("A reader that cannot connect leaves tubes of -watch-per-conn no reader watches", "reader", i, "tubes", tubes)
+			}
+			r.starvation.finished(i)
+			continue
+		}
+		connected++
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			onBackup := false
+			// held are the foreign jobs of -shared the reader keeps
+			// reserved, so it does not get them again and again, until the
+			// server warns that one's time to run is about to run out.
+			// Closing the connection gives them back too.
+			var held []uint64
+			var queue claimQueue
+			defer func() {
+				settleReserved(r, conn, &queue, held)
+				conn.Close()
+			}()
+			defer r.starvation.finished(i)
+			rng := newRand(streamOutcome, uint64(i))
+			if err := watchTubes(conn, tubes); err != nil {
+				fatal("Cannot watch the tubes", "err", err)
+			}
+			if *reserveMode == "block" {
+				// A blocking reserve only returns with a job, so it is
+				// broken off by a read deadline once the readers are done.
+				go func() {
+					<-r.consume.done
+					conn.conn.SetReadDeadline(time.Now())
+				}()
+			}
+			for r.consuming() {
+				if !r.scale.wait(i) {
+					return
+				}
+				if fo.active() && !onBackup {
+					conn = switchToBackup(conn, fo)
+					held = nil
+					queue.drop()
+					onBackup = true
+				}
+				if c := r.health.rehome(conn, home, tubes); c != conn {
+					conn = c
+					held = nil
+					queue.drop()
+				}
+
+				o := outcomeDelete
+				c := queue.take(conn)
+				id, body, err := c.id, c.body, c.err
+				if err == nil {
+					r.starvation.reserved(i)
+				}
+				if err == errDeadlineSoon && len(held) > 0 {
+					err = releaseForeign(conn, held)
+					held = held[:0]
+				} else if err == nil && foreign(body) {
+					r.metrics.foreign.reserved(conn.host, id)
+					held = append(held, id)
+					continue
+				}
+				if err == errTimedOut || err == errDeadlineSoon {
+					// Whatever was left on the primary will not be read
+					// after a failover.
+					if onBackup && fo.finished() {
+						return
+					}
+					continue
+				}
+				if err == nil {
+					reserved := time.Now()
+					r.metrics.inFlight.add(1)
+					r.metrics.readBytes.add(int64(len(body)))
+					if r.pauses.overlaps(c.start, c.start.Add(c.latency)) {
+						r.metrics.reservePaused.record(c.latency)
+					} else {
+						r.metrics.reserve.record(c.latency)
+					}
+					r.metrics.slowReserve.record(c.latency, conn.host, id, len(body))
+					r.metrics.bySize.recordReserve(len(body), c.latency)
+					pri := r.metrics.priorities.take(conn.host, id)
+					r.metrics.priorities.record(pri, c.latency)
+					jobEvents.reserve(conn.host, id, len(body), i, c.latency)
+					r.burst.reserved(c.start, c.latency)
+					if r.order != nil {
+						// Only jobs of the same priority are ready in the
+						// order they were put.
+						r.order.observe("default", pri, time.Now(), body)
+					}
+					raw, ok := r.decompress(body)
+					if ok {
+						r.endToEnd(raw, reserved)
+						r.decode(raw)
+					}
+					o = pickOutcome(rng)
+					if ok {
+						o = script.outcome(raw, o)
+					}
+					if *paranoid && o == outcomeDelete {
+						err = r.checkPeek(conn, id, body)
+					}
+					t0 := time.Now()
+					if err == nil {
+						switch o {
+						case outcomeRelease:
+							err = conn.release(id, pri, 0)
+						case outcomeBury:
+							err = conn.bury(id, pri)
+						default:
+							err = conn.delete(id)
+						}
+					}
+					if err == nil {
+						r.metrics.outcome(o).record(time.Since(t0))
+						jobEvents.outcome(conn.host, id, i, o, time.Since(t0))
+						if o == outcomeDelete {
+							r.audit.deleted(conn.host, id)
+						} else {
+							r.metrics.priorities.put(conn.host, id, pri)
+						}
+					}
+					r.metrics.inFlight.add(-1)
+					if err == errNotFound {
+						// The TTR ran out and another reader has the job.
+						r.cancels.readerNotFound.add(1)
+						continue
+					}
+				}
+				if err != nil && !r.consuming() {
+					return
+				}
+				if err != nil && r.health != nil && connectionLost(err) {
+					if deadlineExceeded(err) {
+						r.metrics.timeouts.add(1)
+					} else {
+						r.metrics.errors.add(1)
+					}
+					r.health.lost(conn.host, err)
+					conn = r.health.redial(conn, home, tubes, func() bool { return !r.consuming() })
+					held = nil
+					queue.drop()
+					continue
+				}
+				if err != nil && deadlineExceeded(err) {
+					r.metrics.timeouts.add(1)
+					conn = redial(conn, tubes, func() bool { return !r.consuming() })
+					held = nil
+					queue.drop()
+					continue
+				}
+				if err != nil && r.soak != nil && connectionLost(err) {
+					r.metrics.errors.add(1)
+					conn = r.soak.reconnect(conn, tubes, func() bool { return !r.consuming() })
+					held = nil
+					queue.drop()
+					continue
+				}
+				if err != nil {
+					if !fo.active() || onBackup {
+						fatal("Reserve failed", "err", err)
+					}
+					fo.read.fail(1)
+					r.metrics.errors.add(1)
+					continue
+				}
+				if !o.terminal() {
+					continue
+				}
+				if fo != nil {
+					fo.read.done(onBackup, 1)
+				}
+				r.consumers.add(i, 1)
+				r.health.read(conn.host)
+				r.read(1)
+			}
+		}(i)
+	}
+	r.readersConnected = time.Since(r.metrics.start)
+	if connected == 0 {
+		fatal("No reader could connect", "readers", readers)
+	}
+	wg.Wait()
+	ch <- 1
+}
@@ -0,0 +1,128 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// The values of -on-stop.
+const (
+	onStopDelete  = "delete"
+	onStopRelease = "release"
+	onStopAbandon = "abandon"
+)
+
+var onStop = flag.String("on-stop", onStopRelease, "What the readers of the native client do with the jobs they still hold reserved when they stop, on an interrupt as at the end of a run: delete, release or abandon them to their TTR")
+
+func validOnStop(s string) error {
+	switch s {
+	case onStopDelete, onStopRelease, onStopAbandon:
+		return nil
+	}
+	return fmt.Errorf("unknown -on-stop %q, want delete, release or abandon", s)
+}
+
+// settleReserved ends the reservations a reader of the native client holds
+// as it leaves: the jobs it reserved ahead with -reserve-pipeline and never
+// got to, and the foreign jobs of -shared it kept. Its own are deleted or
+// released as -on-stop says, the foreign ones released, and with abandon
+// all are left to the connection, which gives them back as it closes
+// unless a proxy holds on to them. What is not settled counts as left
+// reserved.
+func settleReserved(r *run, conn *nativeConn, q *claimQueue, held []uint64) {
+	var own []uint64
+	for _, c := range q.claims[q.next:] {
+		switch {
+		case c.err != nil:
+		case foreign(c.body):
+			held = append(held, c.id)
+		default:
+			own = append(own, c.id)
+		}
+	}
+	q.drop()
+	if len(own)+len(held) == 0 {
+		return
+	}
+	// A blocking reserve broken off by the deadline leaves the connection
+	// out of step with the server, so with -reserve-mode block the jobs are
+	// left to the close as well.
+	if *onStop == onStopAbandon || *reserveMode == "block" {
+		r.metrics.leftReserved.add(int64(len(own) + len(held)))
+		return
+	}
+	for _, id := range own {
+		// The reader never got to the jobs, so their priorities are still
+		// left behind for it.
+		pri := r.metrics.priorities.take(conn.host, id)
+		var err error
+		if *onStop == onStopDelete {
+			err = conn.delete(id)
+		} else {
+			err = conn.release(id, pri, 0)
+		}
+		switch {
+		case err == errNotFound:
+			// The TTR ran out and the server took the job back.
+		case err != nil:
+			r.metrics.leftReserved.add(1)
+		case *onStop == onStopDelete:
+			r.metrics.stopDeleted.add(1)
+			r.audit.deleted(conn.host, id)
+		default:
+			r.metrics.stopReleased.add(1)
+			r.metrics.priorities.put(conn.host, id, pri)
+		}
+	}
+	if len(held) > 0 && releaseForeign(conn, held) != nil {
+		r.metrics.leftReserved.add(int64(len(held)))
+	}
+}
+
+// jsonStop is what the readers did with the jobs they held when they
+// stopped.
+type jsonStop struct {
+	OnStop       string `json:"on_stop"`
+	Interrupted  bool   `json:"interrupted,omitempty"`
+	Deleted      int64  `json:"deleted"`
+	Released     int64  `json:"released"`
+	LeftReserved int64  `json:"left_reserved"`
+}
+
+// stop is nil unless the readers held jobs when they stopped or the run was
+// interrupted.
+func (res *runResult) stop() *jsonStop {
+	m := res.metrics
+	s := &jsonStop{
+		OnStop:       *onStop,
+		Interrupted:  interrupted(),
+		Deleted:      m.stopDeleted.load(),
+		Released:     m.stopReleased.load(),
+		LeftReserved: m.leftReserved.load(),
+	}
+	if !s.Interrupted && s.Deleted+s.Released+s.LeftReserved == 0 {
+		return nil
+	}
+	return s
+}
+
+func reportStop(res *runResult) {
+	if s := res.stop(); s != nil {
+		result("Reserved at stop", "on_stop", s.OnStop, "interrupted", s.Interrupted, "deleted", s.Deleted,
+			"released", s.Released, "left_reserved", s.LeftReserved)
+	}
+}
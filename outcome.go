@@ -0,0 +1,109 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// outcomes is the parsed -outcome flag. A reload of -config changes it
+// while the readers pick from it, under outcomesMu.
+var (
+	outcomes   = outcomeMix{outcomeDelete: 100}
+	outcomesMu sync.RWMutex
+)
+
+// outcome is what a reader does with a job it reserved.
+type outcome int
+
+const (
+	outcomeDelete outcome = iota
+	outcomeRelease
+	outcomeBury
+	numOutcomes
+)
+
+var outcomeNames = []string{"delete", "release", "bury"}
+
+// terminal tells whether the job is done with after the outcome; a released
+// job comes back to be reserved again.
+func (o outcome) terminal() bool {
+	return o != outcomeRelease
+}
+
+// outcomeMix is the weight of every outcome, as set with -outcome.
+type outcomeMix [numOutcomes]int
+
+// parseOutcomes parses a comma separated list of outcome=weight pairs.
+// Outcomes that are left out get a weight of 0.
+func parseOutcomes(s string) (outcomeMix, error) {
+	var mix outcomeMix
+	for _, f := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return mix, fmt.Errorf("outcome %q is not name=weight", f)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return mix, fmt.Errorf("outcome %q has an invalid weight", f)
+		}
+		found := false
+		for i, n := range outcomeNames {
+			if n == name {
+				mix[i], found = w, true
+			}
+		}
+		if !found {
+			return mix, fmt.Errorf("unknown outcome %q, want delete, release or bury", name)
+		}
+	}
+	if mix[outcomeDelete]+mix[outcomeBury] == 0 {
+		return mix, fmt.Errorf("outcomes %q never finish a job", s)
+	}
+	return mix, nil
+}
+
+// pickOutcome draws an outcome with the odds of the current mix.
+func pickOutcome(rng *rand.Rand) outcome {
+	outcomesMu.RLock()
+	defer outcomesMu.RUnlock()
+	return outcomes.pick(rng)
+}
+
+func setOutcomes(mix outcomeMix) {
+	outcomesMu.Lock()
+	outcomes = mix
+	outcomesMu.Unlock()
+}
+
+// pick draws an outcome with the odds of the mix.
+func (m outcomeMix) pick(rng *rand.Rand) outcome {
+	total := 0
+	for _, w := range m {
+		total += w
+	}
+	n := rng.Intn(total)
+	for i, w := range m {
+		if n < w {
+			return outcome(i)
+		}
+		n -= w
+	}
+	return outcomeDelete
+}
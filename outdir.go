@@ -0,0 +1,141 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// outDir is the directory of this run within -out-dir, empty without it.
+// sweepPoint names the directory of the -sweep combination under way
+// within it.
+var (
+	outDir     string
+	sweepPoint string
+)
+
+// logOutput is where the log lines go: stderr or -log-file, and with
+// -out-dir the log file of the run as well.
+var logOutput io.Writer = os.Stderr
+
+// startOutDir creates the directory of the run in -out-dir, named after its
+// start and run id so that no two runs share one, copies the log lines to
+// run.log in it and has the reports of the run that are not given a path
+// written there.
+func startOutDir() {
+	outDir = filepath.Join(*outDirFlag, time.Now().Format("20060102-150405")+"-"+runID)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		fatal("Cannot create the results directory", "dir", outDir, "err", err)
+	}
+	f, err := os.Create(filepath.Join(outDir, "run.log"))
+	if err != nil {
+		fatal("Cannot create the log file", "dir", outDir, "err", err)
+	}
+	logOutput = io.MultiWriter(logOutput, f)
+	if err := setupLogging(logOutput, *logLevel, *logFormat, *quiet); err != nil {
+		fatal("Cannot log to the results directory", "err", err)
+	}
+	for _, d := range []struct {
+		path *string
+		name string
+		use  bool
+	}{
+		{csvPath, "series.csv", true},
+		{reportPath, "report.html", true},
+		{hdrLogPath, "intervals.hlog", true},
+		{hdrHistogramsPath, "histograms.hlog", true},
+		{junitPath, "junit.xml", *asserts != ""},
+		{sweepCSV, "sweep.csv", *sweepSpec != ""},
+	} {
+		if *d.path == "" && d.use {
+			*d.path = filepath.Join(outDir, d.name)
+		}
+	}
+	slog.Info("Writing the results", "dir", outDir)
+}
+
+// writeArtifacts writes the JSON summary and the latency histograms of
+// res to dir, and with all also its throughput over time, which is left to
+// -csv for the run as a whole.
+func writeArtifacts(dir string, res *runResult, all bool) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatal("Cannot create the results directory", "dir", dir, "err", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "summary.json"))
+	if err == nil {
+		err = writeJSONSummary(f, res)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = writeHistogramsCSV(filepath.Join(dir, "histograms.csv"), res)
+	}
+	if err == nil && all {
+		err = writeCSVSeries(filepath.Join(dir, "series.csv"), res)
+	}
+	if err != nil {
+		fatal("Cannot write the results", "dir", dir, "err", err)
+	}
+	slog.Info("Wrote the results", "dir", dir)
+}
+
+// runDir is the directory of run i of -runs within the results directory,
+// in that of the -sweep combination under way.
+func runDir(i int) string {
+	dir := filepath.Join(outDir, sweepPoint)
+	if *runs > 1 {
+		dir = filepath.Join(dir, fmt.Sprintf("run-%d", i))
+	}
+	return dir
+}
+
+// writeHistogramsCSV writes the buckets of the latency histograms of res
+// that counted any operation, one row per bucket with its bounds in
+// microseconds.
+func writeHistogramsCSV(path string, res *runResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"op", "from_us", "to_us", "count"})
+	for _, op := range res.metrics.operations() {
+		for i, n := range op.hist.counts {
+			if n == 0 {
+				continue
+			}
+			w.Write([]string{
+				op.name,
+				strconv.FormatInt(histValue(i), 10),
+				strconv.FormatInt(histHighestEquivalent(i), 10),
+				strconv.FormatInt(n, 10),
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
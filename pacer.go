@@ -0,0 +1,81 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pacerSlack is how far the pacer lets the publishers fall behind their
+// slots and catch up, which covers sleeps that overshoot.
+const pacerSlack = 10 * time.Millisecond
+
+// pacer spaces the puts of all publishers evenly to offer a rate. Slots
+// that nobody used are not made up for later, beyond pacerSlack. A nil
+// pacer or a rate of 0 does not hold anything back.
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(rate float64) *pacer {
+	p := &pacer{}
+	p.setRate(rate)
+	return p
+}
+
+// setRate changes the offered rate in jobs per second; 0 is unlimited.
+func (p *pacer) setRate(rate float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval = 0
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+}
+
+// rate returns the offered rate in jobs per second, 0 if it is unlimited.
+func (p *pacer) rate() float64 {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interval == 0 {
+		return 0
+	}
+	return float64(time.Second) / float64(p.interval)
+}
+
+// wait blocks until n more jobs may be put.
+func (p *pacer) wait(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.interval == 0 {
+		p.mu.Unlock()
+		return
+	}
+	if earliest := time.Now().Add(-pacerSlack); p.next.Before(earliest) {
+		p.next = earliest
+	}
+	slot := p.next
+	p.next = p.next.Add(time.Duration(n) * p.interval)
+	p.mu.Unlock()
+	time.Sleep(time.Until(slot))
+}
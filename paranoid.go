@@ -0,0 +1,87 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var paranoid = flag.Bool("paranoid", false, "Have the readers peek every job by id before they delete it and compare its body with the one they reserved, to catch proxies and replication that serve stale or wrong bodies; needs -client native")
+
+// mismatchWarned is set once the first mismatch was logged; the rest are
+// only counted.
+var mismatchWarned int32
+
+// checkPeek peeks the job id a reader reserved with body, before it is
+// deleted, and counts whether the server has the same body, another one, or
+// no such job while the reader holds it. Only the errors of the connection
+// are returned.
+func (r *run) checkPeek(conn *nativeConn, id uint64, body []byte) error {
+	t0 := time.Now()
+	peeked, err := conn.peek(id)
+	if err == errNotFound {
+		r.metrics.peekMissing.add(1)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.metrics.peek.record(time.Since(t0))
+	r.metrics.peekChecked.add(1)
+	if bytes.Equal(peeked, body) {
+		return nil
+	}
+	r.metrics.peekMismatched.add(1)
+	if atomic.CompareAndSwapInt32(&mismatchWarned, 0, 1) {
+		slog.Warn("The peeked body differs from the reserved one, further mismatches are only counted",
+			"host", conn.host, "id", id, "reserved_bytes", len(body), "peeked_bytes", len(peeked), "differs_at", firstDifference(body, peeked))
+	}
+	return nil
+}
+
+// firstDifference is the offset of the first byte a and b differ in.
+func firstDifference(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
+
+// jsonParanoid is what -paranoid found in the JSON summary.
+type jsonParanoid struct {
+	Checked    int64 `json:"checked"`
+	Mismatched int64 `json:"mismatched"`
+	Missing    int64 `json:"missing"`
+}
+
+func (res *runResult) paranoid() *jsonParanoid {
+	if !*paranoid {
+		return nil
+	}
+	m := res.metrics
+	return &jsonParanoid{Checked: m.peekChecked.load(), Mismatched: m.peekMismatched.load(), Missing: m.peekMissing.load()}
+}
+
+func reportParanoid(res *runResult) {
+	if p := res.paranoid(); p != nil {
+		result("Peek before delete", "checked", p.Checked, "mismatched", p.Mismatched, "missing", p.Missing)
+	}
+}
@@ -0,0 +1,99 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// patternStep is how often a load pattern updates the offered rate.
+const patternStep = 100 * time.Millisecond
+
+// loadPattern is the parsed -pattern flag, with no kind without it.
+var loadPattern patternSpec
+
+// patternSpec modulates the offered rate over the time of a run.
+type patternSpec struct {
+	kind     string
+	min, max float64
+	period   time.Duration
+}
+
+// parsePattern parses <kind>:<name>=<value>,... The only kind is sine,
+// with the settings min and max (jobs/s) and period.
+func parsePattern(s string) (patternSpec, error) {
+	var p patternSpec
+	kind, settings, _ := strings.Cut(s, ":")
+	if kind != "sine" {
+		return p, fmt.Errorf("unknown pattern %q, want sine", kind)
+	}
+	p.kind = kind
+	for _, f := range strings.Split(settings, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return p, fmt.Errorf("pattern setting %q is not name=value", f)
+		}
+		var err error
+		switch k {
+		case "min":
+			p.min, err = strconv.ParseFloat(v, 64)
+		case "max":
+			p.max, err = strconv.ParseFloat(v, 64)
+		case "period":
+			p.period, err = time.ParseDuration(v)
+		default:
+			return p, fmt.Errorf("unknown pattern setting %q, want min, max or period", k)
+		}
+		if err != nil {
+			return p, fmt.Errorf("pattern setting %q: %v", f, err)
+		}
+	}
+	if p.min <= 0 || p.max < p.min || p.period <= 0 {
+		return p, fmt.Errorf("pattern %q needs 0 < min <= max and a positive period", s)
+	}
+	return p, nil
+}
+
+// rate is the offered rate at elapsed into the run. The sine starts at min
+// and peaks at max half a period in.
+func (p patternSpec) rate(elapsed time.Duration) float64 {
+	phase := 2 * math.Pi * float64(elapsed) / float64(p.period)
+	return p.min + (p.max-p.min)*(1-math.Cos(phase))/2
+}
+
+// startPattern sets the rate of pace from the pattern until the returned
+// function is called.
+func startPattern(pace *pacer, p patternSpec) (stop func()) {
+	done := make(chan struct{})
+	t0 := time.Now()
+	pace.setRate(p.rate(0))
+	go func() {
+		ticker := time.NewTicker(patternStep)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				pace.setRate(p.rate(time.Since(t0)))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,149 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// payloadFunc appends the body of the next job to buf and returns the
+// extended slice, so that publishers can reuse one buffer for many jobs. It
+// is called concurrently by the publishers.
+type payloadFunc func(buf []byte) []byte
+
+// payloadBuffers are the buffers of publishers that don't live longer than
+// a job, such as the goroutine per put of the prep client.
+var payloadBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// templateData is what a -payload template:<tmpl> is rendered with.
+type templateData struct {
+	Index     int64
+	Timestamp int64
+	Time      string
+}
+
+// newPayload parses the -payload flag:
+//
+//	zero             size bytes of zeroes
+//	random           size fresh random bytes for every job
+//	file:<path>      a random sample from a corpus; every file of a directory
+//	                 is one sample, every line of a single file is one sample
+//	template:<tmpl>  a text/template rendered with .Index, .Timestamp and .Time
+func newPayload(spec string, size int) (payloadFunc, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "zero":
+		data := make([]byte, size)
+		return func(buf []byte) []byte { return append(buf, data...) }, nil
+
+	case "random":
+		var index uint64
+		return func(buf []byte) []byte {
+			src := seededSource(streamPayload, atomic.AddUint64(&index, 1))
+			for n := size; n > 0; n -= 8 {
+				var b [8]byte
+				binary.LittleEndian.PutUint64(b[:], src.Uint64())
+				buf = append(buf, b[:min(n, 8)]...)
+			}
+			return buf
+		}, nil
+
+	case "file":
+		samples, err := loadCorpus(arg)
+		if err != nil {
+			return nil, err
+		}
+		var index uint64
+		return func(buf []byte) []byte {
+			src := seededSource(streamCorpus, atomic.AddUint64(&index, 1))
+			return append(buf, samples[src.Uint64()%uint64(len(samples))]...)
+		}, nil
+
+	case "template":
+		tmpl, err := template.New("payload").Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		var index int64
+		return func(buf []byte) []byte {
+			now := time.Now()
+			w := bytes.NewBuffer(buf)
+			tmpl.Execute(w, templateData{
+				Index:     atomic.AddInt64(&index, 1) - 1,
+				Timestamp: now.UnixNano(),
+				Time:      now.Format(time.RFC3339Nano),
+			})
+			return w.Bytes()
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown payload %q, expected random, zero, file:<path> or template:<tmpl>", spec)
+}
+
+func loadCorpus(path string) ([][]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples [][]byte
+	if info.IsDir() {
+		err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			data, err := ioutil.ReadFile(p)
+			if err == nil && len(data) > 0 {
+				samples = append(samples, data)
+			}
+			return err
+		})
+	} else {
+		var f *os.File
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 64*1024*1024)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) > 0 {
+				samples = append(samples, append([]byte(nil), scanner.Bytes()...))
+			}
+		}
+		err = scanner.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("corpus %s has no samples", path)
+	}
+	return samples, nil
+}
@@ -0,0 +1,46 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import "time"
+
+// elapsed returns how long the run took, until the later of the end of the
+// publish and of the read phase.
+func (res *runResult) elapsed() time.Duration {
+	return max(res.publishTime, res.readStart+res.readTime)
+}
+
+// overlap returns how long the publish and read phases ran at once.
+func (res *runResult) overlap() time.Duration {
+	if res.publishTime == 0 || res.readTime == 0 {
+		return 0
+	}
+	end := min(res.publishTime, res.readStart+res.readTime)
+	return max(end-res.readStart, 0)
+}
+
+// reportPhases logs when the publish and read phases ran, after the start
+// of the run, and how long they overlapped. The rates of a phase are taken
+// over its own time, so a read phase that waited for the publishers is
+// not slowed down by it; the overlap tells whether the readers kept up
+// with the publishers or worked off what they left.
+func reportPhases(res *runResult) {
+	if res.publishers == 0 || res.readers == 0 || res.readTime == 0 {
+		return
+	}
+	args := []any{"publish", res.publishTime, "read_start", res.readStart, "read", res.readTime, "overlap", res.overlap()}
+	args = append(args, "overlap_share", float64(res.overlap())/float64(res.readTime))
+	result("Phases", args...)
+}
@@ -0,0 +1,170 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxPriorities is the most priorities the readers keep apart; the jobs of
+// any more are counted together.
+const maxPriorities = 64
+
+// priorityWait is how long a native reader waits for the priority of a job
+// it reserved, which may beat the response to its put to the publisher.
+const priorityWait = 10 * time.Millisecond
+
+// priorityStat is what the readers saw of the jobs of a priority.
+type priorityStat struct {
+	Priority uint32 `json:"priority"`
+	// Other is set on the jobs of the priorities beyond maxPriorities.
+	Other    bool    `json:"other,omitempty"`
+	Jobs     int64   `json:"jobs"`
+	SharePct float64 `json:"share_pct"`
+	// Reserve is of the native client, the prep client does not time its
+	// reserves.
+	Reserve *jsonLatency `json:"reserve,omitempty"`
+}
+
+// priorityJobs are the jobs of a priority the readers reserved and the
+// latency of the reserves.
+type priorityJobs struct {
+	jobs    counter
+	reserve *histogram
+}
+
+// priorityStats records the priority of every job the readers reserve,
+// with the latency of its reserve where it is known. The prep client gets
+// the priority with the job. The native client does not, so when the jobs
+// have priorities other than 0, with -script, -replay or -pri-range, its
+// publishers leave the priority of every job behind by id; otherwise all
+// are 0.
+type priorityStats struct {
+	// track is set when the native publishers leave the priorities behind.
+	track bool
+
+	mu      sync.Mutex
+	byPri   map[uint32]*priorityJobs
+	other   *priorityJobs
+	pending sync.Map // auditKey to uint32
+}
+
+func newPriorityStats() *priorityStats {
+	return &priorityStats{byPri: make(map[uint32]*priorityJobs)}
+}
+
+// put leaves the priority of the job id on host behind for a native reader.
+// The native readers release and bury a job with the priority they took,
+// and put it back as that.
+func (s *priorityStats) put(host string, id uint64, pri uint32) {
+	if s.track {
+		s.pending.Store(auditKey{host, id}, pri)
+	}
+}
+
+// take returns the priority of the job id on host a native reader
+// reserved, 0 if it is not left behind within priorityWait.
+func (s *priorityStats) take(host string, id uint64) uint32 {
+	if !s.track {
+		return 0
+	}
+	deadline := time.Now().Add(priorityWait)
+	for {
+		if pri, ok := s.pending.LoadAndDelete(auditKey{host, id}); ok {
+			return pri.(uint32)
+		}
+		if time.Now().After(deadline) {
+			return 0
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+// record counts a job of priority pri reserved in latency, which is
+// negative when it is not known.
+func (s *priorityStats) record(pri uint32, latency time.Duration) {
+	s.mu.Lock()
+	p, ok := s.byPri[pri]
+	if !ok {
+		if len(s.byPri) < maxPriorities {
+			p = &priorityJobs{reserve: newHistogram()}
+			s.byPri[pri] = p
+		} else {
+			if s.other == nil {
+				s.other = &priorityJobs{reserve: newHistogram()}
+			}
+			p = s.other
+		}
+	}
+	s.mu.Unlock()
+	p.jobs.add(1)
+	if latency >= 0 {
+		p.reserve.record(latency)
+	}
+}
+
+// report logs the share of the jobs and the reserve latencies of every
+// priority, when the readers saw more than one, and returns them.
+func (s *priorityStats) report() []priorityStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.byPri) < 2 {
+		return nil
+	}
+	var stats []priorityStat
+	var snaps []*histogram
+	var total int64
+	add := func(pri uint32, other bool, p *priorityJobs) {
+		st := priorityStat{Priority: pri, Other: other, Jobs: p.jobs.load()}
+		snap := p.reserve.snapshot()
+		if snap.total > 0 {
+			l := newJSONLatency(snap)
+			st.Reserve = &l
+		}
+		stats = append(stats, st)
+		snaps = append(snaps, snap)
+		total += st.Jobs
+	}
+	pris := make([]uint32, 0, len(s.byPri))
+	for pri := range s.byPri {
+		pris = append(pris, pri)
+	}
+	sort.Slice(pris, func(i, j int) bool { return pris[i] < pris[j] })
+	for _, pri := range pris {
+		add(pri, false, s.byPri[pri])
+	}
+	if s.other != nil {
+		add(0, true, s.other)
+	}
+	for i := range stats {
+		st := &stats[i]
+		st.SharePct = math.Round(1000*float64(st.Jobs)/float64(total)) / 10
+		var args []any
+		if st.Other {
+			args = []any{"priority", "other"}
+		} else {
+			args = []any{"priority", st.Priority}
+		}
+		args = append(args, "jobs", st.Jobs, "share_pct", st.SharePct)
+		if st.Reserve != nil {
+			args = append(args, "reserve_p50", snaps[i].quantile(0.5), "reserve_p99", snaps[i].quantile(0.99))
+		}
+		result("Priority", args...)
+	}
+	return stats
+}
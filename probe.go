@@ -0,0 +1,342 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var probeRate = flag.Float64("probe-rate", 1, "Canary jobs the probe command sends to every server per second")
+var probeTube = flag.String("probe-tube", "bench-probe", "Tube of the canary jobs of the probe command, which nothing else should use")
+var probeTimeout = flag.Duration("probe-timeout", 5*time.Second, "How long the probe command waits for a canary to be reserved before it counts it as lost")
+var probeFor = flag.Duration("probe-for", 0, "How long the probe command runs, 0 until interrupted")
+
+var (
+	errProbeLost    = errors.New("not reserved within -probe-timeout")
+	errProbeCorrupt = errors.New("reserved with another body than it was put with")
+)
+
+// probeResult is what became of one canary: how long its put, the way
+// from the put to its reserve, and its delete took, or why it failed.
+type probeResult struct {
+	host          string
+	put, e2e, del time.Duration
+	// stale are the canaries of earlier probes deleted on the way, lost
+	// ones that turned up later.
+	stale int64
+	err   error
+}
+
+// prober sends the canaries of one server one at a time, each put,
+// reserved and deleted before the next, over a connection it dials again
+// after any error but a lost or corrupt canary.
+type prober struct {
+	host  string
+	token string
+	seq   uint64
+	conn  *nativeConn
+}
+
+func (p *prober) probe() probeResult {
+	res := probeResult{host: p.host}
+	if p.conn == nil {
+		conn, err := dialNative(p.host)
+		if err == nil {
+			if err = conn.use(*probeTube); err == nil {
+				err = conn.watch(*probeTube)
+			}
+			if err == nil && *probeTube != "default" {
+				err = conn.ignore("default")
+			}
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			res.err = err
+			return res
+		}
+		p.conn = conn
+	}
+	res.err = p.send(&res)
+	if res.err != nil && !errors.Is(res.err, errProbeLost) && !errors.Is(res.err, errProbeCorrupt) {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return res
+}
+
+// send puts a canary and reserves it back, deleting the canaries of
+// earlier probes it reserves first.
+func (p *prober) send(res *probeResult) error {
+	p.seq++
+	body := []byte(p.token + strconv.FormatUint(p.seq, 10))
+	t0 := time.Now()
+	id, err := p.conn.put(0, 0, *probeTimeout, body)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	res.put = time.Since(t0)
+	deadline := t0.Add(*probeTimeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			p.conn.delete(id)
+			return errProbeLost
+		}
+		got, b, err := p.conn.reserve(left)
+		if errors.Is(err, errTimedOut) {
+			p.conn.delete(id)
+			return errProbeLost
+		}
+		if err != nil {
+			return fmt.Errorf("reserve: %w", err)
+		}
+		if got != id {
+			if err := p.conn.delete(got); err != nil {
+				return fmt.Errorf("delete: %w", err)
+			}
+			res.stale++
+			continue
+		}
+		res.e2e = time.Since(t0)
+		t1 := time.Now()
+		if err := p.conn.delete(id); err != nil {
+			return fmt.Errorf("delete: %w", err)
+		}
+		res.del = time.Since(t1)
+		if !bytes.Equal(b, body) {
+			return errProbeCorrupt
+		}
+		return nil
+	}
+}
+
+// probeSample sums up the canaries of one server over a -sample-interval.
+type probeSample struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Sent    int64     `json:"sent"`
+	OK      int64     `json:"ok"`
+	Failed  int64     `json:"failed"`
+	Stale   int64     `json:"stale"`
+	Success float64   `json:"success"`
+	// EndToEnd is the way of the canaries from their put to their reserve.
+	Put      jsonLatency `json:"put"`
+	EndToEnd jsonLatency `json:"end_to_end"`
+	Delete   jsonLatency `json:"delete"`
+}
+
+// probeWindow collects the canaries of one server until the next sample.
+type probeWindow struct {
+	sent, failed, stale int64
+	put, e2e, del       *histogram
+}
+
+func newProbeWindow() *probeWindow {
+	return &probeWindow{put: newHistogram(), e2e: newHistogram(), del: newHistogram()}
+}
+
+func (w *probeWindow) add(res probeResult) {
+	w.sent++
+	w.stale += res.stale
+	if res.err != nil {
+		w.failed++
+		return
+	}
+	w.put.record(res.put)
+	w.e2e.record(res.e2e)
+	w.del.record(res.del)
+}
+
+func (w *probeWindow) sample(now time.Time, host string) probeSample {
+	return probeSample{
+		Time:     now,
+		Host:     host,
+		Sent:     w.sent,
+		OK:       w.sent - w.failed,
+		Failed:   w.failed,
+		Stale:    w.stale,
+		Success:  float64(w.sent-w.failed) / float64(w.sent),
+		Put:      newJSONLatency(w.put.snapshot()),
+		EndToEnd: newJSONLatency(w.e2e.snapshot()),
+		Delete:   newJSONLatency(w.del.snapshot()),
+	}
+}
+
+// probeHosts sends -probe-rate canaries a second to every host until ctx is
+// done, and passes the canaries of every host to emit each interval. A
+// canary that takes longer than the time between two holds up the next,
+// so a server that loses them is probed every -probe-timeout. It returns
+// the canaries of the whole run, by host.
+func probeHosts(ctx context.Context, hosts []string, interval time.Duration, emit func(probeSample)) map[string]*probeWindow {
+	results := make(chan probeResult)
+	token := fmt.Sprintf("probe-%d-%d-", os.Getpid(), time.Now().UnixNano())
+	wg := sync.WaitGroup{}
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(p *prober) {
+			defer wg.Done()
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *probeRate))
+			defer ticker.Stop()
+			for {
+				res := p.probe()
+				if res.err != nil {
+					slog.Warn("Canary failed", "host", p.host, "err", res.err)
+				}
+				results <- res
+				select {
+				case <-ctx.Done():
+					if p.conn != nil {
+						p.conn.Close()
+					}
+					return
+				case <-ticker.C:
+				}
+			}
+		}(&prober{host: h, token: token})
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	windows := make(map[string]*probeWindow)
+	totals := make(map[string]*probeWindow)
+	for _, h := range hosts {
+		windows[h], totals[h] = newProbeWindow(), newProbeWindow()
+	}
+	flush := func() {
+		now := time.Now()
+		for _, h := range hosts {
+			if windows[h].sent > 0 {
+				emit(windows[h].sample(now, h))
+				windows[h] = newProbeWindow()
+			}
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				flush()
+				return totals
+			}
+			windows[res.host].add(res)
+			totals[res.host].add(res)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func runProbe(hosts []string) {
+	if *output != "text" && *output != "json" {
+		fatal("Unknown output format", "output", *output)
+	}
+	if *probeRate <= 0 {
+		fatal("-probe-rate must be positive", "probe-rate", *probeRate)
+	}
+	if *probeTimeout < time.Second {
+		fatal("-probe-timeout must be at least a second, the resolution of reserve-with-timeout", "probe-timeout", *probeTimeout)
+	}
+	if *streamAddr != "" {
+		var err error
+		if stream, err = startStream(*streamAddr); err != nil {
+			fatal("Cannot start the event stream", "addr", *streamAddr, "err", err)
+		}
+	}
+	var w *csv.Writer
+	if *csvPath != "" {
+		f, err := os.Create(*csvPath)
+		if err != nil {
+			fatal("Cannot write CSV", "path", *csvPath, "err", err)
+		}
+		defer f.Close()
+		w = csv.NewWriter(f)
+		w.Write([]string{"time", "host", "sent", "ok", "failed", "stale", "success", "put_p99_us", "e2e_p50_us", "e2e_p99_us", "delete_p99_us"})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	us := func(l jsonLatency, q float64) string {
+		return strconv.FormatFloat(l.US[quantileName(q)], 'f', 0, 64)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *probeFor > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *probeFor)
+		defer cancel()
+	}
+	slog.Info("Probing", "targets", len(hosts), "tube", *probeTube, "rate", *probeRate, "timeout", *probeTimeout, "interval", *sampleInterval)
+	totals := probeHosts(ctx, hosts, *sampleInterval, func(s probeSample) {
+		stream.publish("probe", s)
+		if *output == "json" {
+			enc.Encode(s)
+		} else {
+			d := func(l jsonLatency, q float64) time.Duration {
+				return time.Duration(l.US[quantileName(q)]) * time.Microsecond
+			}
+			result("Probe", "host", s.Host, "sent", s.Sent, "ok", s.OK, "failed", s.Failed, "stale", s.Stale,
+				"success", fmt.Sprintf("%.3f", s.Success), "put_p99", d(s.Put, 0.99),
+				"e2e_p50", d(s.EndToEnd, 0.5), "e2e_p99", d(s.EndToEnd, 0.99), "delete_p99", d(s.Delete, 0.99))
+		}
+		if w != nil {
+			w.Write([]string{
+				s.Time.Format(time.RFC3339Nano), s.Host,
+				strconv.FormatInt(s.Sent, 10), strconv.FormatInt(s.OK, 10),
+				strconv.FormatInt(s.Failed, 10), strconv.FormatInt(s.Stale, 10),
+				strconv.FormatFloat(s.Success, 'f', 3, 64),
+				us(s.Put, 0.99), us(s.EndToEnd, 0.5), us(s.EndToEnd, 0.99), us(s.Delete, 0.99),
+			})
+			w.Flush()
+		}
+	})
+	if w != nil {
+		if err := w.Error(); err != nil {
+			fatal("Cannot write CSV", "path", *csvPath, "err", err)
+		}
+		slog.Info("Wrote CSV", "path", *csvPath)
+	}
+
+	failed := false
+	for _, h := range hosts {
+		t := totals[h]
+		if t.sent == 0 {
+			continue
+		}
+		result("Probe total", append([]any{"host", h, "sent", t.sent, "failed", t.failed, "stale", t.stale,
+			"success", fmt.Sprintf("%.3f", float64(t.sent-t.failed)/float64(t.sent)), "op", "end_to_end"}, latencyArgs(t.e2e.snapshot())...)...)
+		failed = failed || t.failed > 0
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,355 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A process forked by -procs learns which one it is from procEnv and the
+// run id of its parent from procRunEnv, so that all of them mark and name
+// their jobs alike. It writes to the parent on fd 3 and waits on fd 4 for
+// the start.
+const (
+	procEnv    = "BEANSTALKD_BENCHMARK_PROC"
+	procRunEnv = "BEANSTALKD_BENCHMARK_RUN_ID"
+)
+
+// procUnsupported are the flags -procs cannot split across processes,
+// because they steer a single run or a single process.
+var procUnsupported = []string{
+	"runs", "sweep", "scenario", "replay", "soak", "control-addr", "stream-addr", "autotune",
+	"verify-order", "pattern", "burst", "reserve-by-id", "visibility-rate",
+	"audit", "failover", "consumer-schedule", "events",
+}
+
+// parent is the link of a process forked by -procs to the one that forked
+// it, nil in any other process.
+var parent *procLink
+
+type procLink struct {
+	results *os.File
+	start   *os.File
+}
+
+// joinParent links a process forked by -procs to its parent and has its
+// log lines name it.
+func joinParent() {
+	proc := os.Getenv(procEnv)
+	if proc == "" {
+		return
+	}
+	slog.SetDefault(slog.Default().With("proc", proc))
+	parent = &procLink{results: os.NewFile(3, "results"), start: os.NewFile(4, "start")}
+}
+
+// waitStart tells the parent the process is ready to measure and waits
+// until all of them are.
+func (p *procLink) waitStart() {
+	if p == nil {
+		return
+	}
+	if _, err := io.WriteString(p.results, "ready\n"); err != nil {
+		fatal("Cannot reach the parent process", "err", err)
+	}
+	// The parent closes the pipe to start them all at once.
+	io.Copy(io.Discard, p.start)
+}
+
+// report hands what the run measured to the parent.
+func (p *procLink) report(res *runResult) {
+	if err := json.NewEncoder(p.results).Encode(newProcResult(res)); err != nil {
+		fatal("Cannot report to the parent process", "err", err)
+	}
+	p.results.Close()
+}
+
+// procResult is what a forked process measured, as it reports it to the
+// parent.
+type procResult struct {
+	Produced    int                      `json:"produced"`
+	Consumed    int                      `json:"consumed"`
+	PublishTime time.Duration            `json:"publish_time"`
+	ReadStart   time.Duration            `json:"read_start"`
+	ReadTime    time.Duration            `json:"read_time"`
+	Truncated   bool                     `json:"truncated"`
+	ClientCPU   float64                  `json:"client_cpu"`
+	Counters    map[string]int64         `json:"counters"`
+	Latencies   map[string]procHistogram `json:"latencies"`
+}
+
+// procHistogram is a histogram snapshot with only the buckets that counted
+// anything.
+type procHistogram struct {
+	Counts map[int]int64 `json:"counts"`
+	Ops    int64         `json:"ops"`
+	Total  int64         `json:"total"`
+	Sum    int64         `json:"sum"`
+	Min    int64         `json:"min"`
+	Max    int64         `json:"max"`
+}
+
+func newProcResult(res *runResult) procResult {
+	p := procResult{
+		Produced:    res.produced,
+		Consumed:    res.consumed,
+		PublishTime: res.publishTime,
+		ReadStart:   res.readStart,
+		ReadTime:    res.readTime,
+		Truncated:   res.truncated,
+		ClientCPU:   res.clientCPU,
+		Counters:    make(map[string]int64),
+		Latencies:   make(map[string]procHistogram),
+	}
+	for name, c := range res.metrics.counters() {
+		p.Counters[name] = c.load()
+	}
+	for _, op := range res.metrics.operations() {
+		if op.hist.ops == 0 {
+			continue
+		}
+		h := procHistogram{Counts: make(map[int]int64), Ops: op.hist.ops, Total: op.hist.total, Sum: op.hist.sum, Min: op.hist.min, Max: op.hist.max}
+		for i, n := range op.hist.counts {
+			if n > 0 {
+				h.Counts[i] = n
+			}
+		}
+		p.Latencies[op.name] = h
+	}
+	return p
+}
+
+// mergeInto adds the values of p to the snapshot h.
+func (p procHistogram) mergeInto(h *histogram) {
+	for i, n := range p.Counts {
+		h.counts[i] += n
+	}
+	h.ops += p.Ops
+	h.total += p.Total
+	h.sum += p.Sum
+	if p.Min < h.min {
+		h.min = p.Min
+	}
+	if p.Max > h.max {
+		h.max = p.Max
+	}
+}
+
+// checkProcs checks that the benchmark can be split across -procs
+// processes.
+func checkProcs() {
+	for _, name := range procUnsupported {
+		if f := flag.Lookup(name); f.Value.String() != f.DefValue {
+			fatal("-procs cannot be combined with -" + name)
+		}
+	}
+	if *publishers > 0 && *publishers < *procs || *readers > 0 && *readers < *procs {
+		fatal("-procs needs at least as many publishers and readers as processes, unless there are none", "procs", *procs, "publishers", *publishers, "readers", *readers)
+	}
+}
+
+type procChild struct {
+	cmd     *exec.Cmd
+	results *bufio.Reader
+	start   *os.File
+}
+
+// forkProcs runs the benchmark in -procs processes of this executable,
+// each with its share of the publishers, readers, jobs and rates, starts
+// them measuring at once and merges what they measured.
+func forkProcs(hosts []string) *runResult {
+	exe, err := os.Executable()
+	if err != nil {
+		fatal("Cannot find the executable to fork", "err", err)
+	}
+	nextRunTubes(*publishers)
+	defer cleanupRun(hosts)
+	slog.Info("Target host", "host", *host, "targets", strings.Join(hosts, ","))
+	slog.Info("Forking processes", "procs", *procs, "publishers", *publishers, "readers", *readers)
+	before := snapshotStats(hosts)
+
+	children := make([]*procChild, *procs)
+	for i := range children {
+		children[i] = forkProc(exe, i)
+	}
+	abort := func(i int, err error) {
+		for _, c := range children {
+			c.cmd.Process.Kill()
+		}
+		fatal("Process failed", "proc", i, "err", err)
+	}
+	for i, c := range children {
+		if _, err := c.results.ReadString('\n'); err != nil {
+			abort(i, c.cmd.Wait())
+		}
+	}
+	slog.Info("Benchmarking, be patient ...")
+	started := time.Now()
+	for _, c := range children {
+		c.start.Close()
+	}
+	results := make([]procResult, len(children))
+	for i, c := range children {
+		if err := json.NewDecoder(c.results).Decode(&results[i]); err != nil {
+			abort(i, fmt.Errorf("%v, %v", err, c.cmd.Wait()))
+		}
+		if err := c.cmd.Wait(); err != nil {
+			abort(i, err)
+		}
+	}
+
+	res := mergeProcs(started, results)
+	res.meta = collectMetadata(before)
+	after := snapshotStats(hosts)
+	reportStatsDelta(before, after)
+	reportBinlog(before, after)
+	return res
+}
+
+// forkProc starts process i of -procs.
+func forkProc(exe string, i int) *procChild {
+	n := *procs
+	share := func(total int) int {
+		s := total / n
+		if i < total%n {
+			s++
+		}
+		return s
+	}
+	produce := *produceCount
+	if produce <= 0 {
+		produce = *count
+	}
+	// Later flags win, so the shares override what the parent was given.
+	args := append(append([]string(nil), os.Args[1:]...),
+		"-procs=1", "-selftest=false", "-h="+*host, "-d=false", "-yes", "-cleanup=false",
+		"-o=text", "-csv=", "-report=", "-junit=", "-assert=", "-out-dir=", "-log-file=",
+		"-hdr-log=", "-hdr-histograms=",
+		fmt.Sprintf("-seed=%d", *seed+int64(i)+1),
+		fmt.Sprintf("-p=%d", share(*publishers)),
+		fmt.Sprintf("-r=%d", share(*readers)),
+		fmt.Sprintf("-n=%d", share(produce)), "-produce-count=0",
+		fmt.Sprintf("-f=%d", share(*fill)),
+		fmt.Sprintf("-rate=%g", *offeredRate/float64(n)),
+	)
+	// The readers of a process may read the jobs of another, so by default
+	// they read until the tubes are empty rather than their share.
+	if *consumeUntil == untilCount && *consumeCount <= 0 {
+		args = append(args, "-consume-until="+untilEmpty)
+	} else {
+		args = append(args, fmt.Sprintf("-consume-count=%d", share(*consumeCount)))
+	}
+	if totalBytes > 0 {
+		args = append(args, fmt.Sprintf("-total-bytes=%d", totalBytes/int64(n)))
+	}
+	if connectRate > 0 {
+		args = append(args, fmt.Sprintf("-connect-ramp=%g/s", connectRate/float64(n)))
+	}
+
+	resultsR, resultsW, err := os.Pipe()
+	if err != nil {
+		fatal("Cannot fork", "err", err)
+	}
+	startR, startW, err := os.Pipe()
+	if err != nil {
+		fatal("Cannot fork", "err", err)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", procEnv, i), procRunEnv+"="+runID)
+	// The output of the parent is the merged one.
+	cmd.Stdout = logOutput
+	cmd.Stderr = logOutput
+	cmd.ExtraFiles = []*os.File{resultsW, startR}
+	if err := cmd.Start(); err != nil {
+		fatal("Cannot fork", "proc", i, "err", err)
+	}
+	resultsW.Close()
+	startR.Close()
+	return &procChild{cmd: cmd, results: bufio.NewReader(resultsR), start: startW}
+}
+
+// mergeProcs adds up what the processes of -procs measured into one run
+// that started at started. The publishers and readers took as long as the
+// slowest process.
+func mergeProcs(started time.Time, results []procResult) *runResult {
+	m := newMetrics()
+	m.start = started
+	m.series = &series{}
+	hists := make(map[string]*histogram)
+	for _, op := range m.histograms() {
+		op.hist.cells = nil
+		hists[op.name] = op.hist
+	}
+	counters := m.counters()
+	res := &runResult{started: started, publishers: *publishers, readers: *readers, metrics: m}
+	// The read phase runs from the first process that read a job until
+	// the last was done.
+	var readEnd time.Duration
+	res.readStart = -1
+	for _, p := range results {
+		res.produced += p.Produced
+		res.consumed += p.Consumed
+		if p.PublishTime > res.publishTime {
+			res.publishTime = p.PublishTime
+		}
+		if p.ReadTime > 0 && (res.readStart < 0 || p.ReadStart < res.readStart) {
+			res.readStart = p.ReadStart
+		}
+		if p.ReadStart+p.ReadTime > readEnd {
+			readEnd = p.ReadStart + p.ReadTime
+		}
+		res.truncated = res.truncated || p.Truncated
+		res.clientCPU += p.ClientCPU
+		for name, n := range p.Counters {
+			counters[name].add(n)
+		}
+		for name, h := range p.Latencies {
+			h.mergeInto(hists[name])
+		}
+	}
+	if res.readStart < 0 {
+		res.readStart = 0
+	}
+	res.readTime = readEnd - res.readStart
+
+	if res.publishers > 0 {
+		result("Publishers finished", "procs", len(results), "produced", res.produced, "elapsed", res.publishTime, "req_per_sec", rate(res.produced, res.publishTime))
+	}
+	if res.readers > 0 {
+		result("Readers finished", "procs", len(results), "consumed", res.consumed, "elapsed", res.readTime, "req_per_sec", rate(res.consumed, res.readTime))
+	}
+	reportPhases(res)
+	if res.truncated {
+		result("Truncated", "max_duration", *maxDuration, "produced", res.produced, "consumed", res.consumed)
+	}
+	m.reportLatencies()
+	if n := m.timeouts.load(); n > 0 {
+		result("Timeouts", "timeouts", n, "op_timeout", *opTimeout)
+	}
+	reportCompression(res)
+	reportBandwidth(res)
+	reportParanoid(res)
+	reportStop(res)
+	return res
+}
@@ -0,0 +1,162 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// The phases of a put of the native client: dialing its connection, when
+// it was dialed during the run, writing the batch of the put, and waiting
+// for the answer of the server, the round trip included.
+const (
+	phaseDial = iota
+	phaseWrite
+	phaseServer
+	putPhases
+)
+
+var putPhaseNames = [putPhases]string{"dial", "write", "server"}
+
+// budgetBuckets is the number of buckets the put budget sorts the puts
+// into, by the power of two of their latency in microseconds.
+const budgetBuckets = 40
+
+// budgetTail is the share of the slowest puts whose phases are told apart
+// from those of all the puts.
+const budgetTail = 0.01
+
+// budgetBucket sums up the phases of the puts of a bucket.
+type budgetBucket struct {
+	puts int64
+	sums [putPhases]int64
+}
+
+// putPhaseStat is the latency of a phase of the puts and its share of the
+// time of all of them and of the slowest.
+type putPhaseStat struct {
+	Phase     string      `json:"phase"`
+	Latency   jsonLatency `json:"latency"`
+	Share     float64     `json:"share"`
+	TailShare float64     `json:"tail_share"`
+}
+
+// putBudget splits the time of every put of the native client into its
+// phases, so that a slow tail can be put down to connections dialed again
+// or to the server. Besides a histogram of every phase it sums the phases
+// up by the latency of the puts, to tell what the slowest ones spent
+// their time on.
+type putBudget struct {
+	phases  [putPhases]*histogram
+	buckets [budgetBuckets]budgetBucket
+}
+
+func newPutBudget() *putBudget {
+	b := &putBudget{}
+	for i := range b.phases {
+		b.phases[i] = newHistogram()
+	}
+	return b
+}
+
+// record records a put that waited dial for its connection, took write to
+// send with its batch and latency from the start of the batch until its
+// answer.
+func (b *putBudget) record(dial, write, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	parts := [putPhases]time.Duration{dial, write, latency - write}
+	if dial > 0 {
+		b.phases[phaseDial].record(dial)
+	}
+	b.phases[phaseWrite].record(write)
+	b.phases[phaseServer].record(latency - write)
+	i := bits.Len64(uint64((dial + latency) / time.Microsecond))
+	if i >= budgetBuckets {
+		i = budgetBuckets - 1
+	}
+	bucket := &b.buckets[i]
+	atomic.AddInt64(&bucket.puts, 1)
+	for p, d := range parts {
+		atomic.AddInt64(&bucket.sums[p], int64(d))
+	}
+}
+
+// report logs the latency of every phase with its share of the time of all
+// the puts and of the slowest, from the bucket the slowest budgetTail of
+// them starts in, and returns them.
+func (b *putBudget) report() []putPhaseStat {
+	if b == nil {
+		return nil
+	}
+	var puts int64
+	for i := range b.buckets {
+		puts += atomic.LoadInt64(&b.buckets[i].puts)
+	}
+	if puts == 0 {
+		return nil
+	}
+	// The tail starts at the bucket that takes it past budgetTail of the
+	// puts, so it holds at least that many of them.
+	var all, tail [putPhases]int64
+	var tailPuts int64
+	from := 0
+	for i := budgetBuckets - 1; i >= 0; i-- {
+		n := atomic.LoadInt64(&b.buckets[i].puts)
+		if n == 0 {
+			continue
+		}
+		if float64(tailPuts) < budgetTail*float64(puts) {
+			tailPuts += n
+			from = i
+			for p := range tail {
+				tail[p] += atomic.LoadInt64(&b.buckets[i].sums[p])
+			}
+		}
+		for p := range all {
+			all[p] += atomic.LoadInt64(&b.buckets[i].sums[p])
+		}
+	}
+	share := func(sums [putPhases]int64, p int) float64 {
+		var total int64
+		for _, s := range sums {
+			total += s
+		}
+		if total == 0 {
+			return 0
+		}
+		return float64(sums[p]) / float64(total)
+	}
+
+	var tailFrom time.Duration
+	if from > 0 {
+		tailFrom = time.Duration(1<<(from-1)) * time.Microsecond
+	}
+	result("Put latency tail", "puts", tailPuts, "from", tailFrom)
+	var stats []putPhaseStat
+	for p, name := range putPhaseNames {
+		snap := b.phases[p].snapshot()
+		if snap.total == 0 {
+			continue
+		}
+		stat := putPhaseStat{Phase: name, Latency: newJSONLatency(snap), Share: share(all, p), TailShare: share(tail, p)}
+		result("Put latency budget", append([]any{"phase", name, "share", stat.Share, "tail_share", stat.TailShare}, latencyArgs(snap)...)...)
+		stats = append(stats, stat)
+	}
+	return stats
+}
@@ -0,0 +1,136 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var priRange = flag.String("pri-range", "", "Draw the priority of every job from this range, such as 0:1024, rather than putting all at 0")
+var delayRange = flag.String("delay-range", "", "Draw the delay of every job from this range in whole seconds, such as 0:5s, rather than putting all without")
+var ttrRange = flag.String("ttr-range", "", "Draw the TTR of every job from this range in whole seconds, such as 30s:5m, rather than putting all with 120s")
+
+// putRanges are the ranges of -pri-range, -delay-range and -ttr-range the
+// parameters of every put are drawn from, so that the jobs are spread over
+// the heaps of the server rather than all in one place of it. Every job
+// draws from its own place in the stream of -seed, so a run draws the same
+// parameters again whatever the scheduling.
+type putRanges struct {
+	pri          bool
+	priLo, priHi uint32
+	// The delays and TTRs are in whole seconds, the resolution of the
+	// protocol.
+	delay            bool
+	delayLo, delayHi int64
+	ttr              bool
+	ttrLo, ttrHi     int64
+}
+
+// jobRanges are the ranges of the puts, nil without any.
+var jobRanges *putRanges
+
+// parsePutRanges parses the ranges of the flags, nil if none is set.
+func parsePutRanges(pri, delay, ttr string) (*putRanges, error) {
+	if pri == "" && delay == "" && ttr == "" {
+		return nil, nil
+	}
+	r := &putRanges{}
+	if pri != "" {
+		lo, hi, ok := strings.Cut(pri, ":")
+		l, err1 := strconv.ParseUint(strings.TrimSpace(lo), 10, 32)
+		h, err2 := strconv.ParseUint(strings.TrimSpace(hi), 10, 32)
+		if !ok || err1 != nil || err2 != nil || l > h {
+			return nil, fmt.Errorf("-pri-range %q is not lo:hi with 0 <= lo <= hi < 2^32", pri)
+		}
+		r.pri, r.priLo, r.priHi = true, uint32(l), uint32(h)
+	}
+	var err error
+	if delay != "" {
+		if r.delayLo, r.delayHi, err = parseSecondsRange(delay, 0); err != nil {
+			return nil, fmt.Errorf("-delay-range: %v", err)
+		}
+		r.delay = true
+	}
+	if ttr != "" {
+		// The server takes a TTR of 0 for 1.
+		if r.ttrLo, r.ttrHi, err = parseSecondsRange(ttr, 1); err != nil {
+			return nil, fmt.Errorf("-ttr-range: %v", err)
+		}
+		r.ttr = true
+	}
+	return r, nil
+}
+
+// parseSecondsRange parses a range of durations, lo:hi, into whole
+// seconds, the lower end rounded up and the upper down, of at least min.
+func parseSecondsRange(s string, min int64) (int64, int64, error) {
+	lo, hi, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not lo:hi", s)
+	}
+	l, err := time.ParseDuration(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, err
+	}
+	h, err := time.ParseDuration(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, err
+	}
+	ls, hs := seconds(l), int64(h/time.Second)
+	if ls < min {
+		ls = min
+	}
+	if hs < ls {
+		return 0, 0, fmt.Errorf("%q holds no whole second of at least %ds", s, min)
+	}
+	return ls, hs, nil
+}
+
+// draw sets the parameters of the put of job seq of publisher p that have
+// a range.
+func (r *putRanges) draw(job *putJob, p, seq int) {
+	if r == nil {
+		return
+	}
+	src := seededSource(streamPutParams, uint64(p)<<40|uint64(seq))
+	if r.pri {
+		job.pri = r.priLo + uint32(src.Uint64()%(uint64(r.priHi-r.priLo)+1))
+	}
+	if r.delay {
+		job.delay = time.Duration(r.delayLo+int64(src.Uint64()%uint64(r.delayHi-r.delayLo+1))) * time.Second
+	}
+	if r.ttr {
+		job.ttr = time.Duration(r.ttrLo+int64(src.Uint64()%uint64(r.ttrHi-r.ttrLo+1))) * time.Second
+	}
+}
+
+// String sums up the ranges for the log.
+func (r *putRanges) String() string {
+	var parts []string
+	if r.pri {
+		parts = append(parts, fmt.Sprintf("pri %d-%d", r.priLo, r.priHi))
+	}
+	if r.delay {
+		parts = append(parts, fmt.Sprintf("delay %ds-%ds", r.delayLo, r.delayHi))
+	}
+	if r.ttr {
+		parts = append(parts, fmt.Sprintf("ttr %ds-%ds", r.ttrLo, r.ttrHi))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,86 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+var readOnly = flag.Bool("read-only", false, "Refuse every command that changes the servers, put, reserve, delete, bury, kick and the like, and every command of the benchmark that sends them, for pointing it at production to observe")
+
+// readOnlyCommands are the commands of the benchmark -read-only allows,
+// those that only look at the servers or at the results of earlier runs.
+var readOnlyCommands = map[string]bool{"stats": true, "monitor": true, "record": true, "analyze": true, "merge": true}
+
+// readOnlyVerbs are the protocol commands a connection sends with
+// -read-only. Reserving is left out as well, as it takes the job from its
+// consumers until its TTR runs out.
+var readOnlyVerbs = map[string]bool{
+	"stats": true, "stats-job": true, "stats-tube": true,
+	"peek": true, "peek-ready": true, "peek-delayed": true, "peek-buried": true,
+	"list-tubes": true, "list-tube-used": true, "list-tubes-watched": true,
+	"use": true, "watch": true, "ignore": true, "quit": true,
+}
+
+var errReadOnly = errors.New("refused by -read-only")
+
+// checkReadOnly refuses to run cmd with -read-only unless it is one that
+// only looks.
+func checkReadOnly(cmd *command) error {
+	if !*readOnly || readOnlyCommands[cmd.name] {
+		return nil
+	}
+	var allowed []string
+	for name := range readOnlyCommands {
+		allowed = append(allowed, name)
+	}
+	sort.Strings(allowed)
+	return fmt.Errorf("%s changes the servers and cannot run with -read-only, which allows %s", cmd.name, strings.Join(allowed, ", "))
+}
+
+// readOnlyConn refuses to write any command but those of readOnlyVerbs, as
+// a last line of defense behind checkReadOnly should a command that only
+// looks send something it should not. It follows the lines across writes,
+// as a buffered writer may split one anywhere.
+type readOnlyConn struct {
+	net.Conn
+	// verb is the start of the line being written, until its first space,
+	// and past is set once it is complete, until the end of the line.
+	verb []byte
+	past bool
+}
+
+func (c *readOnlyConn) Write(p []byte) (int, error) {
+	for _, b := range p {
+		switch {
+		case b == '\n':
+			c.verb, c.past = c.verb[:0], false
+		case c.past:
+		case b == ' ' || b == '\r':
+			if !readOnlyVerbs[string(c.verb)] {
+				return 0, fmt.Errorf("%w: %s", errReadOnly, c.verb)
+			}
+			c.past = true
+		default:
+			c.verb = append(c.verb, b)
+		}
+	}
+	return c.Conn.Write(p)
+}
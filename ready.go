@@ -0,0 +1,64 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Backoff between readiness probes of a host.
+const (
+	readyBackoffMin = 100 * time.Millisecond
+	readyBackoffMax = 2 * time.Second
+)
+
+// probe checks that h speaks the protocol with a list-tubes, which every
+// server answers without side effects.
+func probe(h string) error {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ListTubes()
+	return err
+}
+
+// waitReady probes every host until it answers, backing off exponentially
+// between attempts, and gives up after timeout.
+func waitReady(hosts []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, h := range hosts {
+		backoff := readyBackoffMin
+		for attempt := 1; ; attempt++ {
+			err := probe(h)
+			if err == nil {
+				slog.Debug("Host is ready", "host", h, "attempts", attempt)
+				break
+			}
+			if time.Now().Add(backoff).After(deadline) {
+				return fmt.Errorf("%s is not ready after %d attempts: %v", h, attempt, err)
+			}
+			slog.Debug("Host is not ready", "host", h, "attempt", attempt, "retry_in", backoff, "err", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > readyBackoffMax {
+				backoff = readyBackoffMax
+			}
+		}
+	}
+	return nil
+}
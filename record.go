@@ -0,0 +1,239 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// recorder follows the jobs put on one server without touching them. Job
+// ids are handed out in sequence, so the ids of the jobs put since the last
+// sample follow from the growth of total-jobs, and every one that is still
+// there is looked up with stats-job and peek. How many jobs every tube got
+// comes from its own total-jobs, and the jobs that were gone before they
+// could be looked up are filled in with what was last seen of their tube.
+type recorder struct {
+	h      string
+	conn   *beanstalk.Conn
+	nextID uint64
+	total  int64
+	tubes  map[string]*recordedTube
+
+	observed, estimated int64
+}
+
+type recordedTube struct {
+	total int64
+	// last is the last job seen in the tube, and seen whether there was one.
+	last traceEntry
+	seen bool
+}
+
+func statInt(stats map[string]string, k string) int64 {
+	v, _ := strconv.ParseInt(stats[k], 10, 64)
+	return v
+}
+
+func newRecorder(h string) (*recorder, error) {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := conn.Stats()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rec := &recorder{h: h, conn: conn, total: statInt(stats, "total-jobs"), tubes: make(map[string]*recordedTube)}
+	rec.nextID = uint64(rec.total) + 1
+	names, err := conn.ListTubes()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, name := range names {
+		stats, err := (&beanstalk.Tube{Conn: conn, Name: name}).Stats()
+		if err != nil {
+			continue
+		}
+		rec.tubes[name] = &recordedTube{total: statInt(stats, "total-jobs")}
+	}
+	return rec, nil
+}
+
+// lookup returns what the job with the given id looks like, if it is
+// still on the server.
+func (rec *recorder) lookup(id uint64) (traceEntry, bool) {
+	stats, err := rec.conn.StatsJob(id)
+	if err != nil {
+		return traceEntry{}, false
+	}
+	body, err := rec.conn.Peek(id)
+	if err != nil {
+		return traceEntry{}, false
+	}
+	return traceEntry{
+		Tube:  stats["tube"],
+		Pri:   uint32(statInt(stats, "pri")),
+		Delay: float64(statInt(stats, "delay")),
+		TTR:   float64(statInt(stats, "ttr")),
+		Size:  len(body),
+	}, true
+}
+
+// sample returns the jobs put since the previous sample, those that were
+// looked up first.
+func (rec *recorder) sample() ([]traceEntry, error) {
+	stats, err := rec.conn.Stats()
+	if err != nil {
+		return nil, err
+	}
+	total := statInt(stats, "total-jobs")
+	var entries []traceEntry
+	found := make(map[string]int64)
+	newest := make(map[string]traceEntry)
+	for ; int64(rec.nextID) <= total; rec.nextID++ {
+		if e, ok := rec.lookup(rec.nextID); ok {
+			entries = append(entries, e)
+			found[e.Tube]++
+			newest[e.Tube] = e
+		}
+	}
+	rec.total = total
+	rec.observed += int64(len(entries))
+
+	names, err := rec.conn.ListTubes()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		tube := &beanstalk.Tube{Conn: rec.conn, Name: name}
+		stats, err := tube.Stats()
+		if err != nil {
+			// The tube went away since it was listed.
+			continue
+		}
+		t := rec.tubes[name]
+		if t == nil {
+			t = &recordedTube{}
+			rec.tubes[name] = t
+		}
+		put := statInt(stats, "total-jobs") - t.total
+		t.total += put
+		if e, ok := newest[name]; ok {
+			t.last, t.seen = e, true
+		}
+		missing := put - found[name]
+		if missing <= 0 {
+			continue
+		}
+		if !t.seen {
+			if id, _, err := tube.PeekReady(); err == nil {
+				t.last, t.seen = rec.lookup(id)
+			}
+		}
+		e := t.last
+		if !t.seen {
+			e = traceEntry{Tube: name}
+		}
+		for i := int64(0); i < missing; i++ {
+			entries = append(entries, e)
+		}
+		rec.estimated += missing
+	}
+	return entries, nil
+}
+
+// record follows the jobs put on hosts each interval, for up to window or
+// until it is interrupted, and passes every one to emit. The jobs put
+// between two samples are spread evenly over the time between them.
+func record(hosts []string, interval, window time.Duration, emit func(traceEntry)) (observed, estimated int64) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if window > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, window)
+		defer cancel()
+	}
+
+	var recs []*recorder
+	for _, h := range hosts {
+		rec, err := newRecorder(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		defer rec.conn.Close()
+		recs = append(recs, rec)
+	}
+	start := time.Now()
+	previous := time.Duration(0)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+		now := time.Since(start)
+		var entries []traceEntry
+		for _, rec := range recs {
+			e, err := rec.sample()
+			if err != nil {
+				fatal("Cannot sample the server", "host", rec.h, "err", err)
+			}
+			entries = append(entries, e...)
+		}
+		for i, e := range entries {
+			at := previous + (now-previous)*time.Duration(i+1)/time.Duration(len(entries))
+			e.At = at.Seconds()
+			emit(e)
+		}
+		slog.Debug("Recorded", "jobs", len(entries), "elapsed", now)
+		previous = now
+	}
+	for _, rec := range recs {
+		observed += rec.observed
+		estimated += rec.estimated
+	}
+	return observed, estimated
+}
+
+func runRecord(hosts []string) {
+	f, err := os.Create(*recordOut)
+	if err != nil {
+		fatal("Cannot write the trace", "path", *recordOut, "err", err)
+	}
+	enc := json.NewEncoder(f)
+	slog.Info("Recording", "targets", len(hosts), "interval", *sampleInterval, "window", *recordFor, "path", *recordOut)
+	t0 := time.Now()
+	observed, estimated := record(hosts, *sampleInterval, *recordFor, func(e traceEntry) {
+		if err := enc.Encode(e); err != nil {
+			fatal("Cannot write the trace", "path", *recordOut, "err", err)
+		}
+	})
+	if err := f.Close(); err != nil {
+		fatal("Cannot write the trace", "path", *recordOut, "err", err)
+	}
+	result("Recorded", "jobs", observed+estimated, "observed", observed, "estimated", estimated, "elapsed", time.Since(t0), "path", *recordOut)
+}
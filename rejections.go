@@ -0,0 +1,98 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	bs "github.com/prep/beanstalk"
+)
+
+// The backoff of the publishers from puts the server turned down doubles
+// with every rejection in a row, from rejectBackoffMin up to
+// rejectBackoffMax.
+const (
+	rejectBackoffMin = 10 * time.Millisecond
+	rejectBackoffMax = time.Second
+)
+
+// rejections counts the puts the server turned down with DRAINING or
+// OUT_OF_MEMORY, which the publishers back off from and go on after, and
+// the time they spent backed off.
+type rejections struct {
+	draining, outOfMemory counter
+	// streak is the rejections in a row, over all publishers, which the
+	// backoff grows with.
+	streak    int64
+	backoffs  counter
+	backedOff counter // nanoseconds
+}
+
+// rejection tells whether err is the server turning a put down, with the
+// native or the prep client.
+func rejection(err error) bool {
+	switch err {
+	case errDraining, errOutOfMemory, bs.ErrDraining, bs.ErrOutOfMemory:
+		return true
+	}
+	return false
+}
+
+// rejected counts a put the server turned down with err.
+func (rj *rejections) rejected(err error) {
+	if err == errDraining || err == bs.ErrDraining {
+		rj.draining.add(1)
+	} else {
+		rj.outOfMemory.add(1)
+	}
+	atomic.AddInt64(&rj.streak, 1)
+}
+
+// accepted ends a streak of rejections.
+func (rj *rejections) accepted() {
+	if atomic.LoadInt64(&rj.streak) != 0 {
+		atomic.StoreInt64(&rj.streak, 0)
+	}
+}
+
+// total is the number of puts turned down.
+func (rj *rejections) total() int64 {
+	return rj.draining.load() + rj.outOfMemory.load()
+}
+
+// backoff sleeps after a rejection, for a random time of up to rejectBackoffMin
+// doubled for every rejection in the streak, and at least half of it, so
+// that the publishers do not come back all at once. The time is drawn from
+// rng, a stream of -seed.
+func (rj *rejections) backoff(rng *rand.Rand) {
+	d := rejectBackoffMax
+	if n := atomic.LoadInt64(&rj.streak); n < 8 {
+		d = min(rejectBackoffMin<<max(n-1, 0), rejectBackoffMax)
+	}
+	d = d/2 + time.Duration(rng.Int63n(int64(d/2)))
+	time.Sleep(d)
+	rj.backoffs.add(1)
+	rj.backedOff.add(int64(d))
+}
+
+func (rj *rejections) report() {
+	if rj.total() == 0 {
+		return
+	}
+	result("Rejected puts", "draining", rj.draining.load(), "out_of_memory", rj.outOfMemory.load(),
+		"backoffs", rj.backoffs.load(), "backed_off", time.Duration(rj.backedOff.load()).Round(time.Millisecond))
+}
@@ -0,0 +1,110 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// aggregatedMetrics are summarized across the runs of -runs, by the names
+// -assert knows them by. Latencies of operations that were not measured
+// are left out.
+var aggregatedMetrics = []string{"publish_rate", "read_rate"}
+
+var aggregatedLatencies = []string{"p50", "p90", "p99", "p999", "max"}
+
+// runStat is the spread of one metric over repeated runs.
+type runStat struct {
+	Metric string  `json:"metric"`
+	Runs   int     `json:"runs"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	// CI95 is the half width of the 95% confidence interval of the mean.
+	CI95 float64 `json:"ci95"`
+}
+
+// tCritical are the two-sided 95% critical values of Student's t
+// distribution by degrees of freedom; beyond the table the normal
+// distribution is close enough.
+var tCritical = []float64{
+	0, 12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+func newRunStat(metric string, values []float64) runStat {
+	s := runStat{Metric: metric, Runs: len(values)}
+	for _, v := range values {
+		s.Mean += v
+	}
+	s.Mean /= float64(len(values))
+	if len(values) < 2 {
+		return s
+	}
+	var sq float64
+	for _, v := range values {
+		sq += (v - s.Mean) * (v - s.Mean)
+	}
+	s.StdDev = math.Sqrt(sq / float64(len(values)-1))
+	t := 1.96
+	if df := len(values) - 1; df < len(tCritical) {
+		t = tCritical[df]
+	}
+	s.CI95 = t * s.StdDev / math.Sqrt(float64(len(values)))
+	return s
+}
+
+// aggregateRuns summarizes the throughput and latency percentiles of every
+// run. A metric is only included if all runs measured it.
+func aggregateRuns(runs []*runResult) []runStat {
+	names := append([]string(nil), aggregatedMetrics...)
+	for _, op := range runs[0].metrics.operations() {
+		for _, q := range aggregatedLatencies {
+			names = append(names, op.name+"_"+q)
+		}
+	}
+
+	var stats []runStat
+	for _, name := range names {
+		values := make([]float64, 0, len(runs))
+		for _, res := range runs {
+			v, err := res.metric(name)
+			if err != nil {
+				break
+			}
+			values = append(values, v)
+		}
+		if len(values) == len(runs) {
+			stats = append(stats, newRunStat(name, values))
+		}
+	}
+	return stats
+}
+
+func (s runStat) format(v float64) string {
+	if isLatencyMetric(s.Metric) {
+		return time.Duration(v).String()
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+func reportAggregate(stats []runStat) {
+	for _, s := range stats {
+		result("Across runs", "metric", s.Metric, "runs", s.Runs, "mean", s.format(s.Mean),
+			"stddev", s.format(s.StdDev), "ci95", "±"+s.format(s.CI95))
+	}
+}
@@ -0,0 +1,134 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	bs "github.com/prep/beanstalk"
+	"sync"
+	"time"
+)
+
+// replayBody returns a body of size bytes, cut from or padded after the
+// content of -payload.
+func replayBody(r *run, buf []byte, size int) []byte {
+	buf = r.payload(buf[:0])
+	if len(buf) > size {
+		return buf[:size]
+	}
+	for len(buf) < size {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// testReplay puts the jobs of trace at their offsets from the start, over
+// publishers connections of the native client or the producer of the prep
+// client, and reports how late the puts went out against the schedule.
+func testReplay(r *run, trace []traceEntry, publishers int, ch chan int) {
+	entries := make(chan traceEntry, publishers)
+	lag := newHistogram()
+	wg := sync.WaitGroup{}
+	if *client == "native" {
+		connected := 0
+		for p := 0; p < publishers; p++ {
+			conn := dialWorker(r, r.hosts[p%len(r.hosts)], newRand(streamDialPublisher, uint64(p)))
+			if conn == nil {
+				continue
+			}
+			connected++
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				defer conn.Close()
+				used := "default"
+				var buf []byte
+				for e := range entries {
+					if e.Tube != used {
+						if err := conn.use(e.Tube); err != nil {
+							fatal("Cannot use tube", "tube", e.Tube, "err", err)
+						}
+						used = e.Tube
+					}
+					buf = replayBody(r, buf, e.Size)
+					r.sent(len(buf))
+					t0 := time.Now()
+					id, err := conn.put(e.Pri, e.delay(), e.ttr(), buf)
+					if err != nil {
+						fatal("Put failed", "tube", e.Tube, "err", err)
+					}
+					r.metrics.put.record(time.Since(t0))
+					r.metrics.slowPut.record(time.Since(t0), conn.host, id, len(buf))
+					r.metrics.bySize.recordPut(len(buf), time.Since(t0))
+					r.metrics.priorities.put(conn.host, id, e.Pri)
+					r.producers.record(p, time.Since(t0))
+					r.byID.offer(id)
+					r.audit.offer(conn.host, id)
+				}
+			}(p)
+		}
+		if connected == 0 {
+			fatal("No publisher could connect", "publishers", publishers)
+		}
+	} else {
+		producer, err := bs.NewProducer(r.hosts, bs.Config{Multiply: perHost(publishers, r.hosts)})
+		if err != nil {
+			fatal("Cannot create producer", "err", err)
+		}
+		defer producer.Stop()
+		waitConnected(producer)
+		for p := 0; p < publishers; p++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var buf []byte
+				for e := range entries {
+					buf = replayBody(r, buf, e.Size)
+					r.sent(len(buf))
+					t0 := time.Now()
+					id, err := producer.Put(context.Background(), e.Tube, buf, bs.PutParams{
+						Priority: e.Pri,
+						Delay:    e.delay(),
+						TTR:      e.ttr(),
+					})
+					if err != nil {
+						fatal("Put failed", "tube", e.Tube, "err", err)
+					}
+					r.metrics.put.record(time.Since(t0))
+					r.metrics.slowPut.record(time.Since(t0), "", id, len(buf))
+					r.metrics.bySize.recordPut(len(buf), time.Since(t0))
+				}
+			}()
+		}
+	}
+
+	start := time.Now()
+	for _, e := range trace {
+		if d := time.Until(start.Add(e.offset())); d > 0 {
+			time.Sleep(d)
+		}
+		r.admit(1)
+		if r.halted() {
+			break
+		}
+		lag.record(time.Since(start.Add(e.offset())))
+		entries <- e
+	}
+	close(entries)
+	wg.Wait()
+	elapsed := time.Since(start)
+	result("Replay", append([]any{"jobs", lag.count(), "tubes", len(traceTubes(trace)), "scheduled", trace[len(trace)-1].offset(), "elapsed", elapsed, "op", "lag"}, latencyArgs(lag)...)...)
+	ch <- 1
+}
@@ -0,0 +1,62 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// writeCSVSeries writes the throughput over time of res to path. The
+// metadata of the run comes first as comment lines starting with #.
+func writeCSVSeries(path string, res *runResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	for _, row := range res.meta.environment() {
+		fmt.Fprintf(f, "# %s: %s\n", row.Name, row.Value)
+	}
+	for _, row := range res.meta.flags() {
+		fmt.Fprintf(f, "# -%s: %s\n", row.Name, row.Value)
+	}
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"elapsed_seconds", "put_rate", "read_rate", "in_flight", "offered_rate", "put_p99_us", "reserve_p99_us", "put_p50_us", "reserve_p50_us", "paused", "note"})
+	for _, p := range res.metrics.series.rates() {
+		w.Write([]string{
+			strconv.FormatFloat(p.elapsed.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(p.put, 'f', 1, 64),
+			strconv.FormatFloat(p.read, 'f', 1, 64),
+			strconv.FormatInt(p.inFlight, 10),
+			strconv.FormatFloat(p.offered, 'f', 1, 64),
+			strconv.FormatInt(int64(p.putP99/time.Microsecond), 10),
+			strconv.FormatInt(int64(p.reserveP99/time.Microsecond), 10),
+			strconv.FormatInt(int64(p.putP50/time.Microsecond), 10),
+			strconv.FormatInt(int64(p.reserveP50/time.Microsecond), 10),
+			strconv.FormatBool(p.paused),
+			p.note,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
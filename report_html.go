@@ -0,0 +1,354 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+)
+
+// runResult is what a benchmark run produced, for the reports written at
+// the end.
+type runResult struct {
+	meta        runMetadata
+	aggregate   []runStat
+	started     time.Time
+	publishers  int
+	readers     int
+	produced    int
+	consumed    int
+	publishTime time.Duration
+	// readStart is when the read phase of readTime started, after the
+	// start of the run and of the publish phase.
+	readStart time.Duration
+	readTime  time.Duration
+	metrics   *metrics
+	// truncated tells whether -max-duration cut the run short.
+	truncated bool
+	// clientCPU is the share of the available CPUs the benchmark used.
+	clientCPU float64
+	// memoryTrends are the trends of the memory over a -soak run.
+	memoryTrends []memoryTrend
+	// consumerSteps are the responses to the steps of -consumer-schedule.
+	consumerSteps []consumerStep
+	// frontend is what became of the requests of -http-frontend.
+	frontend *jsonFrontend
+	// priorities are the jobs the readers got of every priority.
+	priorities []priorityStat
+	// sizeBuckets are the latencies by -size-buckets.
+	sizeBuckets []sizeBucketStat
+	// putBudget is the time the puts of the native client spent in each
+	// of their phases.
+	putBudget []putPhaseStat
+	// hostAvailability is how much of the run every host answered with
+	// -tolerate-host-loss.
+	hostAvailability []hostAvailability
+	// tubePauses are the pauses of the watched tubes, nil if there were
+	// none.
+	tubePauses *jsonPauses
+	// slowest are the slowest puts and reserves of -slowest.
+	slowest []slowOp
+}
+
+func rate(count int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(count) / d.Seconds()
+}
+
+type chartSeries struct {
+	name   string
+	color  string
+	values []float64
+}
+
+// svgLineChart draws the series as lines over evenly spaced x positions,
+// labelled with xLabels.
+func svgLineChart(xLabels []string, series []chartSeries, yUnit string) template.HTML {
+	const w, h, left, right, top, bottom = 760.0, 300.0, 70.0, 20.0, 20.0, 40.0
+	plotW, plotH := w-left-right, h-top-bottom
+
+	var max float64
+	for _, s := range series {
+		for _, v := range s.values {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	max *= 1.1
+
+	x := func(i int) float64 {
+		if len(xLabels) < 2 {
+			return left + plotW/2
+		}
+		return left + plotW*float64(i)/float64(len(xLabels)-1)
+	}
+	y := func(v float64) float64 { return top + plotH - plotH*v/max }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" font-family="sans-serif" font-size="11">`, w, h)
+	for i := 0; i <= 5; i++ {
+		v := max * float64(i) / 5
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`, left, y(v), w-right, y(v))
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="end">%s</text>`, left-5, y(v)+4, html.EscapeString(formatValue(v, yUnit)))
+	}
+	step := (len(xLabels) + 9) / 10
+	for i, l := range xLabels {
+		if step > 1 && i%step != 0 && i != len(xLabels)-1 {
+			continue
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`, x(i), h-bottom+15, html.EscapeString(l))
+	}
+	fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#333"/>`, left, top+plotH, w-right, top+plotH)
+	for n, s := range series {
+		var points []string
+		for i, v := range s.values {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(i), y(v)))
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="2" points="%s"/>`, s.color, strings.Join(points, " "))
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="10" height="10" fill="%s"/>`, left+10+float64(n)*120, h-15, s.color)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f">%s</text>`, left+25+float64(n)*120, h-6, html.EscapeString(s.name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+func formatValue(v float64, unit string) string {
+	if unit == "ms" {
+		return fmt.Sprintf("%.2fms", v)
+	}
+	return fmt.Sprintf("%.0f%s", v, unit)
+}
+
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728"}
+
+type reportRow struct {
+	Name  string
+	Value string
+}
+
+type latencyRow struct {
+	Op     string
+	Count  int64
+	Values []string
+}
+
+type htmlReport struct {
+	Title      string
+	Generated  string
+	Summary    []reportRow
+	Throughput template.HTML
+	// LatencyOverTime charts the p99 of every sample interval.
+	LatencyOverTime template.HTML
+	Latency         template.HTML
+	Quantiles       []string
+	Latencies       []latencyRow
+	Runs            [][]string
+	Connections     []reportRow
+	Config          []reportRow
+	Environment     []reportRow
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f4f4f4; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}</p>
+<h2>Summary</h2>
+<table>{{range .Summary}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+<h2>Throughput over time (jobs/s)</h2>
+{{.Throughput}}
+<h2>p99 latency over time</h2>
+{{.LatencyOverTime}}
+<h2>Latency percentiles</h2>
+{{.Latency}}
+<table>
+<tr><th>Operation</th><th>Count</th>{{range .Quantiles}}<th>{{.}}</th>{{end}}</tr>
+{{range .Latencies}}<tr><td>{{.Op}}</td><td>{{.Count}}</td>{{range .Values}}<td>{{.}}</td>{{end}}</tr>{{end}}
+</table>
+{{if .Runs}}<h2>Across runs</h2>
+<table>
+<tr><th>Metric</th><th>Runs</th><th>Mean</th><th>Std. dev.</th><th>95% CI</th></tr>
+{{range .Runs}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>{{end}}
+</table>{{end}}
+{{if .Connections}}<h2>Connection lifecycle</h2>
+<table>{{range .Connections}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>{{end}}
+<h2>Configuration</h2>
+<table>{{range .Config}}<tr><th>-{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+<h2>Environment</h2>
+<table>{{range .Environment}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>{{end}}</table>
+</body>
+</html>
+`))
+
+// writeHTMLReport writes a self-contained HTML page with the results of
+// res, its configuration and the environment it ran in.
+func writeHTMLReport(path string, res *runResult) error {
+	title := "beanstalkd benchmark"
+	if res.meta.Label != "" {
+		title += ": " + res.meta.Label
+	}
+	report := htmlReport{
+		Title:     title,
+		Generated: time.Now().Format(time.RFC1123),
+		Summary: []reportRow{
+			{"Started", res.started.Format(time.RFC1123)},
+			{"Jobs produced", fmt.Sprint(res.produced)},
+			{"Jobs consumed", fmt.Sprint(res.consumed)},
+			{"Publishers", fmt.Sprint(res.publishers)},
+			{"Readers", fmt.Sprint(res.readers)},
+			{"Publish time", res.publishTime.String()},
+			{"Publish rate", fmt.Sprintf("%.0f jobs/s", rate(res.produced, res.publishTime))},
+			{"Read time", res.readTime.String()},
+			{"Read rate", fmt.Sprintf("%.0f jobs/s", rate(res.consumed, res.readTime))},
+		},
+	}
+	if b := res.bandwidth(); b.PayloadOut+b.PayloadIn > 0 {
+		report.Summary = append(report.Summary, reportRow{"Bandwidth", fmt.Sprintf("%.2f MB/s out, %.2f MB/s in, protocol estimated", b.OutRate, b.InRate)})
+	}
+	if latencySampling < 1 {
+		report.Summary = append(report.Summary, reportRow{"Latency sampling", fmt.Sprintf("%g of the operations; the percentiles are estimates", latencySampling)})
+	}
+	if s := res.stop(); s != nil {
+		report.Summary = append(report.Summary, reportRow{"Reserved at stop", fmt.Sprintf("%s: %d deleted, %d released, %d left reserved", s.OnStop, s.Deleted, s.Released, s.LeftReserved)})
+	}
+	if p := res.paranoid(); p != nil {
+		report.Summary = append(report.Summary, reportRow{"Peek before delete", fmt.Sprintf("%d checked, %d mismatched, %d missing", p.Checked, p.Mismatched, p.Missing)})
+	}
+	if p := res.tubePauses; p != nil {
+		report.Summary = append(report.Summary, reportRow{"Tube pauses", fmt.Sprintf("%d for %.0fs in all, %d reserves kept out of the reserve latencies",
+			p.Pauses, p.PausedSeconds, p.ExcludedReserves)})
+	}
+	if res.truncated {
+		by := "by -max-duration " + maxDuration.String()
+		if interrupted() {
+			by = "by an interrupt"
+		}
+		report.Summary = append(report.Summary, reportRow{"Truncated", by})
+	}
+	for _, t := range res.memoryTrends {
+		report.Summary = append(report.Summary, reportRow{"Memory " + t.Series, t.String()})
+	}
+
+	var labels []string
+	var puts, reads, offered, putP50, putP99, reserveP50, reserveP99 []float64
+	var paced, reserved bool
+	for _, p := range res.metrics.series.rates() {
+		labels = append(labels, p.elapsed.Round(time.Second).String())
+		puts = append(puts, p.put)
+		reads = append(reads, p.read)
+		offered = append(offered, p.offered)
+		putP50 = append(putP50, float64(p.putP50)/float64(time.Millisecond))
+		putP99 = append(putP99, float64(p.putP99)/float64(time.Millisecond))
+		reserveP50 = append(reserveP50, float64(p.reserveP50)/float64(time.Millisecond))
+		reserveP99 = append(reserveP99, float64(p.reserveP99)/float64(time.Millisecond))
+		paced = paced || p.offered > 0
+		reserved = reserved || p.reserveP99 > 0
+	}
+	throughput := []chartSeries{
+		{"put", chartColors[0], puts},
+		{"read", chartColors[1], reads},
+	}
+	if paced {
+		throughput = append(throughput, chartSeries{"offered", chartColors[2], offered})
+	}
+	report.Throughput = svgLineChart(labels, throughput, "")
+	latencyOverTime := []chartSeries{{"put p50", chartColors[2], putP50}, {"put p99", chartColors[0], putP99}}
+	if reserved {
+		latencyOverTime = append(latencyOverTime,
+			chartSeries{"reserve p50", chartColors[3], reserveP50}, chartSeries{"reserve p99", chartColors[1], reserveP99})
+	}
+	report.LatencyOverTime = svgLineChart(labels, latencyOverTime, "ms")
+
+	for _, q := range reportedQuantiles {
+		report.Quantiles = append(report.Quantiles, quantileName(q))
+	}
+	var latency []chartSeries
+	for _, op := range res.metrics.operations() {
+		if op.hist.total == 0 {
+			continue
+		}
+		row := latencyRow{Op: op.name, Count: op.hist.ops}
+		var values []float64
+		for _, q := range reportedQuantiles {
+			d := op.hist.quantile(q)
+			row.Values = append(row.Values, d.String())
+			values = append(values, float64(d)/float64(time.Millisecond))
+		}
+		report.Latencies = append(report.Latencies, row)
+		latency = append(latency, chartSeries{op.name, chartColors[len(latency)%len(chartColors)], values})
+	}
+	report.Latency = svgLineChart(report.Quantiles, latency, "ms")
+
+	for _, s := range res.aggregate {
+		report.Runs = append(report.Runs, []string{s.Metric, fmt.Sprint(s.Runs), s.format(s.Mean), s.format(s.StdDev), "±" + s.format(s.CI95)})
+	}
+
+	if l := lifecycle; l.dials.load() > 0 || l.dialFailures.load() > 0 {
+		report.Connections = []reportRow{
+			{"Dialed", fmt.Sprintf("%d, %d failed", l.dials.load(), l.dialFailures.load())},
+			{"Failed dials", fmt.Sprintf("%d refused, %d reset, %d timed out", l.refused.load(), l.reset.load(), l.dialTimeouts.load())},
+			{"Workers", fmt.Sprintf("%d dials tried again, %d gone without", l.workerRetries.load(), l.workersFailed.load())},
+			{"Open", fmt.Sprintf("%d at most, %d at the end", l.open.highest(), l.open.load())},
+			{"Ended by the peer", fmt.Sprintf("%d closed, %d broken", l.closedByPeer.load(), l.broken.load())},
+			{"Reconnects", fmt.Sprintf("%d in %d attempts", l.reconnects.load(), l.reconnectAttempts.load())},
+		}
+		for _, op := range l.operations() {
+			if op.hist.total > 0 {
+				report.Connections = append(report.Connections, reportRow{op.name, fmt.Sprintf("p50 %v, p99 %v, max %v",
+					op.hist.quantile(0.5), op.hist.quantile(0.99), op.hist.quantile(1))})
+			}
+		}
+	}
+
+	if s := sockets.summary(); s != nil {
+		report.Connections = append(report.Connections,
+			reportRow{"TCP retransmits", fmt.Sprint(s.Retransmits)},
+			reportRow{"TCP round trip", fmt.Sprintf("p50 %v, p99 %v, max %v", sockets.rtt.quantile(0.5), sockets.rtt.quantile(0.99), sockets.rtt.quantile(1))},
+			reportRow{"TCP congestion window", fmt.Sprintf("%d-%d segments, %.1f on average", s.CwndMin, s.CwndMax, s.CwndMean)})
+	}
+
+	report.Config = res.meta.flags()
+	report.Environment = res.meta.environment()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := htmlTemplate.Execute(f, report); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,218 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type jsonLatency struct {
+	Count   int64              `json:"count"`
+	Sampled int64              `json:"sampled,omitempty"`
+	MinUS   int64              `json:"min_us"`
+	MeanUS  int64              `json:"mean_us"`
+	US      map[string]float64 `json:"percentiles_us"`
+	// Histogram is the histogram of the latencies of a run in the encoding
+	// of HdrHistogram, for merge to add up.
+	Histogram string `json:"histogram,omitempty"`
+}
+
+type jsonPoint struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	PutRate        float64 `json:"put_rate"`
+	ReadRate       float64 `json:"read_rate"`
+	InFlight       int64   `json:"in_flight"`
+	OfferedRate    float64 `json:"offered_rate"`
+	PutP50US       int64   `json:"put_p50_us"`
+	PutP99US       int64   `json:"put_p99_us"`
+	ReserveP50US   int64   `json:"reserve_p50_us"`
+	ReserveP99US   int64   `json:"reserve_p99_us"`
+	Paused         bool    `json:"paused,omitempty"`
+	Note           string  `json:"note,omitempty"`
+}
+
+// jsonConnections is the lifecycle of the connections of a run.
+type jsonConnections struct {
+	Dialed       int64                  `json:"dialed"`
+	DialFailures int64                  `json:"dial_failures"`
+	Refused      int64                  `json:"refused"`
+	Reset        int64                  `json:"reset"`
+	DialTimeouts int64                  `json:"dial_timeouts"`
+	Retries      int64                  `json:"worker_retries"`
+	FailedWorker int64                  `json:"failed_workers"`
+	MaxOpen      int64                  `json:"max_open"`
+	OpenAtEnd    int64                  `json:"open_at_end"`
+	ClosedByPeer int64                  `json:"closed_by_peer"`
+	Broken       int64                  `json:"broken"`
+	Reconnects   int64                  `json:"reconnects"`
+	Attempts     int64                  `json:"reconnect_attempts"`
+	Latencies    map[string]jsonLatency `json:"latencies"`
+}
+
+// jsonSummary is the machine readable form of a run, written by -o json.
+type jsonSummary struct {
+	Metadata       runMetadata            `json:"metadata"`
+	Started        time.Time              `json:"started"`
+	Produced       int                    `json:"produced"`
+	Consumed       int                    `json:"consumed"`
+	Publishers     int                    `json:"publishers"`
+	Readers        int                    `json:"readers"`
+	PublishSeconds float64                `json:"publish_seconds"`
+	PublishRate    float64                `json:"publish_rate"`
+	ReadSeconds    float64                `json:"read_seconds"`
+	ReadRate       float64                `json:"read_rate"`
+	ReadStart      float64                `json:"read_start_seconds"`
+	Overlap        float64                `json:"overlap_seconds"`
+	Errors         int64                  `json:"errors"`
+	Timeouts       int64                  `json:"timeouts"`
+	ForeignJobs    int64                  `json:"foreign_jobs"`
+	Compression    *jsonCompression       `json:"compression,omitempty"`
+	Paranoid       *jsonParanoid          `json:"paranoid,omitempty"`
+	Stop           *jsonStop              `json:"stop,omitempty"`
+	Bandwidth      jsonBandwidth          `json:"bandwidth"`
+	MaxInFlight    int64                  `json:"max_in_flight"`
+	ClientCPU      float64                `json:"client_cpu_utilization"`
+	Latencies      map[string]jsonLatency `json:"latencies"`
+	Series         []jsonPoint            `json:"series"`
+	Runs           []runStat              `json:"runs,omitempty"`
+	Truncated      bool                   `json:"truncated,omitempty"`
+	MemoryTrends   []memoryTrend          `json:"memory_trends,omitempty"`
+	ConsumerSteps  []consumerStep         `json:"consumer_steps,omitempty"`
+	HTTPFrontend   *jsonFrontend          `json:"http_frontend,omitempty"`
+	Slowest        []slowOp               `json:"slowest,omitempty"`
+	Priorities     []priorityStat         `json:"priorities,omitempty"`
+	SizeBuckets    []sizeBucketStat       `json:"size_buckets,omitempty"`
+	PutBudget      []putPhaseStat         `json:"put_budget,omitempty"`
+	Hosts          []hostAvailability     `json:"host_availability,omitempty"`
+	TubePauses     *jsonPauses            `json:"tube_pauses,omitempty"`
+	Connections    *jsonConnections       `json:"connections,omitempty"`
+	Sockets        *jsonSockets           `json:"sockets,omitempty"`
+	Summary        *summaryTable          `json:"summary"`
+}
+
+// newJSONLatency summarizes a snapshot.
+func newJSONLatency(h *histogram) jsonLatency {
+	l := jsonLatency{
+		Count:  h.ops,
+		MinUS:  int64(h.minimum() / time.Microsecond),
+		MeanUS: int64(h.mean() / time.Microsecond),
+		US:     make(map[string]float64),
+	}
+	for _, q := range reportedQuantiles {
+		l.US[quantileName(q)] = float64(h.quantile(q) / time.Microsecond)
+	}
+	if h.total != h.ops {
+		l.Sampled = h.total
+	}
+	return l
+}
+
+func newJSONSummary(res *runResult) jsonSummary {
+	s := jsonSummary{
+		Metadata:       res.meta,
+		Started:        res.started,
+		Produced:       res.produced,
+		Consumed:       res.consumed,
+		Publishers:     res.publishers,
+		Readers:        res.readers,
+		PublishSeconds: res.publishTime.Seconds(),
+		PublishRate:    rate(res.produced, res.publishTime),
+		ReadSeconds:    res.readTime.Seconds(),
+		ReadRate:       rate(res.consumed, res.readTime),
+		ReadStart:      res.readStart.Seconds(),
+		Overlap:        res.overlap().Seconds(),
+		Errors:         res.metrics.errors.load(),
+		Timeouts:       res.metrics.timeouts.load(),
+		ForeignJobs:    res.metrics.foreign.jobs(),
+		Compression:    res.compression(),
+		Paranoid:       res.paranoid(),
+		Stop:           res.stop(),
+		Bandwidth:      res.bandwidth(),
+		MaxInFlight:    res.metrics.inFlight.highest(),
+		ClientCPU:      res.clientCPU,
+		Latencies:      make(map[string]jsonLatency),
+		Runs:           res.aggregate,
+		Truncated:      res.truncated,
+		MemoryTrends:   res.memoryTrends,
+		ConsumerSteps:  res.consumerSteps,
+		HTTPFrontend:   res.frontend,
+		Priorities:     res.priorities,
+		SizeBuckets:    res.sizeBuckets,
+		PutBudget:      res.putBudget,
+		TubePauses:     res.tubePauses,
+		Hosts:          res.hostAvailability,
+		Slowest:        res.slowest,
+		Sockets:        sockets.summary(),
+		Summary:        newSummaryTable(res),
+	}
+	for _, op := range res.metrics.operations() {
+		if op.hist.total > 0 {
+			l := newJSONLatency(op.hist)
+			l.Histogram = encodeHDR(op.hist)
+			s.Latencies[op.name] = l
+		}
+	}
+	if l := lifecycle; l.dials.load() > 0 || l.dialFailures.load() > 0 {
+		s.Connections = &jsonConnections{
+			Dialed:       l.dials.load(),
+			DialFailures: l.dialFailures.load(),
+			Refused:      l.refused.load(),
+			Reset:        l.reset.load(),
+			DialTimeouts: l.dialTimeouts.load(),
+			Retries:      l.workerRetries.load(),
+			FailedWorker: l.workersFailed.load(),
+			MaxOpen:      l.open.highest(),
+			OpenAtEnd:    l.open.load(),
+			ClosedByPeer: l.closedByPeer.load(),
+			Broken:       l.broken.load(),
+			Reconnects:   l.reconnects.load(),
+			Attempts:     l.reconnectAttempts.load(),
+			Latencies:    make(map[string]jsonLatency),
+		}
+		for _, op := range l.operations() {
+			if op.hist.total > 0 {
+				s.Connections.Latencies[op.name] = newJSONLatency(op.hist)
+			}
+		}
+	}
+	for _, p := range res.metrics.series.rates() {
+		s.Series = append(s.Series, newJSONPoint(p))
+	}
+	return s
+}
+
+func newJSONPoint(p seriesRate) jsonPoint {
+	return jsonPoint{
+		ElapsedSeconds: p.elapsed.Seconds(),
+		PutRate:        p.put,
+		ReadRate:       p.read,
+		InFlight:       p.inFlight,
+		OfferedRate:    p.offered,
+		PutP50US:       int64(p.putP50 / time.Microsecond),
+		PutP99US:       int64(p.putP99 / time.Microsecond),
+		ReserveP50US:   int64(p.reserveP50 / time.Microsecond),
+		ReserveP99US:   int64(p.reserveP99 / time.Microsecond),
+		Paused:         p.paused,
+		Note:           p.note,
+	}
+}
+
+func writeJSONSummary(w io.Writer, res *runResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newJSONSummary(res))
+}
@@ -0,0 +1,109 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// reserveByID is a pool of workers that reserve jobs by the ids the
+// publishers got back, with reserve-job, while the regular readers
+// compete for the same jobs with reserve.
+type reserveByID struct {
+	ids  chan uint64
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	reserved, notFound counter
+}
+
+// newReserveByID starts workers that between them try rate jobs per second
+// until the readers of r are done.
+func newReserveByID(r *run, workers int, rate float64) *reserveByID {
+	if workers < 1 {
+		workers = 1
+	}
+	b := &reserveByID{ids: make(chan uint64, 4096), stop: make(chan struct{})}
+	interval := time.Duration(float64(workers) * float64(time.Second) / rate)
+	for i := 0; i < workers; i++ {
+		conn, err := dialNative(r.hosts[i%len(r.hosts)])
+		if err != nil {
+			fatal("Cannot connect", "host", r.hosts[i%len(r.hosts)], "err", err)
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer conn.Close()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for r.consuming() {
+				var id uint64
+				select {
+				case <-b.stop:
+					return
+				case <-ticker.C:
+				}
+				select {
+				case <-b.stop:
+					return
+				case id = <-b.ids:
+				}
+
+				t0 := time.Now()
+				_, err := conn.reserveJob(id)
+				switch err {
+				case nil:
+				case errNotFound:
+					// A reader got there first.
+					b.notFound.add(1)
+					continue
+				case errUnknown:
+					fatal("The server does not know reserve-job, which needs beanstalkd 1.12 or later")
+				default:
+					fatal("Reserve by id failed", "id", id, "err", err)
+				}
+				r.metrics.reserveJob.record(time.Since(t0))
+				b.reserved.add(1)
+				t0 = time.Now()
+				if err := conn.delete(id); err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+				r.metrics.delete.record(time.Since(t0))
+				r.audit.deleted(conn.host, id)
+				r.read(1)
+			}
+		}()
+	}
+	return b
+}
+
+// offer hands the id of a published job to the workers. Ids are dropped
+// while the workers are behind, as a reader is bound to get them first.
+func (b *reserveByID) offer(id uint64) {
+	if b == nil {
+		return
+	}
+	select {
+	case b.ids <- id:
+	default:
+	}
+}
+
+func (b *reserveByID) report() {
+	close(b.stop)
+	b.wg.Wait()
+	result("Reserved by id", "reserved", b.reserved.load(), "not_found", b.notFound.load())
+}
@@ -0,0 +1,72 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+)
+
+// Every use of randomness draws from its own stream, so adding randomness in
+// one place doesn't shift the values drawn in another.
+const (
+	streamPayload uint64 = iota + 1
+	streamCorpus
+	streamPriority
+	streamOutcome
+	streamCancel
+	streamDelay
+	streamTenant
+	streamCancelPut
+	streamWorkload
+	streamScript
+	streamEvents
+	streamPutParams
+	streamAudit
+	streamRejectBackoff
+	streamDialPublisher
+	streamDialReader
+	streamLatencySample
+)
+
+// splitMix64 is a tiny rand.Source64. It is cheap enough to create one per
+// job, which keeps what a job draws independent of goroutine scheduling.
+type splitMix64 uint64
+
+func (s *splitMix64) Uint64() uint64 {
+	*s += 0x9e3779b97f4a7c15
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 { return int64(s.Uint64() >> 1) }
+
+func (s *splitMix64) Seed(seed int64) { *s = splitMix64(seed) }
+
+// newRand returns the generator for the index'th draw of a stream, derived
+// from -seed.
+func newRand(stream, index uint64) *rand.Rand {
+	src := seededSource(stream, index)
+	return rand.New(&src)
+}
+
+// seededSource is the source of newRand, for hot paths that can do without
+// the allocation of a rand.Rand.
+func seededSource(stream, index uint64) splitMix64 {
+	src := splitMix64(uint64(*seed))
+	src.Seed(int64(src.Uint64() ^ stream*0xd1b54a32d192ed03 ^ index*0x8cb92ba72f3d8dd7))
+	return src
+}
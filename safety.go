@@ -0,0 +1,102 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A fill of at least this many jobs or bytes is large enough to need -yes
+// on a server that holds data.
+const (
+	largeFillJobs  = 1000000
+	largeFillBytes = 1 << 30
+)
+
+// heldJobs is the number of jobs the server holds in any state, from its
+// stats.
+func heldJobs(stats map[string]string) int64 {
+	var held int64
+	for _, k := range []string{"current-jobs-ready", "current-jobs-reserved", "current-jobs-delayed", "current-jobs-buried"} {
+		n, _ := strconv.ParseInt(stats[k], 10, 64)
+		held += n
+	}
+	return held
+}
+
+// confirmDestructive logs what the run is about to delete with drains and
+// create with fill jobs on every host, and asks for -yes, or for a yes on
+// the terminal, before going ahead against a server that already holds
+// -confirm-above jobs. The embedded server of -selftest is never asked
+// about.
+func confirmDestructive(hosts []string, drains bool, fill int) {
+	if *selftest || !drains && fill == 0 {
+		return
+	}
+	fillBytes := int64(fill) * int64(*size)
+	large := drains || fill >= largeFillJobs || fillBytes >= largeFillBytes
+	var risky []string
+	for _, h := range hosts {
+		conn, err := dialBeanstalk(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		stats, err := conn.Stats()
+		if err != nil {
+			conn.Close()
+			fatal("Cannot fetch server stats", "host", h, "err", err)
+		}
+		args := []any{"host", h, "holds_jobs", heldJobs(stats)}
+		if drains {
+			tube, err := (&beanstalk.Tube{Conn: conn, Name: "default"}).Stats()
+			if err != nil {
+				conn.Close()
+				fatal("Cannot fetch tube stats", "host", h, "tube", "default", "err", err)
+			}
+			ready, _ := strconv.ParseInt(tube["current-jobs-ready"], 10, 64)
+			args = append(args, "drain_deletes", ready)
+		}
+		conn.Close()
+		if fill > 0 {
+			args = append(args, "fill_jobs", fill, "fill_bytes", fillBytes)
+		}
+		slog.Info("Expected data volume", args...)
+		if large && heldJobs(stats) >= *confirmAbove {
+			risky = append(risky, h)
+		}
+	}
+	if len(risky) == 0 || *assumeYes {
+		return
+	}
+
+	what := "drain"
+	if !drains {
+		what = "fill"
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fatal("The servers already hold data; pass -yes to "+what+" them anyway", "hosts", strings.Join(risky, ","), "confirm_above", *confirmAbove)
+	}
+	fmt.Fprintf(os.Stderr, "%s already hold data. Really %s them? [y/N] ", strings.Join(risky, ", "), what)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		fatal("Not confirmed, stopping")
+	}
+}
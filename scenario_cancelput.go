@@ -0,0 +1,166 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const cancelPutTube = "bench-cancelput"
+
+// What became of a put of the cancelput scenario, as the publisher saw it.
+const (
+	putAcked uint8 = iota + 1
+	// putCancelled had its context cancelled before the response came,
+	// and putCancelledLate only after.
+	putCancelled
+	putCancelledLate
+)
+
+// testCancelPut puts count jobs from publishers, cancelling the context of
+// a ratio of the puts at a random time within the given time of sending
+// them, the way a client timeout does. A cancelled put breaks off with its
+// response unread, so the connection is dialed again. The jobs that landed
+// are then reserved to tell the cancelled puts that still stored a job,
+// which a retry would put twice, from those that left none.
+func testCancelPut(h string, publishers, count, size int, ratio float64, within time.Duration) {
+	if size < 8 {
+		size = 8
+	}
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+	clearTube(conn, cancelPutTube)
+	defer clearTube(conn, cancelPutTube)
+
+	// fate holds what the publisher saw of the put of every job.
+	fate := make([]uint8, count)
+	slog.Info("Putting jobs with cancelled contexts", "jobs", count, "publishers", publishers, "ratio", ratio, "within", within)
+	wg := sync.WaitGroup{}
+	for p := 0; p < publishers; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.use(cancelPutTube); err != nil {
+			fatal("Cannot use tube", "tube", cancelPutTube, "err", err)
+		}
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			defer func() { conn.Close() }()
+			rng := newRand(streamCancelPut, uint64(p))
+			body := make([]byte, size)
+			for seq := p; seq < count; seq += publishers {
+				binary.BigEndian.PutUint64(body, uint64(seq))
+				ctx, cancel := context.WithCancel(context.Background())
+				if rng.Float64() < ratio {
+					time.AfterFunc(time.Duration(rng.Int63n(int64(within)+1)), cancel)
+				}
+				// The cancellation breaks off the put under way by
+				// expiring the deadline of the connection.
+				broken := make(chan struct{})
+				stop := context.AfterFunc(ctx, func() {
+					conn.conn.SetDeadline(time.Now())
+					close(broken)
+				})
+				_, err := conn.put(0, 0, 120*time.Second, body)
+				cancelled := !stop()
+				if cancelled {
+					<-broken
+					conn.conn.SetDeadline(time.Time{})
+				}
+				cancel()
+				switch {
+				case err == nil && cancelled:
+					fate[seq] = putCancelledLate
+				case err == nil:
+					fate[seq] = putAcked
+				case cancelled && deadlineExceeded(err):
+					fate[seq] = putCancelled
+					conn = redial(conn, nil, func() bool { return false })
+					if err := conn.use(cancelPutTube); err != nil {
+						fatal("Cannot use tube", "tube", cancelPutTube, "err", err)
+					}
+				default:
+					fatal("Put failed", "err", err)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	reader, err := dialNative(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer reader.Close()
+	if err := watchTubes(reader, []string{cancelPutTube}); err != nil {
+		fatal("Cannot watch tube", "tube", cancelPutTube, "err", err)
+	}
+	landed := make([]int, count)
+	for {
+		id, body, err := reader.reserve(0)
+		if err == errTimedOut {
+			break
+		}
+		if err != nil {
+			fatal("Reserve failed", "err", err)
+		}
+		if seq := binary.BigEndian.Uint64(body); seq < uint64(count) {
+			landed[seq]++
+		}
+		if err := reader.delete(id); err != nil {
+			fatal("Delete failed", "id", id, "err", err)
+		}
+	}
+
+	var acked, ackedLanded, cancelled, cancelledLanded, late, duplicates int
+	for seq, f := range fate {
+		if landed[seq] > 1 {
+			duplicates++
+		}
+		switch f {
+		case putAcked, putCancelledLate:
+			acked++
+			if landed[seq] > 0 {
+				ackedLanded++
+			}
+			if f == putCancelledLate {
+				late++
+			}
+		case putCancelled:
+			cancelled++
+			if landed[seq] > 0 {
+				cancelledLanded++
+			}
+		}
+	}
+	result("Cancelled puts", "puts", count, "cancelled", cancelled, "landed", cancelledLanded, "lost", cancelled-cancelledLanded,
+		"cancelled_after_response", late)
+	result("Acknowledged puts", "acked", acked, "landed", ackedLanded, "missing", acked-ackedLanded, "duplicates", duplicates)
+	if cancelledLanded > 0 {
+		slog.Warn("Cancelled puts stored their job, which a retry would put twice", "jobs", cancelledLanded, "of", cancelled)
+	}
+	if acked > ackedLanded || duplicates > 0 {
+		slog.Warn("ACKNOWLEDGED JOBS WERE MISSING OR DUPLICATED", "missing", acked-ackedLanded, "duplicates", duplicates)
+	}
+}
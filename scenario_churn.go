@@ -0,0 +1,146 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const churnTube = "bench-churn"
+
+// churnPersistent puts rate jobs a second for d over publishers connections
+// that stay open, and returns the put latencies.
+func churnPersistent(h string, publishers, size int, rate float64, d time.Duration) *histogram {
+	data := make([]byte, size)
+	put := newHistogram()
+	pace := newPacer(rate)
+	end := time.Now().Add(d)
+	wg := sync.WaitGroup{}
+	for p := 0; p < publishers; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.use(churnTube); err != nil {
+			fatal("Cannot use tube", "tube", churnTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for {
+				pace.wait(1)
+				if time.Now().After(end) {
+					return
+				}
+				t0 := time.Now()
+				if _, err := conn.put(0, 0, 120*time.Second, data); err != nil {
+					fatal("Put failed", "err", err)
+				}
+				put.record(time.Since(t0))
+			}
+		}()
+	}
+	wg.Wait()
+	return put
+}
+
+// churnSessions opens rate connections a second for d, each of which puts
+// jobs jobs and closes again. It returns the latencies of the dials, of the
+// puts and of the whole sessions, and the dials that failed.
+func churnSessions(h string, size, jobs int, rate float64, d time.Duration) (connect, put, session *histogram, failed int64) {
+	data := make([]byte, size)
+	connect, put, session = newHistogram(), newHistogram(), newHistogram()
+	pace := newPacer(rate)
+	end := time.Now().Add(d)
+	wg := sync.WaitGroup{}
+	for {
+		pace.wait(1)
+		if time.Now().After(end) {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t0 := time.Now()
+			conn, err := dialNative(h)
+			if err != nil {
+				// Running out of ephemeral ports or of the server's
+				// backlog is part of what churn costs.
+				if atomic.AddInt64(&failed, 1) == 1 {
+					slog.Warn("Cannot connect", "host", h, "err", err)
+				}
+				return
+			}
+			defer conn.Close()
+			connect.record(time.Since(t0))
+			if err := conn.use(churnTube); err != nil {
+				fatal("Cannot use tube", "tube", churnTube, "err", err)
+			}
+			for i := 0; i < jobs; i++ {
+				t1 := time.Now()
+				if _, err := conn.put(0, 0, 120*time.Second, data); err != nil {
+					fatal("Put failed", "err", err)
+				}
+				put.record(time.Since(t1))
+			}
+			session.record(time.Since(t0))
+		}()
+	}
+	wg.Wait()
+	return connect, put, session, atomic.LoadInt64(&failed)
+}
+
+// testChurn models producers that live for a handful of jobs, as PHP or
+// CGI scripts do: for d it opens rate connections a second, each putting
+// jobs jobs before it disconnects. It first offers the same jobs a second
+// over publishers persistent connections, and reports what a job costs
+// either way, to show how far the few jobs of a connection amortize its
+// setup.
+func testChurn(h string, publishers, size, jobs int, rate float64, d time.Duration) {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	clearTube(conn, churnTube)
+	defer clearTube(conn, churnTube)
+	defer conn.Close()
+
+	jobRate := rate * float64(jobs)
+	slog.Info("Putting over persistent connections", "publishers", publishers, "rate", jobRate, "for", d)
+	persistent := churnPersistent(h, publishers, size, jobRate, d)
+	result("Churn", append([]any{"phase", "persistent", "connections", publishers, "op", "put"}, latencyArgs(persistent)...)...)
+	clearTube(conn, churnTube)
+	settle("churn")
+
+	slog.Info("Putting over short-lived connections", "rate", rate, "jobs_per_conn", jobs, "for", d)
+	connect, put, session, failed := churnSessions(h, size, jobs, rate, d)
+	phase := []any{"phase", "churn", "connections", session.count(), "failed", failed}
+	result("Churn", append(append(phase, "op", "connect"), latencyArgs(connect)...)...)
+	result("Churn", append(append(phase, "op", "put"), latencyArgs(put)...)...)
+	result("Churn", append(append(phase, "op", "session"), latencyArgs(session)...)...)
+
+	if session.count() == 0 || persistent.count() == 0 {
+		return
+	}
+	// A job of a short-lived producer costs its share of the session, the
+	// dial and the use of the tube included.
+	perJob := session.mean() / time.Duration(jobs)
+	result("Churn cost", "jobs_per_conn", jobs, "per_job_persistent", persistent.mean(), "per_job_churn", perJob,
+		"overhead", float64(perJob)/float64(persistent.mean()), "connect_share", float64(connect.mean())/float64(session.mean()))
+}
@@ -0,0 +1,133 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const deadlineTube = "bench-deadline"
+
+// testDeadlineSoon publishes count jobs with a tight TTR. Each reader
+// reserves a job, holds it for hold, which should end inside the last
+// second of its TTR, and then reserves again before deleting it. Once the
+// tube runs dry those reserves are answered with DEADLINE_SOON; jobs held
+// past their TTR are lost to the reader and show up as NOT_FOUND deletes.
+func testDeadlineSoon(h string, readers, count, size int, ttr, hold time.Duration) {
+	if hold < ttr-time.Second {
+		slog.Warn("The hold ends before the last second of the TTR, so no DEADLINE_SOON is expected", "ttr", ttr, "hold", hold)
+	}
+
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	clearTube(conn, deadlineTube)
+	conn.Close()
+
+	pub, err := dialNative(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer pub.Close()
+	if err := pub.use(deadlineTube); err != nil {
+		fatal("Cannot use tube", "tube", deadlineTube, "err", err)
+	}
+	data := make([]byte, size)
+	for i := 0; i < count; i++ {
+		if _, err := pub.put(0, 0, ttr, data); err != nil {
+			fatal("Put failed", "err", err)
+		}
+	}
+	slog.Info("Published jobs", "jobs", count, "ttr", ttr, "hold", hold)
+
+	first := newHistogram()
+	again := newHistogram()
+	soon := newHistogram()
+	var done, deadlineSoon, expired int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.watch(deadlineTube); err == nil {
+			err = conn.ignore("default")
+		}
+		if err != nil {
+			fatal("Cannot watch tube", "tube", deadlineTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			// finish deletes a job this reader held. If its TTR ran out
+			// first, the job is back in the tube for another reader.
+			finish := func(id uint64) {
+				err := conn.delete(id)
+				if err == errNotFound {
+					atomic.AddInt64(&expired, 1)
+					return
+				}
+				if err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+				atomic.AddInt64(&done, 1)
+			}
+			for atomic.LoadInt64(&done) < int64(count) {
+				t0 := time.Now()
+				held, _, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					continue
+				}
+				if err != nil {
+					fatal("Reserve failed", "err", err)
+				}
+				first.record(time.Since(t0))
+
+				time.Sleep(hold)
+				t0 = time.Now()
+				id, _, err := conn.reserve(ttr)
+				switch err {
+				case nil:
+					again.record(time.Since(t0))
+					finish(id)
+				case errDeadlineSoon:
+					soon.record(time.Since(t0))
+					atomic.AddInt64(&deadlineSoon, 1)
+				case errTimedOut:
+				default:
+					fatal("Reserve failed", "err", err)
+				}
+				finish(held)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result("Deadline soon", "jobs", count, "deadline_soon", deadlineSoon, "expired", expired)
+	for _, op := range []operation{
+		{"reserve", first.snapshot()},
+		{"reserve_holding", again.snapshot()},
+		{"reserve_deadline_soon", soon.snapshot()},
+	} {
+		if op.hist.total > 0 {
+			result("Latency", append([]any{"op", op.name}, latencyArgs(op.hist)...)...)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const delayTube = "bench-delay"
+
+// delayBucket groups the delays of the delay scenario by powers of two of
+// their seconds: 0s, 1s, 2-3s, 4-7s and so on.
+func delayBucket(seconds int64) int {
+	return bits.Len64(uint64(seconds))
+}
+
+// delayBucketName is the range of delays of bucket b.
+func delayBucketName(b int) string {
+	if b <= 1 {
+		return fmt.Sprintf("%ds", b)
+	}
+	return fmt.Sprintf("%d-%ds", 1<<(b-1), 1<<b-1)
+}
+
+// testDelayHeap puts count jobs with delays of whole seconds drawn evenly
+// from zero to maxDelay, and reports the put rate and how late the jobs
+// became ready, overall and by their delay: readers reserving all along
+// compare the time of every reserve with the time the job was due, which
+// the publisher wrote into its body with the delay.
+func testDelayHeap(h string, publishers, readers, count, size int, maxDelay time.Duration) {
+	if size < 16 {
+		size = 16
+	}
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	clearTube(conn, delayTube)
+	conn.Close()
+
+	seconds := int64(maxDelay/time.Second) + 1
+	put := newHistogram()
+	late := newHistogram()
+	byDelay := make([]*histogram, delayBucket(seconds-1)+1)
+	for i := range byDelay {
+		byDelay[i] = newHistogram()
+	}
+	var done, early int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.watch(delayTube); err == nil {
+			err = conn.ignore("default")
+		}
+		if err != nil {
+			fatal("Cannot watch tube", "tube", delayTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for atomic.LoadInt64(&done) < int64(count) {
+				id, body, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					continue
+				}
+				if err != nil {
+					fatal("Reserve failed", "err", err)
+				}
+				lateness := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(body))))
+				if lateness < 0 {
+					atomic.AddInt64(&early, 1)
+				}
+				late.record(lateness)
+				byDelay[delayBucket(int64(binary.BigEndian.Uint64(body[8:])))].record(lateness)
+				if err := conn.delete(id); err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+
+	slog.Info("Putting delayed jobs", "jobs", count, "max_delay", maxDelay)
+	pub := sync.WaitGroup{}
+	t0 := time.Now()
+	for p := 0; p < publishers; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.use(delayTube); err != nil {
+			fatal("Cannot use tube", "tube", delayTube, "err", err)
+		}
+		pub.Add(1)
+		go func(p int) {
+			defer pub.Done()
+			defer conn.Close()
+			rng := newRand(streamDelay, uint64(p))
+			body := make([]byte, size)
+			for j := share(count, publishers, p); j > 0; j-- {
+				delay := time.Duration(rng.Int63n(seconds)) * time.Second
+				t1 := time.Now()
+				binary.BigEndian.PutUint64(body, uint64(t1.Add(delay).UnixNano()))
+				binary.BigEndian.PutUint64(body[8:], uint64(delay/time.Second))
+				if _, err := conn.put(0, delay, 120*time.Second, body); err != nil {
+					fatal("Put failed", "err", err)
+				}
+				put.record(time.Since(t1))
+			}
+		}(p)
+	}
+	pub.Wait()
+	elapsed := time.Since(t0)
+	result("Delayed puts", append([]any{"jobs", count, "elapsed", elapsed, "req_per_sec", rate(count, elapsed), "op", "put"}, latencyArgs(put)...)...)
+
+	wg.Wait()
+	result("Ready lateness", append(latencyArgs(late), "early", atomic.LoadInt64(&early))...)
+	for b, h := range byDelay {
+		if h.count() > 0 {
+			result("Ready lateness by delay", append([]any{"delay", delayBucketName(b)}, latencyArgs(h)...)...)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func fanoutTube(i int) string {
+	return fmt.Sprintf("bench-fanout-%d", i)
+}
+
+// fanoutStep spreads count jobs evenly across tubes tubes, then lets readers
+// that each watch all of them consume the jobs, and returns the reserve
+// latencies and the read rate.
+func fanoutStep(h string, tubes, publishers, readers, count, size int) (*histogram, float64) {
+	data := make([]byte, size)
+	wg := sync.WaitGroup{}
+	for p := 0; p < publishers && p < tubes; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			defer conn.Close()
+			for t := p; t < tubes; t += publishers {
+				if err := conn.use(fanoutTube(t)); err != nil {
+					fatal("Cannot use tube", "tube", fanoutTube(t), "err", err)
+				}
+				for j := share(count, tubes, t); j > 0; j-- {
+					if _, err := conn.put(0, 0, 120*time.Second, data); err != nil {
+						fatal("Put failed", "err", err)
+					}
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	reserve := newHistogram()
+	var done int64
+	t0 := time.Now()
+	for i := 0; i < readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		for t := 0; t < tubes; t++ {
+			if err := conn.watch(fanoutTube(t)); err != nil {
+				fatal("Cannot watch tube", "tube", fanoutTube(t), "err", err)
+			}
+		}
+		if err := conn.ignore("default"); err != nil {
+			fatal("Cannot ignore tube", "tube", "default", "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for atomic.LoadInt64(&done) < int64(count) {
+				t1 := time.Now()
+				id, _, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					continue
+				}
+				if err != nil {
+					fatal("Reserve failed", "err", err)
+				}
+				reserve.record(time.Since(t1))
+				if err := conn.delete(id); err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	return reserve, rate(count, time.Since(t0))
+}
+
+// testFanout measures how the reserve latency of a connection grows with
+// the number of tubes it watches, doubling them from one to maxTubes. At
+// every step the jobs are spread evenly across the watched tubes.
+func testFanout(h string, maxTubes, publishers, readers, count, size int) {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	for t := 0; t < maxTubes; t++ {
+		clearTube(conn, fanoutTube(t))
+	}
+	conn.Close()
+
+	var first time.Duration
+	for tubes := 1; ; tubes *= 2 {
+		if tubes > maxTubes {
+			tubes = maxTubes
+		}
+		reserve, readRate := fanoutStep(h, tubes, publishers, readers, count, size)
+		p99 := reserve.quantile(0.99)
+		if first == 0 {
+			first = p99
+		}
+		result("Fan-out", append([]any{"tubes", tubes, "read_req_per_sec", readRate, "op", "reserve"}, latencyArgs(reserve)...)...)
+		if tubes == maxTubes {
+			if first > 0 {
+				result("Fan-out scaling", "tubes", tubes, "reserve_p99", p99, "reserve_p99_one_tube", first, "ratio", float64(p99)/float64(first))
+			}
+			return
+		}
+		settle("fan-out step")
+	}
+}
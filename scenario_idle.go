@@ -0,0 +1,175 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const idleTube = "bench-idle"
+
+// idleSteps is the number of steps in which the idle scenario opens its
+// idle connections, measuring the active set before the first and after
+// each.
+const idleSteps = 4
+
+// idleStep runs the active set of the idle scenario: publishers put count
+// jobs while readers reserve and delete them. It returns the put and
+// reserve latencies and the read rate.
+func idleStep(h string, publishers, readers, count, size int) (*histogram, *histogram, float64) {
+	data := make([]byte, size)
+	put, reserve := newHistogram(), newHistogram()
+	var done int64
+	t0 := time.Now()
+	wg := sync.WaitGroup{}
+	for p := 0; p < publishers; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.use(idleTube); err != nil {
+			fatal("Cannot use tube", "tube", idleTube, "err", err)
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			defer conn.Close()
+			for ; n > 0; n-- {
+				t1 := time.Now()
+				if _, err := conn.put(0, 0, 120*time.Second, data); err != nil {
+					fatal("Put failed", "err", err)
+				}
+				put.record(time.Since(t1))
+			}
+		}(share(count, publishers, p))
+	}
+	for i := 0; i < readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := watchTubes(conn, []string{idleTube}); err != nil {
+			fatal("Cannot watch tube", "tube", idleTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for atomic.LoadInt64(&done) < int64(count) {
+				t1 := time.Now()
+				id, _, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					continue
+				}
+				if err != nil {
+					fatal("Reserve failed", "err", err)
+				}
+				reserve.record(time.Since(t1))
+				if err := conn.delete(id); err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	return put, reserve, rate(count, time.Since(t0))
+}
+
+// sampleIdle returns the connections the server counts and its resident
+// memory, if it can be read.
+func sampleIdle(h string) (int64, int64, bool) {
+	stats, err := serverStats(h)
+	if err != nil {
+		fatal("Cannot fetch server stats", "host", h, "err", err)
+	}
+	conns, _ := strconv.ParseInt(stats["current-connections"], 10, 64)
+	rss, ok := serverRSS(h, stats)
+	return conns, rss, ok
+}
+
+// testIdleConns measures what connections cost the server by their number
+// alone: it opens up to maxIdle connections that watch a tube and then send
+// nothing, in idleSteps steps, and runs the same active set of publishers
+// and readers before the first step and after every one, reporting its
+// latencies and the server's connections and memory.
+func testIdleConns(h string, maxIdle, publishers, readers, count, size int) {
+	if maxIdle < 1 {
+		fatal("-idle-conns must be at least 1", "idle_conns", maxIdle)
+	}
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	clearTube(conn, idleTube)
+	conn.Close()
+
+	var idle []*nativeConn
+	defer func() {
+		for _, c := range idle {
+			c.Close()
+		}
+	}()
+	var first, last time.Duration
+	var firstRSS, lastRSS int64
+	rssKnown := true
+	for step := 0; step <= idleSteps; step++ {
+		target := step * maxIdle / idleSteps
+		if len(idle) < target {
+			t0 := time.Now()
+			for len(idle) < target {
+				c, err := dialNative(h)
+				if err != nil {
+					fatal("Cannot open an idle connection, check the open files limit of both sides", "host", h, "idle", len(idle), "err", err)
+				}
+				if err := watchTubes(c, []string{idleTube}); err != nil {
+					fatal("Cannot watch tube", "tube", idleTube, "err", err)
+				}
+				idle = append(idle, c)
+			}
+			slog.Info("Idle connections opened", "idle", len(idle), "took", time.Since(t0).Round(time.Millisecond))
+			settle("idle step")
+		}
+
+		put, reserve, readRate := idleStep(h, publishers, readers, count, size)
+		conns, rss, ok := sampleIdle(h)
+		args := []any{"idle", len(idle), "server_connections", conns, "read_req_per_sec", readRate}
+		if ok {
+			args = append(args, "server_rss_bytes", rss)
+		}
+		rssKnown = rssKnown && ok
+		result("Idle connections", append(append(args, "op", "put"), latencyArgs(put)...)...)
+		result("Idle connections", append(append(args, "op", "reserve"), latencyArgs(reserve)...)...)
+
+		p99 := reserve.quantile(0.99)
+		if step == 0 {
+			first, firstRSS = p99, rss
+		}
+		last, lastRSS = p99, rss
+	}
+
+	args := []any{"idle", len(idle), "reserve_p99", last, "reserve_p99_no_idle", first}
+	if first > 0 {
+		args = append(args, "ratio", float64(last)/float64(first))
+	}
+	if rssKnown {
+		args = append(args, "server_bytes_per_conn", (lastRSS-firstRSS)/int64(len(idle)))
+	}
+	result("Idle connection cost", args...)
+}
@@ -0,0 +1,188 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kickTube      = "bench-kick"
+	kickProbeTube = "bench-kick-probe"
+
+	// kickBaseline is how long put latency is probed before the kick.
+	kickBaseline = time.Second
+	// kickProbeInterval paces the probing puts, so the probe itself adds
+	// little load.
+	kickProbeInterval = time.Millisecond
+)
+
+// Phases of the kick storm, for the put latency probe.
+const (
+	kickPhaseBaseline int32 = iota
+	kickPhaseStorm
+	kickPhaseDone
+)
+
+// clearTube deletes every job of a tube, buried ones included.
+func clearTube(conn *beanstalk.Conn, tube string) {
+	t := &beanstalk.Tube{Conn: conn, Name: tube}
+	for {
+		drainTube(conn, tube)
+		n, err := t.Kick(1 << 20)
+		if err != nil {
+			fatal("Kick failed", "tube", tube, "err", err)
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// testKickStorm buries count jobs, then kicks them all at once while
+// readers wait on the tube, and reports how fast the kicked backlog is
+// drained and how the latency of an unrelated stream of puts degrades
+// while it is.
+func testKickStorm(h string, readers, count, size int) {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+	clearTube(conn, kickTube)
+	clearTube(conn, kickProbeTube)
+
+	slog.Info("Burying jobs", "jobs", count, "tube", kickTube)
+	tube := &beanstalk.Tube{Conn: conn, Name: kickTube}
+	ts := beanstalk.NewTubeSet(conn, kickTube)
+	data := make([]byte, size)
+	t0 := time.Now()
+	for i := 0; i < count; i++ {
+		if _, err := tube.Put(data, 0, 0, 120*time.Second); err != nil {
+			fatal("Put failed", "err", err)
+		}
+		id, _, err := ts.Reserve(time.Second)
+		if err != nil {
+			fatal("Reserve failed", "err", err)
+		}
+		if err := conn.Bury(id, 0); err != nil {
+			fatal("Bury failed", "id", id, "err", err)
+		}
+	}
+	result("Buried", "jobs", count, "elapsed", time.Since(t0))
+
+	var phase int32
+	putLatency := []*histogram{newHistogram(), newHistogram()}
+	probeDone := make(chan struct{})
+	go probeKickPuts(h, &phase, putLatency, probeDone)
+
+	// The readers keep going until the kicked jobs are gone; the drain
+	// ends with the last delete.
+	var deleted, lastDelete int64
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		rc, err := dialBeanstalk(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer rc.Close()
+			rts := beanstalk.NewTubeSet(rc, kickTube)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id, _, err := rts.Reserve(250 * time.Millisecond)
+				if err != nil {
+					if isTimeout(err) {
+						continue
+					}
+					fatal("Reserve failed", "err", err)
+				}
+				if err := rc.Delete(id); err != nil {
+					slog.Warn("Delete failed", "id", id, "err", err)
+				}
+				atomic.StoreInt64(&lastDelete, time.Now().UnixNano())
+				atomic.AddInt64(&deleted, 1)
+			}
+		}()
+	}
+
+	time.Sleep(kickBaseline)
+	slog.Info("Kicking", "jobs", count)
+	atomic.StoreInt32(&phase, kickPhaseStorm)
+	t0 = time.Now()
+	kicked, err := tube.Kick(count)
+	if err != nil {
+		fatal("Kick failed", "err", err)
+	}
+	result("Kicked", "jobs", kicked, "elapsed", time.Since(t0))
+	if kicked == 0 {
+		fatal("No jobs were kicked", "tube", kickTube)
+	}
+	if kicked < count {
+		slog.Warn("Fewer jobs kicked than buried", "kicked", kicked, "buried", count)
+	}
+
+	for atomic.LoadInt64(&deleted) < int64(kicked) {
+		time.Sleep(time.Millisecond)
+	}
+	elapsed := time.Duration(atomic.LoadInt64(&lastDelete) - t0.UnixNano())
+	atomic.StoreInt32(&phase, kickPhaseDone)
+	close(stop)
+	wg.Wait()
+	<-probeDone
+	result("Kicked backlog drained", "jobs", kicked, "elapsed", elapsed, "req_per_sec", rate(kicked, elapsed))
+
+	for i, name := range []string{"baseline", "storm"} {
+		result("Put latency", append([]any{"phase", name}, latencyArgs(putLatency[i].snapshot())...)...)
+	}
+	clearTube(conn, kickProbeTube)
+}
+
+// probeKickPuts puts a job into the probe tube every kickProbeInterval and
+// records its latency in the histogram of the current phase, until the
+// phase is done.
+func probeKickPuts(h string, phase *int32, latency []*histogram, done chan struct{}) {
+	defer close(done)
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+	tube := &beanstalk.Tube{Conn: conn, Name: kickProbeTube}
+	ticker := time.NewTicker(kickProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p := atomic.LoadInt32(phase)
+		if p == kickPhaseDone {
+			return
+		}
+		t0 := time.Now()
+		if _, err := tube.Put([]byte("probe"), 0, 0, 120*time.Second); err != nil {
+			fatal("Put failed", "err", err)
+		}
+		latency[p].record(time.Since(t0))
+	}
+}
@@ -0,0 +1,104 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"time"
+)
+
+const maxSizeTube = "bench-maxsize"
+
+// probeSizeLimit is where probing gives up growing the payload; beanstalkd
+// itself refuses a -z larger than 1GB.
+const probeSizeLimit = 1 << 30
+
+func isJobTooBig(err error) bool {
+	cerr, ok := err.(beanstalk.ConnError)
+	return ok && cerr.Err == beanstalk.ErrJobTooBig
+}
+
+// probeMaxJobSize binary-searches the largest payload h accepts. Accepted
+// jobs are deleted straight away.
+func probeMaxJobSize(h string) int {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+
+	if stats, err := conn.Stats(); err == nil && stats["max-job-size"] != "" {
+		slog.Info("Server reports max-job-size", "bytes", stats["max-job-size"])
+	}
+
+	tube := &beanstalk.Tube{Conn: conn, Name: maxSizeTube}
+	tries := 0
+	accepts := func(size int) bool {
+		tries++
+		id, err := tube.Put(make([]byte, size), 0, 0, 120*time.Second)
+		if err != nil {
+			if isJobTooBig(err) {
+				return false
+			}
+			fatal("Put failed", "size", size, "err", err)
+		}
+		if err := conn.Delete(id); err != nil {
+			slog.Warn("Delete failed", "id", id, "err", err)
+		}
+		return true
+	}
+
+	// Grow until a size is refused, then narrow down between the largest
+	// accepted and the smallest refused size.
+	lo, hi := 0, 1024
+	for accepts(hi) {
+		lo = hi
+		if hi >= probeSizeLimit {
+			slog.Warn("Server accepted a huge job, giving up", "bytes", hi)
+			return hi
+		}
+		hi *= 2
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if accepts(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	result("Largest accepted job", "bytes", lo, "puts", tries)
+	return lo
+}
+
+// benchmarkNearLimit runs the regular benchmark with job sizes close to the
+// limit, where the allocator of beanstalkd behaves differently than for
+// small jobs.
+func benchmarkNearLimit(hosts []string, publishers, readers, count, limit int) {
+	for i, percent := range []int{50, 90, 100} {
+		size := limit * percent / 100
+		if size == 0 {
+			continue
+		}
+		if i > 0 {
+			settle("stage")
+		}
+		slog.Info("Benchmarking jobs near the limit", "bytes", size, "percent", percent)
+		payload, _ := newPayload("zero", size)
+		benchmark(hosts, publishers, readers, count, count, payload, false, nil)
+	}
+}
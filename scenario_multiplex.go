@@ -0,0 +1,121 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const multiplexTube = "bench-multiplex"
+
+// multiplexLoss is how much slower sharing a connection may be before the
+// worker count counts as the crossover.
+const multiplexLoss = 0.9
+
+// sharedConn is a connection of the native client that many workers take
+// turns on, one command at a time.
+type sharedConn struct {
+	mu   sync.Mutex
+	conn *nativeConn
+}
+
+func (s *sharedConn) put(body []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.put(0, 0, 120*time.Second, body)
+}
+
+func (s *sharedConn) delete(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.delete(id)
+}
+
+func dialMultiplex(h string) *sharedConn {
+	conn, err := dialNative(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	if err := conn.use(multiplexTube); err != nil {
+		fatal("Cannot use tube", "tube", multiplexTube, "err", err)
+	}
+	return &sharedConn{conn: conn}
+}
+
+// multiplexRate runs count put and delete pairs over workers goroutines
+// and returns the pairs per second. With conns of 0 every worker has a
+// connection of its own, otherwise the workers share conns connections.
+func multiplexRate(h string, workers, conns, count, size int) float64 {
+	if conns == 0 {
+		conns = workers
+	}
+	pool := make([]*sharedConn, conns)
+	for i := range pool {
+		pool[i] = dialMultiplex(h)
+	}
+	defer func() {
+		for _, s := range pool {
+			s.conn.Close()
+		}
+	}()
+
+	data := make([]byte, size)
+	wg := sync.WaitGroup{}
+	t0 := time.Now()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(s *sharedConn, n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				id, err := s.put(data)
+				if err != nil {
+					fatal("Put failed", "err", err)
+				}
+				if err := s.delete(id); err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+			}
+		}(pool[i%conns], share(count, workers, i))
+	}
+	wg.Wait()
+	return rate(count, time.Since(t0))
+}
+
+// testMultiplex compares workers with a connection each against the same
+// number of workers sharing conns connections, doubling the workers up to
+// maxWorkers. The crossover is the first worker count at which sharing
+// falls below multiplexLoss of the dedicated rate.
+func testMultiplex(h string, maxWorkers, conns, count, size int) {
+	if conns < 1 {
+		conns = 1
+	}
+	crossover := 0
+	for workers := 1; workers <= maxWorkers; workers *= 2 {
+		dedicated := multiplexRate(h, workers, 0, count, size)
+		shared := multiplexRate(h, workers, conns, count, size)
+		result("Multiplexing", "workers", workers, "connections", conns,
+			"dedicated_req_per_sec", dedicated, "shared_req_per_sec", shared, "shared_ratio", shared/dedicated)
+		if crossover == 0 && shared < dedicated*multiplexLoss {
+			crossover = workers
+		}
+	}
+	if crossover == 0 {
+		slog.Info("Sharing connections kept up with dedicated ones", "max_workers", maxWorkers, "connections", conns)
+		return
+	}
+	result("Multiplexing crossover", "workers", crossover, "connections", conns, "loss_above", 1-multiplexLoss)
+}
@@ -0,0 +1,153 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const pressureTube = "bench-pressure"
+
+// pressureBase is the stored bytes of the first bucket of put latencies;
+// every further bucket covers twice as many.
+const pressureBase = 1 << 20
+
+func pressureBucket(stored int64) int {
+	return bits.Len64(uint64(stored / pressureBase))
+}
+
+// testPressure fills the server with jobs nobody reserves until it holds
+// maxMemory bytes of job bodies, its resident memory (for a local server)
+// reaches maxMemory, or it answers a put with DRAINING or OUT_OF_MEMORY. The
+// put latency is reported by the stored bytes at the time of the put, in
+// buckets that double in size. The jobs are deleted at the end.
+func testPressure(h string, publishers, size int, maxMemory int64) {
+	if maxMemory <= 0 {
+		fatal("-max-server-memory must be positive", "max_server_memory", maxMemory)
+	}
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+	clearTube(conn, pressureTube)
+
+	buckets := make([]*histogram, pressureBucket(maxMemory)+1)
+	for i := range buckets {
+		buckets[i] = newHistogram()
+	}
+	var stored, jobs int64
+	var stopOnce sync.Once
+	stop := make(chan struct{})
+	halt := func(reason string, args ...any) {
+		stopOnce.Do(func() {
+			slog.Info("Stopping the fill", append([]any{"reason", reason}, args...)...)
+			close(stop)
+		})
+	}
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(*sampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			stats, err := serverStats(h)
+			if err != nil {
+				continue
+			}
+			args := []any{"stored_bytes", atomic.LoadInt64(&stored), "jobs", atomic.LoadInt64(&jobs)}
+			if rss, ok := serverRSS(h, stats); ok {
+				args = append(args, "server_rss_bytes", rss)
+				if rss >= maxMemory {
+					halt("server memory", "server_rss_bytes", rss)
+				}
+			}
+			slog.Info("Filling", args...)
+		}
+	}()
+
+	slog.Info("Filling the server", "tube", pressureTube, "max_server_memory", maxMemory, "size", size)
+	data := make([]byte, size)
+	wg := sync.WaitGroup{}
+	t0 := time.Now()
+	for p := 0; p < publishers; p++ {
+		c, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := c.use(pressureTube); err != nil {
+			fatal("Cannot use tube", "tube", pressureTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.Close()
+			for !stopped() {
+				before := atomic.LoadInt64(&stored)
+				if before >= maxMemory {
+					halt("stored bytes", "stored_bytes", before)
+					return
+				}
+				t1 := time.Now()
+				_, err := c.put(0, 0, 120*time.Second, data)
+				switch err {
+				case nil:
+				case errDraining, errOutOfMemory:
+					halt("server refused the put", "err", err)
+					return
+				default:
+					fatal("Put failed", "err", err)
+				}
+				buckets[pressureBucket(before)].record(time.Since(t1))
+				atomic.AddInt64(&stored, int64(size))
+				atomic.AddInt64(&jobs, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	halt("done")
+	elapsed := time.Since(t0)
+
+	for i, b := range buckets {
+		if b.count() == 0 {
+			continue
+		}
+		var from int64
+		if i > 0 {
+			from = pressureBase << (i - 1)
+		}
+		result("Put latency by stored bytes", append([]any{"stored_from", from, "stored_to", int64(pressureBase) << i, "op", "put"}, latencyArgs(b)...)...)
+	}
+	result("Filled", "jobs", atomic.LoadInt64(&jobs), "stored_bytes", atomic.LoadInt64(&stored), "elapsed", elapsed)
+
+	slog.Info("Deleting the jobs", "tube", pressureTube)
+	clearTube(conn, pressureTube)
+}
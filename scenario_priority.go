@@ -0,0 +1,137 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const priorityTube = "bench-priority"
+
+func parsePriorities(s string) []uint32 {
+	var priorities []uint32
+	for _, f := range strings.Split(s, ",") {
+		p, err := strconv.ParseUint(strings.TrimSpace(f), 10, 32)
+		if err != nil {
+			fatal("Invalid priority", "priority", f, "err", err)
+		}
+		priorities = append(priorities, uint32(p))
+	}
+	return priorities
+}
+
+func isTimeout(err error) bool {
+	cerr, ok := err.(beanstalk.ConnError)
+	return ok && cerr.Err == beanstalk.ErrTimeout
+}
+
+// drainTube deletes every ready job of a single tube.
+func drainTube(conn *beanstalk.Conn, tube string) {
+	ts := beanstalk.NewTubeSet(conn, tube)
+	for {
+		id, _, err := ts.Reserve(0)
+		if err != nil {
+			if !isTimeout(err) {
+				fatal("Reserve failed", "tube", tube, "err", err)
+			}
+			return
+		}
+		if err := conn.Delete(id); err != nil {
+			slog.Warn("Delete failed", "id", id, "err", err)
+		}
+	}
+}
+
+// testPriorityOrder publishes count jobs with priorities picked at random
+// from the given set, and only then consumes them on a single connection.
+// As every job is ready by the time the first one is reserved, the server
+// must hand them out in order of priority; any job that arrives after a
+// job with a larger (less urgent) priority is a violation.
+func testPriorityOrder(h string, count, size int, priorities []uint32) {
+	if size < 4 {
+		size = 4
+	}
+
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+
+	drainTube(conn, priorityTube)
+
+	slog.Info("Publishing jobs with mixed priorities", "jobs", count, "priorities", priorities)
+	tube := &beanstalk.Tube{Conn: conn, Name: priorityTube}
+	rng := newRand(streamPriority, 0)
+	published := make(map[uint32]int)
+	t0 := time.Now()
+	for i := 0; i < count; i++ {
+		pri := priorities[rng.Intn(len(priorities))]
+		data := make([]byte, size)
+		binary.BigEndian.PutUint32(data, pri)
+		if _, err := tube.Put(data, pri, 0, 120*time.Second); err != nil {
+			fatal("Put failed", "err", err)
+		}
+		published[pri]++
+	}
+	result("Published", "jobs", count, "elapsed", time.Since(t0))
+	settle("consume")
+
+	ts := beanstalk.NewTubeSet(conn, priorityTube)
+	consumed := make(map[uint32]int)
+	var last uint32
+	var received, violations int
+	t0 = time.Now()
+	for received < count {
+		id, body, err := ts.Reserve(time.Second)
+		if err != nil {
+			if isTimeout(err) {
+				break
+			}
+			fatal("Reserve failed", "err", err)
+		}
+		if err := conn.Delete(id); err != nil {
+			slog.Warn("Delete failed", "id", id, "err", err)
+		}
+		if len(body) < 4 {
+			slog.Warn("Ignoring job without priority", "id", id)
+			continue
+		}
+		pri := binary.BigEndian.Uint32(body)
+		if received > 0 && pri < last {
+			violations++
+			slog.Warn("Job received out of priority order", "id", id, "priority", pri, "after", last)
+		}
+		last = pri
+		consumed[pri]++
+		received++
+	}
+	result("Consumed", "jobs", received, "elapsed", time.Since(t0))
+
+	reported := make(map[uint32]bool)
+	for _, pri := range priorities {
+		if reported[pri] {
+			continue
+		}
+		reported[pri] = true
+		result("Priority", "priority", pri, "published", published[pri], "consumed", consumed[pri])
+	}
+	result("Priority violations", "violations", violations, "missing", count-received)
+}
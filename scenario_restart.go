@@ -0,0 +1,299 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const restartTube = "bench-restart"
+
+// What became of a put of the restart scenario, as the publisher saw it.
+const (
+	putSent uint8 = iota + 1
+	putConfirmed
+	// putUnconfirmed broke off with the connection, so the job may or may
+	// not have been stored.
+	putUnconfirmed
+)
+
+// restartWatch is when the workers of the restart scenario lost the server
+// and got it back. Times are in unix nanoseconds.
+type restartWatch struct {
+	// lastOK is the last operation that succeeded before the server went
+	// away and firstLost the first that failed.
+	lastOK    int64
+	firstLost int64
+	// reconnected is when the last worker reconnected and firstPut when
+	// the first put after that was acknowledged.
+	reconnected int64
+	firstPut    int64
+	// down is how many workers are without a connection.
+	down int64
+}
+
+func (w *restartWatch) ok() {
+	if atomic.LoadInt64(&w.firstLost) != 0 {
+		return
+	}
+	atomic.StoreInt64(&w.lastOK, time.Now().UnixNano())
+}
+
+func (w *restartWatch) lost() {
+	atomic.CompareAndSwapInt64(&w.firstLost, 0, time.Now().UnixNano())
+	atomic.AddInt64(&w.down, 1)
+}
+
+func (w *restartWatch) back() {
+	atomic.StoreInt64(&w.reconnected, time.Now().UnixNano())
+	atomic.AddInt64(&w.down, -1)
+}
+
+func (w *restartWatch) put() {
+	if atomic.LoadInt64(&w.firstLost) != 0 && atomic.LoadInt64(&w.down) == 0 {
+		atomic.CompareAndSwapInt64(&w.firstPut, 0, time.Now().UnixNano())
+	}
+}
+
+// recovered tells whether the server went away and every worker is back.
+func (w *restartWatch) recovered() bool {
+	return atomic.LoadInt64(&w.firstPut) != 0
+}
+
+// testRestart puts sequence numbered jobs at rate from publishers while
+// readers reserve and delete them, and after the given time restarts the
+// server with cmd, or waits for an operator to, for at most wait. The
+// workers reconnect as they would after any failure. Once the server is
+// back and the run went on for after again, the readers drain the tube,
+// and the jobs that were acknowledged and never read, or read twice, tell
+// what the restart lost or redelivered.
+func testRestart(h string, publishers, readers, size int, rate float64, cmd string, after, wait time.Duration) {
+	if size < 8 {
+		size = 8
+	}
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	clearTube(conn, restartTube)
+	conn.Close()
+
+	var mu sync.Mutex
+	// fate holds what the publisher saw of the put of every job, and seen
+	// how often the readers reserved it.
+	fate := make(map[uint64]uint8)
+	seen := make(map[uint64]int)
+	var next uint64
+	var deletesLost counter
+	w := &restartWatch{}
+
+	stop := make(chan struct{})
+	quit := make(chan struct{})
+	stopped := func(c chan struct{}) func() bool {
+		return func() bool {
+			select {
+			case <-c:
+				return true
+			default:
+				return false
+			}
+		}
+	}
+	publishing, abandoned := stopped(stop), stopped(quit)
+
+	slog.Info("Putting and reading jobs", "rate", rate, "publishers", publishers, "readers", readers)
+	pubs := sync.WaitGroup{}
+	for p := 0; p < publishers; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.use(restartTube); err != nil {
+			fatal("Cannot use tube", "tube", restartTube, "err", err)
+		}
+		pubs.Add(1)
+		go func() {
+			defer pubs.Done()
+			defer func() { conn.Close() }()
+			ticker := time.NewTicker(time.Duration(float64(publishers) * float64(time.Second) / rate))
+			defer ticker.Stop()
+			body := make([]byte, size)
+			for !publishing() && !abandoned() {
+				<-ticker.C
+				seq := atomic.AddUint64(&next, 1)
+				binary.BigEndian.PutUint64(body, seq)
+				mu.Lock()
+				fate[seq] = putSent
+				mu.Unlock()
+				_, err := conn.put(0, 0, 120*time.Second, body)
+				if err == nil {
+					mu.Lock()
+					fate[seq] = putConfirmed
+					mu.Unlock()
+					w.ok()
+					w.put()
+					continue
+				}
+				if !connectionLost(err) {
+					fatal("Put failed", "err", err)
+				}
+				mu.Lock()
+				fate[seq] = putUnconfirmed
+				mu.Unlock()
+				w.lost()
+				for {
+					conn = redial(conn, nil, abandoned)
+					if abandoned() || conn.use(restartTube) == nil {
+						break
+					}
+				}
+				w.back()
+			}
+		}()
+	}
+
+	reads := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := watchTubes(conn, []string{restartTube}); err != nil {
+			fatal("Cannot watch tube", "tube", restartTube, "err", err)
+		}
+		reads.Add(1)
+		go func() {
+			defer reads.Done()
+			defer func() { conn.Close() }()
+			for !abandoned() {
+				id, body, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					if publishing() {
+						return
+					}
+					continue
+				}
+				if err == nil {
+					mu.Lock()
+					seen[binary.BigEndian.Uint64(body)]++
+					mu.Unlock()
+					w.ok()
+					if err = conn.delete(id); err != nil && connectionLost(err) {
+						// The job comes back if the server recovers it.
+						deletesLost.add(1)
+					}
+				}
+				if err == nil || err == errDeadlineSoon {
+					continue
+				}
+				if !connectionLost(err) {
+					fatal("Reserve failed", "err", err)
+				}
+				w.lost()
+				conn = redial(conn, []string{restartTube}, abandoned)
+				w.back()
+			}
+		}()
+	}
+
+	time.Sleep(after)
+	var cmdStart time.Time
+	var cmdTook time.Duration
+	if cmd != "" {
+		slog.Info("Restarting the server", "cmd", cmd)
+		cmdStart = time.Now()
+		c := exec.Command("sh", "-c", cmd)
+		c.Stdout, c.Stderr = logOutput, logOutput
+		if err := c.Run(); err != nil {
+			fatal("The restart command failed", "cmd", cmd, "err", err)
+		}
+		cmdTook = time.Since(cmdStart)
+	} else {
+		slog.Warn("RESTART THE SERVER NOW", "host", h, "within", wait)
+	}
+	deadline := time.Now().Add(wait)
+	for !w.recovered() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !w.recovered() {
+		close(quit)
+		pubs.Wait()
+		reads.Wait()
+		if atomic.LoadInt64(&w.firstLost) == 0 {
+			fatal("The server did not go away", "within", wait)
+		}
+		fatal("The server did not come back", "within", wait)
+	}
+	slog.Info("The server is back, carrying on", "for", after)
+	time.Sleep(after)
+	close(stop)
+	pubs.Wait()
+	slog.Info("Draining the tube")
+	reads.Wait()
+
+	lastOK, firstLost := time.Unix(0, w.lastOK), time.Unix(0, w.firstLost)
+	detected := firstLost.Sub(lastOK)
+	if cmd != "" {
+		detected = firstLost.Sub(cmdStart)
+	}
+	var confirmed, unconfirmed, unconfirmedLanded, lost, duplicates, read int
+	for seq, f := range fate {
+		n := seen[seq]
+		read += n
+		if n > 1 {
+			duplicates++
+		}
+		switch f {
+		case putConfirmed:
+			confirmed++
+			if n == 0 {
+				lost++
+			}
+		case putUnconfirmed:
+			unconfirmed++
+			if n > 0 {
+				unconfirmedLanded++
+			}
+		}
+	}
+	args := []any{"detection", detected.Round(time.Microsecond),
+		"reconnect", time.Unix(0, w.reconnected).Sub(firstLost).Round(time.Microsecond),
+		"no_put_for", time.Unix(0, w.firstPut).Sub(lastOK).Round(time.Microsecond)}
+	if cmd != "" {
+		args = append(args, "cmd_took", cmdTook.Round(time.Millisecond))
+	}
+	result("Restart", args...)
+	result("Restart jobs", "puts", len(fate), "acknowledged", confirmed, "lost", lost,
+		"unacknowledged", unconfirmed, "unacknowledged_landed", unconfirmedLanded,
+		"read", read, "duplicates", duplicates, "deletes_lost", deletesLost.load())
+	if lost > 0 {
+		slog.Warn("ACKNOWLEDGED JOBS WERE LOST ACROSS THE RESTART, is the binlog (-b) of the server on?", "lost", lost, "of", confirmed)
+	}
+	if duplicates > 0 {
+		slog.Warn("Jobs were reserved more than once across the restart", "jobs", duplicates, "deletes_lost", deletesLost.load())
+	}
+
+	conn, err = dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+	clearTube(conn, restartTube)
+}
@@ -0,0 +1,170 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const standbyTube = "bench-standby"
+
+// standbyWindow is the interval over which the standby scenario takes the
+// consume rate, and standbySteady the share of the offered rate at which
+// it counts as steady.
+const (
+	standbyWindow = 100 * time.Millisecond
+	standbySteady = 0.9
+)
+
+// testStandby models a fleet of workers that autoscaling spins up: a
+// publisher puts rate jobs a second while readers are connected and
+// watch the tube but do not reserve. After idle they all activate at once
+// and consume for d. It reports how long after the activation each reader
+// got its first job, how long the pool took to consume at the offered rate
+// and how long to clear the backlog that built up while it stood by.
+func testStandby(h string, readers, size int, rate float64, idle, d time.Duration) {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+	clearTube(conn, standbyTube)
+	defer clearTube(conn, standbyTube)
+
+	activate := make(chan struct{})
+	stop := make(chan struct{})
+	var activated time.Time
+	var puts, reads int64
+	firstJob := newHistogram()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := watchTubes(conn, []string{standbyTube}); err != nil {
+			fatal("Cannot watch tube", "tube", standbyTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			select {
+			case <-activate:
+			case <-stop:
+				return
+			}
+			first := true
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id, _, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					continue
+				}
+				if err != nil {
+					fatal("Reserve failed", "err", err)
+				}
+				if first {
+					firstJob.record(time.Since(activated))
+					first = false
+				}
+				if err := conn.delete(id); err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+				atomic.AddInt64(&reads, 1)
+			}
+		}()
+	}
+
+	publisher, err := dialNative(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	if err := publisher.use(standbyTube); err != nil {
+		fatal("Cannot use tube", "tube", standbyTube, "err", err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer publisher.Close()
+		body := make([]byte, size)
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if _, err := publisher.put(0, 0, 120*time.Second, body); err != nil {
+				fatal("Put failed", "err", err)
+			}
+			atomic.AddInt64(&puts, 1)
+		}
+	}()
+
+	slog.Info("Readers standing by", "readers", readers, "rate", rate, "idle", idle)
+	time.Sleep(idle)
+	backlog := atomic.LoadInt64(&puts)
+	slog.Info("Activating the readers", "readers", readers, "backlog", backlog)
+	activated = time.Now()
+	close(activate)
+
+	// The pool is steady once a window is consumed at nearly the offered
+	// rate, and caught up once at most a window of jobs is left over.
+	var steady, caughtUp time.Duration
+	last := int64(0)
+	ticker := time.NewTicker(standbyWindow)
+	end := time.After(d)
+	for done := false; !done; {
+		select {
+		case <-end:
+			done = true
+		case <-ticker.C:
+			n := atomic.LoadInt64(&reads)
+			since := time.Since(activated)
+			if steady == 0 && float64(n-last) >= standbySteady*rate*standbyWindow.Seconds() {
+				steady = since
+			}
+			if caughtUp == 0 && float64(atomic.LoadInt64(&puts)-n) <= rate*standbyWindow.Seconds() {
+				caughtUp = since
+			}
+			last = n
+		}
+	}
+	ticker.Stop()
+	close(stop)
+	wg.Wait()
+
+	result("Standby activation", "readers", readers, "rate", rate, "idle", idle, "backlog", backlog,
+		"activated", firstJob.count(), "steady", steady, "caught_up", caughtUp)
+	if firstJob.count() > 0 {
+		result("Standby first job", latencyArgs(firstJob.snapshot())...)
+	}
+	if steady == 0 {
+		slog.Warn("The readers never consumed at the offered rate", "rate", rate, "for", d)
+	}
+	if caughtUp == 0 {
+		slog.Warn("The readers never cleared the backlog", "left", atomic.LoadInt64(&puts)-atomic.LoadInt64(&reads), "for", d)
+	}
+}
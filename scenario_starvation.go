@@ -0,0 +1,182 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const starvationTube = "bench-starvation"
+
+// The priorities of the flood and of the trickle in the starvation
+// scenario; the flood is the more urgent.
+const (
+	starvationHigh uint32 = 0
+	starvationLow  uint32 = 1 << 16
+)
+
+// testStarvation floods the server with urgent jobs from publishers for d
+// while a trickle of rate low priority jobs a second joins them, and
+// readers consume both. It reports how long the jobs of either priority
+// waited until they were reserved, and the low priority jobs that were
+// never reserved within the run, with the longest any of them waited.
+func testStarvation(h string, publishers, readers, size int, rate float64, d time.Duration) {
+	if size < 8 {
+		size = 8
+	}
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	defer conn.Close()
+	clearTube(conn, starvationTube)
+	// What the flood left behind goes with the run.
+	defer clearTube(conn, starvationTube)
+
+	high, low := newHistogram(), newHistogram()
+	var floodPuts, trickled int64
+	// waiting holds the time of the put of every low priority job that was
+	// not reserved yet.
+	var mu sync.Mutex
+	waiting := make(map[uint64]time.Time)
+	stop := make(chan struct{})
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := watchTubes(conn, []string{starvationTube}); err != nil {
+			fatal("Cannot watch tube", "tube", starvationTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for !stopped() {
+				id, body, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					continue
+				}
+				if err != nil {
+					fatal("Reserve failed", "err", err)
+				}
+				waited := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(body))))
+				if body[len(body)-1] == 1 {
+					low.record(waited)
+					mu.Lock()
+					delete(waiting, id)
+					mu.Unlock()
+				} else {
+					high.record(waited)
+				}
+				if err := conn.delete(id); err != nil {
+					fatal("Delete failed", "id", id, "err", err)
+				}
+			}
+		}()
+	}
+
+	slog.Info("Flooding with urgent jobs", "publishers", publishers, "low_priority_rate", rate, "duration", d)
+	for p := 0; p < publishers; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := conn.use(starvationTube); err != nil {
+			fatal("Cannot use tube", "tube", starvationTube, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			body := make([]byte, size)
+			for !stopped() {
+				binary.BigEndian.PutUint64(body, uint64(time.Now().UnixNano()))
+				if _, err := conn.put(starvationHigh, 0, 120*time.Second, body); err != nil {
+					fatal("Put failed", "err", err)
+				}
+				atomic.AddInt64(&floodPuts, 1)
+			}
+		}()
+	}
+	trickle, err := dialNative(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	if err := trickle.use(starvationTube); err != nil {
+		fatal("Cannot use tube", "tube", starvationTube, "err", err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer trickle.Close()
+		body := make([]byte, size)
+		body[size-1] = 1
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			t := time.Now()
+			binary.BigEndian.PutUint64(body, uint64(t.UnixNano()))
+			// The reader may have the job before its id is known here.
+			mu.Lock()
+			id, err := trickle.put(starvationLow, 0, 120*time.Second, body)
+			if err == nil {
+				waiting[id] = t
+			}
+			mu.Unlock()
+			if err != nil {
+				fatal("Put failed", "err", err)
+			}
+			trickled++
+		}
+	}()
+
+	time.Sleep(d)
+	close(stop)
+	wg.Wait()
+
+	var oldest time.Duration
+	end := time.Now()
+	for _, t := range waiting {
+		if age := end.Sub(t); age > oldest {
+			oldest = age
+		}
+	}
+	result("Starvation wait", append([]any{"priority", starvationHigh, "puts", floodPuts}, latencyArgs(high)...)...)
+	result("Starvation wait", append([]any{"priority", starvationLow, "puts", trickled}, latencyArgs(low)...)...)
+	result("Starved", "low_priority_puts", trickled, "never_reserved", len(waiting), "longest_waiting", oldest)
+	if len(waiting) > 0 {
+		slog.Warn("Low priority jobs were starved", "never_reserved", len(waiting), "of", trickled)
+	}
+}
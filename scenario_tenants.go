@@ -0,0 +1,260 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tenant is a user of a shared server in the tenants scenario, as read
+// from the -tenants file.
+type tenant struct {
+	Name string `json:"name"`
+	// Tubes are the tubes of the tenant, "tenant-<name>" by default.
+	Tubes []string `json:"tubes"`
+	// Rate is the jobs per second its publishers offer together, 0 for as
+	// fast as they can.
+	Rate float64 `json:"rate"`
+	Size int     `json:"size"`
+	// Priority is the band its priorities are drawn from evenly, both
+	// ends included.
+	Priority   [2]uint32 `json:"priority"`
+	Publishers int       `json:"publishers"`
+	Readers    int       `json:"readers"`
+	Jobs       int       `json:"jobs"`
+}
+
+// readTenants reads a JSON array of tenants, filling in size and count for
+// those that leave out their size or jobs.
+func readTenants(path string, size, count int) ([]tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, err
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("%s has no tenants", path)
+	}
+	seen := make(map[string]bool)
+	for i := range tenants {
+		t := &tenants[i]
+		if t.Name == "" || seen[t.Name] {
+			return nil, fmt.Errorf("tenant %d needs a name of its own", i+1)
+		}
+		seen[t.Name] = true
+		if len(t.Tubes) == 0 {
+			t.Tubes = []string{"tenant-" + t.Name}
+		}
+		if t.Size == 0 {
+			t.Size = size
+		}
+		if t.Size < 8 {
+			// The body carries the time of the put.
+			t.Size = 8
+		}
+		if t.Jobs == 0 {
+			t.Jobs = count
+		}
+		if t.Publishers == 0 {
+			t.Publishers = 1
+		}
+		if t.Readers == 0 {
+			t.Readers = 1
+		}
+		if t.Rate < 0 || t.Jobs < 0 || t.Publishers < 0 || t.Readers < 0 || t.Priority[0] > t.Priority[1] {
+			return nil, fmt.Errorf("tenant %q has a negative rate, jobs, publishers or readers, or an inverted priority band", t.Name)
+		}
+	}
+	return tenants, nil
+}
+
+// tenantResult is what a tenant measured in a phase of the scenario.
+type tenantResult struct {
+	put, reserve, delete *histogram
+	// queued is the time from the put of a job until it was reserved.
+	queued  *histogram
+	elapsed time.Duration
+}
+
+// runTenant puts the jobs of t over its tubes at its rate while its readers
+// consume them from all of its tubes.
+func runTenant(h string, index int, t tenant) *tenantResult {
+	res := &tenantResult{put: newHistogram(), reserve: newHistogram(), delete: newHistogram(), queued: newHistogram()}
+	pace := newPacer(t.Rate)
+	var done int64
+	wg := sync.WaitGroup{}
+	t0 := time.Now()
+	for i := 0; i < t.Readers; i++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		if err := watchTubes(conn, t.Tubes); err != nil {
+			fatal("Cannot watch the tubes", "tenant", t.Name, "err", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			for atomic.LoadInt64(&done) < int64(t.Jobs) {
+				t1 := time.Now()
+				id, body, err := conn.reserve(time.Second)
+				if err == errTimedOut {
+					continue
+				}
+				if err != nil {
+					fatal("Reserve failed", "tenant", t.Name, "err", err)
+				}
+				res.reserve.record(time.Since(t1))
+				res.queued.record(time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(body)))))
+				t1 = time.Now()
+				if err := conn.delete(id); err != nil {
+					fatal("Delete failed", "tenant", t.Name, "id", id, "err", err)
+				}
+				res.delete.record(time.Since(t1))
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+	for p := 0; p < t.Publishers; p++ {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			defer conn.Close()
+			rng := newRand(streamTenant, uint64(index)<<32|uint64(p))
+			body := make([]byte, t.Size)
+			used := ""
+			for j := 0; j < share(t.Jobs, t.Publishers, p); j++ {
+				tube := t.Tubes[(j*t.Publishers+p)%len(t.Tubes)]
+				if tube != used {
+					if err := conn.use(tube); err != nil {
+						fatal("Cannot use tube", "tube", tube, "err", err)
+					}
+					used = tube
+				}
+				pri := t.Priority[0] + uint32(rng.Int63n(int64(t.Priority[1]-t.Priority[0])+1))
+				pace.wait(1)
+				t1 := time.Now()
+				binary.BigEndian.PutUint64(body, uint64(t1.UnixNano()))
+				if _, err := conn.put(pri, 0, 120*time.Second, body); err != nil {
+					fatal("Put failed", "tenant", t.Name, "err", err)
+				}
+				res.put.record(time.Since(t1))
+			}
+		}(p)
+	}
+	wg.Wait()
+	res.elapsed = time.Since(t0)
+	return res
+}
+
+// runTenants runs the tenants at once and returns what each measured.
+func runTenants(h string, tenants []tenant, indexes []int) []*tenantResult {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	for _, i := range indexes {
+		for _, tube := range tenants[i].Tubes {
+			clearTube(conn, tube)
+		}
+	}
+	conn.Close()
+
+	results := make([]*tenantResult, len(indexes))
+	wg := sync.WaitGroup{}
+	for n, i := range indexes {
+		wg.Add(1)
+		go func(n, i int) {
+			defer wg.Done()
+			results[n] = runTenant(h, i, tenants[i])
+		}(n, i)
+	}
+	wg.Wait()
+	return results
+}
+
+// reportTenant logs the rate and latencies of a tenant in a phase.
+func reportTenant(t tenant, phase string, res *tenantResult) {
+	result("Tenant", "tenant", t.Name, "phase", phase, "jobs", t.Jobs, "elapsed", res.elapsed, "req_per_sec", rate(t.Jobs, res.elapsed))
+	for _, op := range []operation{{"put", res.put}, {"reserve", res.reserve}, {"delete", res.delete}, {"queued", res.queued}} {
+		result("Tenant latency", append([]any{"tenant", t.Name, "phase", phase, "op", op.name}, latencyArgs(op.hist)...)...)
+	}
+}
+
+// testTenants runs the tenants of the -tenants file on a shared server,
+// each with its own tubes, rate, job size and priority band, and reports
+// the latencies of every tenant. Unless isolated is false every tenant is
+// run on its own first, and the p99 of its latencies when sharing the
+// server is compared with those, which tells what the neighbors cost it.
+func testTenants(h, path string, size, count int, isolated bool) {
+	tenants, err := readTenants(path, size, count)
+	if err != nil {
+		fatal("Invalid -tenants", "err", err)
+	}
+	alone := make([]*tenantResult, len(tenants))
+	if isolated {
+		for i, t := range tenants {
+			slog.Info("Running tenant alone", "tenant", t.Name, "jobs", t.Jobs, "rate", t.Rate)
+			alone[i] = runTenants(h, tenants, []int{i})[0]
+			reportTenant(t, "alone", alone[i])
+		}
+	}
+	all := make([]int, len(tenants))
+	for i := range all {
+		all[i] = i
+	}
+	slog.Info("Running tenants together", "tenants", len(tenants))
+	shared := runTenants(h, tenants, all)
+	for i, t := range tenants {
+		reportTenant(t, "shared", shared[i])
+		if !isolated {
+			continue
+		}
+		args := []any{"tenant", t.Name}
+		for _, op := range []string{"put", "reserve", "queued"} {
+			a, s := tenantHistogram(alone[i], op).quantile(0.99), tenantHistogram(shared[i], op).quantile(0.99)
+			args = append(args, op+"_p99_alone", a, op+"_p99_shared", s)
+			if a > 0 {
+				args = append(args, op+"_p99_slowdown", float64(s)/float64(a))
+			}
+		}
+		result("Noisy neighbors", args...)
+	}
+}
+
+func tenantHistogram(res *tenantResult, op string) *histogram {
+	switch op {
+	case "put":
+		return res.put
+	case "reserve":
+		return res.reserve
+	}
+	return res.queued
+}
@@ -0,0 +1,180 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tubesWindows is the number of steps in which the tubes scenario creates
+// its tubes, sampling the server after each.
+const tubesWindows = 10
+
+func manyTube(i int) string {
+	return fmt.Sprintf("bench-tubes-%d", i)
+}
+
+// serverRSS returns the resident memory of the server in bytes, which
+// beanstalkd does not report in its stats. It is only known for a server
+// on this machine, from the /proc entry of the pid of its stats.
+func serverRSS(h string, stats map[string]string) (int64, bool) {
+	host, _, err := net.SplitHostPort(h)
+	if err != nil {
+		return 0, false
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return 0, false
+	}
+	return processRSS(stats["pid"])
+}
+
+// processRSS returns the resident memory in bytes of the process with the
+// given pid, or "self", from its /proc entry.
+func processRSS(pid string) (int64, bool) {
+	f, err := os.Open("/proc/" + pid + "/status")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "VmRSS:"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB")), 10, 64)
+			return kb * 1024, err == nil
+		}
+	}
+	return 0, false
+}
+
+// sampleTubes logs the number of tubes of the server and its memory, if
+// it can be read, and returns the number of tubes.
+func sampleTubes(h string, args ...any) int64 {
+	stats, err := serverStats(h)
+	if err != nil {
+		fatal("Cannot fetch server stats", "host", h, "err", err)
+	}
+	tubes, _ := strconv.ParseInt(stats["current-tubes"], 10, 64)
+	args = append(args, "current_tubes", tubes)
+	if rss, ok := serverRSS(h, stats); ok {
+		args = append(args, "server_rss_bytes", rss)
+	}
+	result("Tubes", args...)
+	return tubes
+}
+
+// testManyTubes puts count jobs spread across tubeCount tubes of their own,
+// at least one job per tube, and reports the put latency and the server's
+// memory as the tubes accumulate. The jobs are deleted at the end, after
+// which the server should have freed the tubes again.
+func testManyTubes(h string, tubeCount, publishers, count, size int) {
+	if tubeCount < 1 {
+		fatal("-tube-count must be at least 1", "tube_count", tubeCount)
+	}
+	before := sampleTubes(h, "phase", "start")
+
+	data := make([]byte, size)
+	var created int64
+	for w := 0; w < tubesWindows; w++ {
+		first, last := w*tubeCount/tubesWindows, (w+1)*tubeCount/tubesWindows
+		if first == last {
+			continue
+		}
+		put := newHistogram()
+		next := int64(first)
+		wg := sync.WaitGroup{}
+		for p := 0; p < publishers; p++ {
+			conn, err := dialNative(h)
+			if err != nil {
+				fatal("Cannot connect", "host", h, "err", err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				for {
+					t := int(atomic.AddInt64(&next, 1) - 1)
+					if t >= last {
+						return
+					}
+					if err := conn.use(manyTube(t)); err != nil {
+						fatal("Cannot use tube", "tube", manyTube(t), "err", err)
+					}
+					n := share(count, tubeCount, t)
+					if n < 1 {
+						n = 1
+					}
+					for j := n; j > 0; j-- {
+						t0 := time.Now()
+						if _, err := conn.put(0, 0, 120*time.Second, data); err != nil {
+							fatal("Put failed", "tube", manyTube(t), "err", err)
+						}
+						put.record(time.Since(t0))
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		created = int64(last)
+		sampleTubes(h, append([]any{"phase", "fill", "created", created, "op", "put"}, latencyArgs(put)...)...)
+	}
+
+	slog.Info("Deleting the jobs of every tube", "tubes", tubeCount)
+	t0 := time.Now()
+	conn, err := dialNative(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	watched := "default"
+	for t := 0; t < tubeCount; t++ {
+		if err := conn.watch(manyTube(t)); err == nil {
+			err = conn.ignore(watched)
+		}
+		if err != nil {
+			fatal("Cannot watch tube", "tube", manyTube(t), "err", err)
+		}
+		watched = manyTube(t)
+		for {
+			id, _, err := conn.reserve(0)
+			if err == errTimedOut {
+				break
+			}
+			if err != nil {
+				fatal("Reserve failed", "tube", watched, "err", err)
+			}
+			if err := conn.delete(id); err != nil {
+				fatal("Delete failed", "id", id, "err", err)
+			}
+		}
+	}
+	conn.Close()
+	cleanup := time.Since(t0)
+	// The server frees a tube once it is empty and no connection uses or
+	// watches it, which for the last one happens when the connection is
+	// closed.
+	time.Sleep(100 * time.Millisecond)
+	after := sampleTubes(h, "phase", "cleanup", "elapsed", cleanup)
+	if left := after - before; left > 0 {
+		slog.Warn("The server kept tubes after they were emptied", "tubes", left)
+	}
+}
@@ -0,0 +1,213 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// putJob is a job to put: its body and the parameters of its put.
+type putJob struct {
+	body  []byte
+	pri   uint32
+	delay time.Duration
+	ttr   time.Duration
+}
+
+// defaultJob is the put of a job without a script.
+var defaultJob = putJob{ttr: 120 * time.Second}
+
+// jobScript is the Starlark script of -script. Its function produce(seq,
+// publisher) returns the body of a job, as a string or bytes, or a dict of
+// its body and the pri, delay and ttr of its put, the times in seconds;
+// consume(body) gets the body of a job a reader reserved as a string and
+// returns what the reader does with it, "delete", "release" or "bury", or
+// None for the odds of -outcome. Either may be left out. The script also
+// sees size, which is -s, and random() and randint(a, b), which draw from
+// the stream of -seed.
+type jobScript struct {
+	path    string
+	produce starlark.Value
+	consume starlark.Value
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// script is the script of -script, nil without it.
+var script *jobScript
+
+func loadScript(path string) (*jobScript, error) {
+	s := &jobScript{path: path, rng: newRand(streamScript, 0)}
+	predeclared := starlark.StringDict{
+		"size": starlark.MakeInt(*size),
+		"random": starlark.NewBuiltin("random", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackPositionalArgs("random", args, kwargs, 0); err != nil {
+				return nil, err
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return starlark.Float(s.rng.Float64()), nil
+		}),
+		"randint": starlark.NewBuiltin("randint", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var lo, hi int
+			if err := starlark.UnpackPositionalArgs("randint", args, kwargs, 2, &lo, &hi); err != nil {
+				return nil, err
+			}
+			if hi < lo {
+				return nil, fmt.Errorf("randint: %d is below %d", hi, lo)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return starlark.MakeInt(lo + s.rng.Intn(hi-lo+1)), nil
+		}),
+	}
+	globals, err := starlark.ExecFile(s.thread("load"), path, nil, predeclared)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	s.produce, s.consume = globals["produce"], globals["consume"]
+	if s.produce == nil && s.consume == nil {
+		return nil, fmt.Errorf("%s defines neither produce nor consume", path)
+	}
+	for name, fn := range map[string]starlark.Value{"produce": s.produce, "consume": s.consume} {
+		if _, ok := fn.(starlark.Callable); fn != nil && !ok {
+			return nil, fmt.Errorf("%s: %s is a %s, not a function", path, name, fn.Type())
+		}
+	}
+	return s, nil
+}
+
+// thread returns a thread for a call of the script; a thread must not be
+// shared between goroutines.
+func (s *jobScript) thread(name string) *starlark.Thread {
+	return &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			slog.Info(msg, "script", s.path)
+		},
+	}
+}
+
+// scriptError adds the Starlark backtrace to err.
+func scriptError(err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return errors.New(evalErr.Backtrace())
+	}
+	return err
+}
+
+// next returns the job seq of publisher p, the default one if the script
+// has no produce. Its body is what the script returned, without the headers
+// the payload adds.
+func (s *jobScript) next(p, seq int) putJob {
+	job := defaultJob
+	if s.produce == nil {
+		return job
+	}
+	v, err := starlark.Call(s.thread("produce"), s.produce, starlark.Tuple{starlark.MakeInt(seq), starlark.MakeInt(p)}, nil)
+	if err != nil {
+		fatal("The produce of the script failed", "script", s.path, "err", scriptError(err))
+	}
+	dict, isDict := v.(*starlark.Dict)
+	if isDict {
+		if v, _, err = dict.Get(starlark.String("body")); err != nil || v == nil {
+			fatal("The produce of the script returned a dict without a body", "script", s.path)
+		}
+	}
+	switch v := v.(type) {
+	case starlark.String:
+		job.body = []byte(v)
+	case starlark.Bytes:
+		job.body = []byte(v)
+	default:
+		fatal("The produce of the script returned neither a string, bytes nor a dict", "script", s.path, "type", v.Type())
+	}
+	if !isDict {
+		return job
+	}
+	if v, ok, _ := dict.Get(starlark.String("pri")); ok {
+		pri, err := starlark.AsInt32(v)
+		if err != nil || pri < 0 {
+			fatal("The produce of the script returned an invalid pri", "script", s.path, "pri", v.String())
+		}
+		job.pri = uint32(pri)
+	}
+	seconds := func(key string, d *time.Duration) {
+		if v, ok, _ := dict.Get(starlark.String(key)); ok {
+			f, ok := starlark.AsFloat(v)
+			if !ok || f < 0 {
+				fatal("The produce of the script returned an invalid "+key, "script", s.path, key, v.String())
+			}
+			*d = time.Duration(f * float64(time.Second))
+		}
+	}
+	seconds("delay", &job.delay)
+	seconds("ttr", &job.ttr)
+	return job
+}
+
+// outcome returns what the script says to do with the job of body, o with
+// no consume or a consume that returns None.
+func (s *jobScript) outcome(body []byte, o outcome) outcome {
+	if s == nil || s.consume == nil {
+		return o
+	}
+	if len(body) >= decodePrefix {
+		body = body[decodePrefix:]
+	}
+	v, err := starlark.Call(s.thread("consume"), s.consume, starlark.Tuple{starlark.String(body)}, nil)
+	if err != nil {
+		fatal("The consume of the script failed", "script", s.path, "err", scriptError(err))
+	}
+	if v == starlark.None {
+		return o
+	}
+	name, _ := starlark.AsString(v)
+	for i, n := range outcomeNames {
+		if n == name {
+			return outcome(i)
+		}
+	}
+	fatal("The consume of the script returned an unknown outcome, want delete, release, bury or None", "script", s.path, "outcome", v.String())
+	return o
+}
+
+// scriptPayload returns the payload of a publisher of -script, the body in
+// raw behind the bytes -decode leaves to the headers of -verify-order and
+// -shared, marked and compressed like any other payload.
+func (r *run) scriptPayload(raw *[]byte) payloadFunc {
+	payload := func(buf []byte) []byte {
+		for i := 0; i < decodePrefix; i++ {
+			buf = append(buf, 0)
+		}
+		return append(buf, *raw...)
+	}
+	if markJobs() {
+		payload = markedPayload(payload)
+	}
+	if *compressCodec != "none" {
+		payload = compressedPayload(payload, r.metrics)
+	}
+	return payload
+}
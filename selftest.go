@@ -0,0 +1,921 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The embedded server of -selftest speaks enough of the beanstalkd protocol
+// for the benchmark, its scenarios and both clients: jobs with priorities,
+// delays and TTRs, tubes, burying and kicking, and the stats commands. It
+// keeps everything in memory and has no binlog.
+const (
+	selftestVersion    = "selftest"
+	selftestMaxJobSize = 65535
+	selftestMaxLine    = 224
+	selftestMaxTube    = 200
+	// selftestSafetyMargin is the last part of a TTR in which reserves get
+	// DEADLINE_SOON, as with beanstalkd.
+	selftestSafetyMargin = time.Second
+	// selftestTick is how often TTRs and delays are checked.
+	selftestTick = 10 * time.Millisecond
+)
+
+type jobState int
+
+const (
+	stateReady jobState = iota
+	stateDelayed
+	stateReserved
+	stateBuried
+)
+
+var jobStateNames = []string{"ready", "delayed", "reserved", "buried"}
+
+type sjob struct {
+	id       uint64
+	pri      uint32
+	delay    time.Duration
+	ttr      time.Duration
+	body     []byte
+	tube     *stube
+	state    jobState
+	created  time.Time
+	deadline time.Time // when delayed or reserved
+	owner    *sconn    // when reserved
+	index    int       // in the ready heap
+
+	reserves, timeouts, releases, buries, kicks int
+}
+
+// readyQueue orders the ready jobs of a tube by priority, then by id.
+type readyQueue []*sjob
+
+func (q readyQueue) Len() int { return len(q) }
+func (q readyQueue) Less(i, j int) bool {
+	if q[i].pri != q[j].pri {
+		return q[i].pri < q[j].pri
+	}
+	return q[i].id < q[j].id
+}
+func (q readyQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *readyQueue) Push(x any) {
+	j := x.(*sjob)
+	j.index = len(*q)
+	*q = append(*q, j)
+}
+func (q *readyQueue) Pop() any {
+	old := *q
+	j := old[len(old)-1]
+	*q = old[:len(old)-1]
+	j.index = -1
+	return j
+}
+
+type stube struct {
+	name     string
+	ready    readyQueue
+	buried   []*sjob
+	delayed  map[uint64]*sjob
+	reserved int
+	total    int64
+	deletes  int64
+	using    int
+	watching int
+}
+
+// sconn is a client connection of the embedded server.
+type sconn struct {
+	use      *stube
+	watch    map[string]bool
+	reserved map[uint64]*sjob
+}
+
+type waiter struct {
+	c  *sconn
+	ch chan *sjob
+}
+
+type selftestServer struct {
+	mu      sync.Mutex
+	ln      net.Listener
+	started time.Time
+	nextID  uint64
+	jobs    map[uint64]*sjob
+	tubes   map[string]*stube
+	waiters []*waiter
+	cmds    map[string]int64
+	conns   int
+	total   int
+	timeout int64
+}
+
+// startSelftestServer listens on a free port of the loopback interface.
+func startSelftestServer() (*selftestServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &selftestServer{
+		ln:      ln,
+		started: time.Now(),
+		jobs:    make(map[uint64]*sjob),
+		tubes:   make(map[string]*stube),
+		cmds:    make(map[string]int64),
+	}
+	go s.tick()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *selftestServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *selftestServer) tube(name string) *stube {
+	t, ok := s.tubes[name]
+	if !ok {
+		t = &stube{name: name, delayed: make(map[uint64]*sjob)}
+		s.tubes[name] = t
+	}
+	return t
+}
+
+// tick moves delayed jobs whose delay is over, and reserved ones whose TTR
+// ran out, to the ready queues.
+func (s *selftestServer) tick() {
+	for range time.Tick(selftestTick) {
+		now := time.Now()
+		s.mu.Lock()
+		moved := false
+		for _, j := range s.jobs {
+			if j.state == stateDelayed && !now.Before(j.deadline) {
+				delete(j.tube.delayed, j.id)
+				s.makeReady(j)
+				moved = true
+			} else if j.state == stateReserved && !now.Before(j.deadline) {
+				delete(j.owner.reserved, j.id)
+				j.tube.reserved--
+				j.owner = nil
+				j.timeouts++
+				s.timeout++
+				s.makeReady(j)
+				moved = true
+			}
+		}
+		if moved {
+			s.wake()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// reap frees t once it is empty and no connection uses or watches it, as
+// beanstalkd does. The default tube is kept.
+func (s *selftestServer) reap(t *stube) {
+	if t.name == "default" || t.using > 0 || t.watching > 0 || t.reserved > 0 ||
+		len(t.ready) > 0 || len(t.buried) > 0 || len(t.delayed) > 0 {
+		return
+	}
+	delete(s.tubes, t.name)
+}
+
+func (s *selftestServer) makeReady(j *sjob) {
+	j.state = stateReady
+	heap.Push(&j.tube.ready, j)
+}
+
+// unlink takes a job out of wherever its state keeps it.
+func (s *selftestServer) unlink(j *sjob) {
+	switch j.state {
+	case stateReady:
+		heap.Remove(&j.tube.ready, j.index)
+	case stateDelayed:
+		delete(j.tube.delayed, j.id)
+	case stateReserved:
+		delete(j.owner.reserved, j.id)
+		j.tube.reserved--
+		j.owner = nil
+	case stateBuried:
+		for i, b := range j.tube.buried {
+			if b == j {
+				j.tube.buried = append(j.tube.buried[:i], j.tube.buried[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (s *selftestServer) reserveFor(c *sconn, j *sjob) {
+	s.unlink(j)
+	j.state = stateReserved
+	j.owner = c
+	j.deadline = time.Now().Add(j.ttr)
+	j.reserves++
+	j.tube.reserved++
+	c.reserved[j.id] = j
+}
+
+// next returns the most urgent ready job of the tubes c watches.
+func (s *selftestServer) next(c *sconn) *sjob {
+	var best *sjob
+	for name := range c.watch {
+		t := s.tubes[name]
+		if t == nil || len(t.ready) == 0 {
+			continue
+		}
+		j := t.ready[0]
+		if best == nil || j.pri < best.pri || (j.pri == best.pri && j.id < best.id) {
+			best = j
+		}
+	}
+	return best
+}
+
+// wake hands ready jobs to the connections waiting in a reserve, in the
+// order they started waiting.
+func (s *selftestServer) wake() {
+	kept := s.waiters[:0]
+	for _, w := range s.waiters {
+		if j := s.next(w.c); j != nil {
+			s.reserveFor(w.c, j)
+			w.ch <- j
+			continue
+		}
+		kept = append(kept, w)
+	}
+	s.waiters = kept
+}
+
+// deadlineSoon returns when the first job c holds enters its safety
+// margin.
+func (c *sconn) deadlineSoon() (time.Time, bool) {
+	var soon time.Time
+	for _, j := range c.reserved {
+		if t := j.deadline.Add(-selftestSafetyMargin); soon.IsZero() || t.Before(soon) {
+			soon = t
+		}
+	}
+	return soon, !soon.IsZero()
+}
+
+var errSelftestDeadlineSoon = fmt.Errorf("DEADLINE_SOON")
+
+// reserve waits up to timeout, or forever if timeout is negative, for a job.
+func (s *selftestServer) reserve(c *sconn, timeout time.Duration) (*sjob, error) {
+	s.mu.Lock()
+	if j := s.next(c); j != nil {
+		s.reserveFor(c, j)
+		s.mu.Unlock()
+		return j, nil
+	}
+	soon, holding := c.deadlineSoon()
+	if holding && !time.Now().Before(soon) {
+		s.mu.Unlock()
+		return nil, errSelftestDeadlineSoon
+	}
+	if timeout == 0 {
+		s.mu.Unlock()
+		return nil, errTimedOut
+	}
+	w := &waiter{c: c, ch: make(chan *sjob, 1)}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var margin <-chan time.Time
+	if holding {
+		timer := time.NewTimer(time.Until(soon))
+		defer timer.Stop()
+		margin = timer.C
+	}
+	var err error
+	select {
+	case j := <-w.ch:
+		return j, nil
+	case <-expired:
+		err = errTimedOut
+	case <-margin:
+		err = errSelftestDeadlineSoon
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.waiters {
+		if o == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return nil, err
+		}
+	}
+	// The job was handed over while the timer fired.
+	return <-w.ch, nil
+}
+
+func (s *selftestServer) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &sconn{watch: map[string]bool{"default": true}, reserved: make(map[uint64]*sjob)}
+	s.mu.Lock()
+	c.use = s.tube("default")
+	c.use.using++
+	c.use.watching++
+	s.conns++
+	s.total++
+	s.mu.Unlock()
+	defer s.disconnect(c)
+
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(line) > selftestMaxLine {
+			fmt.Fprint(w, "BAD_FORMAT\r\n")
+		} else if len(fields) == 0 {
+			fmt.Fprint(w, "UNKNOWN_COMMAND\r\n")
+		} else if fields[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := s.command(c, fields, r, w); err != nil {
+			return
+		}
+		// Flush only when the client waits for answers, so pipelined
+		// commands are answered in one go.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// disconnect releases the jobs a closed connection held.
+func (s *selftestServer) disconnect(c *sconn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns--
+	c.use.using--
+	for _, j := range c.reserved {
+		s.unlink(j)
+		s.makeReady(j)
+	}
+	s.wake()
+	s.reap(c.use)
+	for name := range c.watch {
+		t := s.tube(name)
+		t.watching--
+		s.reap(t)
+	}
+}
+
+func (s *selftestServer) count(cmd string) {
+	s.mu.Lock()
+	s.cmds["cmd-"+cmd]++
+	s.mu.Unlock()
+}
+
+func parseUint(f []string, i int) (uint64, bool) {
+	if i >= len(f) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(f[i], 10, 64)
+	return n, err == nil
+}
+
+func parsePri(f []string, i int) (uint32, bool) {
+	n, ok := parseUint(f, i)
+	return uint32(n), ok && n <= math.MaxUint32
+}
+
+// validTube tells whether the command names a tube beanstalkd accepts.
+func validTube(f []string) bool {
+	if len(f) != 2 || len(f[1]) > selftestMaxTube || f[1][0] == '-' {
+		return false
+	}
+	for _, r := range f[1] {
+		if !strings.ContainsRune("+/;.$_()-", r) && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// command runs one command; only errors of the connection are returned.
+func (s *selftestServer) command(c *sconn, f []string, r *bufio.Reader, w *bufio.Writer) error {
+	s.count(f[0])
+	reply := func(format string, args ...any) error {
+		_, err := fmt.Fprintf(w, format+"\r\n", args...)
+		return err
+	}
+	switch f[0] {
+	case "put":
+		pri, ok1 := parsePri(f, 1)
+		delay, ok2 := parseUint(f, 2)
+		ttr, ok3 := parseUint(f, 3)
+		n, ok4 := parseUint(f, 4)
+		if !ok1 || !ok2 || !ok3 || !ok4 || len(f) != 5 {
+			return reply("BAD_FORMAT")
+		}
+		if n > selftestMaxJobSize {
+			if _, err := io.CopyN(io.Discard, r, int64(n)+2); err != nil {
+				return err
+			}
+			return reply("JOB_TOO_BIG")
+		}
+		body := make([]byte, n+2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		if body[n] != '\r' || body[n+1] != '\n' {
+			return reply("EXPECTED_CRLF")
+		}
+		if ttr == 0 {
+			ttr = 1
+		}
+		return reply("INSERTED %d", s.put(c.use, pri, time.Duration(delay)*time.Second, time.Duration(ttr)*time.Second, body[:n]))
+
+	case "use":
+		if !validTube(f) {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		c.use.using--
+		s.reap(c.use)
+		c.use = s.tube(f[1])
+		c.use.using++
+		s.mu.Unlock()
+		return reply("USING %s", f[1])
+
+	case "watch", "ignore":
+		if !validTube(f) {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if f[0] == "watch" {
+			if !c.watch[f[1]] {
+				c.watch[f[1]] = true
+				s.tube(f[1]).watching++
+			}
+		} else if c.watch[f[1]] {
+			if len(c.watch) == 1 {
+				return reply("NOT_IGNORED")
+			}
+			delete(c.watch, f[1])
+			t := s.tube(f[1])
+			t.watching--
+			s.reap(t)
+		}
+		return reply("WATCHING %d", len(c.watch))
+
+	case "reserve", "reserve-with-timeout":
+		timeout := time.Duration(-1)
+		if f[0] == "reserve-with-timeout" {
+			secs, ok := parseUint(f, 1)
+			if !ok {
+				return reply("BAD_FORMAT")
+			}
+			timeout = time.Duration(secs) * time.Second
+		}
+		j, err := s.reserve(c, timeout)
+		switch err {
+		case nil:
+			return s.replyJob(w, "RESERVED", j)
+		case errTimedOut:
+			return reply("TIMED_OUT")
+		}
+		return reply("DEADLINE_SOON")
+
+	case "reserve-job":
+		id, ok := parseUint(f, 1)
+		if !ok {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		j := s.jobs[id]
+		if j == nil || j.state == stateReserved {
+			s.mu.Unlock()
+			return reply("NOT_FOUND")
+		}
+		s.reserveFor(c, j)
+		s.mu.Unlock()
+		return s.replyJob(w, "RESERVED", j)
+
+	case "delete":
+		id, ok := parseUint(f, 1)
+		if !ok {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j := s.jobs[id]
+		if j == nil || (j.state == stateReserved && j.owner != c) {
+			return reply("NOT_FOUND")
+		}
+		s.unlink(j)
+		j.tube.deletes++
+		delete(s.jobs, id)
+		s.reap(j.tube)
+		return reply("DELETED")
+
+	case "release":
+		id, ok1 := parseUint(f, 1)
+		pri, ok2 := parsePri(f, 2)
+		delay, ok3 := parseUint(f, 3)
+		if !ok1 || !ok2 || !ok3 {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j := c.reserved[id]
+		if j == nil {
+			return reply("NOT_FOUND")
+		}
+		s.unlink(j)
+		j.pri = pri
+		j.releases++
+		s.schedule(j, time.Duration(delay)*time.Second)
+		return reply("RELEASED")
+
+	case "bury":
+		id, ok1 := parseUint(f, 1)
+		pri, ok2 := parsePri(f, 2)
+		if !ok1 || !ok2 {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j := c.reserved[id]
+		if j == nil {
+			return reply("NOT_FOUND")
+		}
+		s.unlink(j)
+		j.pri = pri
+		j.buries++
+		j.state = stateBuried
+		j.tube.buried = append(j.tube.buried, j)
+		return reply("BURIED")
+
+	case "touch":
+		id, ok := parseUint(f, 1)
+		if !ok {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j := c.reserved[id]
+		if j == nil {
+			return reply("NOT_FOUND")
+		}
+		j.deadline = time.Now().Add(j.ttr)
+		return reply("TOUCHED")
+
+	case "kick":
+		bound, ok := parseUint(f, 1)
+		if !ok {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		t := c.use
+		kicked := 0
+		if len(t.buried) > 0 {
+			for len(t.buried) > 0 && uint64(kicked) < bound {
+				j := t.buried[0]
+				t.buried = t.buried[1:]
+				j.kicks++
+				s.makeReady(j)
+				kicked++
+			}
+		} else {
+			delayed := make([]*sjob, 0, len(t.delayed))
+			for _, j := range t.delayed {
+				delayed = append(delayed, j)
+			}
+			sort.Slice(delayed, func(a, b int) bool { return delayed[a].id < delayed[b].id })
+			for _, j := range delayed {
+				if uint64(kicked) >= bound {
+					break
+				}
+				delete(t.delayed, j.id)
+				j.kicks++
+				s.makeReady(j)
+				kicked++
+			}
+		}
+		s.wake()
+		return reply("KICKED %d", kicked)
+
+	case "kick-job":
+		id, ok := parseUint(f, 1)
+		if !ok {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j := s.jobs[id]
+		if j == nil || (j.state != stateBuried && j.state != stateDelayed) {
+			return reply("NOT_FOUND")
+		}
+		s.unlink(j)
+		j.kicks++
+		s.makeReady(j)
+		s.wake()
+		return reply("KICKED")
+
+	case "peek", "peek-ready", "peek-delayed", "peek-buried":
+		s.mu.Lock()
+		j := s.peek(c.use, f)
+		s.mu.Unlock()
+		if j == nil {
+			return reply("NOT_FOUND")
+		}
+		return s.replyJob(w, "FOUND", j)
+
+	case "stats":
+		return s.replyYAML(w, s.stats())
+
+	case "stats-tube":
+		if !validTube(f) {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		t, ok := s.tubes[f[1]]
+		var stats [][2]string
+		if ok {
+			stats = s.tubeStats(t)
+		}
+		s.mu.Unlock()
+		if !ok {
+			return reply("NOT_FOUND")
+		}
+		return s.replyYAML(w, stats)
+
+	case "stats-job":
+		id, ok := parseUint(f, 1)
+		if !ok {
+			return reply("BAD_FORMAT")
+		}
+		s.mu.Lock()
+		j := s.jobs[id]
+		var stats [][2]string
+		if j != nil {
+			stats = jobStats(j)
+		}
+		s.mu.Unlock()
+		if j == nil {
+			return reply("NOT_FOUND")
+		}
+		return s.replyYAML(w, stats)
+
+	case "list-tubes", "list-tubes-watched":
+		s.mu.Lock()
+		var names []string
+		for name := range s.tubes {
+			if f[0] == "list-tubes" || c.watch[name] {
+				names = append(names, name)
+			}
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+		data := "---\n"
+		for _, n := range names {
+			data += "- " + n + "\n"
+		}
+		return reply("OK %d\r\n%s", len(data), data)
+
+	case "list-tube-used":
+		return reply("USING %s", c.use.name)
+	}
+	return reply("UNKNOWN_COMMAND")
+}
+
+func (s *selftestServer) put(t *stube, pri uint32, delay, ttr time.Duration, body []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	j := &sjob{id: s.nextID, pri: pri, delay: delay, ttr: ttr, body: body, tube: t, created: time.Now(), index: -1}
+	s.jobs[j.id] = j
+	t.total++
+	s.schedule(j, delay)
+	return j.id
+}
+
+// schedule makes j ready, or delayed if delay is positive.
+func (s *selftestServer) schedule(j *sjob, delay time.Duration) {
+	if delay > 0 {
+		j.state = stateDelayed
+		j.delay = delay
+		j.deadline = time.Now().Add(delay)
+		j.tube.delayed[j.id] = j
+		return
+	}
+	s.makeReady(j)
+	s.wake()
+}
+
+func (s *selftestServer) peek(t *stube, f []string) *sjob {
+	switch f[0] {
+	case "peek":
+		id, _ := parseUint(f, 1)
+		return s.jobs[id]
+	case "peek-ready":
+		if len(t.ready) > 0 {
+			return t.ready[0]
+		}
+	case "peek-buried":
+		if len(t.buried) > 0 {
+			return t.buried[0]
+		}
+	case "peek-delayed":
+		var first *sjob
+		for _, j := range t.delayed {
+			if first == nil || j.deadline.Before(first.deadline) {
+				first = j
+			}
+		}
+		return first
+	}
+	return nil
+}
+
+func (s *selftestServer) replyJob(w *bufio.Writer, word string, j *sjob) error {
+	if _, err := fmt.Fprintf(w, "%s %d %d\r\n", word, j.id, len(j.body)); err != nil {
+		return err
+	}
+	w.Write(j.body)
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+func (s *selftestServer) replyYAML(w *bufio.Writer, stats [][2]string) error {
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, kv := range stats {
+		fmt.Fprintf(&b, "%s: %s\n", kv[0], kv[1])
+	}
+	_, err := fmt.Fprintf(w, "OK %d\r\n%s\r\n", b.Len(), b.String())
+	return err
+}
+
+func (s *selftestServer) stats() [][2]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ready, reserved, delayed, buried, urgent int
+	for _, j := range s.jobs {
+		switch j.state {
+		case stateReady:
+			ready++
+			if j.pri < 1024 {
+				urgent++
+			}
+		case stateReserved:
+			reserved++
+		case stateDelayed:
+			delayed++
+		case stateBuried:
+			buried++
+		}
+	}
+	utime, _ := processCPUTime()
+	stats := [][2]string{
+		{"current-jobs-urgent", strconv.Itoa(urgent)},
+		{"current-jobs-ready", strconv.Itoa(ready)},
+		{"current-jobs-reserved", strconv.Itoa(reserved)},
+		{"current-jobs-delayed", strconv.Itoa(delayed)},
+		{"current-jobs-buried", strconv.Itoa(buried)},
+	}
+	cmds := make([]string, 0, len(s.cmds))
+	for k := range s.cmds {
+		cmds = append(cmds, k)
+	}
+	sort.Strings(cmds)
+	for _, k := range cmds {
+		stats = append(stats, [2]string{k, strconv.FormatInt(s.cmds[k], 10)})
+	}
+	var total int64
+	for _, t := range s.tubes {
+		total += t.total
+	}
+	return append(stats, [][2]string{
+		{"job-timeouts", strconv.FormatInt(s.timeout, 10)},
+		{"total-jobs", strconv.FormatInt(total, 10)},
+		{"max-job-size", strconv.Itoa(selftestMaxJobSize)},
+		{"current-tubes", strconv.Itoa(len(s.tubes))},
+		{"current-connections", strconv.Itoa(s.conns)},
+		{"current-waiting", strconv.Itoa(len(s.waiters))},
+		{"total-connections", strconv.Itoa(s.total)},
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"version", selftestVersion},
+		{"rusage-utime", fmt.Sprintf("%.6f", utime.Seconds())},
+		{"rusage-stime", "0.000000"},
+		{"uptime", strconv.Itoa(int(time.Since(s.started).Seconds()))},
+	}...)
+}
+
+func (s *selftestServer) tubeStats(t *stube) [][2]string {
+	urgent := 0
+	for _, j := range t.ready {
+		if j.pri < 1024 {
+			urgent++
+		}
+	}
+	waiting := 0
+	for _, w := range s.waiters {
+		if w.c.watch[t.name] {
+			waiting++
+		}
+	}
+	return [][2]string{
+		{"name", t.name},
+		{"current-jobs-urgent", strconv.Itoa(urgent)},
+		{"current-jobs-ready", strconv.Itoa(len(t.ready))},
+		{"current-jobs-reserved", strconv.Itoa(t.reserved)},
+		{"current-jobs-delayed", strconv.Itoa(len(t.delayed))},
+		{"current-jobs-buried", strconv.Itoa(len(t.buried))},
+		{"total-jobs", strconv.FormatInt(t.total, 10)},
+		{"current-using", strconv.Itoa(t.using)},
+		{"current-watching", strconv.Itoa(t.watching)},
+		{"current-waiting", strconv.Itoa(waiting)},
+		{"cmd-delete", strconv.FormatInt(t.deletes, 10)},
+		{"cmd-pause-tube", "0"},
+		{"pause", "0"},
+		{"pause-time-left", "0"},
+	}
+}
+
+func jobStats(j *sjob) [][2]string {
+	left := time.Duration(0)
+	if j.state == stateReserved || j.state == stateDelayed {
+		left = time.Until(j.deadline)
+	}
+	return [][2]string{
+		{"id", strconv.FormatUint(j.id, 10)},
+		{"tube", j.tube.name},
+		{"state", jobStateNames[j.state]},
+		{"pri", strconv.FormatUint(uint64(j.pri), 10)},
+		{"age", strconv.Itoa(int(time.Since(j.created).Seconds()))},
+		{"delay", strconv.Itoa(int(j.delay.Seconds()))},
+		{"ttr", strconv.Itoa(int(j.ttr.Seconds()))},
+		{"time-left", strconv.Itoa(int(left.Seconds()))},
+		{"file", "0"},
+		{"reserves", strconv.Itoa(j.reserves)},
+		{"timeouts", strconv.Itoa(j.timeouts)},
+		{"releases", strconv.Itoa(j.releases)},
+		{"buries", strconv.Itoa(j.buries)},
+		{"kicks", strconv.Itoa(j.kicks)},
+	}
+}
+
+// startSelftest starts the embedded server and points -h at it.
+func startSelftest() {
+	s, err := startSelftestServer()
+	if err != nil {
+		fatal("Cannot start the embedded server", "err", err)
+	}
+	*host = s.addr()
+	slog.Info("Embedded server listening", "addr", s.addr())
+}
@@ -0,0 +1,135 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sizeBound is a size the latencies are split at, as given.
+type sizeBound struct {
+	bytes int64
+	text  string
+}
+
+// sizeBucketBounds are the sizes of -size-buckets.
+var sizeBucketBounds []sizeBound
+
+// parseSizeBuckets parses -size-buckets, ascending sizes such as
+// 1KiB,16KiB.
+func parseSizeBuckets(s string) ([]sizeBound, error) {
+	var bounds []sizeBound
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := parseBytes(f)
+		if err != nil {
+			return nil, err
+		}
+		if len(bounds) > 0 && n <= bounds[len(bounds)-1].bytes {
+			return nil, fmt.Errorf("sizes %q are not ascending", s)
+		}
+		bounds = append(bounds, sizeBound{n, f})
+	}
+	return bounds, nil
+}
+
+// sizeBucketStat is the latency of an operation on the jobs of a size
+// bucket.
+type sizeBucketStat struct {
+	Size    string      `json:"size"`
+	Op      string      `json:"op"`
+	Latency jsonLatency `json:"latency"`
+}
+
+// sizeBuckets splits the latencies of the puts and of the reserves by the
+// size of the body, at the bounds of -size-buckets.
+type sizeBuckets struct {
+	bounds       []sizeBound
+	put, reserve []*histogram
+}
+
+func newSizeBuckets(bounds []sizeBound) *sizeBuckets {
+	b := &sizeBuckets{bounds: bounds}
+	for i := 0; i <= len(bounds); i++ {
+		b.put = append(b.put, newHistogram())
+		b.reserve = append(b.reserve, newHistogram())
+	}
+	return b
+}
+
+// bucket returns the index of the bucket of a body of size bytes.
+func (b *sizeBuckets) bucket(size int) int {
+	i := 0
+	for i < len(b.bounds) && int64(size) >= b.bounds[i].bytes {
+		i++
+	}
+	return i
+}
+
+// name is the range of sizes of bucket i, such as 1KiB-16KiB.
+func (b *sizeBuckets) name(i int) string {
+	switch {
+	case i == 0:
+		return "<" + b.bounds[0].text
+	case i == len(b.bounds):
+		return ">=" + b.bounds[i-1].text
+	}
+	return b.bounds[i-1].text + "-" + b.bounds[i].text
+}
+
+// recordPut records the latency of the put of a body of size bytes.
+func (b *sizeBuckets) recordPut(size int, latency time.Duration) {
+	b.put[b.bucket(size)].record(latency)
+}
+
+// recordReserve records the latency of the reserve of a body of size
+// bytes.
+func (b *sizeBuckets) recordReserve(size int, latency time.Duration) {
+	b.reserve[b.bucket(size)].record(latency)
+}
+
+// report logs the latencies of every size bucket when the publishers put
+// bodies of more than one, and returns them.
+func (b *sizeBuckets) report() []sizeBucketStat {
+	used := 0
+	for _, h := range b.put {
+		if h.count() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		return nil
+	}
+	var stats []sizeBucketStat
+	for _, op := range []struct {
+		name  string
+		hists []*histogram
+	}{{"put", b.put}, {"reserve", b.reserve}} {
+		for i, h := range op.hists {
+			snap := h.snapshot()
+			if snap.total == 0 {
+				continue
+			}
+			result("Latency by size", append([]any{"size", b.name(i), "op", op.name}, latencyArgs(snap)...)...)
+			stats = append(stats, sizeBucketStat{Size: b.name(i), Op: op.name, Latency: newJSONLatency(snap)})
+		}
+	}
+	return stats
+}
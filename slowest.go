@@ -0,0 +1,133 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowOp is one of the slowest operations of -slowest.
+type slowOp struct {
+	Op        string    `json:"op"`
+	Started   time.Time `json:"started"`
+	LatencyUS int64     `json:"latency_us"`
+	Host      string    `json:"host"`
+	ID        uint64    `json:"id"`
+	Size      int       `json:"size"`
+	// GCPauseUS is how long the GC paused the benchmark during the
+	// operation, with -mem-stats.
+	GCPauseUS int64 `json:"gc_pause_us,omitempty"`
+
+	latency time.Duration
+}
+
+// slowHeap is a min-heap of operations by latency, so that the fastest of
+// the slowest is the one that goes.
+type slowHeap []slowOp
+
+func (h slowHeap) Len() int            { return len(h) }
+func (h slowHeap) Less(i, j int) bool  { return h[i].latency < h[j].latency }
+func (h slowHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slowHeap) Push(x interface{}) { *h = append(*h, x.(slowOp)) }
+func (h *slowHeap) Pop() interface{} {
+	old := *h
+	op := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return op
+}
+
+// slowest keeps the n slowest operations of a kind, nil to keep none.
+type slowest struct {
+	op string
+	n  int
+	// floor is the latency an operation must beat to be kept, once n are.
+	floor int64
+
+	mu   sync.Mutex
+	heap slowHeap
+}
+
+func newSlowest(op string, n int) *slowest {
+	if n <= 0 {
+		return nil
+	}
+	return &slowest{op: op, n: n}
+}
+
+// record offers an operation that took latency, on the job id of size
+// bytes on host. Operations that are faster than all kept ones cost an
+// atomic load.
+func (s *slowest) record(latency time.Duration, host string, id uint64, size int) {
+	if s == nil || int64(latency) <= atomic.LoadInt64(&s.floor) {
+		return
+	}
+	op := slowOp{
+		Op:        s.op,
+		Started:   time.Now().Add(-latency),
+		LatencyUS: int64(latency / time.Microsecond),
+		Host:      host,
+		ID:        id,
+		Size:      size,
+		latency:   latency,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.heap) < s.n {
+		heap.Push(&s.heap, op)
+	} else if latency > s.heap[0].latency {
+		s.heap[0] = op
+		heap.Fix(&s.heap, 0)
+	}
+	if len(s.heap) == s.n {
+		atomic.StoreInt64(&s.floor, int64(s.heap[0].latency))
+	}
+}
+
+// report logs the kept operations, the slowest first, with when they
+// started relative to start, and returns them. With the GC pauses of mem
+// every operation tells how long the benchmark itself was stopped during
+// it, so that those pauses are not taken for the server's.
+func (s *slowest) report(start time.Time, mem *memStats) []slowOp {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	ops := append([]slowOp(nil), s.heap...)
+	s.mu.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].latency > ops[j].latency })
+	paused := 0
+	for i := range ops {
+		op := &ops[i]
+		args := []any{"rank", i + 1, "latency", op.latency, "started", op.Started.Format(time.RFC3339Nano),
+			"elapsed", op.Started.Sub(start).Round(time.Microsecond), "host", op.Host, "id", op.ID, "size", op.Size}
+		if mem != nil {
+			gc := mem.pausedDuring(op.Started, op.Started.Add(op.latency))
+			op.GCPauseUS = int64(gc / time.Microsecond)
+			if gc > 0 {
+				paused++
+			}
+			args = append(args, "gc_pause", gc)
+		}
+		result("Slowest "+s.op, args...)
+	}
+	if mem != nil && len(ops) > 0 {
+		result("Slowest "+s.op+" during GC", "overlapping", paused, "of", len(ops))
+	}
+	return ops
+}
@@ -0,0 +1,224 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// soakSeriesPoints is how many points of the throughput series a soak run
+// keeps in memory; the older ones are only in the files.
+const soakSeriesPoints = 4096
+
+// soakRecord is what a soak run measured in an interval, one line of the
+// files it writes.
+type soakRecord struct {
+	Time            time.Time              `json:"time"`
+	ElapsedSeconds  float64                `json:"elapsed_seconds"`
+	IntervalSeconds float64                `json:"interval_seconds"`
+	Puts            int64                  `json:"puts"`
+	Reads           int64                  `json:"reads"`
+	PutRate         float64                `json:"put_rate"`
+	ReadRate        float64                `json:"read_rate"`
+	Errors          int64                  `json:"errors"`
+	Reconnects      int64                  `json:"reconnects"`
+	Lost            int64                  `json:"lost"`
+	Memory          map[string]int64       `json:"memory_bytes"`
+	Latencies       map[string]jsonLatency `json:"latencies"`
+}
+
+// soak runs the benchmark of -soak: the publishers and readers go on for
+// the whole duration, what every interval measured is appended to files
+// that are rotated, and connections of the native client that break are
+// dialed again instead of ending the run.
+type soak struct {
+	m *metrics
+	r *run
+
+	mu     sync.Mutex
+	file   *os.File
+	opened time.Time
+	files  int
+
+	// last are the snapshots the current interval is measured from.
+	last      []operation
+	lastAt    time.Time
+	lastPuts  int64
+	lastReads int64
+	lastErrs  int64
+	lastConns int64
+	lastLost  int64
+	intervals int
+
+	reconnects counter
+	// lost counts the puts that were sent on a connection that broke
+	// before they were acknowledged.
+	lost counter
+	// downtime is the time spent dialing, in nanoseconds over all
+	// connections.
+	downtime counter
+	memory   *memoryWatch
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startSoak starts writing the intervals of r to -soak-dir and stops the
+// publishers once -soak has passed. The readers stop then as well, by
+// -consume-until duration.
+func startSoak(r *run) *soak {
+	if err := os.MkdirAll(*soakDir, 0o755); err != nil {
+		fatal("Cannot create the soak directory", "dir", *soakDir, "err", err)
+	}
+	s := &soak{
+		m:      r.metrics,
+		r:      r,
+		last:   r.metrics.operations(),
+		lastAt: time.Now(),
+		memory: newMemoryWatch(r.hosts),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	r.metrics.series.keep(soakSeriesPoints)
+	if err := s.rotate(); err != nil {
+		fatal("Cannot create soak file", "err", err)
+	}
+	time.AfterFunc(*soakFor, r.stop)
+	slog.Info("Soaking", "duration", *soakFor, "interval", *soakInterval, "rotate", *soakRotate, "dir", *soakDir)
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(*soakInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flush(false)
+			case <-s.stop:
+				s.flush(true)
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// rotate starts a new file, named after the time it was started.
+func (s *soak) rotate() error {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+	}
+	s.opened = time.Now()
+	name := filepath.Join(*soakDir, "soak-"+s.opened.UTC().Format("20060102T150405")+".ndjson")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.files++
+	slog.Debug("Soak file", "path", name)
+	return nil
+}
+
+// flush writes what was measured since the last flush, to a new file once
+// the current one is due unless it is the last flush. Only the snapshots
+// the interval is taken from are kept, so memory does not grow with the
+// length of the run.
+func (s *soak) flush(last bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	ops := s.m.operations()
+	puts, reads := s.m.put.count(), s.r.reads.load()
+	errs, conns, lost := s.m.errors.load(), s.reconnects.load(), s.lost.load()
+	interval := soakRecord{
+		Time:            now,
+		ElapsedSeconds:  now.Sub(s.m.start).Seconds(),
+		IntervalSeconds: now.Sub(s.lastAt).Seconds(),
+		Puts:            puts - s.lastPuts,
+		Reads:           reads - s.lastReads,
+		PutRate:         rate(int(puts-s.lastPuts), now.Sub(s.lastAt)),
+		ReadRate:        rate(int(reads-s.lastReads), now.Sub(s.lastAt)),
+		Errors:          errs - s.lastErrs,
+		Reconnects:      conns - s.lastConns,
+		Lost:            lost - s.lastLost,
+		Memory:          s.memory.sample(),
+		Latencies:       make(map[string]jsonLatency),
+	}
+	for i, op := range ops {
+		if h := op.hist.since(s.last[i].hist); h.total > 0 {
+			interval.Latencies[op.name] = newJSONLatency(h)
+		}
+	}
+	s.last, s.lastAt = ops, now
+	s.lastPuts, s.lastReads, s.lastErrs, s.lastConns, s.lastLost = puts, reads, errs, conns, lost
+	s.intervals++
+
+	if !last && now.Sub(s.opened) >= *soakRotate {
+		if err := s.rotate(); err != nil {
+			slog.Warn("Cannot rotate soak file", "err", err)
+		}
+	}
+	line, err := json.Marshal(interval)
+	if err != nil {
+		fatal("Cannot encode soak interval", "err", err)
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		slog.Warn("Cannot write soak interval", "path", s.file.Name(), "err", err)
+	}
+}
+
+// connectionLost tells whether err broke the connection, rather than being
+// an answer of the server.
+func connectionLost(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// reconnect replaces the broken conn like redial does, counting the
+// reconnect and the time it took.
+func (s *soak) reconnect(conn *nativeConn, tubes []string, stopped func() bool) *nativeConn {
+	s.reconnects.add(1)
+	t0 := time.Now()
+	defer func() { s.downtime.add(int64(time.Since(t0))) }()
+	return redial(conn, tubes, stopped)
+}
+
+// report logs what the soak run did and the trends of its memory, which it
+// returns.
+func (s *soak) report() []memoryTrend {
+	if s == nil {
+		return nil
+	}
+	close(s.stop)
+	<-s.done
+	if err := s.file.Close(); err != nil {
+		slog.Warn("Cannot close soak file", "err", err)
+	}
+	result("Soak", "intervals", s.intervals, "files", s.files, "reconnects", s.reconnects.load(),
+		"lost", s.lost.load(), "downtime", time.Duration(s.downtime.load()).Round(time.Millisecond))
+	trends := s.memory.trends()
+	reportMemoryTrends(trends)
+	return trends
+}
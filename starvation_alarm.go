@@ -0,0 +1,178 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// starvationAlarm watches the readers with -starvation-threshold for any
+// that goes that long without a reserve while ready jobs wait in the
+// tubes it watches, which happens when the client or the server hands the
+// jobs out unevenly. The native client is watched per reader connection,
+// the prep client, whose goroutines are its own, as a whole.
+type starvationAlarm struct {
+	r         *run
+	threshold time.Duration
+	// last is the time in nanoseconds every reader last reserved a job,
+	// or started, and 0 once it is done. starved is set while it starves,
+	// so every starvation counts once.
+	last    []int64
+	starved []bool
+	tubes   [][]string
+	hosts   [][]string
+
+	events  counter
+	longest time.Duration
+	readers map[int]bool
+
+	stop, done chan struct{}
+}
+
+// startStarvationAlarm watches readers readers of r, nil without
+// -starvation-threshold. Native readers watch the tubes of readerTubes on
+// their host, the prep consumer all of them on every host.
+func startStarvationAlarm(r *run, readers int, threshold time.Duration) *starvationAlarm {
+	if threshold <= 0 || readers == 0 {
+		return nil
+	}
+	if *client != "native" {
+		readers = 1
+	}
+	a := &starvationAlarm{
+		r:         r,
+		threshold: threshold,
+		last:      make([]int64, readers),
+		starved:   make([]bool, readers),
+		readers:   make(map[int]bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for i := 0; i < readers; i++ {
+		if *client == "native" {
+			a.tubes = append(a.tubes, r.readerTubes(i))
+			a.hosts = append(a.hosts, []string{r.hosts[i%len(r.hosts)]})
+		} else {
+			a.tubes = append(a.tubes, r.tubes)
+			a.hosts = append(a.hosts, r.hosts)
+		}
+		if a.tubes[i] == nil {
+			a.tubes[i] = []string{"default"}
+		}
+		a.last[i] = time.Now().UnixNano()
+	}
+	go a.loop()
+	return a
+}
+
+// reserved notes that reader i reserved a job.
+func (a *starvationAlarm) reserved(i int) {
+	if a != nil {
+		atomic.StoreInt64(&a.last[i], time.Now().UnixNano())
+	}
+}
+
+// finished notes that reader i is done and no longer reserves.
+func (a *starvationAlarm) finished(i int) {
+	if a != nil {
+		atomic.StoreInt64(&a.last[i], 0)
+	}
+}
+
+func (a *starvationAlarm) loop() {
+	defer close(a.done)
+	conns := make(map[string]*nativeConn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for _, h := range a.r.hosts {
+		conn, err := dialNative(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		conns[h] = conn
+	}
+	ticker := time.NewTicker(max(a.threshold/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		// The ready jobs are only looked up for readers that are overdue.
+		ready := make(map[[2]string]int64)
+		for i := range a.last {
+			last := atomic.LoadInt64(&a.last[i])
+			idle := time.Since(time.Unix(0, last))
+			if a.r.scale.idle(i) {
+				// A reader scaled down starts over once it is back.
+				atomic.CompareAndSwapInt64(&a.last[i], last, time.Now().UnixNano())
+				a.starved[i] = false
+				continue
+			}
+			if last == 0 || idle < a.threshold {
+				a.starved[i] = false
+				continue
+			}
+			var waiting int64
+			for _, h := range a.hosts[i] {
+				for _, tube := range a.tubes[i] {
+					key := [2]string{h, tube}
+					n, ok := ready[key]
+					if !ok {
+						if stats, err := conns[h].statsTube(tube); err == nil {
+							n, _ = strconv.ParseInt(stats["current-jobs-ready"], 10, 64)
+						}
+						ready[key] = n
+					}
+					waiting += n
+				}
+			}
+			if waiting == 0 {
+				a.starved[i] = false
+				continue
+			}
+			if idle > a.longest {
+				a.longest = idle
+			}
+			if !a.starved[i] {
+				a.starved[i] = true
+				a.events.add(1)
+				a.readers[i] = true
+				slog.Warn("Reader starving", "reader", i, "without_reserve", idle.Round(time.Millisecond), "ready", waiting, "threshold", a.threshold)
+			}
+		}
+	}
+}
+
+// report stops the alarm and logs the starvations.
+func (a *starvationAlarm) report() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	<-a.done
+	if n := a.events.load(); n > 0 {
+		result("Reserve starvation", "events", n, "readers", len(a.readers), "longest", a.longest.Round(time.Millisecond), "threshold", a.threshold)
+	} else {
+		result("Reserve starvation", "events", 0, "threshold", a.threshold)
+	}
+}
@@ -0,0 +1,117 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+)
+
+// keyStats are the counters of the server's stats whose change over the
+// run is always reported; the others are logged at debug level.
+var keyStats = []string{
+	"cmd-put",
+	"cmd-reserve",
+	"cmd-reserve-with-timeout",
+	"cmd-delete",
+	"job-timeouts",
+	"total-jobs",
+	"current-jobs-ready",
+	"current-connections",
+	"total-connections",
+	"rusage-utime",
+	"rusage-stime",
+}
+
+// serverStats fetches the output of the stats command of h.
+func serverStats(h string) (map[string]string, error) {
+	conn, err := dialBeanstalk(h)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Stats()
+}
+
+// snapshotStats fetches the stats of every host, leaving out those that
+// don't answer.
+func snapshotStats(hosts []string) map[string]map[string]string {
+	snapshot := make(map[string]map[string]string)
+	for _, h := range hosts {
+		stats, err := serverStats(h)
+		if err != nil {
+			slog.Warn("Cannot fetch server stats", "host", h, "err", err)
+			continue
+		}
+		snapshot[h] = stats
+	}
+	return snapshot
+}
+
+// statsDelta returns the change of every numeric stat between before and
+// after.
+func statsDelta(before, after map[string]string) map[string]float64 {
+	delta := make(map[string]float64)
+	for k, a := range after {
+		av, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			continue
+		}
+		bv, err := strconv.ParseFloat(before[k], 64)
+		if err != nil {
+			continue
+		}
+		delta[k] = av - bv
+	}
+	return delta
+}
+
+// reportStatsDelta logs how the stats of each host changed over the run,
+// which is the amount of work the server saw from its side.
+func reportStatsDelta(before, after map[string]map[string]string) {
+	hosts := make([]string, 0, len(after))
+	for h := range after {
+		if before[h] != nil {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+
+	for _, h := range hosts {
+		delta := statsDelta(before[h], after[h])
+		args := []any{"host", h}
+		for _, k := range keyStats {
+			if v, ok := delta[k]; ok {
+				args = append(args, k, v)
+			}
+		}
+		result("Server stats delta", args...)
+
+		if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+			keys := make([]string, 0, len(delta))
+			for k := range delta {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			args = []any{"host", h}
+			for _, k := range keys {
+				args = append(args, k, delta[k])
+			}
+			slog.Debug("Full server stats delta", args...)
+		}
+	}
+}
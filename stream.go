@@ -0,0 +1,224 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamBuffer is how many events a subscriber may fall behind by before
+// it misses the next ones.
+const streamBuffer = 64
+
+// websocketGUID is the GUID of RFC 6455 the accept key is derived with.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// stream is the event stream of -stream-addr, nil without it.
+var stream *streamServer
+
+// streamEvent is an event of the stream: the name and its JSON.
+type streamEvent struct {
+	name string
+	data []byte
+}
+
+// streamServer pushes the intervals of the running benchmark, and the
+// summary of every run, to its subscribers as they come. Like the control
+// API it outlives the runs of -runs.
+type streamServer struct {
+	mu   sync.Mutex
+	subs map[chan streamEvent]bool
+}
+
+// startStream serves the event stream on addr:
+//
+//	GET /events  Server-Sent Events, for an EventSource
+//	GET /ws      the same in text messages of a WebSocket, each an object
+//	             of the event and its data
+//
+// The events are start, with the hosts and workers of a run as it starts,
+// interval, with the rates and latencies of every -sample-interval, and
+// summary, the JSON summary of a run once it is done.
+func startStream(addr string) (*streamServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &streamServer{subs: make(map[chan streamEvent]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.serveEvents)
+	mux.HandleFunc("/ws", s.serveWebSocket)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Warn("Event stream stopped", "err", err)
+		}
+	}()
+	slog.Info("Event stream listening", "addr", ln.Addr().String())
+	return s, nil
+}
+
+func (s *streamServer) subscribe() chan streamEvent {
+	ch := make(chan streamEvent, streamBuffer)
+	s.mu.Lock()
+	s.subs[ch] = true
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *streamServer) unsubscribe(ch chan streamEvent) {
+	s.mu.Lock()
+	delete(s.subs, ch)
+	s.mu.Unlock()
+}
+
+// publish sends an event to every subscriber that keeps up.
+func (s *streamServer) publish(name string, v any) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Warn("Cannot encode an event of the stream", "event", name, "err", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- streamEvent{name, data}:
+		default:
+		}
+	}
+}
+
+// streamStart is the start event of a run.
+type streamStart struct {
+	Started    time.Time `json:"started"`
+	Hosts      []string  `json:"hosts"`
+	Publishers int       `json:"publishers"`
+	Readers    int       `json:"readers"`
+	Produce    int       `json:"produce"`
+	Consume    int       `json:"consume"`
+}
+
+// interval publishes the last interval of a series.
+func (s *streamServer) interval(series *series) {
+	if s == nil {
+		return
+	}
+	if p, ok := series.latest(); ok {
+		s.publish("interval", newJSONPoint(p))
+	}
+}
+
+func (s *streamServer) serveEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case ev := <-ch:
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// serveWebSocket upgrades the request to a WebSocket and sends it the
+// events. Whatever the client sends is read and ignored until it closes
+// the connection.
+func (s *streamServer) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrades are not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(io.Discard, rw)
+	}()
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	for {
+		select {
+		case <-closed:
+			return
+		case ev := <-ch:
+			msg := fmt.Sprintf(`{"event":%q,"data":%s}`, ev.name, ev.data)
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := writeTextFrame(rw.Writer, []byte(msg)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeTextFrame writes msg as a single unmasked text frame, as a server
+// sends them.
+func writeTextFrame(w *bufio.Writer, msg []byte) error {
+	header := []byte{0x81}
+	switch n := len(msg); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n < 1<<16:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	w.Write(header)
+	w.Write(msg)
+	return w.Flush()
+}
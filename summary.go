@@ -0,0 +1,162 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// summaryPhase is a phase of the run in the summary table: the jobs it
+// handled, how long it took and its rate.
+type summaryPhase struct {
+	Phase   string  `json:"phase"`
+	Jobs    int     `json:"jobs"`
+	Start   float64 `json:"start_seconds"`
+	Seconds float64 `json:"seconds"`
+	Rate    float64 `json:"per_sec"`
+}
+
+// summaryOp is an operation in the summary table, with its rate over the
+// phase it belongs to and its latency percentiles.
+type summaryOp struct {
+	Op    string  `json:"op"`
+	Count int64   `json:"count"`
+	Rate  float64 `json:"per_sec"`
+	P50US float64 `json:"p50_us"`
+	P90US float64 `json:"p90_us"`
+	P99US float64 `json:"p99_us"`
+	MaxUS float64 `json:"max_us"`
+}
+
+// summaryTable is the summary of a run printed at its end, and the same in
+// the JSON summary.
+type summaryTable struct {
+	Phases     []summaryPhase `json:"phases"`
+	Operations []summaryOp    `json:"operations"`
+	Errors     int64          `json:"errors"`
+	Timeouts   int64          `json:"timeouts"`
+	Bytes      jsonBandwidth  `json:"bandwidth"`
+}
+
+// newSummaryTable sums res up. The rate of the put is taken over the
+// publish phase and that of every other operation over the read phase.
+func newSummaryTable(res *runResult) *summaryTable {
+	t := &summaryTable{
+		Errors:   res.metrics.errors.load(),
+		Timeouts: res.metrics.timeouts.load(),
+		Bytes:    res.bandwidth(),
+	}
+	if res.publishers > 0 {
+		t.Phases = append(t.Phases, summaryPhase{"publish", res.produced, 0, res.publishTime.Seconds(), rate(res.produced, res.publishTime)})
+	}
+	if res.readers > 0 {
+		t.Phases = append(t.Phases, summaryPhase{"read", res.consumed, res.readStart.Seconds(), res.readTime.Seconds(), rate(res.consumed, res.readTime)})
+	}
+	us := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	for _, op := range res.metrics.operations() {
+		if op.hist.total == 0 {
+			continue
+		}
+		elapsed := res.readTime
+		if op.name == "put" {
+			elapsed = res.publishTime
+		}
+		t.Operations = append(t.Operations, summaryOp{
+			Op:    op.name,
+			Count: op.hist.ops,
+			Rate:  rate(int(op.hist.ops), elapsed),
+			P50US: us(op.hist.quantile(0.5)),
+			P90US: us(op.hist.quantile(0.9)),
+			P99US: us(op.hist.quantile(0.99)),
+			MaxUS: us(op.hist.quantile(1)),
+		})
+	}
+	return t
+}
+
+// write renders the table for a terminal: the phases, the operations and
+// the errors and traffic, each in aligned columns.
+func (t *summaryTable) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "phase\tjobs\tstart\tduration\trate\t")
+	for _, p := range t.Phases {
+		start := time.Duration(p.Start * float64(time.Second))
+		d := time.Duration(p.Seconds * float64(time.Second))
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", p.Phase, siValue(float64(p.Jobs), ""), roundDuration(start), roundDuration(d), siValue(p.Rate, "/s"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, "op\tcount\trate\tp50\tp90\tp99\tmax\t")
+	for _, op := range t.Operations {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", op.Op, siValue(float64(op.Count), ""), siValue(op.Rate, "/s"),
+			roundDuration(microseconds(op.P50US)), roundDuration(microseconds(op.P90US)),
+			roundDuration(microseconds(op.P99US)), roundDuration(microseconds(op.MaxUS)))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(tw, "errors\t%d\ttimeouts\t%d\t\n", t.Errors, t.Timeouts)
+	fmt.Fprintf(tw, "sent\t%sB\treceived\t%sB\t\n", siValue(float64(t.Bytes.WireOut), ""), siValue(float64(t.Bytes.WireIn), ""))
+	return tw.Flush()
+}
+
+func microseconds(us float64) time.Duration {
+	return time.Duration(us * float64(time.Microsecond))
+}
+
+// siValue formats v with three significant digits and an SI prefix, such
+// as 12.3k.
+func siValue(v float64, unit string) string {
+	prefixes := []string{"", "k", "M", "G", "T"}
+	i := 0
+	for math.Abs(v) >= 999.5 && i < len(prefixes)-1 {
+		v /= 1000
+		i++
+	}
+	s := fmt.Sprintf("%.3g", v)
+	if strings.Contains(s, "e") {
+		s = fmt.Sprintf("%.0f", v)
+	}
+	return s + prefixes[i] + unit
+}
+
+// roundDuration rounds d to three significant digits.
+func roundDuration(d time.Duration) time.Duration {
+	r := time.Duration(1)
+	for d >= 1000*r {
+		r *= 10
+	}
+	return d.Round(r)
+}
+
+// printSummary writes the summary table of res after the log lines, unless
+// they are JSON, which the table would break up.
+func printSummary(res *runResult) {
+	if strings.ToLower(*logFormat) != "text" {
+		return
+	}
+	fmt.Fprintln(logOutput)
+	if err := newSummaryTable(res).write(logOutput); err != nil {
+		fatal("Cannot write the summary", "err", err)
+	}
+}
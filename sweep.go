@@ -0,0 +1,204 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sweepParam is a flag of -sweep and the values it takes.
+type sweepParam struct {
+	name   string
+	values []string
+}
+
+// sweepMetrics are the columns of the results of a sweep, by the names
+// -assert knows them by.
+var sweepMetrics = []string{"publish_rate", "read_rate", "put_p50", "put_p99", "reserve_p50", "reserve_p99"}
+
+// parseSweep parses a list of flag=value,value,... separated by
+// semicolons. Every value is checked against its flag.
+func parseSweep(s string) ([]sweepParam, error) {
+	var grid []sweepParam
+	for _, f := range strings.Split(s, ";") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		name, list, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not flag=value,value,...", f)
+		}
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		fl := flag.Lookup(name)
+		if fl == nil {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		if name == "sweep" || name == "runs" {
+			return nil, fmt.Errorf("-%s cannot be swept", name)
+		}
+		p := sweepParam{name: name}
+		old := fl.Value.String()
+		for _, v := range strings.Split(list, ",") {
+			v = strings.TrimSpace(v)
+			if err := fl.Value.Set(v); err != nil {
+				return nil, fmt.Errorf("-%s=%s: %v", name, v, err)
+			}
+			p.values = append(p.values, v)
+		}
+		fl.Value.Set(old)
+		grid = append(grid, p)
+	}
+	if len(grid) == 0 {
+		return nil, fmt.Errorf("%q has no flags", s)
+	}
+	return grid, nil
+}
+
+// combinations returns every combination of the values of the grid, the
+// last flag varying fastest.
+func combinations(grid []sweepParam) [][]string {
+	combos := [][]string{nil}
+	for _, p := range grid {
+		var next [][]string
+		for _, c := range combos {
+			for _, v := range p.values {
+				next = append(next, append(append([]string(nil), c...), v))
+			}
+		}
+		combos = next
+	}
+	return combos
+}
+
+// sweepValue is a metric of res, its mean across the runs of -runs.
+func sweepValue(res *runResult, name string) (float64, bool) {
+	for _, s := range res.aggregate {
+		if s.Metric == name {
+			return s.Mean, true
+		}
+	}
+	v, err := res.metric(name)
+	return v, err == nil
+}
+
+// flagSet tells whether the flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// runSweep measures every combination of the flags of the grid, draining
+// the hosts before each, and logs and writes the results of all of them at
+// the end. Unless -r is swept or set, the readers follow -p.
+func runSweep(hosts []string, grid []sweepParam, trace []traceEntry) {
+	followReaders := !flagSet("r")
+	for _, p := range grid {
+		if p.name == "r" {
+			followReaders = false
+		}
+	}
+	combos := combinations(grid)
+	results := make([]*runResult, len(combos))
+	for i, c := range combos {
+		if expired() {
+			combos, results = combos[:i], results[:i]
+			break
+		}
+		args := []any{"combination", i + 1, "of", len(combos)}
+		for j, p := range grid {
+			flag.Set(p.name, c[j])
+			args = append(args, p.name, c[j])
+		}
+		if followReaders {
+			*readers = *publishers
+		}
+		if i > 0 {
+			drainBetween(hosts, "sweep")
+		}
+		slog.Info("Sweeping", args...)
+		sweepPoint = fmt.Sprintf("sweep-%d", i+1)
+		results[i] = measure(hosts, trace)
+	}
+
+	header := []string{}
+	for _, p := range grid {
+		header = append(header, p.name)
+	}
+	for _, m := range sweepMetrics {
+		if isLatencyMetric(m) {
+			m += "_us"
+		}
+		header = append(header, m)
+	}
+	rows := [][]string{header}
+	for i, c := range combos {
+		args := []any{}
+		row := append([]string(nil), c...)
+		for j, p := range grid {
+			args = append(args, p.name, c[j])
+		}
+		for _, m := range sweepMetrics {
+			v, ok := sweepValue(results[i], m)
+			cell := ""
+			switch {
+			case !ok:
+			case isLatencyMetric(m):
+				cell = strconv.FormatInt(int64(v)/1000, 10)
+				args = append(args, m, time.Duration(v))
+			default:
+				cell = strconv.FormatFloat(v, 'f', 1, 64)
+				args = append(args, m, cell)
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+		result("Sweep", args...)
+	}
+
+	if *sweepCSV != "" {
+		if err := writeSweepCSV(*sweepCSV, rows); err != nil {
+			fatal("Cannot write CSV", "path", *sweepCSV, "err", err)
+		}
+		slog.Info("Wrote sweep", "path", *sweepCSV)
+	}
+	if expired() {
+		os.Exit(1)
+	}
+}
+
+func writeSweepCSV(path string, rows [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.WriteAll(rows)
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
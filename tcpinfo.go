@@ -0,0 +1,164 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tcpSample is what TCP_INFO tells of a connection at one time.
+type tcpSample struct {
+	rtt time.Duration
+	// cwnd is the congestion window, in segments.
+	cwnd uint32
+	// retransmits are all the segments retransmitted since the connection
+	// was opened.
+	retransmits uint32
+}
+
+// socketStats aggregates TCP_INFO of the connections the benchmark dials,
+// sampled each -sample-interval with -tcp-info, so a network that loses or
+// delays segments can be told from a slow server.
+type socketStats struct {
+	open sync.Map // of *trackedConn
+
+	samples, retransmits counter
+	rtt                  *histogram
+
+	mu                 sync.Mutex
+	cwndMin, cwndMax   uint32
+	cwndSum, cwndCount uint64
+}
+
+var sockets = &socketStats{rtt: newHistogram()}
+
+// tcpOf returns the TCP connection under conn, nil if there is none.
+func tcpOf(conn net.Conn) *net.TCPConn {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c
+	case *delayedConn:
+		return tcpOf(c.Conn)
+	case *throttledConn:
+		return tcpOf(c.Conn)
+	}
+	return nil
+}
+
+// startSocketSampler samples the open connections each interval until
+// the process ends.
+func startSocketSampler(interval time.Duration) {
+	if !tcpInfoSupported {
+		slog.Warn("-tcp-info needs Linux, running without it")
+		*tcpInfo = false
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			sockets.open.Range(func(_, c any) bool {
+				sockets.sample(c.(*trackedConn))
+				return true
+			})
+		}
+	}()
+}
+
+// track adds c to the connections sampled, with -tcp-info.
+func (s *socketStats) track(c *trackedConn) {
+	if *tcpInfo && c.tcp != nil {
+		s.open.Store(c, c)
+	}
+}
+
+// untrack samples c a last time, so the retransmits of its tail are
+// counted, before it is closed.
+func (s *socketStats) untrack(c *trackedConn) {
+	if _, ok := s.open.LoadAndDelete(c); ok {
+		s.sample(c)
+	}
+}
+
+func (s *socketStats) sample(c *trackedConn) {
+	t, ok := readTCPInfo(c.tcp)
+	if !ok {
+		return
+	}
+	s.samples.add(1)
+	s.rtt.record(t.rtt)
+	// The retransmits are counted once, by the growth since the last
+	// sample of the connection.
+	if last := atomic.SwapUint32(&c.retransmits, t.retransmits); t.retransmits > last {
+		s.retransmits.add(int64(t.retransmits - last))
+	}
+	s.mu.Lock()
+	if s.cwndCount == 0 || t.cwnd < s.cwndMin {
+		s.cwndMin = t.cwnd
+	}
+	if t.cwnd > s.cwndMax {
+		s.cwndMax = t.cwnd
+	}
+	s.cwndSum += uint64(t.cwnd)
+	s.cwndCount++
+	s.mu.Unlock()
+}
+
+// cwnd returns the smallest, mean and largest congestion window sampled.
+func (s *socketStats) cwnd() (uint32, float64, uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cwndCount == 0 {
+		return 0, 0, 0
+	}
+	return s.cwndMin, float64(s.cwndSum) / float64(s.cwndCount), s.cwndMax
+}
+
+// jsonSockets is what -tcp-info sampled, in the JSON summary.
+type jsonSockets struct {
+	Samples     int64       `json:"samples"`
+	Retransmits int64       `json:"retransmits"`
+	RTT         jsonLatency `json:"rtt"`
+	CwndMin     uint32      `json:"cwnd_min"`
+	CwndMean    float64     `json:"cwnd_mean"`
+	CwndMax     uint32      `json:"cwnd_max"`
+}
+
+// summary returns what was sampled, nil without -tcp-info or samples.
+func (s *socketStats) summary() *jsonSockets {
+	if !*tcpInfo || s.samples.load() == 0 {
+		return nil
+	}
+	j := &jsonSockets{Samples: s.samples.load(), Retransmits: s.retransmits.load(), RTT: newJSONLatency(s.rtt)}
+	j.CwndMin, j.CwndMean, j.CwndMax = s.cwnd()
+	return j
+}
+
+func (s *socketStats) report() {
+	j := s.summary()
+	if j == nil {
+		return
+	}
+	result("Sockets", "samples", j.Samples, "retransmits", j.Retransmits,
+		"cwnd_min", j.CwndMin, "cwnd_mean", fmt.Sprintf("%.1f", j.CwndMean), "cwnd_max", j.CwndMax)
+	result("Socket RTT", latencyArgs(s.rtt)...)
+	if j.Retransmits > 0 {
+		slog.Warn("TCP SEGMENTS WERE RETRANSMITTED: the network lost or delayed part of the traffic, and the latencies include the time to resend it",
+			"retransmits", j.Retransmits)
+	}
+}
@@ -0,0 +1,49 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+//go:build linux && !386
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const tcpInfoSupported = true
+
+// readTCPInfo reads TCP_INFO of conn.
+func readTCPInfo(conn *net.TCPConn) (tcpSample, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return tcpSample{}, false
+	}
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 {
+		return tcpSample{}, false
+	}
+	return tcpSample{
+		rtt:         time.Duration(info.Rtt) * time.Microsecond,
+		cwnd:        info.Snd_cwnd,
+		retransmits: info.Total_retrans,
+	}, true
+}
@@ -0,0 +1,105 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// traceEntry is a line of a trace file: a job put at a time relative to
+// the start of the trace.
+type traceEntry struct {
+	// At is the offset of the put in seconds.
+	At    float64 `json:"at"`
+	Tube  string  `json:"tube"`
+	Pri   uint32  `json:"pri"`
+	Delay float64 `json:"delay,omitempty"`
+	TTR   float64 `json:"ttr,omitempty"`
+	Size  int     `json:"size"`
+}
+
+func (e traceEntry) offset() time.Duration {
+	return time.Duration(e.At * float64(time.Second))
+}
+
+func (e traceEntry) delay() time.Duration {
+	return time.Duration(e.Delay * float64(time.Second))
+}
+
+// ttr is the TTR of the job, 120s if the trace leaves it out.
+func (e traceEntry) ttr() time.Duration {
+	if e.TTR <= 0 {
+		return 120 * time.Second
+	}
+	return time.Duration(e.TTR * float64(time.Second))
+}
+
+// readTrace reads a trace of newline delimited JSON objects, skipping empty
+// lines, and returns its entries in the order of their offsets.
+func readTrace(path string) ([]traceEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []traceEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var e traceEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if e.Tube == "" {
+			e.Tube = "default"
+		}
+		if e.At < 0 || e.Size < 0 || e.Delay < 0 {
+			return nil, fmt.Errorf("%s:%d: negative at, size or delay", path, n)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s has no entries", path)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At < entries[j].At })
+	return entries, nil
+}
+
+// traceTubes returns the tubes of a trace, sorted.
+func traceTubes(entries []traceEntry) []string {
+	seen := make(map[string]bool)
+	var tubes []string
+	for _, e := range entries {
+		if !seen[e.Tube] {
+			seen[e.Tube] = true
+			tubes = append(tubes, e.Tube)
+		}
+	}
+	sort.Strings(tubes)
+	return tubes
+}
@@ -0,0 +1,192 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"github.com/kr/beanstalk"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pauseWindow is a time during which a watched tube was paused.
+type pauseWindow struct {
+	host, tube string
+	from, to   time.Time
+}
+
+// pauseWatch samples the stats of the watched tubes on every host for
+// pause-tube, by the benchmark or anyone else, and keeps the windows the
+// tubes were paused in. A reserve on a paused tube waits for the pause
+// rather than for the server, so the readers keep the reserves that
+// overlap a window out of the reserve latencies, and the intervals of the
+// series that overlap one are marked.
+type pauseWatch struct {
+	conns    []*beanstalk.Conn
+	hosts    []string
+	tubes    []string
+	interval time.Duration
+
+	mu      sync.Mutex
+	windows []pauseWindow
+	// open are the windows of the tubes that are paused, by host and tube.
+	open map[[2]string]int
+	// any is set once there is a window, so that the readers need not
+	// take the lock before.
+	any int32
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startPauseWatch samples the tubes of r every interval, nil without
+// -pause-aware.
+func startPauseWatch(r *run, interval time.Duration) *pauseWatch {
+	if !*pauseAware {
+		return nil
+	}
+	w := &pauseWatch{
+		hosts:    r.hosts,
+		tubes:    r.watched(),
+		interval: interval,
+		open:     make(map[[2]string]int),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, h := range r.hosts {
+		conn, err := dialBeanstalk(h)
+		if err != nil {
+			fatal("Cannot connect", "host", h, "err", err)
+		}
+		w.conns = append(w.conns, conn)
+	}
+	go w.loop()
+	return w
+}
+
+func (w *pauseWatch) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	warned := false
+	for {
+		for i, conn := range w.conns {
+			for _, tube := range w.tubes {
+				stats, err := (&beanstalk.Tube{Conn: conn, Name: tube}).Stats()
+				if cerr, ok := err.(beanstalk.ConnError); ok && cerr.Err == beanstalk.ErrNotFound {
+					// The tube does not exist on the host yet.
+					continue
+				}
+				if err != nil {
+					if !warned {
+						slog.Warn("Cannot fetch tube stats", "host", w.hosts[i], "tube", tube, "err", err)
+						warned = true
+					}
+					continue
+				}
+				pause, _ := strconv.ParseInt(stats["pause"], 10, 64)
+				left, _ := strconv.ParseInt(stats["pause-time-left"], 10, 64)
+				w.observe(w.hosts[i], tube, time.Now(), time.Duration(pause)*time.Second, time.Duration(left)*time.Second)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// observe records what the stats of a tube said at now: paused for pause,
+// with left of it to go. The server counts both in whole seconds, so the
+// window is taken to end a second later than it says, and ends when the
+// tube is seen unpaused before that.
+func (w *pauseWatch) observe(host, tube string, now time.Time, pause, left time.Duration) {
+	key := [2]string{host, tube}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	i, ok := w.open[key]
+	if left <= 0 {
+		if ok {
+			if w.windows[i].to.After(now) {
+				w.windows[i].to = now
+			}
+			delete(w.open, key)
+		}
+		return
+	}
+	from, to := now.Add(left-pause-time.Second), now.Add(left+time.Second)
+	if ok && !from.After(w.windows[i].to) {
+		w.windows[i].to = to
+		return
+	}
+	w.open[key] = len(w.windows)
+	w.windows = append(w.windows, pauseWindow{host, tube, from, to})
+	atomic.StoreInt32(&w.any, 1)
+	slog.Info("Tube paused", "host", host, "tube", tube, "pause", pause, "left", left)
+}
+
+// overlaps tells whether any tube was paused between from and to.
+func (w *pauseWatch) overlaps(from, to time.Time) bool {
+	if w == nil || atomic.LoadInt32(&w.any) == 0 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, p := range w.windows {
+		if p.from.Before(to) && p.to.After(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish stops sampling, logs the windows and the reserves kept out of
+// the reserve latencies, counted in excluded, and returns them.
+func (w *pauseWatch) finish(excluded *histogram) *jsonPauses {
+	if w == nil {
+		return nil
+	}
+	close(w.stop)
+	<-w.done
+	for _, conn := range w.conns {
+		conn.Close()
+	}
+	if len(w.windows) == 0 {
+		return nil
+	}
+	now := time.Now()
+	var paused time.Duration
+	for _, p := range w.windows {
+		to := p.to
+		if to.After(now) {
+			to = now
+		}
+		paused += to.Sub(p.from)
+		result("Tube pause", "host", p.host, "tube", p.tube, "from", p.from.Format(time.RFC3339), "for", to.Sub(p.from).Round(time.Second))
+	}
+	snap := excluded.snapshot()
+	result("Tube pauses", append([]any{"pauses", len(w.windows), "paused", paused.Round(time.Second)}, latencyArgs(snap)...)...)
+	return &jsonPauses{Pauses: len(w.windows), PausedSeconds: paused.Seconds(), ExcludedReserves: snap.ops}
+}
+
+// jsonPauses sums up the pauses of the watched tubes during a run.
+type jsonPauses struct {
+	Pauses           int     `json:"pauses"`
+	PausedSeconds    float64 `json:"paused_seconds"`
+	ExcludedReserves int64   `json:"excluded_reserves"`
+}
@@ -0,0 +1,125 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// runID tells the tubes of this process from those of other benchmarks
+// against the same server, for {run_id} of -tube. The processes of -procs
+// share that of their parent.
+var runID = func() string {
+	if id := os.Getenv(procRunEnv); id != "" {
+		return id
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// benchTubes are the tubes -tube expands to for the run under way, nil for
+// the default tube, and runsStarted counts the runs, for {run}. Being the
+// run's own, -cleanup deletes all their jobs.
+var (
+	benchTubes  []string
+	runsStarted int
+)
+
+var tubeVariable = regexp.MustCompile(`\{[^}]*\}`)
+
+// expandTube fills in the variables of a -tube template for the given run
+// and publisher.
+func expandTube(template string, run, worker int) string {
+	return strings.NewReplacer(
+		"{run_id}", runID,
+		"{run}", strconv.Itoa(run),
+		"{worker}", strconv.Itoa(worker),
+	).Replace(template)
+}
+
+// checkTubeTemplate checks that template only uses known variables and
+// expands to tube names the server accepts.
+func checkTubeTemplate(template string, publishers int) error {
+	for _, v := range tubeVariable.FindAllString(template, -1) {
+		if v != "{run_id}" && v != "{run}" && v != "{worker}" {
+			return fmt.Errorf("unknown variable %s, want {run_id}, {run} or {worker}", v)
+		}
+	}
+	// The longest name is that of the last publisher of a late run.
+	if name := expandTube(template, 999999, publishers); !validTube([]string{"use", name}) {
+		return fmt.Errorf("%q is not a valid tube name", name)
+	}
+	return nil
+}
+
+// nextRunTubes expands -tube for the next run, which publishers share:
+// one tube each with {worker} in it, otherwise one for all of them.
+func nextRunTubes(publishers int) {
+	if *tubeTemplate == "" {
+		return
+	}
+	runsStarted++
+	benchTubes = nil
+	for p := 0; p < publishers || p == 0; p++ {
+		name := expandTube(*tubeTemplate, runsStarted, p)
+		if len(benchTubes) > 0 && benchTubes[0] == name {
+			break
+		}
+		benchTubes = append(benchTubes, name)
+	}
+	slog.Info("Tubes of the run", "run", runsStarted, "tubes", len(benchTubes), "first", benchTubes[0])
+}
+
+// putTube is the tube publisher p puts its jobs on.
+func (r *run) putTube(p int) string {
+	if r.tubes == nil {
+		return "default"
+	}
+	return r.tubes[p%len(r.tubes)]
+}
+
+// readerTubes are the tubes reader i of the native client watches: all of
+// them, or -watch-per-conn of them, the readers taking the next ones in
+// turn.
+func (r *run) readerTubes(i int) []string {
+	n := *watchPerConn
+	if r.tubes == nil || n <= 0 || n >= len(r.tubes) {
+		return r.tubes
+	}
+	tubes := make([]string, n)
+	for k := range tubes {
+		tubes[k] = r.tubes[(i*n+k)%len(r.tubes)]
+	}
+	return tubes
+}
+
+// useTube makes conn, a connection of publisher p of the native client,
+// put on its tube. Once the run is over it is left as it is.
+func (r *run) useTube(conn *nativeConn, p int) {
+	if r.tubes == nil || r.halted() || expired() {
+		return
+	}
+	if err := conn.use(r.putTube(p)); err != nil {
+		fatal("Cannot use the tube", "tube", r.putTube(p), "err", err)
+	}
+}
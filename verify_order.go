@@ -0,0 +1,127 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every payload published with -verify-order starts with a small header:
+// a magic marker, the index of the publisher that produced it and that
+// publisher's sequence number for the job.
+const (
+	orderMagic      = 0x4253424f // "BSBO"
+	orderHeaderSize = 16
+)
+
+func putOrderHeader(data []byte, producer uint32, seq uint64) {
+	binary.BigEndian.PutUint32(data[0:4], orderMagic)
+	binary.BigEndian.PutUint32(data[4:8], producer)
+	binary.BigEndian.PutUint64(data[8:16], seq)
+}
+
+// orderedPayload returns a copy of body with the order header in front,
+// grown to the size of the header if body is smaller.
+func orderedPayload(body []byte, producer uint32, seq uint64) []byte {
+	data := make([]byte, orderHeaderSize, orderHeaderSize+len(body))
+	if len(body) > orderHeaderSize {
+		data = append(data[:0], body...)
+	}
+	putOrderHeader(data, producer, seq)
+	return data
+}
+
+func readOrderHeader(data []byte) (producer uint32, seq uint64, ok bool) {
+	if len(data) < orderHeaderSize || binary.BigEndian.Uint32(data[0:4]) != orderMagic {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(data[4:8]), binary.BigEndian.Uint64(data[8:16]), true
+}
+
+type orderKey struct {
+	tube     string
+	priority uint32
+	producer uint32
+}
+
+type orderObservation struct {
+	reservedAt time.Time
+	key        orderKey
+	seq        uint64
+}
+
+// orderChecker collects the jobs seen by the readers. Jobs are handled by
+// many goroutines at once, so the order they reach the callback in says
+// nothing; the check is done afterwards on the reservation timestamps.
+type orderChecker struct {
+	mu           sync.Mutex
+	observations []orderObservation
+	unmarked     int
+}
+
+func (c *orderChecker) observe(tube string, priority uint32, reservedAt time.Time, body []byte) {
+	producer, seq, ok := readOrderHeader(body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok {
+		c.unmarked++
+		return
+	}
+	c.observations = append(c.observations, orderObservation{
+		reservedAt: reservedAt,
+		key:        orderKey{tube: tube, priority: priority, producer: producer},
+		seq:        seq,
+	})
+}
+
+// report counts the inversions: jobs that were reserved after a job with a
+// higher sequence number from the same publisher, tube and priority. The
+// magnitude of an inversion is how far behind the highest sequence number
+// seen so far the job was.
+func (c *orderChecker) report() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sort.SliceStable(c.observations, func(i, j int) bool {
+		return c.observations[i].reservedAt.Before(c.observations[j].reservedAt)
+	})
+
+	highest := make(map[orderKey]uint64)
+	seen := make(map[orderKey]bool)
+	var inversions, total, worst uint64
+	for _, o := range c.observations {
+		if seen[o.key] && o.seq < highest[o.key] {
+			distance := highest[o.key] - o.seq
+			inversions++
+			total += distance
+			if distance > worst {
+				worst = distance
+			}
+			continue
+		}
+		highest[o.key] = o.seq
+		seen[o.key] = true
+	}
+
+	var mean float64
+	if inversions > 0 {
+		mean = float64(total) / float64(inversions)
+	}
+	result("Order inversions", "checked", len(c.observations), "unmarked", c.unmarked,
+		"inversions", inversions, "max_distance", worst, "mean_distance", mean)
+}
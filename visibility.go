@@ -0,0 +1,158 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// visibilityTube is the tube of the visibility probes, which no reader of
+// the benchmark watches.
+const visibilityTube = "bench-visibility"
+
+// visibilityTimeout is how long a probe may take to be received before it
+// is given up as lost.
+const visibilityTimeout = 5 * time.Second
+
+// visibilityProbe tells how long after a put a job can be reserved, apart
+// from how long the put takes to be acknowledged. A prober puts one job at
+// a time into its own tube while a reader of its own waits in reserve on
+// that tube, on the same server or, with -visibility-host, on another
+// endpoint such as a replica or the other side of a proxy. The job is
+// visible when the reader gets it: the time from sending the put to then
+// is recorded as visible, and the time from the acknowledgment to then as
+// visible_after_ack, which is negative, and recorded as 0, when the reader
+// gets the job before the prober gets its acknowledgment.
+type visibilityProbe struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	probes, lost counter
+}
+
+type visibilityReceipt struct {
+	seq uint64
+	at  time.Time
+}
+
+// startVisibilityProbe starts probing rate times per second, putting on h
+// and reserving on readHost, into the metrics of r.
+func startVisibilityProbe(r *run, h, readHost string, rate float64) *visibilityProbe {
+	pub, err := dialNative(h)
+	if err != nil {
+		fatal("Cannot connect", "host", h, "err", err)
+	}
+	sub, err := dialNative(readHost)
+	if err != nil {
+		fatal("Cannot connect", "host", readHost, "err", err)
+	}
+	if err := pub.use(visibilityTube); err != nil {
+		fatal("Cannot use tube", "tube", visibilityTube, "err", err)
+	}
+	if err := watchTubes(sub, []string{visibilityTube}); err != nil {
+		fatal("Cannot watch tube", "tube", visibilityTube, "err", err)
+	}
+	v := &visibilityProbe{stop: make(chan struct{})}
+	// Probes of an earlier run still in the tube carry another nonce.
+	nonce := uint64(time.Now().UnixNano())
+	received := make(chan visibilityReceipt, 1)
+
+	v.wg.Add(2)
+	go func() {
+		defer v.wg.Done()
+		defer sub.Close()
+		for {
+			select {
+			case <-v.stop:
+				return
+			default:
+			}
+			id, body, err := sub.reserve(time.Second)
+			at := time.Now()
+			if err == errTimedOut || err == errDeadlineSoon {
+				continue
+			}
+			if err != nil {
+				slog.Warn("Visibility probe reserve failed", "host", readHost, "err", err)
+				return
+			}
+			if err := sub.delete(id); err != nil {
+				slog.Warn("Visibility probe delete failed", "id", id, "err", err)
+			}
+			if len(body) != 16 || binary.BigEndian.Uint64(body) != nonce {
+				continue
+			}
+			select {
+			case received <- visibilityReceipt{binary.BigEndian.Uint64(body[8:]), at}:
+			default:
+			}
+		}
+	}()
+	go func() {
+		defer v.wg.Done()
+		defer pub.Close()
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		body := make([]byte, 16)
+		binary.BigEndian.PutUint64(body, nonce)
+		for seq := uint64(0); ; seq++ {
+			select {
+			case <-v.stop:
+				return
+			case <-ticker.C:
+			}
+			binary.BigEndian.PutUint64(body[8:], seq)
+			t0 := time.Now()
+			if _, err := pub.put(0, 0, 120*time.Second, body); err != nil {
+				slog.Warn("Visibility probe put failed", "host", h, "err", err)
+				return
+			}
+			acked := time.Now()
+			v.probes.add(1)
+			timeout := time.After(visibilityTimeout)
+		wait:
+			for {
+				select {
+				case <-v.stop:
+					return
+				case <-timeout:
+					v.lost.add(1)
+					break wait
+				case rec := <-received:
+					if rec.seq != seq {
+						// A probe that was given up on came after all.
+						continue
+					}
+					r.metrics.visible.record(rec.at.Sub(t0))
+					r.metrics.visibleAfterAck.record(rec.at.Sub(acked))
+					break wait
+				}
+			}
+		}
+	}()
+	return v
+}
+
+func (v *visibilityProbe) report() {
+	if v == nil {
+		return
+	}
+	close(v.stop)
+	v.wg.Wait()
+	result("Visibility probes", "probes", v.probes.load(), "lost", v.lost.load(), "timeout", visibilityTimeout)
+}
@@ -0,0 +1,125 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Workload makes up the jobs of the benchmark and handles the jobs the
+// readers reserve, for the job patterns of a domain that neither -payload
+// nor -decode covers. A workload is either registered with
+// registerWorkload from the init function of a file added to the build, or
+// built as a Go plugin (go build -buildmode=plugin) that exports a variable
+// named Workload whose pointer implements the interface, and picked with
+// -workload. Its methods are called by all the publishers and readers at
+// once.
+type Workload interface {
+	// Setup prepares the workload with -workload-args, once before the
+	// first run.
+	Setup(args string) error
+	// ProduceNext appends the body of the next job to buf and returns it.
+	ProduceNext(buf []byte) []byte
+	// Consume handles the body of a job a reader reserved, timed as the
+	// workload operation. An error counts as an error of the run.
+	Consume(body []byte) error
+}
+
+var (
+	workloadsMu sync.Mutex
+	workloads   = make(map[string]Workload)
+)
+
+// selectedWorkload is the workload of -workload, nil without it.
+var selectedWorkload Workload
+
+// registerWorkload makes w available to -workload as name.
+func registerWorkload(name string, w Workload) {
+	workloadsMu.Lock()
+	defer workloadsMu.Unlock()
+	if _, ok := workloads[name]; ok {
+		panic("workload " + name + " registered twice")
+	}
+	workloads[name] = w
+}
+
+// loadWorkload returns the workload registered as spec, or the one of the
+// Go plugin at spec if it ends in .so, set up with args.
+func loadWorkload(spec, args string) (Workload, error) {
+	var w Workload
+	if strings.HasSuffix(spec, ".so") {
+		p, err := plugin.Open(spec)
+		if err != nil {
+			return nil, err
+		}
+		sym, err := p.Lookup("Workload")
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if w, ok = sym.(Workload); !ok {
+			return nil, fmt.Errorf("%s: Workload is a %T, which does not have the methods Setup, ProduceNext and Consume", spec, sym)
+		}
+	} else {
+		workloadsMu.Lock()
+		w = workloads[spec]
+		var names []string
+		for name := range workloads {
+			names = append(names, name)
+		}
+		workloadsMu.Unlock()
+		if w == nil {
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown workload %q, want one of %s or the path of a plugin ending in .so", spec, strings.Join(names, ", "))
+		}
+	}
+	if err := w.Setup(args); err != nil {
+		return nil, fmt.Errorf("setting up workload %s: %v", spec, err)
+	}
+	return w, nil
+}
+
+// workloadPayload is the payload of w. The bodies start with the bytes
+// -decode leaves to the headers of -verify-order and -shared.
+func workloadPayload(w Workload) payloadFunc {
+	return func(buf []byte) []byte {
+		for i := 0; i < decodePrefix; i++ {
+			buf = append(buf, 0)
+		}
+		return w.ProduceNext(buf)
+	}
+}
+
+// consumeWorkload hands body to the workload of -workload, timing it.
+func (r *run) consumeWorkload(body []byte) {
+	t0 := time.Now()
+	if len(body) < decodePrefix {
+		r.metrics.errors.add(1)
+		slog.Warn("The job is too short for the workload", "size", len(body))
+		return
+	}
+	if err := selectedWorkload.Consume(body[decodePrefix:]); err != nil {
+		r.metrics.errors.add(1)
+		slog.Warn("The workload failed to consume the job", "workload", *workloadName, "err", err)
+		return
+	}
+	r.metrics.workload.record(time.Since(t0))
+}
@@ -0,0 +1,108 @@
+//   Copyright 2013 Fang Li <surivlee@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	registerWorkload("orders", &ordersWorkload{items: 3})
+}
+
+// ordersWorkload is an example of a Workload: orders of a shop as JSON,
+// from customers of whom a few place most of the orders, with up to
+// items=N line items each, set with -workload-args items=N.
+type ordersWorkload struct {
+	items int
+	seq   int64
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	zipf *rand.Zipf
+}
+
+type order struct {
+	ID       int64       `json:"id"`
+	Customer uint64      `json:"customer"`
+	Placed   int64       `json:"placed"`
+	Items    []orderItem `json:"items"`
+}
+
+type orderItem struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+	Cents    int    `json:"cents"`
+}
+
+func (w *ordersWorkload) Setup(args string) error {
+	for _, f := range strings.Split(args, ",") {
+		if f == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(f, "=")
+		n, err := strconv.Atoi(v)
+		if k != "items" || err != nil || n < 1 {
+			return fmt.Errorf("invalid argument %q, want items=N with N at least 1", f)
+		}
+		w.items = n
+	}
+	w.rng = newRand(streamWorkload, 0)
+	w.zipf = rand.NewZipf(w.rng, 1.1, 1, 1e6)
+	return nil
+}
+
+func (w *ordersWorkload) ProduceNext(buf []byte) []byte {
+	o := order{ID: atomic.AddInt64(&w.seq, 1), Placed: time.Now().UnixNano()}
+	w.mu.Lock()
+	o.Customer = w.zipf.Uint64()
+	n := 1 + w.rng.Intn(w.items)
+	for i := 0; i < n; i++ {
+		o.Items = append(o.Items, orderItem{
+			SKU:      fmt.Sprintf("SKU-%05d", w.rng.Intn(50000)),
+			Quantity: 1 + w.rng.Intn(4),
+			Cents:    99 + w.rng.Intn(20000),
+		})
+	}
+	w.mu.Unlock()
+	data, _ := json.Marshal(&o)
+	return append(buf, data...)
+}
+
+func (w *ordersWorkload) Consume(body []byte) error {
+	var o order
+	if err := json.Unmarshal(body, &o); err != nil {
+		return err
+	}
+	if len(o.Items) == 0 {
+		return errors.New("order without items")
+	}
+	total := 0
+	for _, it := range o.Items {
+		total += it.Quantity * it.Cents
+	}
+	if total <= 0 {
+		return errors.New("order without a total")
+	}
+	return nil
+}